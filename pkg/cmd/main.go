@@ -25,13 +25,18 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -45,6 +50,7 @@ import (
 	kubectl_util "k8s.io/kubernetes/pkg/kubectl/cmd/util"
 
 	"github.com/zlabjp/nghttpx-ingress-lb/pkg/controller"
+	"github.com/zlabjp/nghttpx-ingress-lb/pkg/metrics"
 	"github.com/zlabjp/nghttpx-ingress-lb/pkg/nghttpx"
 )
 
@@ -87,11 +93,211 @@ var (
                 external IP address. This is the workaround for the cluster configuration where NodeExternalIP or
                 NodeLegacyHostIP is not assigned or cannot be used.`)
 
-	defaultTLSSecret = flags.String("default-tls-secret", "",
-		`Optional, name of the Secret that contains TLS server certificate and secret key to enable TLS by default.  For those client connections which are not TLS encrypted, they are redirected to https URI permantently.`)
+	addressType = flags.StringSlice("address-type", nil,
+		`The preference order of Node address types which are published in Ingress status.  It is a comma separated list of
+		ExternalIP, InternalIP, and Hostname, e.g., "ExternalIP,InternalIP".  The addresses of the first type which Node has are
+		published.  If it is not given, ExternalIP is used, and InternalIP is used only with --allow-internal-ip.  It cannot be
+		used with --allow-internal-ip.`)
+
+	defaultTLSSecret = flags.StringSlice("default-tls-secret", nil,
+		`Optional, name of the Secret that contains TLS server certificate and secret key to enable TLS by default.  For those client connections which are not TLS encrypted, they are redirected to https URI permantently.  Comma separated list of Secrets can be given, and the certificate is selected by SNI.  The first one is used for the client which does not send SNI or matches none of them.`)
 
 	ingressClass = flags.String("ingress-class", "nghttpx",
 		`Ingress class which this controller is responsible for.`)
+
+	watchWithoutClass = flags.Bool("watch-without-class", true,
+		`Process the Ingress which has no Ingress class annotation, or its value is empty.  Set this to false when another Ingress
+		controller in the cluster also processes such Ingresses.`)
+
+	redirectWithoutCert = flags.Bool("redirect-without-cert", true,
+		`Redirect cleartext HTTP requests to https URI even if no TLS certificate matches the host.  nghttpx serves the default
+		certificate to such host, and clients see the certificate error.  The controller records a warning Event on the Ingress
+		regardless of this flag.  Set this to false to serve such host over cleartext HTTP instead.  The host listed in spec.tls of
+		the Ingress is always redirected.`)
+
+	nghttpxWorkers = flags.String("nghttpx-workers", "",
+		`Optional, the number of nghttpx worker threads.  It must be a positive integer or "auto".  If "auto" is given, the number
+		is computed from CPU quota of the container.  If omitted, the number of CPU cores is used.  "workers" key in ConfigMap
+		overrides this value.`)
+
+	defaultBackendPreference = flags.String("default-backend-preference", controller.DefaultBackendPreferIngress,
+		`Specify which of the catch-all rule (empty host and path "/") in Ingress or --default-backend-service serves the requests
+		which do not match any other rules.  It must be either "ingress" or "global".  If "ingress" is given, the catch-all rule in
+		Ingress is used, and --default-backend-service serves the requests only if the rule has no available endpoints.  If
+		"global" is given, --default-backend-service always serves them, and the catch-all rules in Ingress are ignored.`)
+
+	proxyProto = flags.Bool("proxy-proto", false,
+		`Enable PROXY protocol on the public frontends (port 80 and 443).  nghttpx accepts both PROXY protocol v1 and v2.  The
+		frontends for API and health monitoring never enable it.`)
+
+	proxyProtoExcludePorts = flags.IntSlice("proxy-proto-exclude-ports", nil,
+		`Comma separated list of public frontend ports on which PROXY protocol is not enabled even if --proxy-proto is given.`)
+
+	includeNotReadyEndpoints = flags.Bool("include-not-ready-endpoints", false,
+		`Include not-ready endpoint addresses of Service as backends.  This helps to avoid 503 errors during scale-up when readiness
+		checks are slow, but requests might be forwarded to the backends which are not ready to serve them.`)
+
+	maxPathLength = flags.Int("max-path-length", 0,
+		`The maximum length of Path in Ingress.  The rule which has longer Path is ignored with a warning.  0 means no limit.`)
+
+	weightPerService = flags.Bool("weight-per-service", false,
+		`When multiple Services serve the same host and path, assign weights to their backends so that traffic is split evenly among
+		Services rather than by the number of endpoints.`)
+
+	requiredPodConditions = flags.StringSlice("required-pod-conditions", nil,
+		`Comma separated list of Pod condition types (e.g., custom readiness gates) which must be True for the endpoints backed by
+		the Pod to be used as backends.`)
+
+	endpointWeightLabel = flags.String("endpoint-weight-label", "",
+		`The key of Pod label which specifies the weight of the endpoints backed by the Pod in the range [1, 256], e.g.,
+		"ingress.zlab.co.jp/weight".  The endpoint whose Pod has no such label, or has an invalid value, uses the weight in backend
+		configuration.  --weight-per-service overrides it.`)
+
+	strictPathValidation = flags.Bool("strict-path-validation", true,
+		`Ignore the rule in Ingress whose Path does not start with "/".  If false is given, such Path is passed to nghttpx as is.`)
+
+	cacheUpstreams = flags.Bool("cache-upstreams", false,
+		`Reuse the computed backends when only nghttpx ConfigMap has changed.  nghttpx configuration is still regenerated and
+		reloaded.`)
+
+	minReloadInterval = flags.Duration("min-reload-interval", 0,
+		`The minimum interval between nghttpx reloads.  The configuration changes within this interval after the previous reload
+		are coalesced, and applied after the interval elapses.  0 means no limit.`)
+
+	httpBindAddress = flags.String("http-bind-address", "",
+		`The IP address which cleartext HTTP frontend (port 80) binds to.  If omitted, it binds to all addresses.`)
+
+	httpsBindAddress = flags.String("https-bind-address", "",
+		`The IP address which TLS frontend (port 443) binds to.  If omitted, it binds to all addresses.`)
+
+	publishService = flags.String("publish-service", "",
+		`Optional, Service whose LoadBalancer addresses are written to Ingress status instead of the addresses of Nodes where
+		controller Pods run.  Takes the form namespace/name.  This is useful when the controller runs behind a cloud load
+		balancer.`)
+
+	syncMaxRetries = flags.Int("sync-max-retries", 10,
+		`The maximum number of retries with exponential backoff when computing or applying nghttpx configuration fails.  After
+		that, an event is recorded, and the controller waits for the next change.  0 means no limit.`)
+
+	ocspFetchMode = flags.String("ocsp-fetch-mode", controller.OCSPFetchModeActive,
+		`How OCSP responses are obtained for TLS certificates.  It must be either "active" or "off".  If "active" is given, nghttpx
+		fetches OCSP responses from the OCSP responder in the certificate's AIA extension, and staples them.  If "off" is given,
+		OCSP stapling is disabled.`)
+
+	ocspUpdateInterval = flags.Duration("ocsp-update-interval", 0,
+		`The interval to refresh OCSP responses in "active" OCSP fetch mode.  It must be 0 or at least 1 second.  0 means nghttpx
+		default.`)
+
+	nghttpxAPIBind = flags.String("nghttpx-api-bind", "127.0.0.1",
+		`The address which nghttpx API frontend (port 3001) binds to.  It must be either "127.0.0.1" or "0.0.0.0".  The API
+		frontend has no authentication, and "0.0.0.0" allows anyone who can reach the Pod to change nghttpx backends.`)
+
+	scopeSecretsToWatchNamespace = flags.Bool("scope-secrets-to-watch-namespace", false,
+		`Watch Secrets only in --watch-namespace, so that the controller does not need cluster-wide Secret read permission.  It
+		requires --watch-namespace, and --default-tls-secret must be in that namespace.`)
+
+	defaultBackendResponse = flags.String("default-backend-response", "",
+		`Optional, static response which nghttpx serves when --default-backend-service has no endpoints.  It takes the form
+		<CODE>[:<BODY>], e.g., "404:Not Found".  If <BODY> starts with "@", the rest is the path to the file which contains the
+		body.  If omitted, nghttpx responds with 503.`)
+
+	nghttpxHealthBind = flags.String("nghttpx-health-bind", "127.0.0.1",
+		`The address which nghttpx health monitor frontend (port 8080) binds to.  It must be either "127.0.0.1" or "0.0.0.0".`)
+
+	allowUnixSocketBackend = flags.Bool("allow-unix-socket-backend", false,
+		`Honor unixSocketPath in ingress.zlab.co.jp/backend-config annotation.  Enable this only if the controller Pod shares the
+		volume which contains the socket with the backend, e.g., when the backend runs as a sidecar.`)
+
+	nghttpxMaxWorkerProcesses = flags.Int("nghttpx-max-worker-processes", 0,
+		`The maximum number of nghttpx worker processes, including the old ones which are still serving in-flight requests after
+		reload.  If the number exceeds it, the oldest worker process is killed.  0 means no limit.  This requires nghttpx v1.43.0 or
+		later.`)
+
+	nghttpxWorkerProcessGraceShutdownPeriod = flags.Duration("nghttpx-worker-process-grace-shutdown-period", 0,
+		`The maximum period for the old nghttpx worker process to finish in-flight requests after reload.  After that, it is
+		killed.  It must be 0 or at least 1 second.  0 means no limit.  This requires nghttpx v1.43.0 or later.`)
+
+	nghttpxExtraArgs = flags.StringArray("nghttpx-extra-args", nil,
+		`Additional command-line argument passed to nghttpx, e.g., "--frontend-http2-max-concurrent-streams=200".  Repeat this
+		flag to pass multiple arguments.  --conf, --pid-file, and --daemon cannot be given.  The options which can be written in
+		configuration file should be given in nghttpx-conf key of ConfigMap instead, so that they can be changed without restarting
+		the controller.`)
+
+	rejectConflictingRules = flags.Bool("reject-conflicting-rules", false,
+		`When multiple Ingresses define the same host and path, use only the rules of the oldest Ingress, and record a warning event
+		on the others.  By default, the backends of such rules are merged.`)
+
+	startupValidateBackends = flags.Bool("startup-validate-backends", false,
+		`Before /startupz succeeds for the first time, wait until at least one of a few sampled backends accepts TCP connection, so
+		that the controller does not become ready while Pod networking is not ready yet.  The wait is bounded by
+		--startup-validate-backends-timeout.`)
+
+	startupValidateBackendsTimeout = flags.Duration("startup-validate-backends-timeout", 30*time.Second,
+		`The maximum duration to wait for backends to become reachable at startup.  After that, /startupz succeeds regardless.`)
+
+	fullResyncPeriod = flags.Duration("full-resync-period", 0,
+		`If positive, recompute and apply the whole nghttpx configuration this often regardless of watch events, so that the drift of
+		nghttpx configuration is corrected.  It uses the cached objects, and does not issue requests to API server.  0 disables it.`)
+
+	backendTLSCASecret = flags.String("backend-tls-ca-secret", "",
+		`Optional, name of the Secret in the form of namespace/name which contains CA bundle under ca.crt key.  nghttpx verifies the
+		certificates of TLS backends against it instead of the system default CA store.`)
+
+	clientCASecret = flags.String("client-ca-secret", "",
+		`Optional, name of the Secret in the form of namespace/name which contains CA bundle under ca.crt key.  If it is given, nghttpx
+		requires TLS client certificates on all TLS hosts, and verifies them against it.`)
+
+	reloadRate = flags.Float64("reload-rate", 1.0,
+		`The maximum number of nghttpx configuration reloads per second.`)
+
+	reloadBurst = flags.Int("reload-burst", 1,
+		`The maximum burst of nghttpx configuration reloads.  It is only used by token-bucket reload strategy.`)
+
+	reloadStrategy = flags.String("reload-strategy", controller.ReloadStrategyTokenBucket,
+		`The algorithm to limit the rate of nghttpx configuration reloads.  "token-bucket" allows a burst of --reload-burst reloads.
+		"min-interval" guarantees at least 1/--reload-rate seconds between any two reloads, which gives predictable reload cadence
+		when endpoints are flapping.`)
+
+	emptyUpstreamBehavior = flags.String("empty-upstream-behavior", controller.EmptyUpstreamBehaviorDrop,
+		`The behavior for the Ingress rule whose Service has no active endpoints.  "drop" ignores the rule, and the default backend
+		serves its requests.  "503" keeps the rule, and responds to its requests with 503 so that clients can tell that the Service
+		is unavailable.`)
+
+	nghttpxReloadMethod = flags.String("nghttpx-reload-method", nghttpx.ReloadMethodAPI,
+		`The method to make nghttpx load new configuration.  "api" applies the backend-only changes through nghttpx backendconfig API,
+		and sends SIGHUP to nghttpx when the other configuration changes.  "signal" always sends SIGHUP.  "none" writes the
+		configuration files, but never tells nghttpx to load them.`)
+
+	nghttpxBaseConfig = flags.String("nghttpx-base-config", "",
+		`Path to nghttpx configuration file, e.g., the one mounted from ConfigMap, which is included in the generated configuration,
+		so that its settings survive reloads.  The settings in nghttpx-conf key of ConfigMap take precedence over it.  The change of
+		the file is applied on the next sync.`)
+
+	annotateConfig = flags.Bool("annotate-config", false,
+		`Render the Ingress and its annotations which each backend is created from, and the Secret which each TLS certificate is
+		created from as comments in the generated nghttpx configuration.  This is useful to diagnose the configuration, but makes
+		it larger.`)
+
+	clientCertHeaders = flags.Bool("client-cert-headers", false,
+		`Send the subject name and SHA-256 fingerprint of TLS client certificate, and the result of its verification to backend in
+		the request header fields given by --client-cert-subject-header, --client-cert-fingerprint-header, and
+		--client-verify-header.  The header fields in the requests from clients are removed, so that they cannot be spoofed.`)
+
+	clientCertSubjectHeader = flags.String("client-cert-subject-header", "X-Client-Cert-Subject",
+		`The request header field which carries the subject name of TLS client certificate.  It is only used with
+		--client-cert-headers.`)
+
+	clientCertFingerprintHeader = flags.String("client-cert-fingerprint-header", "X-Client-Cert-Fingerprint",
+		`The request header field which carries the SHA-256 fingerprint of TLS client certificate.  It is only used with
+		--client-cert-headers.`)
+
+	clientVerifyHeader = flags.String("client-verify-header", "X-Client-Verify",
+		`The request header field which carries the result of TLS client certificate verification, either "SUCCESS" or "NONE".  It
+		is only used with --client-cert-headers.`)
+
+	appendCAToCert = flags.Bool("append-ca-to-cert", false,
+		`Append the certificates in ca.crt of TLS Secret to its certificate chain, so that intermediate certificates are served
+		even if tls.crt lacks them.  Self-signed root certificate and the certificates already in tls.crt are not appended.`)
 )
 
 func main() {
@@ -105,6 +311,8 @@ func main() {
 
 	glog.Infof("Using build: %v - %v", gitRepo, version)
 
+	registerBuildInfo(metrics.DefaultRegistry, version, gitRepo)
+
 	if *buildCfg {
 		fmt.Println("dump-nghttpx-configuration was deprecated.")
 		os.Exit(0)
@@ -138,15 +346,208 @@ func main() {
 	}
 	glog.Infof("Validated %v as the default backend", *defaultSvc)
 
+	if *publishService != "" {
+		if _, _, err := controller.ParseNSName(*publishService); err != nil {
+			glog.Fatalf("could not parse publish service name %v: %v", *publishService, err)
+		}
+	}
+
 	if *ngxConfigMap != "" {
 		if _, _, err := controller.ParseNSName(*ngxConfigMap); err != nil {
 			glog.Fatalf("could not parse configmap name %v: %v", *ngxConfigMap, err)
 		}
 	}
 
-	if *defaultTLSSecret != "" {
-		if _, _, err := controller.ParseNSName(*defaultTLSSecret); err != nil {
-			glog.Fatalf("could not parse Secret %v: %v", *defaultTLSSecret, err)
+	for _, secret := range *defaultTLSSecret {
+		if _, _, err := controller.ParseNSName(secret); err != nil {
+			glog.Fatalf("could not parse Secret %v: %v", secret, err)
+		}
+	}
+
+	if *backendTLSCASecret != "" {
+		if _, _, err := controller.ParseNSName(*backendTLSCASecret); err != nil {
+			glog.Fatalf("could not parse Secret %v: %v", *backendTLSCASecret, err)
+		}
+	}
+
+	if *clientCASecret != "" {
+		if _, _, err := controller.ParseNSName(*clientCASecret); err != nil {
+			glog.Fatalf("could not parse Secret %v: %v", *clientCASecret, err)
+		}
+	}
+
+	if *scopeSecretsToWatchNamespace {
+		if *watchNamespace == api.NamespaceAll {
+			glog.Fatalf("--scope-secrets-to-watch-namespace requires --watch-namespace")
+		}
+		for _, secret := range *defaultTLSSecret {
+			if ns, _, _ := controller.ParseNSName(secret); ns != *watchNamespace {
+				glog.Fatalf("--default-tls-secret must be in namespace %v if --scope-secrets-to-watch-namespace is given", *watchNamespace)
+			}
+		}
+		if *backendTLSCASecret != "" {
+			if ns, _, _ := controller.ParseNSName(*backendTLSCASecret); ns != *watchNamespace {
+				glog.Fatalf("--backend-tls-ca-secret must be in namespace %v if --scope-secrets-to-watch-namespace is given", *watchNamespace)
+			}
+		}
+		if *clientCASecret != "" {
+			if ns, _, _ := controller.ParseNSName(*clientCASecret); ns != *watchNamespace {
+				glog.Fatalf("--client-ca-secret must be in namespace %v if --scope-secrets-to-watch-namespace is given", *watchNamespace)
+			}
+		}
+	}
+
+	switch *defaultBackendPreference {
+	case controller.DefaultBackendPreferIngress, controller.DefaultBackendPreferGlobal:
+	default:
+		glog.Fatalf("--default-backend-preference must be either %v or %v", controller.DefaultBackendPreferIngress,
+			controller.DefaultBackendPreferGlobal)
+	}
+
+	switch *ocspFetchMode {
+	case controller.OCSPFetchModeActive, controller.OCSPFetchModeOff:
+	default:
+		glog.Fatalf("--ocsp-fetch-mode must be either %v or %v", controller.OCSPFetchModeActive, controller.OCSPFetchModeOff)
+	}
+
+	if *reloadRate <= 0 {
+		glog.Fatalf("--reload-rate must be positive")
+	}
+
+	if *reloadBurst < 1 {
+		glog.Fatalf("--reload-burst must be positive")
+	}
+
+	switch *reloadStrategy {
+	case controller.ReloadStrategyTokenBucket, controller.ReloadStrategyMinInterval:
+	default:
+		glog.Fatalf("--reload-strategy must be either %v or %v", controller.ReloadStrategyTokenBucket,
+			controller.ReloadStrategyMinInterval)
+	}
+
+	switch *nghttpxReloadMethod {
+	case nghttpx.ReloadMethodAPI, nghttpx.ReloadMethodSignal, nghttpx.ReloadMethodNone:
+	default:
+		glog.Fatalf("--nghttpx-reload-method must be one of %v, %v, or %v", nghttpx.ReloadMethodAPI, nghttpx.ReloadMethodSignal,
+			nghttpx.ReloadMethodNone)
+	}
+
+	switch *emptyUpstreamBehavior {
+	case controller.EmptyUpstreamBehaviorDrop, controller.EmptyUpstreamBehaviorServiceUnavailable:
+	default:
+		glog.Fatalf("--empty-upstream-behavior must be either %v or %v", controller.EmptyUpstreamBehaviorDrop,
+			controller.EmptyUpstreamBehaviorServiceUnavailable)
+	}
+
+	var addressTypes []api.NodeAddressType
+	for _, t := range *addressType {
+		switch t := api.NodeAddressType(t); t {
+		case api.NodeExternalIP, api.NodeInternalIP, api.NodeHostName:
+			addressTypes = append(addressTypes, t)
+		default:
+			glog.Fatalf("--address-type: %v must be one of %v, %v, or %v", t, api.NodeExternalIP, api.NodeInternalIP,
+				api.NodeHostName)
+		}
+	}
+	if len(addressTypes) > 0 && *allowInternalIP {
+		glog.Fatalf("--address-type and --allow-internal-ip cannot be used together")
+	}
+
+	var ccHeaders *nghttpx.ClientCertHeaders
+	if *clientCertHeaders {
+		for _, h := range []struct {
+			flag string
+			name string
+		}{
+			{"client-cert-subject-header", *clientCertSubjectHeader},
+			{"client-cert-fingerprint-header", *clientCertFingerprintHeader},
+			{"client-verify-header", *clientVerifyHeader},
+		} {
+			if !validHeaderFieldName(h.name) {
+				glog.Fatalf("--%v: invalid header field name %q", h.flag, h.name)
+			}
+		}
+		ccHeaders = &nghttpx.ClientCertHeaders{
+			Subject:     *clientCertSubjectHeader,
+			Fingerprint: *clientCertFingerprintHeader,
+			Verify:      *clientVerifyHeader,
+		}
+	}
+
+	var (
+		defaultBackendResponseCode int
+		defaultBackendResponseBody []byte
+	)
+	if *defaultBackendResponse != "" {
+		defaultBackendResponseCode, defaultBackendResponseBody, err = parseDefaultBackendResponse(*defaultBackendResponse)
+		if err != nil {
+			glog.Fatalf("--default-backend-response: %v", err)
+		}
+	}
+
+	if *nghttpxMaxWorkerProcesses < 0 {
+		glog.Fatalf("--nghttpx-max-worker-processes must not be negative")
+	}
+
+	if *nghttpxWorkerProcessGraceShutdownPeriod != 0 && *nghttpxWorkerProcessGraceShutdownPeriod < time.Second {
+		glog.Fatalf("--nghttpx-worker-process-grace-shutdown-period must be 0 or at least 1 second")
+	}
+
+	if *nghttpxBaseConfig != "" {
+		if _, err := os.Stat(*nghttpxBaseConfig); err != nil {
+			glog.Fatalf("could not access --nghttpx-base-config: %v", err)
+		}
+	}
+
+	if *fullResyncPeriod < 0 {
+		glog.Fatalf("--full-resync-period must not be negative")
+	}
+
+	if *startupValidateBackendsTimeout <= 0 {
+		glog.Fatalf("--startup-validate-backends-timeout must be positive")
+	}
+
+	if err := nghttpx.ValidateExtraArgs(*nghttpxExtraArgs); err != nil {
+		glog.Fatalf("--nghttpx-extra-args: %v", err)
+	}
+
+	if *ocspUpdateInterval != 0 && *ocspUpdateInterval < time.Second {
+		glog.Fatalf("--ocsp-update-interval must be 0 or at least 1 second")
+	}
+
+	for _, port := range *proxyProtoExcludePorts {
+		if port != 80 && port != 443 {
+			glog.Fatalf("--proxy-proto-exclude-ports: %v is not a public frontend port", port)
+		}
+	}
+
+	if *maxPathLength < 0 {
+		glog.Fatalf("--max-path-length must be greater than or equal to 0")
+	}
+
+	// The controller always accesses API and health monitor frontends via 127.0.0.1.
+	for flag, addr := range map[string]string{"--nghttpx-api-bind": *nghttpxAPIBind, "--nghttpx-health-bind": *nghttpxHealthBind} {
+		if addr != "127.0.0.1" && addr != "0.0.0.0" {
+			glog.Fatalf("%v must be either 127.0.0.1 or 0.0.0.0", flag)
+		}
+	}
+
+	if *httpBindAddress != "" && net.ParseIP(*httpBindAddress) == nil {
+		glog.Fatalf("--http-bind-address: %v is not a valid IP address", *httpBindAddress)
+	}
+	if *httpsBindAddress != "" && net.ParseIP(*httpsBindAddress) == nil {
+		glog.Fatalf("--https-bind-address: %v is not a valid IP address", *httpsBindAddress)
+	}
+
+	if *minReloadInterval < 0 {
+		glog.Fatalf("--min-reload-interval must be greater than or equal to 0")
+	}
+
+	var workers string
+	if *nghttpxWorkers != "" {
+		workers, err = nghttpx.ParseWorkers(*nghttpxWorkers)
+		if err != nil {
+			glog.Fatalf("could not parse --nghttpx-workers: %v", err)
 		}
 	}
 
@@ -163,16 +564,63 @@ func main() {
 	}
 
 	controllerConfig := controller.Config{
-		ResyncPeriod:          *resyncPeriod,
-		DefaultBackendService: *defaultSvc,
-		WatchNamespace:        *watchNamespace,
-		NghttpxConfigMap:      *ngxConfigMap,
-		DefaultTLSSecret:      *defaultTLSSecret,
-		IngressClass:          *ingressClass,
-		AllowInternalIP:       *allowInternalIP,
+		ResyncPeriod:                     *resyncPeriod,
+		DefaultBackendService:            *defaultSvc,
+		WatchNamespace:                   *watchNamespace,
+		NghttpxConfigMap:                 *ngxConfigMap,
+		DefaultTLSSecrets:                *defaultTLSSecret,
+		IngressClass:                     *ingressClass,
+		WatchWithoutClass:                *watchWithoutClass,
+		RedirectWithoutCert:              *redirectWithoutCert,
+		AllowInternalIP:                  *allowInternalIP,
+		AddressTypes:                     addressTypes,
+		NghttpxWorkers:                   workers,
+		DefaultBackendPreference:         *defaultBackendPreference,
+		ProxyProto:                       *proxyProto,
+		ProxyProtoExcludePorts:           *proxyProtoExcludePorts,
+		IncludeNotReadyEndpoints:         *includeNotReadyEndpoints,
+		MaxPathLength:                    *maxPathLength,
+		WeightPerService:                 *weightPerService,
+		RequiredPodConditions:            *requiredPodConditions,
+		EndpointWeightLabel:              *endpointWeightLabel,
+		StrictPathValidation:             *strictPathValidation,
+		CacheUpstreams:                   *cacheUpstreams,
+		HTTPBindAddress:                  *httpBindAddress,
+		HTTPSBindAddress:                 *httpsBindAddress,
+		PublishService:                   *publishService,
+		SyncMaxRetries:                   *syncMaxRetries,
+		OCSPFetchMode:                    *ocspFetchMode,
+		OCSPUpdateInterval:               *ocspUpdateInterval,
+		MaxWorkerProcesses:               *nghttpxMaxWorkerProcesses,
+		WorkerProcessGraceShutdownPeriod: *nghttpxWorkerProcessGraceShutdownPeriod,
+		NghttpxAPIBind:                   *nghttpxAPIBind,
+		NghttpxHealthBind:                *nghttpxHealthBind,
+		ScopeSecretsToWatchNamespace:     *scopeSecretsToWatchNamespace,
+		DefaultBackendResponseCode:       defaultBackendResponseCode,
+		DefaultBackendResponseBody:       defaultBackendResponseBody,
+		AllowUnixSocketBackend:           *allowUnixSocketBackend,
+		RejectConflictingRules:           *rejectConflictingRules,
+		AppendCAToCert:                   *appendCAToCert,
+		StartupValidateBackends:          *startupValidateBackends,
+		StartupValidateBackendsTimeout:   *startupValidateBackendsTimeout,
+		FullResyncPeriod:                 *fullResyncPeriod,
+		BackendTLSCASecret:               *backendTLSCASecret,
+		ClientCASecret:                   *clientCASecret,
+		NghttpxBaseConfig:                *nghttpxBaseConfig,
+		AnnotateConfig:                   *annotateConfig,
+		ClientCertHeaders:                ccHeaders,
+		ReloadRate:                       *reloadRate,
+		ReloadBurst:                      *reloadBurst,
+		ReloadStrategy:                   *reloadStrategy,
+		EmptyUpstreamBehavior:            *emptyUpstreamBehavior,
+		MetricsRegistry:                  metrics.DefaultRegistry,
 	}
 
-	lbc := controller.NewLoadBalancerController(clientset, nghttpx.NewManager(), &controllerConfig, runtimePodInfo)
+	ngx := nghttpx.NewManager(*nghttpxReloadMethod)
+	ngx.MinReloadInterval = *minReloadInterval
+	ngx.ExtraArgs = *nghttpxExtraArgs
+
+	lbc := controller.NewLoadBalancerController(clientset, ngx, &controllerConfig, runtimePodInfo)
 
 	go registerHandlers(lbc)
 	go handleSigterm(lbc)
@@ -185,17 +633,30 @@ func main() {
 	}
 }
 
+// nghttpxHealthzURL is the URL of nghttpx health monitor frontend.
+const nghttpxHealthzURL = "http://127.0.0.1:8080/healthz"
+
 // healthzChecker implements healthz.HealthzChecker interface.
-type healthzChecker struct{}
+type healthzChecker struct {
+	// url is the URL of nghttpx health monitor frontend.
+	url string
+	// supervised returns false if nghttpx process is no longer supervised.  Then the check fails regardless of url, so that
+	// kubelet restarts the Pod.
+	supervised func() bool
+}
 
 // Name returns the healthcheck name
 func (hc healthzChecker) Name() string {
 	return "nghttpx"
 }
 
-// Check returns if the nghttpx healthz endpoint is returning ok (status code 200)
+// Check returns if the nghttpx healthz endpoint is returning ok (status code 200), and nghttpx process is supervised.
 func (hc healthzChecker) Check(_ *http.Request) error {
-	res, err := http.Get("http://127.0.0.1:8080/healthz")
+	if hc.supervised != nil && !hc.supervised() {
+		return fmt.Errorf("nghttpx process is no longer supervised")
+	}
+
+	res, err := http.Get(hc.url)
 	if err != nil {
 		return err
 	}
@@ -208,9 +669,73 @@ func (hc healthzChecker) Check(_ *http.Request) error {
 	return nil
 }
 
+// startupzHandler returns http.Handler which fails until configApplied returns true.  It is intended to be used as startup probe.
+func startupzHandler(configApplied func() bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !configApplied() {
+			http.Error(w, "nghttpx configuration has not been applied yet", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+}
+
+// parseDefaultBackendResponse parses s in the form of <CODE>[:<BODY>], and returns status code and body.  If <BODY> starts with "@",
+// the body is read from the file whose path follows "@".
+func parseDefaultBackendResponse(s string) (int, []byte, error) {
+	codeStr, body := s, ""
+	if i := strings.Index(s, ":"); i != -1 {
+		codeStr, body = s[:i], s[i+1:]
+	}
+
+	code, err := strconv.Atoi(codeStr)
+	if err != nil || code < 200 || code > 599 {
+		return 0, nil, fmt.Errorf("invalid status code %v", codeStr)
+	}
+
+	if strings.HasPrefix(body, "@") {
+		b, err := ioutil.ReadFile(body[1:])
+		if err != nil {
+			return 0, nil, fmt.Errorf("could not read body: %v", err)
+		}
+		return code, b, nil
+	}
+
+	return code, []byte(body), nil
+}
+
+// validHeaderFieldName returns true if name is a valid HTTP header field name, that is a non-empty token defined in RFC 7230.
+func validHeaderFieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range []byte(name) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) != -1:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// registerBuildInfo registers nghttpx_ingress_controller_build_info metric to reg.  Its value is always 1, and the build variables
+// are given as labels.
+func registerBuildInfo(reg *metrics.Registry, version, gitRepo string) {
+	buildInfo := metrics.NewGaugeVec("nghttpx_ingress_controller_build_info",
+		"A metric with a constant '1' value labeled by version and git_repo from which the controller was built.", "version", "git_repo")
+	buildInfo.Set(1, version, gitRepo)
+	reg.MustRegister(buildInfo)
+}
+
 func registerHandlers(lbc *controller.LoadBalancerController) {
 	mux := http.NewServeMux()
-	healthz.InstallHandler(mux, &healthzChecker{})
+	healthz.InstallHandler(mux, &healthzChecker{url: nghttpxHealthzURL, supervised: lbc.NghttpxSupervised})
+
+	mux.Handle("/startupz", startupzHandler(lbc.ConfigApplied))
+
+	mux.Handle("/metrics", metrics.DefaultRegistry.Handler())
 
 	http.HandleFunc("/build", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -225,6 +750,25 @@ func registerHandlers(lbc *controller.LoadBalancerController) {
 		mux.HandleFunc("/debug/pprof/", pprof.Index)
 		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+
+		mux.HandleFunc("/debug/sni", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(lbc.SNIMapping()); err != nil {
+				glog.Errorf("Could not write SNI mapping: %v", err)
+			}
+		})
+
+		mux.HandleFunc("/debug/config", func(w http.ResponseWriter, r *http.Request) {
+			ingConfig := lbc.AppliedIngressConfig()
+			if ingConfig == nil {
+				http.Error(w, "no configuration has been applied yet", http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(ingConfig); err != nil {
+				glog.Errorf("Could not write applied configuration: %v", err)
+			}
+		})
 	}
 
 	server := &http.Server{
@@ -0,0 +1,143 @@
+/**
+ * Copyright 2017, nghttpx Ingress controller contributors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/zlabjp/nghttpx-ingress-lb/pkg/metrics"
+)
+
+// TestStartupzHandler verifies that startupzHandler fails until configuration is applied, and succeeds after that.
+func TestStartupzHandler(t *testing.T) {
+	applied := false
+	h := startupzHandler(func() bool { return applied })
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/startupz", nil))
+	if got, want := w.Code, http.StatusServiceUnavailable; got != want {
+		t.Errorf("w.Code = %v, want %v", got, want)
+	}
+
+	applied = true
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/startupz", nil))
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Errorf("w.Code = %v, want %v", got, want)
+	}
+}
+
+// TestHealthzCheckerUnsupervised verifies that healthzChecker fails if nghttpx process is no longer supervised, even if nghttpx
+// health monitor responds with 200.
+func TestHealthzCheckerUnsupervised(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	supervised := true
+	hc := healthzChecker{url: ts.URL, supervised: func() bool { return supervised }}
+
+	if err := hc.Check(nil); err != nil {
+		t.Errorf("hc.Check(nil) returned unexpected error %v", err)
+	}
+
+	supervised = false
+
+	if err := hc.Check(nil); err == nil {
+		t.Errorf("hc.Check(nil) did not return error")
+	}
+}
+
+// TestBuildInfo verifies that build_info metric has the build variables as labels.
+func TestBuildInfo(t *testing.T) {
+	reg := metrics.NewRegistry()
+	registerBuildInfo(reg, version, gitRepo)
+
+	w := httptest.NewRecorder()
+	reg.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("w.Code = %v, want %v", got, want)
+	}
+
+	want := `nghttpx_ingress_controller_build_info{version="` + version + `",git_repo="` + gitRepo + `"} 1` + "\n"
+	if got := w.Body.String(); !strings.Contains(got, want) {
+		t.Errorf("w.Body = %q, does not contain %q", got, want)
+	}
+}
+
+// TestParseDefaultBackendResponse verifies parseDefaultBackendResponse.
+func TestParseDefaultBackendResponse(t *testing.T) {
+	f, err := ioutil.TempFile("", "body")
+	if err != nil {
+		t.Fatalf("ioutil.TempFile(...) returned unexpected error %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("<h1>Not Found</h1>")
+	f.Close()
+
+	tests := []struct {
+		in       string
+		wantCode int
+		wantBody string
+		wantErr  bool
+	}{
+		{in: "404", wantCode: 404},
+		{in: "404:Not Found", wantCode: 404, wantBody: "Not Found"},
+		{in: "503:a:b", wantCode: 503, wantBody: "a:b"},
+		{in: "404:@" + f.Name(), wantCode: 404, wantBody: "<h1>Not Found</h1>"},
+		{in: "404:@" + f.Name() + ".missing", wantErr: true},
+		{in: "foo", wantErr: true},
+		{in: "99:Not Found", wantErr: true},
+	}
+
+	for i, tt := range tests {
+		code, body, err := parseDefaultBackendResponse(tt.in)
+		if err != nil {
+			if !tt.wantErr {
+				t.Errorf("#%v: parseDefaultBackendResponse(%q) returned unexpected error %v", i, tt.in, err)
+			}
+			continue
+		}
+		if tt.wantErr {
+			t.Errorf("#%v: parseDefaultBackendResponse(%q) did not return error", i, tt.in)
+			continue
+		}
+		if got, want := code, tt.wantCode; got != want {
+			t.Errorf("#%v: code = %v, want %v", i, got, want)
+		}
+		if got, want := string(body), tt.wantBody; got != want {
+			t.Errorf("#%v: body = %q, want %q", i, got, want)
+		}
+	}
+}
+
+// TestValidHeaderFieldName verifies validHeaderFieldName.
+func TestValidHeaderFieldName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "X-Client-Cert-Subject", want: true},
+		{name: "x_client.verify~1", want: true},
+		{name: ""},
+		{name: "X Client"},
+		{name: "X-Client:"},
+		{name: "X-Client\r\n"},
+	}
+
+	for i, tt := range tests {
+		if got, want := validHeaderFieldName(tt.name), tt.want; got != want {
+			t.Errorf("#%v: validHeaderFieldName(%q) = %v, want %v", i, tt.name, got, want)
+		}
+	}
+}
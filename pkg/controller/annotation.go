@@ -10,8 +10,7 @@ package controller
 
 import (
 	"encoding/json"
-
-	"github.com/golang/glog"
+	"fmt"
 
 	"github.com/zlabjp/nghttpx-ingress-lb/pkg/nghttpx"
 )
@@ -21,26 +20,57 @@ const (
 	backendConfigKey = "ingress.zlab.co.jp/backend-config"
 	// ingressClassKey is a key to annotation in order to run multiple Ingress controllers.
 	ingressClassKey = "kubernetes.io/ingress.class"
+	// pathConfigKey is a key to annotation for extra path configuration.
+	pathConfigKey = "ingress.zlab.co.jp/path-config"
+	// allowHTTPKey is a key to annotation which specifies whether the Ingress is served over cleartext HTTP.
+	allowHTTPKey = "kubernetes.io/ingress.allow-http"
+	// disabledKey is a key to annotation which takes the Ingress out of rotation without deleting it.
+	disabledKey = "ingress.zlab.co.jp/disabled"
 )
 
 type ingressAnnotation map[string]string
 
-func (ia ingressAnnotation) getBackendConfig() map[string]map[string]nghttpx.PortBackendConfig {
+// getBackendConfig returns backend configuration from annotation.  The first key specifies service name, and secondary key
+// specifies port name.  It returns an error if the annotation cannot be parsed.
+func (ia ingressAnnotation) getBackendConfig() (map[string]map[string]nghttpx.PortBackendConfig, error) {
 	data := ia[backendConfigKey]
-	// the first key specifies service name, and secondary key specifies port name.
 	var config map[string]map[string]nghttpx.PortBackendConfig
 	if data == "" {
-		return config
+		return config, nil
+	}
+	if err := json.Unmarshal([]byte(data), &config); err != nil {
+		return nil, fmt.Errorf("Could not parse %v annotation: %v", backendConfigKey, err)
+	}
+
+	return config, nil
+}
+
+// getPathConfig returns path configuration from annotation.  The key is the concatenation of host and path of the rule, e.g.,
+// "example.com/alpha".  It returns an error if the annotation cannot be parsed.
+func (ia ingressAnnotation) getPathConfig() (map[string]*nghttpx.PathConfig, error) {
+	data := ia[pathConfigKey]
+	var config map[string]*nghttpx.PathConfig
+	if data == "" {
+		return config, nil
 	}
 	if err := json.Unmarshal([]byte(data), &config); err != nil {
-		glog.Errorf("unexpected error reading %v annotation: %v", backendConfigKey, err)
-		return config
+		return nil, fmt.Errorf("Could not parse %v annotation: %v", pathConfigKey, err)
 	}
 
-	return config
+	return config, nil
 }
 
 // getIngressClass returns Ingress class from annotation.
 func (ia ingressAnnotation) getIngressClass() string {
 	return ia[ingressClassKey]
 }
+
+// getAllowHTTP returns false if the Ingress must not be served over cleartext HTTP.  It returns true unless the annotation is "false".
+func (ia ingressAnnotation) getAllowHTTP() bool {
+	return ia[allowHTTPKey] != "false"
+}
+
+// getDisabled returns true if the Ingress is disabled.  It returns true only if the annotation is "true".
+func (ia ingressAnnotation) getDisabled() bool {
+	return ia[disabledKey] == "true"
+}
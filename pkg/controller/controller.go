@@ -25,14 +25,18 @@ limitations under the License.
 package controller
 
 import (
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"math/rand"
 	"net"
+	"net/http"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
@@ -54,6 +58,7 @@ import (
 	"k8s.io/kubernetes/pkg/util/workqueue"
 	"k8s.io/kubernetes/pkg/watch"
 
+	"github.com/zlabjp/nghttpx-ingress-lb/pkg/metrics"
 	"github.com/zlabjp/nghttpx-ingress-lb/pkg/nghttpx"
 )
 
@@ -64,38 +69,185 @@ const (
 	// syncKey is a key to put into the queue.  Since we create load balancer configuration using all available information, it is
 	// suffice to queue only one item.  Further, queue is somewhat overkill here, but we just keep using it for simplicity.
 	syncKey = "ingress"
+	// caCertKey is the key of CA bundle in Secret.
+	caCertKey = "ca.crt"
+	// httpPort is the port of cleartext HTTP frontend.
+	httpPort = 80
+	// httpsPort is the port of TLS frontend.
+	httpsPort = 443
+	// publishServiceRetryPeriod is the interval to retry Ingress status update when the published Service has not been assigned
+	// an address yet.
+	publishServiceRetryPeriod = 5 * time.Second
+	// syncRetryBaseDelay is the initial delay to retry failed sync.  It is doubled on each failure up to syncRetryMaxDelay.
+	syncRetryBaseDelay = time.Second
+	// syncRetryMaxDelay is the maximum delay to retry failed sync.
+	syncRetryMaxDelay = 5 * time.Minute
+	// startupValidateSampleSize is the maximum number of backends which are validated at startup.
+	startupValidateSampleSize = 5
+	// slowStartSteps is the number of steps in which the weight of a new backend is increased during slow start.
+	slowStartSteps = 10
+	// incompleteSecretRetryDelay is the delay to recompute the configuration when TLS Secret referenced by Ingress lacks
+	// certificate or private key.
+	incompleteSecretRetryDelay = 5 * time.Second
+	// incompleteSecretMaxRetries is the maximum number of consecutive retries for incomplete TLS Secret.  After that, the
+	// controller waits for the update of Secret.
+	incompleteSecretMaxRetries = 6
+)
+
+// incompleteSecretError is returned when TLS Secret lacks certificate or private key.  It is usually transient, e.g., while the
+// certificate is being issued.
+type incompleteSecretError struct {
+	secretKey string
+	missing   string
+}
+
+func (e *incompleteSecretError) Error() string {
+	return fmt.Sprintf("Secret %v has no %v", e.secretKey, e.missing)
+}
+
+// errNoPublishServiceAddress is returned when the published Service has not been assigned an address yet.
+var errNoPublishServiceAddress = fmt.Errorf("Published Service has no LoadBalancer address yet")
+
+const (
+	// DefaultBackendPreferIngress makes the catch-all rule (empty host and path "/") in Ingress override the default backend
+	// Service.  The default backend Service is still used if the catch-all rule has no available endpoints.
+	DefaultBackendPreferIngress = "ingress"
+	// DefaultBackendPreferGlobal makes the default backend Service always serve the catch-all requests, and the catch-all rules in
+	// Ingress are ignored.
+	DefaultBackendPreferGlobal = "global"
+)
+
+const (
+	// OCSPFetchModeActive makes nghttpx fetch OCSP responses from the OCSP responder, and staple them.
+	OCSPFetchModeActive = "active"
+	// OCSPFetchModeOff disables OCSP stapling.
+	OCSPFetchModeOff = "off"
+)
+
+const (
+	// EmptyUpstreamBehaviorDrop drops the rule whose Service has no active endpoints, and the default backend serves the requests.
+	EmptyUpstreamBehaviorDrop = "drop"
+	// EmptyUpstreamBehaviorServiceUnavailable keeps the rule whose Service has no active endpoints, and responds to its requests
+	// with 503.
+	EmptyUpstreamBehaviorServiceUnavailable = "503"
+)
+
+const (
+	// ReloadStrategyTokenBucket limits the rate of reloads by token bucket, which allows a burst of reloads.
+	ReloadStrategyTokenBucket = "token-bucket"
+	// ReloadStrategyMinInterval guarantees the minimum interval between any two reloads.
+	ReloadStrategyMinInterval = "min-interval"
+)
+
+const (
+	// defaultReloadRate is the default number of reloads per second.
+	defaultReloadRate = 1.0
+	// defaultReloadBurst is the default burst of reloads of token bucket.
+	defaultReloadBurst = 1
 )
 
 // LoadBalancerController watches the kubernetes api and adds/removes services
 // from the loadbalancer
 type LoadBalancerController struct {
-	clientset        internalclientset.Interface
-	ingController    *cache.Controller
-	epController     *cache.Controller
-	svcController    *cache.Controller
-	secretController *cache.Controller
-	cmController     *cache.Controller
-	podController    *cache.Controller
-	nodeController   *cache.Controller
-	ingLister        ingressLister
-	svcLister        serviceLister
-	epLister         cache.StoreToEndpointsLister
-	secretLister     secretLister
-	cmLister         configMapLister
-	podLister        cache.StoreToPodLister
-	nodeLister       cache.StoreToNodeLister
-	nghttpx          nghttpx.Interface
-	podInfo          *PodInfo
-	defaultSvc       string
-	ngxConfigMap     string
-	defaultTLSSecret string
-	watchNamespace   string
-	ingressClass     string
-	allowInternalIP  bool
+	// upstreamsGeneration is incremented whenever an object which affects upstreams changes.  It must be accessed atomically, and
+	// it is placed first to guarantee 64-bit alignment.
+	upstreamsGeneration uint64
+
+	clientset         internalclientset.Interface
+	ingController     *cache.Controller
+	epController      *cache.Controller
+	svcController     *cache.Controller
+	secretController  *cache.Controller
+	cmController      *cache.Controller
+	podController     *cache.Controller
+	nodeController    *cache.Controller
+	ingLister         ingressLister
+	svcLister         serviceLister
+	epLister          cache.StoreToEndpointsLister
+	secretLister      secretLister
+	cmLister          configMapLister
+	podLister         cache.StoreToPodLister
+	nodeLister        cache.StoreToNodeLister
+	nghttpx           nghttpx.Interface
+	podInfo           *PodInfo
+	defaultSvc        string
+	ngxConfigMap      string
+	defaultTLSSecrets []string
+	watchNamespace    string
+	ingressClass      string
+	watchWithoutClass bool
+	// redirectWithoutCert is true if cleartext HTTP requests are redirected to https URI even if no TLS certificate matches the
+	// host.
+	redirectWithoutCert bool
+	// emptyUpstreamBehavior is the behavior for the rule whose Service has no active endpoints.
+	emptyUpstreamBehavior string
+	allowInternalIP       bool
+	addressTypes          []api.NodeAddressType
+	nghttpxWorkers        string
+	// defaultBackendPreference is either DefaultBackendPreferIngress or DefaultBackendPreferGlobal.
+	defaultBackendPreference string
+	proxyProto               bool
+	proxyProtoExcludePorts   []int
+	includeNotReadyEndpoints bool
+	maxPathLength            int
+	weightPerService         bool
+	requiredPodConditions    []string
+	// endpointWeightLabel is the key of Pod label which specifies the weight of the endpoints backed by the Pod.  Empty string
+	// disables it.
+	endpointWeightLabel              string
+	strictPathValidation             bool
+	cacheUpstreams                   bool
+	httpBindAddress                  string
+	httpsBindAddress                 string
+	publishService                   string
+	syncMaxRetries                   int
+	ocspFetchMode                    string
+	ocspUpdateInterval               time.Duration
+	maxWorkerProcesses               int
+	workerProcessGraceShutdownPeriod time.Duration
+	nghttpxAPIBind                   string
+	nghttpxHealthBind                string
+	allowUnixSocketBackend           bool
+	rejectConflictingRules           bool
+	appendCAToCert                   bool
+	startupValidateBackends          bool
+	startupValidateBackendsTimeout   time.Duration
+	fullResyncPeriod                 time.Duration
+	backendTLSCASecret               string
+	clientCASecret                   string
+	nghttpxBaseConfig                string
+	// annotateConfig is true if the source of upstreams and TLS certificates is rendered as comments in nghttpx configuration.
+	annotateConfig bool
+	// clientCertHeaders is the names of header fields which carry TLS client certificate information to backend.  nil means that
+	// they are not sent.
+	clientCertHeaders *nghttpx.ClientCertHeaders
+	// defaultBackendResponseCode is the status code of static response served when the default backend Service has no
+	// endpoints.  0 means that static response is disabled.
+	defaultBackendResponseCode int
+	defaultBackendResponseBody []byte
+	// cachedIngConfig is the result of getUpstreamServers computed when upstreamsGeneration was cachedUpstreamsGeneration.  They
+	// are only accessed from sync.
+	cachedIngConfig           *nghttpx.IngressConfig
+	cachedUpstreamsGeneration uint64
+	// endpointFirstSeen is a mapping from backend key to the time when the backend with slow start was first seen.  nil means that
+	// upstreams have never been computed.  It is only accessed from sync.
+	endpointFirstSeen map[string]time.Time
+	// incompleteSecretRetries is the number of consecutive retries scheduled because some TLS Secret is incomplete.  It is only
+	// accessed from sync.
+	incompleteSecretRetries int
 
 	recorder record.EventRecorder
 
-	syncQueue workqueue.Interface
+	syncQueue workqueue.RateLimitingInterface
+
+	// pendingMu protects pendingKey and pendingIngConfig.
+	pendingMu sync.Mutex
+	// pendingKey is the queue key which pendingIngConfig is computed for.
+	pendingKey string
+	// pendingIngConfig is the latest computed configuration which has not been applied yet.
+	pendingIngConfig *nghttpx.IngressConfig
+	// pendingCh is signaled when pendingIngConfig is updated.
+	pendingCh chan struct{}
 
 	// stopLock is used to enforce only a single call to Stop is active.
 	// Needed because we allow stopping through an http endpoint and
@@ -108,6 +260,39 @@ type LoadBalancerController struct {
 	controllersInSyncHandler func() bool
 
 	reloadRateLimiter flowcontrol.RateLimiter
+
+	// configApplied is nonzero if nghttpx configuration has been successfully applied at least once.  Access it atomically.
+	configApplied int32
+	// startupValidateOnce ensures that backends are validated only once at startup.
+	startupValidateOnce sync.Once
+
+	// sniMappingMu protects sniMapping.
+	sniMappingMu sync.Mutex
+	// sniMapping is a mapping from SNI host name to the list of Secrets which contain the certificate for the host.  It is
+	// computed from the last applied configuration.
+	sniMapping map[string][]string
+
+	// noNodeAddressWarnedMu protects noNodeAddressWarned.
+	noNodeAddressWarnedMu sync.Mutex
+	// noNodeAddressWarned is the set of Node names which have been warned that they have no address to publish.
+	noNodeAddressWarned map[string]bool
+
+	// appliedIngConfigMu protects appliedIngConfig.
+	appliedIngConfigMu sync.Mutex
+	// appliedIngConfig is the last applied configuration.
+	appliedIngConfig *nghttpx.IngressConfig
+
+	// backendEndpoints is the number of endpoints per Service referenced by Ingress.
+	backendEndpoints *metrics.GaugeVec
+	// ingressReloads is the number of nghttpx reloads which applied the change of Ingress.
+	ingressReloads *metrics.CounterVec
+}
+
+// backendKey identifies a Service referenced by Ingress.
+type backendKey struct {
+	namespace string
+	ingress   string
+	service   string
 }
 
 type Config struct {
@@ -119,11 +304,122 @@ type Config struct {
 	WatchNamespace string
 	// NghttpxConfigMap is the name of ConfigMap resource which contains additional configuration for nghttpx.
 	NghttpxConfigMap string
-	// DefaultTLSSecret is the default TLS Secret to enable TLS by default.
-	DefaultTLSSecret string
+	// DefaultTLSSecrets is the list of default TLS Secrets to enable TLS by default.  The first one is used for the client which
+	// does not send SNI.
+	DefaultTLSSecrets []string
 	// IngressClass is the Ingress class this controller is responsible for.
-	IngressClass    string
-	AllowInternalIP bool
+	IngressClass string
+	// WatchWithoutClass is true if the Ingress which has no Ingress class annotation, or its value is empty, is processed.
+	WatchWithoutClass bool
+	// RedirectWithoutCert is true if cleartext HTTP requests are redirected to https URI even if no TLS certificate matches the
+	// host.
+	RedirectWithoutCert bool
+	AllowInternalIP     bool
+	// AddressTypes is the preference order of Node address types which are published in Ingress status.  The addresses of the
+	// first type which Node has are published.  If it is empty, external addresses are preferred, and internal addresses are used
+	// only if AllowInternalIP is true.
+	AddressTypes []api.NodeAddressType
+	// NghttpxWorkers is the number of nghttpx worker threads.  If it is empty, the number of CPU cores is used.  ConfigMap can
+	// override this value.
+	NghttpxWorkers string
+	// DefaultBackendPreference specifies which of the catch-all rule in Ingress or the default backend Service is used for the
+	// requests which do not match any other rules.  It is either DefaultBackendPreferIngress or DefaultBackendPreferGlobal.  If
+	// it is empty, DefaultBackendPreferIngress is assumed.
+	DefaultBackendPreference string
+	// ProxyProto is true if PROXY protocol is enabled on public frontends.  nghttpx accepts both PROXY protocol v1 and v2.
+	ProxyProto bool
+	// ProxyProtoExcludePorts is the list of frontend ports on which PROXY protocol is not enabled even if ProxyProto is true.
+	ProxyProtoExcludePorts []int
+	// IncludeNotReadyEndpoints is true if not-ready endpoint addresses are also used as backends.
+	IncludeNotReadyEndpoints bool
+	// MaxPathLength is the maximum length of Path in Ingress.  Path which exceeds this limit is ignored.  0 means no limit.
+	MaxPathLength int
+	// WeightPerService is true if traffic for the same host and path is split evenly among Services rather than by the number of
+	// endpoints.
+	WeightPerService bool
+	// RequiredPodConditions is the list of Pod condition types which must be True for the endpoints backed by the Pod to be used as
+	// backends.
+	RequiredPodConditions []string
+	// EndpointWeightLabel is the key of Pod label which specifies the weight of the endpoints backed by the Pod.  Empty string
+	// disables it.
+	EndpointWeightLabel string
+	// StrictPathValidation is true if Path which does not start with "/" is rejected.  If it is false, such Path is passed to
+	// nghttpx as is.
+	StrictPathValidation bool
+	// CacheUpstreams is true if the computed upstreams are reused when only nghttpx ConfigMap has changed.
+	CacheUpstreams bool
+	// HTTPBindAddress is the IP address which cleartext HTTP frontend binds to.  Empty string means all addresses.
+	HTTPBindAddress string
+	// HTTPSBindAddress is the IP address which TLS frontend binds to.  Empty string means all addresses.
+	HTTPSBindAddress string
+	// PublishService is the namespace/name of Service whose LoadBalancer status is mirrored into Ingress status.  If it is empty,
+	// the addresses of the Nodes where controller Pods run are used.
+	PublishService string
+	// SyncMaxRetries is the maximum number of retries when sync fails.  0 means no limit.
+	SyncMaxRetries int
+	// OCSPFetchMode is either OCSPFetchModeActive or OCSPFetchModeOff.  If it is empty, OCSPFetchModeActive is assumed.
+	OCSPFetchMode string
+	// OCSPUpdateInterval is the interval to refresh OCSP responses.  0 means nghttpx default.
+	OCSPUpdateInterval time.Duration
+	// MaxWorkerProcesses is the maximum number of nghttpx worker processes including the old ones.  0 means nghttpx default.
+	MaxWorkerProcesses int
+	// WorkerProcessGraceShutdownPeriod is the maximum period for old nghttpx worker process to shut down after reload.  0 means
+	// nghttpx default.
+	WorkerProcessGraceShutdownPeriod time.Duration
+	// NghttpxAPIBind is the address which nghttpx API frontend binds to.  Empty string means loopback address.
+	NghttpxAPIBind string
+	// NghttpxHealthBind is the address which nghttpx health monitor frontend binds to.  Empty string means loopback address.
+	NghttpxHealthBind string
+	// ScopeSecretsToWatchNamespace is true if Secrets are only watched in WatchNamespace.  This allows the controller to run without
+	// cluster-wide Secret read permission.
+	ScopeSecretsToWatchNamespace bool
+	// DefaultBackendResponseCode is the status code of static response which nghttpx serves when the default backend Service
+	// has no endpoints.  0 means that static response is disabled.
+	DefaultBackendResponseCode int
+	// DefaultBackendResponseBody is the body of static response.
+	DefaultBackendResponseBody []byte
+	// AllowUnixSocketBackend is true if unixSocketPath in backend configuration is honored.  It only makes sense if nghttpx shares
+	// the volume which contains the socket with the backend.
+	AllowUnixSocketBackend bool
+	// RejectConflictingRules is true if the rule whose host and path are also defined by an older Ingress is ignored.  If it is
+	// false, the backends of such rules are merged.
+	RejectConflictingRules bool
+	// AppendCAToCert is true if the certificates in ca.crt of TLS Secret, except for self-signed one, are appended to the
+	// certificate chain.
+	AppendCAToCert bool
+	// StartupValidateBackends is true if the controller waits for sampled backends to become reachable before it reports that
+	// configuration has been applied for the first time.
+	StartupValidateBackends bool
+	// StartupValidateBackendsTimeout is the maximum duration to wait for backends at startup.
+	StartupValidateBackendsTimeout time.Duration
+	// FullResyncPeriod is the interval to recompute and apply nghttpx configuration regardless of watch events.  0 disables it.
+	FullResyncPeriod time.Duration
+	// BackendTLSCASecret is the Secret in the form of namespace/name which contains CA bundle to verify backend server
+	// certificates.  If it is empty, nghttpx uses the system default CA store.
+	BackendTLSCASecret string
+	// ClientCASecret is the Secret in the form of namespace/name which contains CA bundle to verify client certificates.  If it is
+	// empty, client certificate verification is disabled.
+	ClientCASecret string
+	// NghttpxBaseConfig is the path to nghttpx configuration file which is included in the generated configuration.  Empty string
+	// means no file is included.
+	NghttpxBaseConfig string
+	// AnnotateConfig is true if the Ingress and its annotations which each upstream is created from, and the Secret which each TLS
+	// certificate is created from are rendered as comments in nghttpx configuration.
+	AnnotateConfig bool
+	// ClientCertHeaders is the names of request header fields which carry TLS client certificate information to backend.  The
+	// header fields from client are removed.  nil means that they are not sent nor removed.
+	ClientCertHeaders *nghttpx.ClientCertHeaders
+	// ReloadRate is the maximum number of reloads per second.  0 means defaultReloadRate.
+	ReloadRate float64
+	// ReloadBurst is the maximum burst of reloads.  It is only used by ReloadStrategyTokenBucket.  0 means defaultReloadBurst.
+	ReloadBurst int
+	// ReloadStrategy is the algorithm to limit the rate of reloads.  Empty string means ReloadStrategyTokenBucket.
+	ReloadStrategy string
+	// EmptyUpstreamBehavior is the behavior for the rule whose Service has no active endpoints.  Empty string means
+	// EmptyUpstreamBehaviorDrop.
+	EmptyUpstreamBehavior string
+	// MetricsRegistry is the Registry which the controller registers its metrics to.  If it is nil, metrics are not registered.
+	MetricsRegistry *metrics.Registry
 }
 
 // NewLoadBalancerController creates a controller for nghttpx loadbalancer
@@ -133,19 +429,58 @@ func NewLoadBalancerController(clientset internalclientset.Interface, manager ng
 	eventBroadcaster.StartRecordingToSink(&unversionedcore.EventSinkImpl{Interface: clientset.Core().Events(config.WatchNamespace)})
 
 	lbc := LoadBalancerController{
-		clientset:         clientset,
-		stopCh:            make(chan struct{}),
-		podInfo:           runtimeInfo,
-		nghttpx:           manager,
-		ngxConfigMap:      config.NghttpxConfigMap,
-		defaultSvc:        config.DefaultBackendService,
-		defaultTLSSecret:  config.DefaultTLSSecret,
-		watchNamespace:    config.WatchNamespace,
-		ingressClass:      config.IngressClass,
-		allowInternalIP:   config.AllowInternalIP,
-		recorder:          eventBroadcaster.NewRecorder(api.EventSource{Component: "nghttpx-ingress-controller"}),
-		syncQueue:         workqueue.New(),
-		reloadRateLimiter: flowcontrol.NewTokenBucketRateLimiter(1.0, 1),
+		clientset:                        clientset,
+		stopCh:                           make(chan struct{}),
+		podInfo:                          runtimeInfo,
+		nghttpx:                          manager,
+		ngxConfigMap:                     config.NghttpxConfigMap,
+		defaultSvc:                       config.DefaultBackendService,
+		defaultTLSSecrets:                config.DefaultTLSSecrets,
+		watchNamespace:                   config.WatchNamespace,
+		ingressClass:                     config.IngressClass,
+		watchWithoutClass:                config.WatchWithoutClass,
+		redirectWithoutCert:              config.RedirectWithoutCert,
+		allowInternalIP:                  config.AllowInternalIP,
+		addressTypes:                     config.AddressTypes,
+		nghttpxWorkers:                   config.NghttpxWorkers,
+		defaultBackendPreference:         config.DefaultBackendPreference,
+		proxyProto:                       config.ProxyProto,
+		proxyProtoExcludePorts:           config.ProxyProtoExcludePorts,
+		includeNotReadyEndpoints:         config.IncludeNotReadyEndpoints,
+		maxPathLength:                    config.MaxPathLength,
+		weightPerService:                 config.WeightPerService,
+		requiredPodConditions:            config.RequiredPodConditions,
+		endpointWeightLabel:              config.EndpointWeightLabel,
+		strictPathValidation:             config.StrictPathValidation,
+		cacheUpstreams:                   config.CacheUpstreams,
+		httpBindAddress:                  config.HTTPBindAddress,
+		httpsBindAddress:                 config.HTTPSBindAddress,
+		publishService:                   config.PublishService,
+		syncMaxRetries:                   config.SyncMaxRetries,
+		ocspFetchMode:                    config.OCSPFetchMode,
+		ocspUpdateInterval:               config.OCSPUpdateInterval,
+		maxWorkerProcesses:               config.MaxWorkerProcesses,
+		workerProcessGraceShutdownPeriod: config.WorkerProcessGraceShutdownPeriod,
+		nghttpxAPIBind:                   config.NghttpxAPIBind,
+		nghttpxHealthBind:                config.NghttpxHealthBind,
+		defaultBackendResponseCode:       config.DefaultBackendResponseCode,
+		defaultBackendResponseBody:       config.DefaultBackendResponseBody,
+		allowUnixSocketBackend:           config.AllowUnixSocketBackend,
+		rejectConflictingRules:           config.RejectConflictingRules,
+		appendCAToCert:                   config.AppendCAToCert,
+		startupValidateBackends:          config.StartupValidateBackends,
+		startupValidateBackendsTimeout:   config.StartupValidateBackendsTimeout,
+		fullResyncPeriod:                 config.FullResyncPeriod,
+		backendTLSCASecret:               config.BackendTLSCASecret,
+		clientCASecret:                   config.ClientCASecret,
+		nghttpxBaseConfig:                config.NghttpxBaseConfig,
+		annotateConfig:                   config.AnnotateConfig,
+		clientCertHeaders:                config.ClientCertHeaders,
+		recorder:                         eventBroadcaster.NewRecorder(api.EventSource{Component: "nghttpx-ingress-controller"}),
+		syncQueue:                        workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(syncRetryBaseDelay, syncRetryMaxDelay)),
+		pendingCh:                        make(chan struct{}, 1),
+		reloadRateLimiter:                newReloadRateLimiter(config.ReloadStrategy, config.ReloadRate, config.ReloadBurst),
+		emptyUpstreamBehavior:            config.EmptyUpstreamBehavior,
 	}
 
 	ingIndexer, ingController := cache.NewIndexerInformer(
@@ -200,16 +535,25 @@ func NewLoadBalancerController(clientset internalclientset.Interface, manager ng
 		},
 		&api.Service{},
 		depResyncPeriod(),
-		cache.ResourceEventHandlerFuncs{},
+		cache.ResourceEventHandlerFuncs{
+			AddFunc:    lbc.addServiceNotification,
+			UpdateFunc: lbc.updateServiceNotification,
+			DeleteFunc: lbc.deleteServiceNotification,
+		},
 	)
 
+	secretNamespace := api.NamespaceAll
+	if config.ScopeSecretsToWatchNamespace {
+		secretNamespace = config.WatchNamespace
+	}
+
 	lbc.secretLister.Store, lbc.secretController = cache.NewInformer(
 		&cache.ListWatch{
 			ListFunc: func(options api.ListOptions) (runtime.Object, error) {
-				return lbc.clientset.Core().Secrets(api.NamespaceAll).List(options)
+				return lbc.clientset.Core().Secrets(secretNamespace).List(options)
 			},
 			WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
-				return lbc.clientset.Core().Secrets(api.NamespaceAll).Watch(options)
+				return lbc.clientset.Core().Secrets(secretNamespace).Watch(options)
 			},
 		},
 		&api.Secret{},
@@ -251,25 +595,21 @@ func NewLoadBalancerController(clientset internalclientset.Interface, manager ng
 		},
 		&api.Node{},
 		depResyncPeriod(),
-		cache.ResourceEventHandlerFuncs{},
+		cache.ResourceEventHandlerFuncs{
+			AddFunc:    lbc.addNodeNotification,
+			UpdateFunc: lbc.updateNodeNotification,
+			DeleteFunc: lbc.deleteNodeNotification,
+		},
 	)
 
-	var cmNamespace string
-	if lbc.ngxConfigMap != "" {
-		ns, _, _ := ParseNSName(lbc.ngxConfigMap)
-		cmNamespace = ns
-	} else {
-		// Just watch runtimeInfo.PodNamespace to make codebase simple
-		cmNamespace = runtimeInfo.PodNamespace
-	}
-
+	// Watch all namespaces, because Ingress might refer to ConfigMap in its namespace.
 	lbc.cmLister.Store, lbc.cmController = cache.NewInformer(
 		&cache.ListWatch{
 			ListFunc: func(options api.ListOptions) (runtime.Object, error) {
-				return lbc.clientset.Core().ConfigMaps(cmNamespace).List(options)
+				return lbc.clientset.Core().ConfigMaps(api.NamespaceAll).List(options)
 			},
 			WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
-				return lbc.clientset.Core().ConfigMaps(cmNamespace).Watch(options)
+				return lbc.clientset.Core().ConfigMaps(api.NamespaceAll).Watch(options)
 			},
 		},
 		&api.ConfigMap{},
@@ -283,6 +623,15 @@ func NewLoadBalancerController(clientset internalclientset.Interface, manager ng
 
 	lbc.controllersInSyncHandler = lbc.controllersInSync
 
+	lbc.backendEndpoints = metrics.NewGaugeVec("nghttpx_ingress_backend_endpoints",
+		"The number of endpoints of Service referenced by Ingress.", "namespace", "ingress", "service")
+	lbc.ingressReloads = metrics.NewCounterVec("nghttpx_ingress_reloads_total",
+		"The number of nghttpx reloads which applied the change of Ingress.", "namespace", "ingress")
+	if config.MetricsRegistry != nil {
+		config.MetricsRegistry.MustRegister(lbc.backendEndpoints)
+		config.MetricsRegistry.MustRegister(lbc.ingressReloads)
+	}
+
 	return &lbc
 }
 
@@ -372,28 +721,79 @@ func (lbc *LoadBalancerController) deleteEndpointsNotification(obj interface{})
 
 // endpointsReferenced returns true if we are interested in ep.
 func (lbc *LoadBalancerController) endpointsReferenced(ep *api.Endpoints) bool {
-	if fmt.Sprintf("%v/%v", ep.Namespace, ep.Name) == lbc.defaultSvc {
+	return lbc.serviceReferenced(ep.Namespace, ep.Name)
+}
+
+func (lbc *LoadBalancerController) addServiceNotification(obj interface{}) {
+	svc := obj.(*api.Service)
+	if !lbc.serviceReferenced(svc.Namespace, svc.Name) {
+		return
+	}
+	glog.V(4).Infof("Service %v/%v added", svc.Namespace, svc.Name)
+	lbc.enqueue(syncKey)
+}
+
+func (lbc *LoadBalancerController) updateServiceNotification(old, cur interface{}) {
+	if reflect.DeepEqual(old, cur) {
+		return
+	}
+
+	oldSvc := old.(*api.Service)
+	curSvc := cur.(*api.Service)
+	if !lbc.serviceReferenced(oldSvc.Namespace, oldSvc.Name) && !lbc.serviceReferenced(curSvc.Namespace, curSvc.Name) {
+		return
+	}
+	glog.V(4).Infof("Service %v/%v updated", curSvc.Namespace, curSvc.Name)
+	lbc.enqueue(syncKey)
+}
+
+func (lbc *LoadBalancerController) deleteServiceNotification(obj interface{}) {
+	svc, ok := obj.(*api.Service)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			glog.Errorf("Couldn't get object from tombstone %+v", obj)
+			return
+		}
+		svc, ok = tombstone.Obj.(*api.Service)
+		if !ok {
+			glog.Errorf("Tombstone contained object that is not a Service %+v", obj)
+			return
+		}
+	}
+	if !lbc.serviceReferenced(svc.Namespace, svc.Name) {
+		return
+	}
+	glog.V(4).Infof("Service %v/%v deleted", svc.Namespace, svc.Name)
+	lbc.enqueue(syncKey)
+}
+
+// serviceReferenced returns true if we are interested in the Service denoted by namespace and name.  The Service is interesting if it
+// is the default backend, or it is referenced by Ingress.
+func (lbc *LoadBalancerController) serviceReferenced(namespace, name string) bool {
+	if fmt.Sprintf("%v/%v", namespace, name) == lbc.defaultSvc {
 		return true
 	}
 
-	ings, err := lbc.ingLister.Ingresses(ep.Namespace).List(labels.Everything())
+	ings, err := lbc.ingLister.Ingresses(namespace).List(labels.Everything())
 	if err != nil {
-		glog.Errorf("Could not list Ingress namespace=%v: %v", ep.Namespace, err)
+		glog.Errorf("Could not list Ingress namespace=%v: %v", namespace, err)
 		return false
 	}
 	for _, ing := range ings {
-		if !lbc.validateIngressClass(ing) {
+		if !lbc.ingressServed(ing) {
 			continue
 		}
-		for i, _ := range ing.Spec.Rules {
-			rule := &ing.Spec.Rules[i]
+		rules := ingressRules(ing)
+		for i, _ := range rules {
+			rule := &rules[i]
 			if rule.HTTP == nil {
 				continue
 			}
 			for i, _ := range rule.HTTP.Paths {
 				path := &rule.HTTP.Paths[i]
-				if ep.Name == path.Backend.ServiceName {
-					glog.V(4).Infof("Endpoints %v/%v is referenced by Ingress %v/%v", ep.Namespace, ep.Name, ing.Namespace, ing.Name)
+				if name == path.Backend.ServiceName {
+					glog.V(4).Infof("Service %v/%v is referenced by Ingress %v/%v", namespace, name, ing.Namespace, ing.Name)
 					return true
 				}
 			}
@@ -450,12 +850,7 @@ func (lbc *LoadBalancerController) deleteSecretNotification(obj interface{}) {
 
 func (lbc *LoadBalancerController) addConfigMapNotification(obj interface{}) {
 	c := obj.(*api.ConfigMap)
-	cKey := fmt.Sprintf("%v/%v", c.Namespace, c.Name)
-	if cKey != lbc.ngxConfigMap {
-		return
-	}
-	glog.V(4).Infof("ConfigMap %v added", cKey)
-	lbc.enqueue(syncKey)
+	lbc.enqueueConfigMap(c, "added")
 }
 
 func (lbc *LoadBalancerController) updateConfigMapNotification(old, cur interface{}) {
@@ -464,13 +859,8 @@ func (lbc *LoadBalancerController) updateConfigMapNotification(old, cur interfac
 	}
 
 	curC := cur.(*api.ConfigMap)
-	cKey := fmt.Sprintf("%v/%v", curC.Namespace, curC.Name)
 	// updates to configuration configmaps can trigger an update
-	if cKey != lbc.ngxConfigMap {
-		return
-	}
-	glog.V(4).Infof("ConfigMap %v updated", cKey)
-	lbc.enqueue(syncKey)
+	lbc.enqueueConfigMap(curC, "updated")
 }
 
 func (lbc *LoadBalancerController) deleteConfigMapNotification(obj interface{}) {
@@ -487,12 +877,49 @@ func (lbc *LoadBalancerController) deleteConfigMapNotification(obj interface{})
 			return
 		}
 	}
+	lbc.enqueueConfigMap(c, "deleted")
+}
+
+// enqueueConfigMap enqueues sync if c is nghttpx ConfigMap, or it is referenced by Ingress.  op describes the change, and is used for
+// logging.
+func (lbc *LoadBalancerController) enqueueConfigMap(c *api.ConfigMap, op string) {
 	cKey := fmt.Sprintf("%v/%v", c.Namespace, c.Name)
-	if cKey != lbc.ngxConfigMap {
-		return
+	switch {
+	case cKey == lbc.ngxConfigMap:
+		glog.V(4).Infof("ConfigMap %v %v", cKey, op)
+		lbc.enqueueConfigMapChange(syncKey)
+	case lbc.configMapReferenced(c.Namespace, c.Name):
+		glog.V(4).Infof("ConfigMap %v %v", cKey, op)
+		lbc.enqueue(syncKey)
 	}
-	glog.V(4).Infof("ConfigMap %v deleted", cKey)
-	lbc.enqueue(syncKey)
+}
+
+// configMapReferenced returns true if ConfigMap identified by namespace and name is referenced by path configuration of Ingress.
+// ConfigMaps in all namespaces are watched, and this function filters out the ones which are not relevant.
+func (lbc *LoadBalancerController) configMapReferenced(namespace, name string) bool {
+	ings, err := lbc.ingLister.Ingresses(namespace).List(labels.Everything())
+	if err != nil {
+		glog.Errorf("Could not list Ingress namespace=%v: %v", namespace, err)
+		return false
+	}
+	for _, ing := range ings {
+		if !lbc.ingressServed(ing) {
+			continue
+		}
+		pathConfig, err := ingressAnnotation(ing.ObjectMeta.Annotations).getPathConfig()
+		if err != nil {
+			continue
+		}
+		for _, pc := range pathConfig {
+			for _, ref := range configMapRefs(pc) {
+				if refName, _, err := parseConfigMapRef(ref); err == nil && refName == name {
+					glog.V(4).Infof("ConfigMap %v/%v is referenced by Ingress %v/%v", namespace, name, ing.Namespace, ing.Name)
+					return true
+				}
+			}
+		}
+	}
+	return false
 }
 
 func (lbc *LoadBalancerController) addPodNotification(obj interface{}) {
@@ -555,11 +982,12 @@ func (lbc *LoadBalancerController) podReferenced(pod *api.Pod) bool {
 		return false
 	}
 	for _, ing := range ings {
-		if !lbc.validateIngressClass(ing) {
+		if !lbc.ingressServed(ing) {
 			continue
 		}
-		for i, _ := range ing.Spec.Rules {
-			rule := &ing.Spec.Rules[i]
+		rules := ingressRules(ing)
+		for i, _ := range rules {
+			rule := &rules[i]
 			if rule.HTTP == nil {
 				continue
 			}
@@ -583,7 +1011,57 @@ func (lbc *LoadBalancerController) podReferenced(pod *api.Pod) bool {
 	return false
 }
 
+// Node notifications only care about labels, which nodeSelector in backend configuration matches against.  Node status is updated
+// periodically, and does not trigger sync.
+func (lbc *LoadBalancerController) addNodeNotification(obj interface{}) {
+	node := obj.(*api.Node)
+	glog.V(4).Infof("Node %v added", node.Name)
+	lbc.enqueue(syncKey)
+}
+
+func (lbc *LoadBalancerController) updateNodeNotification(old, cur interface{}) {
+	oldNode := old.(*api.Node)
+	curNode := cur.(*api.Node)
+	if reflect.DeepEqual(oldNode.Labels, curNode.Labels) {
+		return
+	}
+	glog.V(4).Infof("Node %v updated", curNode.Name)
+	lbc.enqueue(syncKey)
+}
+
+func (lbc *LoadBalancerController) deleteNodeNotification(obj interface{}) {
+	node, ok := obj.(*api.Node)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			glog.Errorf("Couldn't get object from tombstone %+v", obj)
+			return
+		}
+		node, ok = tombstone.Obj.(*api.Node)
+		if !ok {
+			glog.Errorf("Tombstone contained object that is not Node %+v", obj)
+			return
+		}
+	}
+	glog.V(4).Infof("Node %v deleted", node.Name)
+	lbc.enqueue(syncKey)
+}
+
+// enqueue enqueues key.  It also invalidates the cached upstreams, because the objects which upstreams are computed from might have
+// changed.
 func (lbc *LoadBalancerController) enqueue(key string) {
+	atomic.AddUint64(&lbc.upstreamsGeneration, 1)
+	lbc.syncQueue.Add(key)
+}
+
+// enqueueAfter enqueues key after delay.  Like enqueue, it invalidates the cached upstreams.
+func (lbc *LoadBalancerController) enqueueAfter(key string, delay time.Duration) {
+	atomic.AddUint64(&lbc.upstreamsGeneration, 1)
+	lbc.syncQueue.AddAfter(key, delay)
+}
+
+// enqueueConfigMapChange enqueues key without invalidating the cached upstreams.  It is used when only nghttpx ConfigMap has changed.
+func (lbc *LoadBalancerController) enqueueConfigMapChange(key string) {
 	lbc.syncQueue.Add(key)
 }
 
@@ -596,13 +1074,53 @@ func (lbc *LoadBalancerController) worker() {
 			}
 
 			defer lbc.syncQueue.Done(key)
-			if err := lbc.sync(key.(string)); err != nil {
-				glog.Error(err)
+			ingConfig, err := lbc.prepare(key.(string))
+			if err != nil {
+				lbc.retryOrForget(key, err)
+				return
 			}
+			lbc.setPendingIngConfig(key.(string), ingConfig)
 		}()
 	}
 }
 
+// setPendingIngConfig stores ingConfig as the configuration to apply next, and wakes up reloadWorker.  If the previous configuration
+// has not been applied yet, it is discarded in favor of ingConfig.
+func (lbc *LoadBalancerController) setPendingIngConfig(key string, ingConfig *nghttpx.IngressConfig) {
+	lbc.pendingMu.Lock()
+	lbc.pendingKey = key
+	lbc.pendingIngConfig = ingConfig
+	lbc.pendingMu.Unlock()
+
+	select {
+	case lbc.pendingCh <- struct{}{}:
+	default:
+	}
+}
+
+// reloadWorker applies the configuration computed by worker.  It runs separately from worker, so that the next configuration can be
+// computed while nghttpx is reloading.  It always applies the latest computed configuration.
+func (lbc *LoadBalancerController) reloadWorker() {
+	for {
+		select {
+		case <-lbc.stopCh:
+			return
+		case <-lbc.pendingCh:
+		}
+
+		lbc.pendingMu.Lock()
+		key, ingConfig := lbc.pendingKey, lbc.pendingIngConfig
+		lbc.pendingIngConfig = nil
+		lbc.pendingMu.Unlock()
+
+		if ingConfig == nil {
+			continue
+		}
+
+		lbc.retryOrForget(key, lbc.apply(key, ingConfig))
+	}
+}
+
 func (lbc *LoadBalancerController) controllersInSync() bool {
 	return lbc.ingController.HasSynced() &&
 		lbc.svcController.HasSynced() &&
@@ -629,134 +1147,684 @@ func (lbc *LoadBalancerController) getConfigMap(cmKey string) (*api.ConfigMap, e
 	return obj.(*api.ConfigMap), nil
 }
 
+// sync computes nghttpx configuration, and applies it.
 func (lbc *LoadBalancerController) sync(key string) error {
-	lbc.reloadRateLimiter.Accept()
-
-	retry := false
-
-	defer func() { lbc.retryOrForget(key, retry) }()
-
-	ings, err := lbc.ingLister.List(labels.Everything())
+	ingConfig, err := lbc.prepare(key)
 	if err != nil {
 		return err
 	}
-	ingConfig, err := lbc.getUpstreamServers(ings)
+	return lbc.apply(key, ingConfig)
+}
+
+// prepare computes nghttpx configuration from the cached objects.
+func (lbc *LoadBalancerController) prepare(key string) (*nghttpx.IngressConfig, error) {
+	ingConfig, err := lbc.getCachedUpstreamServers()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if lbc.nghttpxWorkers != "" {
+		ingConfig.Workers = lbc.nghttpxWorkers
 	}
 
 	cm, err := lbc.getConfigMap(lbc.ngxConfigMap)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	nghttpx.ReadConfig(ingConfig, cm)
 
-	if reloaded, err := lbc.nghttpx.CheckAndReload(ingConfig); err != nil {
+	if lbc.nghttpxBaseConfig != "" {
+		baseConfig, err := nghttpx.CreateBaseConfig(lbc.nghttpxBaseConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read nghttpx base configuration: %v", err)
+		}
+		ingConfig.BaseConfig = baseConfig
+	}
+
+	ingConfig.AnnotateConfig = lbc.annotateConfig
+
+	if lbc.clientCertHeaders != nil {
+		ingConfig.Mruby = nghttpx.CreatePerPatternMrubyChecksumFile(nghttpx.CreateClientCertHeadersMruby(*lbc.clientCertHeaders))
+	}
+
+	return ingConfig, nil
+}
+
+// apply makes nghttpx load ingConfig if it differs from the current configuration.  key is the queue key which ingConfig is
+// computed for.
+func (lbc *LoadBalancerController) apply(key string, ingConfig *nghttpx.IngressConfig) error {
+	// Rate limit right before reloading, so that the limit applies to reloads rather than computations.  The configuration which is
+	// the same as the applied one does not consume the budget.
+	lbc.appliedIngConfigMu.Lock()
+	unchanged := reflect.DeepEqual(lbc.appliedIngConfig, ingConfig)
+	lbc.appliedIngConfigMu.Unlock()
+	if !unchanged {
+		lbc.reloadRateLimiter.Accept()
+	}
+
+	reloaded, err := lbc.nghttpx.CheckAndReload(ingConfig)
+	if err != nil {
+		if e, ok := err.(*nghttpx.ReloadSuppressedError); ok {
+			glog.V(2).Infof("Postpone reload for %v because the previous reload happened too recently", e.RetryAfter)
+			time.AfterFunc(e.RetryAfter, func() { lbc.syncQueue.Add(key) })
+			return nil
+		}
+		lbc.recorder.Eventf(lbc.podReference(), api.EventTypeWarning, "ReloadFailed", "Could not apply nghttpx configuration: %v", err)
 		return err
 	} else if !reloaded {
 		glog.V(4).Infof("No need to reload configuration.")
 	}
 
+	if lbc.startupValidateBackends {
+		lbc.startupValidateOnce.Do(func() {
+			backends := sampleBackends(ingConfig, startupValidateSampleSize)
+			go func() {
+				if !waitBackendsReachable(backends, lbc.startupValidateBackendsTimeout) {
+					glog.Warningf("No backend became reachable within %v; proceeding anyway", lbc.startupValidateBackendsTimeout)
+				}
+				atomic.StoreInt32(&lbc.configApplied, 1)
+			}()
+		})
+	} else {
+		atomic.StoreInt32(&lbc.configApplied, 1)
+	}
+
+	lbc.updateSNIMapping(ingConfig)
+
+	lbc.appliedIngConfigMu.Lock()
+	prevIngConfig := lbc.appliedIngConfig
+	lbc.appliedIngConfig = ingConfig
+	lbc.appliedIngConfigMu.Unlock()
+
+	// The first configuration is not attributed to any Ingress.
+	if reloaded && prevIngConfig != nil {
+		lbc.recordReloadedIngresses(prevIngConfig, ingConfig)
+	}
+
 	return nil
 }
 
-func (lbc *LoadBalancerController) getDefaultUpstream() *nghttpx.Upstream {
-	upstream := &nghttpx.Upstream{
-		Name:             lbc.defaultSvc,
-		RedirectIfNotTLS: lbc.defaultTLSSecret != "",
+// recordReloadedIngresses records Reloaded Event on the Ingresses whose configuration differs between prevIngConfig and ingConfig,
+// and increments their reload counters.
+func (lbc *LoadBalancerController) recordReloadedIngresses(prevIngConfig, ingConfig *nghttpx.IngressConfig) {
+	keys := make([]string, 0, len(ingConfig.IngressChecksums))
+	for key, checksum := range ingConfig.IngressChecksums {
+		if prevIngConfig.IngressChecksums[key] == checksum {
+			continue
+		}
+		keys = append(keys, key)
 	}
-	svcKey := lbc.defaultSvc
-	svcObj, svcExists, err := lbc.svcLister.GetByKey(svcKey)
-	if err != nil {
-		glog.Warningf("unexpected error searching the default backend %v: %v", lbc.defaultSvc, err)
-		upstream.Backends = append(upstream.Backends, nghttpx.NewDefaultServer())
-		return upstream
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		obj, exists, err := lbc.ingLister.indexer.GetByKey(key)
+		if err != nil || !exists {
+			continue
+		}
+		ing := obj.(*extensions.Ingress)
+		lbc.recorder.Eventf(ing, api.EventTypeNormal, "Reloaded", "nghttpx configuration was reloaded with the change of this Ingress")
+		lbc.ingressReloads.Inc(ing.Namespace, ing.Name)
 	}
+}
 
-	if !svcExists {
-		glog.Warningf("service %v does no exists", svcKey)
-		upstream.Backends = append(upstream.Backends, nghttpx.NewDefaultServer())
-		return upstream
+// newReloadRateLimiter returns flowcontrol.RateLimiter which limits the rate of reloads with strategy.  The zero values of rate and
+// burst are replaced with the defaults.
+func newReloadRateLimiter(strategy string, rate float64, burst int) flowcontrol.RateLimiter {
+	if rate <= 0 {
+		rate = defaultReloadRate
+	}
+	if burst <= 0 {
+		burst = defaultReloadBurst
 	}
 
-	svc := svcObj.(*api.Service)
+	switch strategy {
+	case ReloadStrategyMinInterval:
+		return newMinIntervalRateLimiter(float32(rate))
+	default:
+		return flowcontrol.NewTokenBucketRateLimiter(float32(rate), burst)
+	}
+}
 
-	portBackendConfig := nghttpx.DefaultPortBackendConfig()
+// getCachedUpstreamServers returns nghttpx.IngressConfig computed by getUpstreamServers.  If lbc.cacheUpstreams is true, and no
+// object which affects upstreams has changed since the last computation, the cached result is reused.  The returned object is
+// always a fresh copy, so that the caller can modify its fields.
+func (lbc *LoadBalancerController) getCachedUpstreamServers() (*nghttpx.IngressConfig, error) {
+	gen := atomic.LoadUint64(&lbc.upstreamsGeneration)
 
-	eps := lbc.getEndpoints(svc, &svc.Spec.Ports[0], api.ProtocolTCP, &portBackendConfig)
-	if len(eps) == 0 {
-		glog.Warningf("service %v does no have any active endpoints", svcKey)
-		upstream.Backends = append(upstream.Backends, nghttpx.NewDefaultServer())
-	} else {
-		upstream.Backends = append(upstream.Backends, eps...)
+	if lbc.cacheUpstreams && lbc.cachedIngConfig != nil && lbc.cachedUpstreamsGeneration == gen {
+		glog.V(4).Infof("Reuse cached upstreams")
+		ingConfig := *lbc.cachedIngConfig
+		return &ingConfig, nil
 	}
 
-	return upstream
+	ings, err := lbc.ingLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	ingConfig, err := lbc.getUpstreamServers(ings)
+	if err != nil {
+		return nil, err
+	}
+
+	if lbc.cacheUpstreams {
+		cached := *ingConfig
+		lbc.cachedIngConfig = &cached
+		lbc.cachedUpstreamsGeneration = gen
+	}
+
+	return ingConfig, nil
 }
 
-// in nghttpx terminology, nghttpx.Upstream is backend, nghttpx.Server is frontend
-func (lbc *LoadBalancerController) getUpstreamServers(ings []*extensions.Ingress) (*nghttpx.IngressConfig, error) {
-	ingConfig := nghttpx.NewIngressConfig()
+// getPathMruby returns the mruby features specified in pc.  namespace is the namespace of Ingress which pc belongs to, and path is
+// the normalized Path of the rule.  The built-in features, that is rateLimitRPS, clientMaxBodySize, rewriteTarget, hostRewrite, and
+// errorPages, cannot be used with mruby script given by user.
+func (lbc *LoadBalancerController) getPathMruby(namespace, path string, pc *nghttpx.PathConfig) (*nghttpx.PathMruby, error) {
+	if pc.MrubyConfigMapRef != nil || pc.Mruby != nil {
+		if pc.RateLimitRPS != nil || pc.RateLimitBurst != nil || pc.ClientMaxBodySize != nil || pc.RewriteTarget != nil ||
+			pc.HostRewrite != nil || len(pc.ErrorPages) > 0 {
+			return nil, fmt.Errorf("mruby cannot be used with rateLimitRPS, clientMaxBodySize, rewriteTarget, hostRewrite, or errorPages")
+		}
+		if pc.MrubyConfigMapRef != nil {
+			mruby, err := lbc.getDataFromConfigMap(namespace, *pc.MrubyConfigMapRef)
+			if err != nil {
+				return nil, err
+			}
+			return &nghttpx.PathMruby{User: mruby}, nil
+		}
+		return &nghttpx.PathMruby{User: []byte(*pc.Mruby)}, nil
+	}
 
-	var (
-		upstreams []*nghttpx.Upstream
-		pems      []*nghttpx.TLSCred
-	)
+	pathMruby := &nghttpx.PathMruby{}
 
-	if lbc.defaultTLSSecret != "" {
-		tlsCred, err := lbc.getTLSCredFromSecret(lbc.defaultTLSSecret)
-		if err != nil {
-			return nil, err
+	if pc.RateLimitRPS != nil {
+		rps := *pc.RateLimitRPS
+		if rps <= 0 {
+			return nil, fmt.Errorf("rateLimitRPS must be positive: %v", rps)
+		}
+		burst := rps
+		if pc.RateLimitBurst != nil {
+			burst = *pc.RateLimitBurst
+			if burst <= 0 {
+				return nil, fmt.Errorf("rateLimitBurst must be positive: %v", burst)
+			}
 		}
+		pathMruby.RateLimit = &nghttpx.RateLimit{RPS: rps, Burst: burst}
+	} else if pc.RateLimitBurst != nil {
+		return nil, fmt.Errorf("rateLimitBurst requires rateLimitRPS")
+	}
 
-		ingConfig.TLS = true
-		ingConfig.DefaultTLSCred = tlsCred
+	if pc.ClientMaxBodySize != nil {
+		limit := pc.ClientMaxBodySize.Value()
+		if limit < 0 {
+			return nil, fmt.Errorf("clientMaxBodySize must not be negative: %v", pc.ClientMaxBodySize.String())
+		}
+		pathMruby.ClientMaxBodySize = &limit
 	}
 
-	for _, ing := range ings {
-		if !lbc.validateIngressClass(ing) {
-			continue
+	if pc.RewriteTarget != nil {
+		target := *pc.RewriteTarget
+		if err := validateRewriteTarget(target); err != nil {
+			return nil, err
 		}
-		var requireTLS bool
-		if ingPems, err := lbc.getTLSCredFromIngress(ing); err != nil {
-			glog.Warningf("Ingress %v/%v is disabled because its TLS Secret cannot be processed: %v", ing.Namespace, ing.Name, err)
-			continue
-		} else {
-			pems = append(pems, ingPems...)
-			requireTLS = len(ingPems) > 0
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("rewriteTarget requires Path which starts with /: %v", path)
 		}
+		pathMruby.Rewrite = &nghttpx.Rewrite{Prefix: strings.TrimRight(path, "/"), Target: target}
+	}
 
-		backendConfig := ingressAnnotation(ing.ObjectMeta.Annotations).getBackendConfig()
+	if pc.HostRewrite != nil {
+		host := *pc.HostRewrite
+		if err := validateHostRewrite(host); err != nil {
+			return nil, err
+		}
+		pathMruby.HostRewrite = host
+	}
 
-		for i, _ := range ing.Spec.Rules {
-			rule := &ing.Spec.Rules[i]
-			if rule.HTTP == nil {
-				continue
+	if len(pc.ErrorPages) > 0 {
+		pathMruby.ErrorPages = make(map[int][]byte, len(pc.ErrorPages))
+		for code, ref := range pc.ErrorPages {
+			if code < 400 || code > 599 {
+				return nil, fmt.Errorf("errorPages status code must be in the range [400, 599]: %v", code)
 			}
-
+			page, err := lbc.getDataFromConfigMap(namespace, ref)
+			if err != nil {
+				return nil, fmt.Errorf("errorPages for status code %v: %v", code, err)
+			}
+			pathMruby.ErrorPages[code] = page
+		}
+	}
+
+	return pathMruby, nil
+}
+
+// getDataFromConfigMap returns the data, e.g., mruby script, stored in the key of ConfigMap referred by ref in the form of name/key.
+func (lbc *LoadBalancerController) getDataFromConfigMap(namespace, ref string) ([]byte, error) {
+	name, key, err := parseConfigMapRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	cmKey := fmt.Sprintf("%v/%v", namespace, name)
+	obj, exists, err := lbc.cmLister.GetByKey(cmKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get ConfigMap %v: %v", cmKey, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("ConfigMap %v not found", cmKey)
+	}
+
+	cm := obj.(*api.ConfigMap)
+	data, ok := cm.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("ConfigMap %v has no key %v", cmKey, key)
+	}
+
+	return []byte(data), nil
+}
+
+// podReference returns the reference to the Pod where the controller runs.
+func (lbc *LoadBalancerController) podReference() *api.ObjectReference {
+	return &api.ObjectReference{
+		Kind:      "Pod",
+		Namespace: lbc.podInfo.PodNamespace,
+		Name:      lbc.podInfo.PodName,
+	}
+}
+
+// updateSNIMapping computes the mapping from SNI host name to Secret from ingConfig, and stores it.
+func (lbc *LoadBalancerController) updateSNIMapping(ingConfig *nghttpx.IngressConfig) {
+	var creds []*nghttpx.TLSCred
+	if ingConfig.DefaultTLSCred != nil {
+		creds = append(creds, ingConfig.DefaultTLSCred)
+	}
+	creds = append(creds, ingConfig.SubTLSCred...)
+
+	m := createSNIMapping(creds)
+
+	if glog.V(3) {
+		hosts := make([]string, 0, len(m))
+		for host := range m {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			glog.Infof("SNI host %v is served by certificate from Secret %v", host, strings.Join(m[host], ", "))
+		}
+	}
+
+	lbc.sniMappingMu.Lock()
+	defer lbc.sniMappingMu.Unlock()
+
+	lbc.sniMapping = m
+}
+
+// SNIMapping returns the mapping from SNI host name to the list of Secrets which contain the certificate for the host.  It only
+// contains Secret names, and never key material.
+func (lbc *LoadBalancerController) SNIMapping() map[string][]string {
+	lbc.sniMappingMu.Lock()
+	defer lbc.sniMappingMu.Unlock()
+
+	m := make(map[string][]string, len(lbc.sniMapping))
+	for host, secrets := range lbc.sniMapping {
+		m[host] = append([]string(nil), secrets...)
+	}
+	return m
+}
+
+// AppliedIngressConfig returns the last applied configuration.  The content of private key files is removed.  If no configuration
+// has been applied yet, it returns nil.  The caller must not modify the returned object.
+func (lbc *LoadBalancerController) AppliedIngressConfig() *nghttpx.IngressConfig {
+	lbc.appliedIngConfigMu.Lock()
+	ingConfig := lbc.appliedIngConfig
+	lbc.appliedIngConfigMu.Unlock()
+
+	if ingConfig == nil {
+		return nil
+	}
+
+	redacted := *ingConfig
+	if ingConfig.DefaultTLSCred != nil {
+		redacted.DefaultTLSCred = redactTLSCred(ingConfig.DefaultTLSCred)
+	}
+	redacted.SubTLSCred = nil
+	for _, cred := range ingConfig.SubTLSCred {
+		redacted.SubTLSCred = append(redacted.SubTLSCred, redactTLSCred(cred))
+	}
+	return &redacted
+}
+
+// NghttpxSupervised returns false if nghttpx process has exited, and nothing supervises it anymore.
+func (lbc *LoadBalancerController) NghttpxSupervised() bool {
+	return lbc.nghttpx.Supervised()
+}
+
+// ConfigApplied returns true if nghttpx configuration has been successfully applied at least once.
+func (lbc *LoadBalancerController) ConfigApplied() bool {
+	return atomic.LoadInt32(&lbc.configApplied) != 0
+}
+
+func (lbc *LoadBalancerController) getDefaultUpstream() *nghttpx.Upstream {
+	upstream := &nghttpx.Upstream{
+		Name:             lbc.defaultSvc,
+		RedirectIfNotTLS: len(lbc.defaultTLSSecrets) > 0,
+	}
+	svcKey := lbc.defaultSvc
+	svcObj, svcExists, err := lbc.svcLister.GetByKey(svcKey)
+	if err != nil {
+		glog.Warningf("unexpected error searching the default backend %v: %v", lbc.defaultSvc, err)
+		lbc.setDefaultServer(upstream)
+		return upstream
+	}
+
+	if !svcExists {
+		glog.Warningf("service %v does no exists", svcKey)
+		lbc.setDefaultServer(upstream)
+		return upstream
+	}
+
+	svc := svcObj.(*api.Service)
+
+	portBackendConfig := nghttpx.DefaultPortBackendConfig()
+
+	eps := lbc.getEndpoints(svc, &svc.Spec.Ports[0], api.ProtocolTCP, &portBackendConfig)
+	if len(eps) == 0 {
+		glog.Warningf("service %v does no have any active endpoints", svcKey)
+		lbc.setDefaultServer(upstream)
+	} else {
+		upstream.Backends = append(upstream.Backends, eps...)
+	}
+
+	return upstream
+}
+
+// setDefaultServer makes upstream use the default server.  If the static default backend response is configured, upstream responds
+// with it.
+func (lbc *LoadBalancerController) setDefaultServer(upstream *nghttpx.Upstream) {
+	upstream.Backends = append(upstream.Backends, nghttpx.NewDefaultServer())
+	if lbc.defaultBackendResponseCode != 0 {
+		upstream.Mruby = nghttpx.CreatePerPatternMrubyChecksumFile(
+			nghttpx.CreateStaticResponseMruby(lbc.defaultBackendResponseCode, lbc.defaultBackendResponseBody))
+	}
+}
+
+// getServicePortBackends returns the backends for the service port bp of svc.  svcBackendConfig is the backend configuration for
+// svc found in ing.  It also returns the backend configuration used for bp.  If svc has no port which matches bp, it returns nil
+// configuration.
+func (lbc *LoadBalancerController) getServicePortBackends(ing *extensions.Ingress, svc *api.Service, bp string,
+	svcBackendConfig map[string]nghttpx.PortBackendConfig) ([]nghttpx.UpstreamServer, *nghttpx.PortBackendConfig) {
+	svcKey := fmt.Sprintf("%v/%v", svc.Namespace, svc.Name)
+
+	for i, _ := range svc.Spec.Ports {
+		servicePort := &svc.Spec.Ports[i]
+		// According to the documentation, servicePort.TargetPort is optional.  If it is omitted, use
+		// servicePort.Port.  servicePort.TargetPort could be a string.  This is really messy.
+		if strconv.Itoa(int(servicePort.Port)) != bp && servicePort.TargetPort.String() != bp && servicePort.Name != bp {
+			continue
+		}
+
+		portBackendConfig, ok := svcBackendConfig[bp]
+		// Affinity in annotation takes precedence over Service session affinity.
+		explicitAffinity := ok && portBackendConfig.Affinity != ""
+		if ok {
+			if err := nghttpx.ValidatePortBackendConfig(portBackendConfig); err != nil {
+				lbc.recorder.Eventf(ing, api.EventTypeWarning, "InvalidAnnotation", "%v annotation for service %v, port %v: %v",
+					backendConfigKey, svc.Name, bp, err)
+			}
+			portBackendConfig = nghttpx.FixupPortBackendConfig(portBackendConfig, svcKey, bp)
+		} else {
+			portBackendConfig = nghttpx.DefaultPortBackendConfig()
+		}
+
+		if !explicitAffinity && svc.Spec.SessionAffinity == api.ServiceAffinityClientIP {
+			glog.V(4).Infof("Use client IP based session affinity for service %v, port %v because of its session affinity", svcKey, bp)
+			portBackendConfig.Affinity = nghttpx.AffinityIP
+		}
+
+		if portBackendConfig.UnixSocketPath != "" && !lbc.allowUnixSocketBackend {
+			lbc.recorder.Eventf(ing, api.EventTypeWarning, "InvalidAnnotation",
+				"%v annotation for service %v, port %v: unixSocketPath is not allowed", backendConfigKey, svc.Name, bp)
+			portBackendConfig.UnixSocketPath = ""
+		}
+
+		eps := lbc.getEndpoints(svc, servicePort, api.ProtocolTCP, &portBackendConfig)
+		if len(eps) == 0 {
+			glog.Warningf("service %v does no have any active endpoints for port %v", svcKey, bp)
+		}
+		return eps, &portBackendConfig
+	}
+
+	glog.Warningf("service %v has no port %v", svcKey, bp)
+	return nil, nil
+}
+
+// getRuleOwners returns a mapping from the concatenation of host and path to the Ingress which owns the rule.  If multiple
+// Ingresses define the same host and path, the oldest one owns it.
+func (lbc *LoadBalancerController) getRuleOwners(ings []*extensions.Ingress) map[string]*extensions.Ingress {
+	owners := make(map[string]*extensions.Ingress)
+	for _, ing := range ings {
+		if !lbc.ingressServed(ing) {
+			continue
+		}
+		for _, rule := range ingressRules(ing) {
+			if rule.HTTP == nil {
+				continue
+			}
+			for i := range rule.HTTP.Paths {
+				normalizedPath, err := normalizePath(rule.HTTP.Paths[i].Path, lbc.strictPathValidation)
+				if err != nil {
+					continue
+				}
+				key := rule.Host + normalizedPath
+				if owner, ok := owners[key]; !ok || ingressOlder(ing, owner) {
+					owners[key] = ing
+				}
+			}
+		}
+	}
+	return owners
+}
+
+// in nghttpx terminology, nghttpx.Upstream is backend, nghttpx.Server is frontend
+func (lbc *LoadBalancerController) getUpstreamServers(ings []*extensions.Ingress) (*nghttpx.IngressConfig, error) {
+	ingConfig := nghttpx.NewIngressConfig()
+	if lbc.httpBindAddress != "" {
+		ingConfig.HTTPBindAddress = lbc.httpBindAddress
+	}
+	if lbc.httpsBindAddress != "" {
+		ingConfig.HTTPSBindAddress = lbc.httpsBindAddress
+	}
+	if lbc.nghttpxAPIBind != "" {
+		ingConfig.APIBindAddress = lbc.nghttpxAPIBind
+	}
+	if lbc.nghttpxHealthBind != "" {
+		ingConfig.HealthBindAddress = lbc.nghttpxHealthBind
+	}
+	ingConfig.HTTPProxyProto = lbc.proxyProtoEnabled(httpPort)
+	ingConfig.HTTPSProxyProto = lbc.proxyProtoEnabled(httpsPort)
+	ingConfig.NoOCSP = lbc.ocspFetchMode == OCSPFetchModeOff
+	if lbc.ocspUpdateInterval > 0 {
+		ingConfig.OCSPUpdateInterval = fmt.Sprintf("%vs", int64(lbc.ocspUpdateInterval/time.Second))
+	}
+	ingConfig.MaxWorkerProcesses = lbc.maxWorkerProcesses
+	if lbc.workerProcessGraceShutdownPeriod > 0 {
+		ingConfig.WorkerProcessGraceShutdownPeriod = fmt.Sprintf("%vs", int64(lbc.workerProcessGraceShutdownPeriod/time.Second))
+	}
+
+	var (
+		upstreams []*nghttpx.Upstream
+		pems      []*nghttpx.TLSCred
+		// backendEndpoints is a mapping from Service referenced by Ingress to the set of its endpoints.
+		backendEndpoints = make(map[backendKey]map[string]bool)
+		// ingHashes is a mapping from namespace/name of Ingress to the hash of the configuration derived from it.
+		ingHashes = make(map[string]hash.Hash)
+		// ingUpstreams is the list of upstreams created from Ingresses paired with the Ingress.
+		ingUpstreams []ingressUpstream
+	)
+
+	// The order of ings depends on the cache.  Sort them so that the same set of Ingresses always produces the same configuration,
+	// even if some of them have the conflicting rules.
+	ings = append([]*extensions.Ingress(nil), ings...)
+	sort.Slice(ings, func(i, j int) bool {
+		return ings[i].Namespace < ings[j].Namespace || (ings[i].Namespace == ings[j].Namespace && ings[i].Name < ings[j].Name)
+	})
+
+	// The default TLS certificates other than the first one are served by SNI like the ones from Ingresses.
+	for i, secret := range lbc.defaultTLSSecrets {
+		tlsCred, err := lbc.getTLSCredFromSecret(secret)
+		if err != nil {
+			return nil, err
+		}
+
+		if i == 0 {
+			ingConfig.TLS = true
+			ingConfig.DefaultTLSCred = tlsCred
+			continue
+		}
+		pems = append(pems, tlsCred)
+	}
+
+	if lbc.backendTLSCASecret != "" {
+		ca, err := lbc.getCAFromSecret(lbc.backendTLSCASecret)
+		if err != nil {
+			return nil, err
+		}
+
+		ingConfig.BackendTLSCACert = nghttpx.CreateBackendTLSCACert(ca)
+	}
+
+	if lbc.clientCASecret != "" {
+		ca, err := lbc.getCAFromSecret(lbc.clientCASecret)
+		if err != nil {
+			return nil, err
+		}
+
+		ingConfig.ClientCACert = nghttpx.CreateClientCACert(ca)
+	}
+
+	var ruleOwners map[string]*extensions.Ingress
+	// retryIncompleteSecret is true if some TLS Secret of Ingress is skipped because it is incomplete.
+	var retryIncompleteSecret bool
+	if lbc.rejectConflictingRules {
+		ruleOwners = lbc.getRuleOwners(ings)
+	}
+
+	for _, ing := range ings {
+		if !lbc.ingressServed(ing) {
+			continue
+		}
+
+		// Cleartext HTTP requests are redirected even if some TLS Secret is incomplete, so that the Ingress is never served
+		// without TLS because of it.
+		requireTLS := len(ing.Spec.TLS) > 0
+		ingPems, err := lbc.getTLSCredFromIngress(ing)
+		if err != nil {
+			if _, ok := err.(*incompleteSecretError); !ok {
+				glog.Warningf("Ingress %v/%v is disabled because its TLS Secret cannot be processed: %v", ing.Namespace, ing.Name, err)
+				lbc.recorder.Eventf(ing, api.EventTypeWarning, "InvalidSecret", "Ingress is disabled because TLS Secret cannot be processed: %v",
+					err)
+				continue
+			}
+			glog.Warningf("Ingress %v/%v: incomplete TLS Secret is skipped: %v", ing.Namespace, ing.Name, err)
+			lbc.recorder.Eventf(ing, api.EventTypeWarning, "IncompleteSecret", "Incomplete TLS Secret is skipped: %v", err)
+			retryIncompleteSecret = true
+		}
+		pems = append(pems, ingPems...)
+		for _, cred := range ingPems {
+			fmt.Fprintf(ingressHash(ingHashes, ing), "%v;%v;%v\n", cred.Key.Path, cred.Key.Checksum, cred.Cert.Checksum)
+		}
+
+		backendConfig, err := ingressAnnotation(ing.ObjectMeta.Annotations).getBackendConfig()
+		if err != nil {
+			glog.Errorf("Ingress %v/%v: %v", ing.Namespace, ing.Name, err)
+			lbc.recorder.Eventf(ing, api.EventTypeWarning, "InvalidAnnotation", "%v", err)
+		}
+
+		allowHTTP := ingressAnnotation(ing.ObjectMeta.Annotations).getAllowHTTP()
+
+		pathConfig, err := ingressAnnotation(ing.ObjectMeta.Annotations).getPathConfig()
+		if err != nil {
+			glog.Errorf("Ingress %v/%v: %v", ing.Namespace, ing.Name, err)
+			lbc.recorder.Eventf(ing, api.EventTypeWarning, "InvalidAnnotation", "%v", err)
+		}
+
+		rules := ingressRules(ing)
+		for i, _ := range rules {
+			rule := &rules[i]
+			if rule.HTTP == nil {
+				continue
+			}
+
 			for i, _ := range rule.HTTP.Paths {
 				path := &rule.HTTP.Paths[i]
-				var normalizedPath string
-				if path.Path == "" {
-					normalizedPath = "/"
-				} else if !strings.HasPrefix(path.Path, "/") {
-					glog.Infof("Ingress %v/%v, host %v has Path which does not start /: %v", ing.Namespace, ing.Name, rule.Host, path.Path)
+				normalizedPath, err := normalizePath(path.Path, lbc.strictPathValidation)
+				if err != nil {
+					glog.Infof("Ingress %v/%v, host %v: %v", ing.Namespace, ing.Name, rule.Host, err)
 					continue
-				} else {
-					normalizedPath = path.Path
 				}
-				// The format of upsName is similar to backend option syntax of nghttpx.
-				upsName := fmt.Sprintf("%v/%v,%v;%v%v", ing.Namespace, path.Backend.ServiceName, path.Backend.ServicePort.String(), rule.Host, normalizedPath)
+				if !strings.HasPrefix(normalizedPath, "/") {
+					glog.Infof("Ingress %v/%v, host %v has Path which does not start /; passing it to nghttpx as is: %v", ing.Namespace,
+						ing.Name, rule.Host, normalizedPath)
+				}
+				if lbc.maxPathLength > 0 && len(normalizedPath) > lbc.maxPathLength {
+					glog.Warningf("Ingress %v/%v, host %v has Path which is longer than %v bytes: %v", ing.Namespace, ing.Name,
+						rule.Host, lbc.maxPathLength, normalizedPath)
+					continue
+				}
+				if owner := ruleOwners[rule.Host+normalizedPath]; owner != nil && owner != ing {
+					glog.Warningf("Ingress %v/%v, host %v, path %v is ignored because it conflicts with older Ingress %v/%v",
+						ing.Namespace, ing.Name, rule.Host, normalizedPath, owner.Namespace, owner.Name)
+					lbc.recorder.Eventf(ing, api.EventTypeWarning, "ConflictingRule",
+						"Rule for host %v, path %v is ignored because it is already defined by Ingress %v/%v", rule.Host,
+						normalizedPath, owner.Namespace, owner.Name)
+					continue
+				}
+				upsName, shortened := createUpstreamName(ing.Namespace, path.Backend.ServiceName, path.Backend.ServicePort.String(),
+					rule.Host, normalizedPath)
+				if shortened {
+					glog.Warningf("Ingress %v/%v, host %v has very long Path; upstream name is shortened to %v", ing.Namespace, ing.Name,
+						rule.Host, upsName)
+				}
 				ups := &nghttpx.Upstream{
 					Name:             upsName,
 					Host:             rule.Host,
 					Path:             normalizedPath,
-					RedirectIfNotTLS: requireTLS || lbc.defaultTLSSecret != "",
+					RedirectIfNotTLS: requireTLS || len(lbc.defaultTLSSecrets) > 0,
+				}
+				if lbc.annotateConfig {
+					ups.Comments = ingressComments(ing)
+				}
+
+				pathMruby := &nghttpx.PathMruby{}
+				if pc := pathConfig[rule.Host+normalizedPath]; pc != nil {
+					pathMruby, err = lbc.getPathMruby(ing.Namespace, normalizedPath, pc)
+					if err != nil {
+						// Serving the requests without mruby script might be unsafe, because it might implement access control.
+						glog.Warningf("Ingress %v/%v, host %v, path %v is ignored because its mruby script cannot be obtained: %v",
+							ing.Namespace, ing.Name, rule.Host, normalizedPath, err)
+						lbc.recorder.Eventf(ing, api.EventTypeWarning, "InvalidMruby", "Rule for host %v, path %v is ignored: %v",
+							rule.Host, normalizedPath, err)
+						continue
+					}
+				}
+
+				if !allowHTTP {
+					// Reject cleartext HTTP requests rather than redirecting them.  The check runs before the other mruby features.
+					ups.RedirectIfNotTLS = false
+					pathMruby.DenyPlaintext = true
+				}
+
+				if mruby := nghttpx.CreatePathMruby(pathMruby); mruby != nil {
+					ups.Mruby = nghttpx.CreatePerPatternMrubyChecksumFile(mruby)
 				}
 
 				glog.V(4).Infof("Found rule for upstream name=%v, host=%v, path=%v", upsName, ups.Host, ups.Path)
 
+				bk := backendKey{namespace: ing.Namespace, ingress: ing.Name, service: path.Backend.ServiceName}
+				if backendEndpoints[bk] == nil {
+					backendEndpoints[bk] = make(map[string]bool)
+				}
+
 				svcKey := fmt.Sprintf("%v/%v", ing.Namespace, path.Backend.ServiceName)
 				svcObj, svcExists, err := lbc.svcLister.GetByKey(svcKey)
 				if err != nil {
@@ -775,40 +1843,80 @@ func (lbc *LoadBalancerController) getUpstreamServers(ings []*extensions.Ingress
 
 				svcBackendConfig := backendConfig[path.Backend.ServiceName]
 
-				for i, _ := range svc.Spec.Ports {
-					servicePort := &svc.Spec.Ports[i]
-					// According to the documentation, servicePort.TargetPort is optional.  If it is omitted, use
-					// servicePort.Port.  servicePort.TargetPort could be a string.  This is really messy.
-					if strconv.Itoa(int(servicePort.Port)) == bp || servicePort.TargetPort.String() == bp || servicePort.Name == bp {
-						portBackendConfig, ok := svcBackendConfig[bp]
-						if ok {
-							portBackendConfig = nghttpx.FixupPortBackendConfig(portBackendConfig, svcKey, bp)
-						} else {
-							portBackendConfig = nghttpx.DefaultPortBackendConfig()
+				eps, portBackendConfig := lbc.getServicePortBackends(ing, svc, bp, svcBackendConfig)
+				ups.Backends = append(ups.Backends, eps...)
+				if portBackendConfig != nil {
+					for _, extraPort := range portBackendConfig.ExtraPorts {
+						if extraPort == bp {
+							continue
 						}
-
-						eps := lbc.getEndpoints(svc, servicePort, api.ProtocolTCP, &portBackendConfig)
-						if len(eps) == 0 {
-							glog.Warningf("service %v does no have any active endpoints", svcKey)
-							break
-						}
-
+						eps, _ := lbc.getServicePortBackends(ing, svc, extraPort, svcBackendConfig)
 						ups.Backends = append(ups.Backends, eps...)
-						break
 					}
 				}
 
+				for _, backend := range ups.Backends {
+					backendEndpoints[bk][backend.Address+","+backend.Port+","+backend.UnixSocketPath] = true
+				}
+
 				if len(ups.Backends) == 0 {
-					glog.Warningf("no backend service port found for service %v", svcKey)
-					continue
+					if lbc.emptyUpstreamBehavior != EmptyUpstreamBehaviorServiceUnavailable {
+						glog.Warningf("no backend service port found for service %v", svcKey)
+						continue
+					}
+					glog.Warningf("no backend service port found for service %v; respond with 503", svcKey)
+					// nghttpx requires at least one backend.  The mruby script responds before the request is forwarded to it.
+					// It replaces the other mruby features of the rule, which have nothing to forward the requests to anyway, except
+					// for the rejection of cleartext HTTP requests.
+					ups.Backends = append(ups.Backends, nghttpx.NewDefaultServer())
+					ups.Mruby = nghttpx.CreatePerPatternMrubyChecksumFile(nghttpx.CreatePathMruby(&nghttpx.PathMruby{
+						DenyPlaintext: pathMruby.DenyPlaintext,
+						StaticResponse: &nghttpx.StaticResponse{
+							StatusCode: http.StatusServiceUnavailable,
+							Body:       []byte(http.StatusText(http.StatusServiceUnavailable)),
+						},
+					}))
 				}
 
+				ingUpstreams = append(ingUpstreams, ingressUpstream{ing: ing, upstream: ups})
 				upstreams = append(upstreams, ups)
 			}
 		}
 	}
 
-	sort.Slice(pems, func(i, j int) bool { return pems[i].Key.Path < pems[j].Key.Path })
+	// The certificates are known only after all Ingresses are processed.
+	certWarned := make(map[string]bool)
+	for _, iu := range ingUpstreams {
+		ing, ups := iu.ing, iu.upstream
+		if ups.RedirectIfNotTLS && ups.Host != "" && !certMatchesHost(ingConfig.DefaultTLSCred, pems, ups.Host) {
+			// The host which Ingress lists in spec.tls is always redirected, e.g., while its Secret is still incomplete, so that it
+			// is never served over cleartext HTTP.
+			if !lbc.redirectWithoutCert && !ingressListsTLSHost(ing, ups.Host) {
+				ups.RedirectIfNotTLS = false
+			}
+			if key := fmt.Sprintf("%v/%v/%v", ing.Namespace, ing.Name, ups.Host); !certWarned[key] {
+				certWarned[key] = true
+				glog.Warningf("Ingress %v/%v, host %v has no matching TLS certificate", ing.Namespace, ing.Name, ups.Host)
+				if ups.RedirectIfNotTLS {
+					lbc.recorder.Eventf(ing, api.EventTypeWarning, "MissingCertificate",
+						"Host %v is redirected to https URI, but no TLS certificate matches it; the default certificate is served", ups.Host)
+				} else {
+					lbc.recorder.Eventf(ing, api.EventTypeWarning, "MissingCertificate",
+						"Host %v is not redirected to https URI because no TLS certificate matches it", ups.Host)
+				}
+			}
+		}
+
+		writeUpstream(ingressHash(ingHashes, ing), ups)
+	}
+
+	ingConfig.IngressChecksums = make(map[string]string, len(ingHashes))
+	for key, h := range ingHashes {
+		ingConfig.IngressChecksums[key] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	// Keep the order of the same Secret referenced by multiple Ingresses, so that RemoveDuplicatePems always picks the same one.
+	sort.SliceStable(pems, func(i, j int) bool { return pems[i].Key.Path < pems[j].Key.Path })
 	pems = nghttpx.RemoveDuplicatePems(pems)
 
 	if ingConfig.DefaultTLSCred != nil {
@@ -826,26 +1934,50 @@ func (lbc *LoadBalancerController) getUpstreamServers(ings []*extensions.Ingress
 		ingConfig.SubTLSCred = pems[1:]
 	}
 
-	// find default backend.  If only it is not found, use default backend.  This is useful to override default backend with ingress.
-	defaultUpstreamFound := false
-
-	for _, upstream := range upstreams {
-		if upstream.Host == "" && (upstream.Path == "" || upstream.Path == "/") {
-			defaultUpstreamFound = true
-			break
+	if lbc.defaultBackendPreference == DefaultBackendPreferGlobal {
+		// Remove the catch-all rules in Ingress, so that the default backend Service always serves them.
+		var filtered []*nghttpx.Upstream
+		for _, upstream := range upstreams {
+			if isDefaultUpstream(upstream) {
+				glog.V(3).Infof("Ignore upstream %v because the default backend Service is preferred", upstream.Name)
+				continue
+			}
+			filtered = append(filtered, upstream)
+		}
+		upstreams = append(filtered, lbc.getDefaultUpstream())
+	} else {
+		// find default backend.  If only it is not found, use default backend.  This is useful to override default backend with
+		// ingress.  Since the upstream without available endpoints has been removed, the default backend also serves as a
+		// fallback.
+		defaultUpstreamFound := false
+
+		for _, upstream := range upstreams {
+			if isDefaultUpstream(upstream) {
+				defaultUpstreamFound = true
+				break
+			}
 		}
-	}
 
-	if !defaultUpstreamFound {
-		upstreams = append(upstreams, lbc.getDefaultUpstream())
+		if !defaultUpstreamFound {
+			upstreams = append(upstreams, lbc.getDefaultUpstream())
+		}
 	}
 
-	sort.Slice(upstreams, func(i, j int) bool { return upstreams[i].Name < upstreams[j].Name })
+	// Upstreams of the same name might come from different Ingresses.  Keep their order which is determined by the sorted ings.
+	sort.SliceStable(upstreams, func(i, j int) bool { return upstreams[i].Name < upstreams[j].Name })
 
 	for _, value := range upstreams {
 		backends := value.Backends
-		sort.Slice(backends, func(i, j int) bool {
-			return backends[i].Address < backends[j].Address || (backends[i].Address == backends[j].Address && backends[i].Port < backends[j].Port)
+		// The same endpoint might be found through multiple ports with the different backend configuration.  Keep their order
+		// which is determined by the sorted ings, so that the same one survives deduplication below.
+		sort.SliceStable(backends, func(i, j int) bool {
+			if backends[i].Address != backends[j].Address {
+				return backends[i].Address < backends[j].Address
+			}
+			if backends[i].Port != backends[j].Port {
+				return backends[i].Port < backends[j].Port
+			}
+			return backends[i].UnixSocketPath < backends[j].UnixSocketPath
 		})
 
 		// remove duplicate UpstreamServer
@@ -853,7 +1985,7 @@ func (lbc *LoadBalancerController) getUpstreamServers(ings []*extensions.Ingress
 		for _, sv := range backends[1:] {
 			lastBackend := &uniqBackends[len(uniqBackends)-1]
 
-			if lastBackend.Address == sv.Address && lastBackend.Port == sv.Port {
+			if lastBackend.Address == sv.Address && lastBackend.Port == sv.Port && lastBackend.UnixSocketPath == sv.UnixSocketPath {
 				continue
 			}
 
@@ -863,11 +1995,113 @@ func (lbc *LoadBalancerController) getUpstreamServers(ings []*extensions.Ingress
 		value.Backends = uniqBackends
 	}
 
+	if lbc.weightPerService {
+		assignWeightPerService(upstreams)
+	}
+
+	if !retryIncompleteSecret {
+		lbc.incompleteSecretRetries = 0
+	} else if lbc.incompleteSecretRetries < incompleteSecretMaxRetries {
+		lbc.incompleteSecretRetries++
+		lbc.enqueueAfter(syncKey, incompleteSecretRetryDelay)
+	} else {
+		glog.Warningf("Some TLS Secret is still incomplete after %v retries; wait for its update", incompleteSecretMaxRetries)
+	}
+
+	if next := lbc.applySlowStart(upstreams, time.Now()); next > 0 {
+		glog.V(4).Infof("Some backends are in slow start; recompute weights in %v", next)
+		lbc.enqueueAfter(syncKey, next)
+	}
+
 	ingConfig.Upstreams = upstreams
 
+	lbc.updateBackendEndpointsMetric(backendEndpoints)
+
 	return ingConfig, nil
 }
 
+// applySlowStart reduces the weight of the backends which were added within their slow start duration.  The time when a backend
+// was first seen is remembered in lbc.endpointFirstSeen, and the backends found in the first computation are considered old, so
+// that restarting the controller does not slow down all backends.  It returns the duration after which the weights should be
+// recomputed, or 0 if no backend is in slow start.
+func (lbc *LoadBalancerController) applySlowStart(upstreams []*nghttpx.Upstream, now time.Time) time.Duration {
+	firstSeen := make(map[string]time.Time)
+	var next time.Duration
+
+	for _, ups := range upstreams {
+		var ramping bool
+		for i := range ups.Backends {
+			backend := &ups.Backends[i]
+			if backend.SlowStart == 0 {
+				continue
+			}
+			key := ups.Host + ups.Path + "," + backend.Address + "," + backend.Port
+			t, ok := lbc.endpointFirstSeen[key]
+			if !ok && lbc.endpointFirstSeen != nil {
+				t = now
+			}
+			firstSeen[key] = t
+
+			elapsed := now.Sub(t)
+			if elapsed >= backend.SlowStart {
+				continue
+			}
+			ramping = true
+
+			step := backend.SlowStart / slowStartSteps
+			if step < time.Second {
+				step = time.Second
+			}
+			if next == 0 || step < next {
+				next = step
+			}
+		}
+
+		if !ramping {
+			continue
+		}
+
+		// Weight 0 means nghttpx default weight 1 which cannot be lowered.  Use the maximum weight as the full weight instead.
+		for i := range ups.Backends {
+			backend := &ups.Backends[i]
+			if backend.Weight == 0 {
+				backend.Weight = nghttpx.MaxBackendWeight
+			}
+			if backend.SlowStart == 0 {
+				continue
+			}
+			t := firstSeen[ups.Host+ups.Path+","+backend.Address+","+backend.Port]
+			backend.Weight = slowStartWeight(backend.Weight, now.Sub(t), backend.SlowStart)
+		}
+	}
+
+	lbc.endpointFirstSeen = firstSeen
+
+	return next
+}
+
+// updateBackendEndpointsMetric replaces the samples of backend endpoints metric with backendEndpoints.  The Services which are no
+// longer referenced are removed.
+func (lbc *LoadBalancerController) updateBackendEndpointsMetric(backendEndpoints map[backendKey]map[string]bool) {
+	lbc.backendEndpoints.Reset()
+	for bk, eps := range backendEndpoints {
+		lbc.backendEndpoints.Set(float64(len(eps)), bk.namespace, bk.ingress, bk.service)
+	}
+}
+
+// proxyProtoEnabled returns true if PROXY protocol is enabled on the frontend which listens on port.
+func (lbc *LoadBalancerController) proxyProtoEnabled(port int) bool {
+	if !lbc.proxyProto {
+		return false
+	}
+	for _, p := range lbc.proxyProtoExcludePorts {
+		if p == port {
+			return false
+		}
+	}
+	return true
+}
+
 // getTLSCredFromSecret returns nghttpx.TLSCred obtained from the Secret denoted by secretKey.
 func (lbc *LoadBalancerController) getTLSCredFromSecret(secretKey string) (*nghttpx.TLSCred, error) {
 	obj, exists, err := lbc.secretLister.GetByKey(secretKey)
@@ -884,9 +2118,13 @@ func (lbc *LoadBalancerController) getTLSCredFromSecret(secretKey string) (*nght
 	return tlsCred, nil
 }
 
-// getTLSCredFromIngress returns list of nghttpx.TLSCred obtained from Ingress resource.
+// getTLSCredFromIngress returns list of nghttpx.TLSCred obtained from Ingress resource.  The Secret which lacks certificate or
+// private key is skipped, and *incompleteSecretError for it is returned along with the list of the other ones.
 func (lbc *LoadBalancerController) getTLSCredFromIngress(ing *extensions.Ingress) ([]*nghttpx.TLSCred, error) {
-	var pems []*nghttpx.TLSCred
+	var (
+		pems       []*nghttpx.TLSCred
+		incomplete error
+	)
 
 	for i, _ := range ing.Spec.TLS {
 		tls := &ing.Spec.TLS[i]
@@ -900,27 +2138,63 @@ func (lbc *LoadBalancerController) getTLSCredFromIngress(ing *extensions.Ingress
 		}
 		tlsCred, err := lbc.createTLSCredFromSecret(obj.(*api.Secret))
 		if err != nil {
+			if _, ok := err.(*incompleteSecretError); ok {
+				if incomplete == nil {
+					incomplete = err
+				}
+				continue
+			}
 			return nil, err
 		}
 
 		pems = append(pems, tlsCred)
 	}
 
-	return pems, nil
+	return pems, incomplete
+}
+
+// getCAFromSecret returns CA bundle obtained from the Secret denoted by secretKey.
+func (lbc *LoadBalancerController) getCAFromSecret(secretKey string) ([]byte, error) {
+	obj, exists, err := lbc.secretLister.GetByKey(secretKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get CA Secret %v: %v", secretKey, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("Secret %v has been deleted", secretKey)
+	}
+	secret := obj.(*api.Secret)
+	ca, ok := secret.Data[caCertKey]
+	if !ok {
+		return nil, fmt.Errorf("Secret %v has no CA bundle", secretKey)
+	}
+	if err := nghttpx.CheckCACert(ca); err != nil {
+		return nil, fmt.Errorf("No valid CA bundle found in Secret %v: %v", secretKey, err)
+	}
+	return ca, nil
 }
 
 // createTLSCredFromSecret creates nghttpx.TLSCred from secret.
 func (lbc *LoadBalancerController) createTLSCredFromSecret(secret *api.Secret) (*nghttpx.TLSCred, error) {
-	cert, ok := secret.Data[api.TLSCertKey]
-	if !ok {
-		return nil, fmt.Errorf("Secret %v/%v has no certificate", secret.Namespace, secret.Name)
+	cert := secret.Data[api.TLSCertKey]
+	if len(cert) == 0 {
+		return nil, &incompleteSecretError{secretKey: secret.Namespace + "/" + secret.Name, missing: "certificate"}
 	}
-	key, ok := secret.Data[api.TLSPrivateKeyKey]
-	if !ok {
-		return nil, fmt.Errorf("Secret %v/%v has no private key", secret.Namespace, secret.Name)
+	key := secret.Data[api.TLSPrivateKeyKey]
+	if len(key) == 0 {
+		return nil, &incompleteSecretError{secretKey: secret.Namespace + "/" + secret.Name, missing: "private key"}
+	}
+
+	if ca, ok := secret.Data[caCertKey]; ok && lbc.appendCAToCert {
+		chain, err := nghttpx.AppendCACert(cert, ca)
+		if err != nil {
+			glog.Warningf("Ignoring %v in Secret %v/%v: %v", caCertKey, secret.Namespace, secret.Name, err)
+		} else {
+			cert = chain
+		}
 	}
 
-	if _, err := nghttpx.CommonNames(cert); err != nil {
+	hosts, err := nghttpx.CommonNames(cert)
+	if err != nil {
 		return nil, fmt.Errorf("No valid TLS certificate found in Secret %v/%v: %v", secret.Namespace, secret.Name, err)
 	}
 
@@ -933,11 +2207,20 @@ func (lbc *LoadBalancerController) createTLSCredFromSecret(secret *api.Secret) (
 		return nil, fmt.Errorf("Could not create private key and certificate files for Secret %v/%v: %v", secret.Namespace, secret.Name, err)
 	}
 
+	tlsCred.Secret = fmt.Sprintf("%v/%v", secret.Namespace, secret.Name)
+	tlsCred.Hosts = hosts
+
 	return tlsCred, nil
 }
 
 func (lbc *LoadBalancerController) secretReferenced(namespace, name string) bool {
-	if lbc.defaultTLSSecret == fmt.Sprintf("%v/%v", namespace, name) {
+	for _, secret := range lbc.defaultTLSSecrets {
+		if secret == fmt.Sprintf("%v/%v", namespace, name) {
+			return true
+		}
+	}
+
+	if lbc.backendTLSCASecret == fmt.Sprintf("%v/%v", namespace, name) || lbc.clientCASecret == fmt.Sprintf("%v/%v", namespace, name) {
 		return true
 	}
 
@@ -947,7 +2230,7 @@ func (lbc *LoadBalancerController) secretReferenced(namespace, name string) bool
 		return false
 	}
 	for _, ing := range ings {
-		if !lbc.validateIngressClass(ing) {
+		if !lbc.ingressServed(ing) {
 			continue
 		}
 		for i, _ := range ing.Spec.TLS {
@@ -962,8 +2245,28 @@ func (lbc *LoadBalancerController) secretReferenced(namespace, name string) bool
 
 // getEndpoints returns a list of <endpoint ip>:<port> for a given
 // service/target port combination.  portBackendConfig is additional
-// per-port configuration for backend, which must not be nil.
+// per-port configuration for backend, which must not be nil.  If
+// portBackendConfig has UnixSocketPath, it returns a single backend
+// which connects to the socket.
 func (lbc *LoadBalancerController) getEndpoints(s *api.Service, servicePort *api.ServicePort, proto api.Protocol, portBackendConfig *nghttpx.PortBackendConfig) []nghttpx.UpstreamServer {
+	if portBackendConfig.UnixSocketPath != "" {
+		glog.V(3).Infof("use Unix domain socket %v for service %v/%v and port %v", portBackendConfig.UnixSocketPath, s.Namespace, s.Name,
+			servicePort.TargetPort.String())
+		return []nghttpx.UpstreamServer{
+			{
+				UnixSocketPath:       portBackendConfig.UnixSocketPath,
+				Protocol:             portBackendConfig.Proto,
+				TLS:                  portBackendConfig.TLS,
+				SNI:                  portBackendConfig.SNI,
+				Affinity:             portBackendConfig.Affinity,
+				AffinityCookieName:   portBackendConfig.AffinityCookieName,
+				AffinityCookiePath:   portBackendConfig.AffinityCookiePath,
+				AffinityCookieSecure: portBackendConfig.AffinityCookieSecure,
+				Weight:               portBackendConfig.Weight,
+			},
+		}
+	}
+
 	glog.V(3).Infof("getting endpoints for service %v/%v and port %v protocol %v", s.Namespace, s.Name, servicePort.TargetPort.String(), servicePort.Protocol)
 	ep, err := lbc.epLister.GetServiceEndpoints(s)
 	if err != nil {
@@ -973,6 +2276,33 @@ func (lbc *LoadBalancerController) getEndpoints(s *api.Service, servicePort *api
 
 	upsServers := []nghttpx.UpstreamServer{}
 
+	var slowStart time.Duration
+	if portBackendConfig.SlowStart != nil {
+		slowStart = portBackendConfig.SlowStart.Duration
+	}
+
+	var endpointSelector labels.Selector
+	if portBackendConfig.EndpointSelector != "" {
+		endpointSelector, err = labels.Parse(portBackendConfig.EndpointSelector)
+		if err != nil {
+			glog.Warningf("service %v/%v has invalid endpoint selector %v: %v", s.Namespace, s.Name, portBackendConfig.EndpointSelector, err)
+			return upsServers
+		}
+	}
+
+	var nodeSelector labels.Selector
+	if portBackendConfig.NodeSelector != "" {
+		nodeSelector, err = labels.Parse(portBackendConfig.NodeSelector)
+		if err != nil {
+			// Ignore the invalid selector rather than dropping all endpoints.
+			glog.Warningf("service %v/%v has invalid node selector %v; ignore it: %v", s.Namespace, s.Name,
+				portBackendConfig.NodeSelector, err)
+			nodeSelector = nil
+		}
+	}
+	// fallbackServers are the endpoints excluded by nodeSelector.  They are used if no endpoint matches nodeSelector.
+	var fallbackServers []nghttpx.UpstreamServer
+
 	for i, _ := range ep.Subsets {
 		ss := &ep.Subsets[i]
 		for i, _ := range ss.Ports {
@@ -1013,26 +2343,174 @@ func (lbc *LoadBalancerController) getEndpoints(s *api.Service, servicePort *api
 				continue
 			}
 
-			for i, _ := range ss.Addresses {
-				epAddress := &ss.Addresses[i]
+			addresses := ss.Addresses
+			if lbc.includeNotReadyEndpoints && len(ss.NotReadyAddresses) > 0 {
+				addresses = append(append([]api.EndpointAddress(nil), ss.Addresses...), ss.NotReadyAddresses...)
+			}
+
+			for i, _ := range addresses {
+				epAddress := &addresses[i]
+				if endpointSelector != nil && !lbc.podLabelsMatch(epAddress, endpointSelector) {
+					glog.V(4).Infof("Exclude endpoint %v of service %v/%v because its Pod does not match endpoint selector %v",
+						epAddress.IP, s.Namespace, s.Name, endpointSelector)
+					continue
+				}
+				if len(lbc.requiredPodConditions) > 0 && !lbc.podConditionsSatisfied(epAddress) {
+					glog.V(4).Infof("Exclude endpoint %v of service %v/%v because its Pod does not satisfy required conditions",
+						epAddress.IP, s.Namespace, s.Name)
+					continue
+				}
 				ups := nghttpx.UpstreamServer{
-					Address:  epAddress.IP,
-					Port:     strconv.Itoa(int(targetPort)),
-					Protocol: portBackendConfig.Proto,
-					TLS:      portBackendConfig.TLS,
-					SNI:      portBackendConfig.SNI,
-					DNS:      portBackendConfig.DNS,
-					Affinity: portBackendConfig.Affinity,
+					Address:              epAddress.IP,
+					Port:                 strconv.Itoa(int(targetPort)),
+					Protocol:             portBackendConfig.Proto,
+					TLS:                  portBackendConfig.TLS,
+					SNI:                  portBackendConfig.SNI,
+					DNS:                  portBackendConfig.DNS,
+					Affinity:             portBackendConfig.Affinity,
+					AffinityCookieName:   portBackendConfig.AffinityCookieName,
+					AffinityCookiePath:   portBackendConfig.AffinityCookiePath,
+					AffinityCookieSecure: portBackendConfig.AffinityCookieSecure,
+					Weight:               portBackendConfig.Weight,
+					SlowStart:            slowStart,
+				}
+				if lbc.endpointWeightLabel != "" {
+					if w, ok := lbc.podWeight(epAddress); ok {
+						ups.Weight = w
+					}
+				}
+				if nodeSelector != nil && !lbc.nodeLabelsMatch(epAddress, nodeSelector) {
+					glog.V(4).Infof("Exclude endpoint %v of service %v/%v because its Node does not match node selector %v",
+						epAddress.IP, s.Namespace, s.Name, nodeSelector)
+					fallbackServers = append(fallbackServers, ups)
+					continue
 				}
 				upsServers = append(upsServers, ups)
 			}
 		}
 	}
 
+	if len(upsServers) == 0 && len(fallbackServers) > 0 {
+		glog.Warningf("No endpoint of service %v/%v matches node selector %v; use all endpoints", s.Namespace, s.Name, nodeSelector)
+		upsServers = fallbackServers
+	}
+
 	glog.V(3).Infof("endpoints found: %+v", upsServers)
 	return upsServers
 }
 
+// getEndpointPod returns the Pod backing epAddress.  If epAddress does not refer to a Pod, it returns nil, and nil error.
+func (lbc *LoadBalancerController) getEndpointPod(epAddress *api.EndpointAddress) (*api.Pod, error) {
+	ref := epAddress.TargetRef
+	if ref == nil || ref.Kind != "Pod" {
+		return nil, nil
+	}
+
+	pod, err := lbc.podLister.Pods(ref.Namespace).Get(ref.Name)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get Pod %v/%v from lister: %v", ref.Namespace, ref.Name, err)
+	}
+	return pod, nil
+}
+
+// podLabelsMatch returns true if the Pod backing epAddress matches selector.  If epAddress does not refer to a Pod, it returns false.
+func (lbc *LoadBalancerController) podLabelsMatch(epAddress *api.EndpointAddress, selector labels.Selector) bool {
+	pod, err := lbc.getEndpointPod(epAddress)
+	if err != nil {
+		glog.V(4).Info(err)
+		return false
+	}
+	if pod == nil {
+		return false
+	}
+	return selector.Matches(labels.Set(pod.Labels))
+}
+
+// podWeight returns the weight in the label lbc.endpointWeightLabel of the Pod backing epAddress.  It returns false if the Pod or
+// the label is not found, or the label value is not an integer in [1, nghttpx.MaxBackendWeight].
+func (lbc *LoadBalancerController) podWeight(epAddress *api.EndpointAddress) (uint32, bool) {
+	pod, err := lbc.getEndpointPod(epAddress)
+	if err != nil {
+		glog.V(4).Info(err)
+		return 0, false
+	}
+	if pod == nil {
+		return 0, false
+	}
+	v, ok := pod.Labels[lbc.endpointWeightLabel]
+	if !ok {
+		return 0, false
+	}
+	w, err := strconv.ParseUint(v, 10, 32)
+	if err != nil || w < 1 || w > nghttpx.MaxBackendWeight {
+		glog.Warningf("Ignoring label %v=%v of Pod %v/%v: weight must be an integer in [1, %v]", lbc.endpointWeightLabel, v,
+			pod.Namespace, pod.Name, nghttpx.MaxBackendWeight)
+		return 0, false
+	}
+	return uint32(w), true
+}
+
+// nodeLabelsMatch returns true if the Node where the endpoint epAddress runs matches selector.  If the Node is unknown, it returns
+// false.
+func (lbc *LoadBalancerController) nodeLabelsMatch(epAddress *api.EndpointAddress, selector labels.Selector) bool {
+	var nodeName string
+	if epAddress.NodeName != nil {
+		nodeName = *epAddress.NodeName
+	} else {
+		pod, err := lbc.getEndpointPod(epAddress)
+		if err != nil {
+			glog.V(4).Info(err)
+			return false
+		}
+		if pod == nil {
+			return false
+		}
+		nodeName = pod.Spec.NodeName
+	}
+	if nodeName == "" {
+		return false
+	}
+
+	obj, exists, err := lbc.nodeLister.GetByKey(nodeName)
+	if err != nil {
+		glog.V(4).Infof("Could not get Node %v from lister: %v", nodeName, err)
+		return false
+	}
+	if !exists {
+		return false
+	}
+	return selector.Matches(labels.Set(obj.(*api.Node).Labels))
+}
+
+// podConditionsSatisfied returns true if the Pod backing epAddress has all conditions in lbc.requiredPodConditions with status True.
+// If epAddress does not refer to a Pod, it returns true.
+func (lbc *LoadBalancerController) podConditionsSatisfied(epAddress *api.EndpointAddress) bool {
+	pod, err := lbc.getEndpointPod(epAddress)
+	if err != nil {
+		glog.V(4).Info(err)
+		return false
+	}
+	if pod == nil {
+		return true
+	}
+
+	for _, condType := range lbc.requiredPodConditions {
+		satisfied := false
+		for i := range pod.Status.Conditions {
+			cond := &pod.Status.Conditions[i]
+			if string(cond.Type) == condType {
+				satisfied = cond.Status == api.ConditionTrue
+				break
+			}
+		}
+		if !satisfied {
+			return false
+		}
+	}
+
+	return true
+}
+
 // getNamedPortFromPod returns port number from Pod sharing the same port name with servicePort.
 func (lbc *LoadBalancerController) getNamedPortFromPod(svc *api.Service, servicePort *api.ServicePort) (int32, error) {
 	pods, err := lbc.podLister.Pods(svc.Namespace).List(labels.Set(svc.Spec.Selector).AsSelector())
@@ -1088,7 +2566,11 @@ func (lbc *LoadBalancerController) Run() {
 	<-ready
 
 	go wait.Until(lbc.worker, time.Second, lbc.stopCh)
+	go lbc.reloadWorker()
 	go lbc.syncIngress(lbc.stopCh)
+	if lbc.fullResyncPeriod > 0 {
+		go lbc.fullResync(lbc.stopCh)
+	}
 
 	<-lbc.stopCh
 
@@ -1097,6 +2579,21 @@ func (lbc *LoadBalancerController) Run() {
 	lbc.syncQueue.ShutDown()
 }
 
+// fullResync enqueues syncKey every lbc.fullResyncPeriod until stopCh becomes readable.  The cached upstreams are invalidated, so
+// that the whole configuration is recomputed from the cached objects.
+func (lbc *LoadBalancerController) fullResync(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(lbc.fullResyncPeriod):
+		}
+
+		glog.V(4).Infof("Full resync")
+		lbc.enqueue(syncKey)
+	}
+}
+
 // waitForControllerToSync waits for controllers to sync their caches
 func (lbc *LoadBalancerController) waitForControllerToSync(ready chan<- struct{}) {
 Loop:
@@ -1115,52 +2612,91 @@ Loop:
 	close(ready)
 }
 
-func (lbc *LoadBalancerController) retryOrForget(key interface{}, requeue bool) {
-	if requeue {
-		lbc.syncQueue.Add(key)
+// retryOrForget requeues key with exponential backoff if err is not nil.  If the number of retries reaches syncMaxRetries, it records
+// an event, and gives up.  If err is nil, the backoff for key is reset.
+func (lbc *LoadBalancerController) retryOrForget(key interface{}, err error) {
+	if err == nil {
+		lbc.syncQueue.Forget(key)
+		return
+	}
+
+	glog.Error(err)
+
+	if lbc.syncMaxRetries > 0 && lbc.syncQueue.NumRequeues(key) >= lbc.syncMaxRetries {
+		lbc.recorder.Eventf(lbc.podReference(), api.EventTypeWarning, "SyncFailed", "Giving up sync after %v retries: %v",
+			lbc.syncMaxRetries, err)
+		lbc.syncQueue.Forget(key)
+		return
 	}
+
+	lbc.syncQueue.AddRateLimited(key)
 }
 
 // validateIngressClass checks whether this controller should process ing or not.  If ing has "kubernetes.io/ingress.class" annotation, its
-// value should be empty or "nghttpx".
+// value should be "nghttpx".  If it is empty or missing, ing is processed only if lbc.watchWithoutClass is true.
 func (lbc *LoadBalancerController) validateIngressClass(ing *extensions.Ingress) bool {
 	switch ingressAnnotation(ing.ObjectMeta.Annotations).getIngressClass() {
-	case "", lbc.ingressClass:
+	case "":
+		return lbc.watchWithoutClass
+	case lbc.ingressClass:
 		return true
 	default:
 		return false
 	}
 }
 
+// ingressServed returns true if this controller should process ing, and ing is not disabled by annotation.  The disabled Ingress is
+// not served, and does not make the objects it refers to referenced.
+func (lbc *LoadBalancerController) ingressServed(ing *extensions.Ingress) bool {
+	return lbc.validateIngressClass(ing) && !ingressAnnotation(ing.ObjectMeta.Annotations).getDisabled()
+}
+
 // syncIngress udpates Ingress resource status.
 func (lbc *LoadBalancerController) syncIngress(stopCh <-chan struct{}) {
 	for {
+		interval := time.Duration(float64(30*time.Second) * (rand.Float64() + 1))
 		if err := lbc.getNodeIPAndUpdateIngress(); err != nil {
 			glog.Errorf("Could not update Ingress status: %v", err)
+			if err == errNoPublishServiceAddress {
+				interval = publishServiceRetryPeriod
+			}
 		}
 
 		select {
 		case <-stopCh:
-			if err := lbc.removeAddressFromLoadBalancerIngress(); err != nil {
-				glog.Error(err)
+			// The address of published Service is shared by all controllers, and must not be removed by one of them.
+			if lbc.publishService == "" {
+				if err := lbc.removeAddressFromLoadBalancerIngress(); err != nil {
+					glog.Error(err)
+				}
 			}
 			return
-		case <-time.After(time.Duration(float64(30*time.Second) * (rand.Float64() + 1))):
+		case <-time.After(interval):
 		}
 	}
 }
 
-// getNodeIPAndUpdateIngress gets node IP where Ingress controller is running, and updates Ingress Status with them.
+// getNodeIPAndUpdateIngress gets node IP where Ingress controller is running, and updates Ingress Status with them.  If
+// publishService is not empty, the LoadBalancer status of the Service is used instead.
 func (lbc *LoadBalancerController) getNodeIPAndUpdateIngress() error {
-	thisPod, err := lbc.getThisPod()
-	if err != nil {
-		return err
-	}
+	var lbIngs []api.LoadBalancerIngress
+	if lbc.publishService != "" {
+		var err error
+		lbIngs, err = lbc.getPublishServiceLoadBalancerIngress()
+		if err != nil {
+			return err
+		}
+	} else {
+		thisPod, err := lbc.getThisPod()
+		if err != nil {
+			return err
+		}
 
-	selector := labels.Set(thisPod.Labels).AsSelector()
-	lbIngs, err := lbc.getLoadBalancerIngress(selector)
-	if err != nil {
-		return fmt.Errorf("Could not get Node IP of Ingress controller: %v", err)
+		selector := labels.Set(thisPod.Labels).AsSelector()
+		lbIngs, err = lbc.getLoadBalancerIngress(selector)
+		if err != nil {
+			return fmt.Errorf("Could not get Node IP of Ingress controller: %v", err)
+		}
 	}
 
 	sortLoadBalancerIngress(lbIngs)
@@ -1168,6 +2704,27 @@ func (lbc *LoadBalancerController) getNodeIPAndUpdateIngress() error {
 	return lbc.updateIngressStatus(uniqLoadBalancerIngress(lbIngs))
 }
 
+// getPublishServiceLoadBalancerIngress returns a copy of LoadBalancer status of publishService.  It returns
+// errNoPublishServiceAddress if the Service has not been assigned an address yet.
+func (lbc *LoadBalancerController) getPublishServiceLoadBalancerIngress() ([]api.LoadBalancerIngress, error) {
+	obj, exists, err := lbc.svcLister.GetByKey(lbc.publishService)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get Service %v from lister: %v", lbc.publishService, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("Service %v not found", lbc.publishService)
+	}
+	svc := obj.(*api.Service)
+	if len(svc.Status.LoadBalancer.Ingress) == 0 {
+		return nil, errNoPublishServiceAddress
+	}
+
+	lbIngs := make([]api.LoadBalancerIngress, len(svc.Status.LoadBalancer.Ingress))
+	copy(lbIngs, svc.Status.LoadBalancer.Ingress)
+
+	return lbIngs, nil
+}
+
 // getThisPod returns this controller's pod.
 func (lbc *LoadBalancerController) getThisPod() (*api.Pod, error) {
 	pod, err := lbc.podLister.Pods(lbc.podInfo.PodNamespace).Get(lbc.podInfo.PodName)
@@ -1196,18 +2753,28 @@ func (lbc *LoadBalancerController) updateIngressStatus(lbIngs []api.LoadBalancer
 			continue
 		}
 
+		ingLBIngs := lbIngs
+		// The disabled Ingress is not served, and should not advertise any address.
+		if ingressAnnotation(ing.ObjectMeta.Annotations).getDisabled() {
+			ingLBIngs = nil
+		}
+
 		// Just pass ing.Status.LoadBalancerIngress.Ingress without sorting them.  This is OK since we write sorted
 		// LoadBalancerIngress array, and will eventually get sorted one.
-		if loadBalancerIngressesIPEqual(ing.Status.LoadBalancer.Ingress, lbIngs) {
+		if loadBalancerIngressesIPEqual(ing.Status.LoadBalancer.Ingress, ingLBIngs) {
 			continue
 		}
 
-		glog.V(4).Infof("Update Ingress %v/%v .Status.LoadBalancer.Ingress to %q", ing.Namespace, ing.Name, lbIngs)
+		glog.V(4).Infof("Update Ingress %v/%v .Status.LoadBalancer.Ingress to %q", ing.Namespace, ing.Name, ingLBIngs)
 
 		newIng := *ing
-		newIng.Status.LoadBalancer.Ingress = lbIngs
+		newIng.Status.LoadBalancer.Ingress = ingLBIngs
 
 		if _, err := lbc.clientset.Extensions().Ingresses(ing.Namespace).UpdateStatus(&newIng); err != nil {
+			if errors.IsNotFound(err) {
+				glog.V(4).Infof("Ingress %v/%v has been deleted", ing.Namespace, ing.Name)
+				continue
+			}
 			glog.Errorf("Could not update Ingress %v/%v status: %v", ing.Namespace, ing.Name, err)
 		}
 	}
@@ -1225,57 +2792,108 @@ func (lbc *LoadBalancerController) getLoadBalancerIngress(selector labels.Select
 	var lbIngs []api.LoadBalancerIngress
 
 	for _, pod := range pods {
-		externalIP, err := lbc.getPodAddress(pod)
+		addrs, err := lbc.getPodAddresses(pod)
 		if err != nil {
 			glog.Error(err)
 			continue
 		}
 
-		lbIng := api.LoadBalancerIngress{}
-		// This is really a messy specification.
-		if net.ParseIP(externalIP) != nil {
-			lbIng.IP = externalIP
-		} else {
-			lbIng.Hostname = externalIP
+		for _, addr := range addrs {
+			lbIng := api.LoadBalancerIngress{}
+			// This is really a messy specification.
+			if net.ParseIP(addr) != nil {
+				lbIng.IP = addr
+			} else {
+				lbIng.Hostname = addr
+			}
+			lbIngs = append(lbIngs, lbIng)
 		}
-		lbIngs = append(lbIngs, lbIng)
 	}
 
 	return lbIngs, nil
 }
 
-// getPodAddress returns pod's address.  It prefers external IP.  It may return internal IP if configuration allows it.
-func (lbc *LoadBalancerController) getPodAddress(pod *api.Pod) (string, error) {
+// getPodAddresses returns pod's addresses.  It returns all external addresses of the Node so that both IPv4 and IPv6 addresses are
+// published on dual-stack cluster.  If Node has no external address, it returns internal addresses if configuration allows it.  If
+// addressTypes is given, it returns all addresses of the first type in it which Node has instead.  IP addresses are returned in
+// canonical form.
+func (lbc *LoadBalancerController) getPodAddresses(pod *api.Pod) ([]string, error) {
 	var node *api.Node
 	if obj, exists, err := lbc.nodeLister.GetByKey(pod.Spec.NodeName); err != nil {
-		return "", fmt.Errorf("Could not get Node %v for Pod %v/%v from lister: %v", pod.Spec.NodeName, pod.Namespace, pod.Name, err)
+		return nil, fmt.Errorf("Could not get Node %v for Pod %v/%v from lister: %v", pod.Spec.NodeName, pod.Namespace, pod.Name, err)
 	} else if !exists {
-		return "", fmt.Errorf("Node %v for Pod %v/%v has been deleted", pod.Spec.NodeName, pod.Namespace, pod.Name)
+		return nil, fmt.Errorf("Node %v for Pod %v/%v has been deleted", pod.Spec.NodeName, pod.Namespace, pod.Name)
 	} else {
 		node = obj.(*api.Node)
 	}
-	var externalIP string
+
+	if len(lbc.addressTypes) > 0 {
+		for _, addressType := range lbc.addressTypes {
+			var addrs []string
+			for i := range node.Status.Addresses {
+				address := &node.Status.Addresses[i]
+				if address.Type == addressType && address.Address != "" {
+					addrs = append(addrs, canonicalAddress(address.Address))
+				}
+			}
+			if len(addrs) > 0 {
+				return addrs, nil
+			}
+		}
+		err := fmt.Errorf("Node %v has no address of type %v", node.Name, lbc.addressTypes)
+		lbc.warnNoNodeAddress(node, err.Error())
+		return nil, err
+	}
+
+	var externalAddrs, fallbackAddrs []string
+	hasInternalIP := false
 	for i, _ := range node.Status.Addresses {
 		address := &node.Status.Addresses[i]
-		if address.Type == api.NodeExternalIP {
-			if address.Address == "" {
-				continue
-			}
-			externalIP = address.Address
-			break
+		if address.Address == "" {
+			continue
+		}
+		switch {
+		case address.Type == api.NodeExternalIP:
+			externalAddrs = append(externalAddrs, canonicalAddress(address.Address))
+		case (lbc.allowInternalIP && address.Type == api.NodeInternalIP) || address.Type == api.NodeLegacyHostIP:
+			fallbackAddrs = append(fallbackAddrs, canonicalAddress(address.Address))
+		case address.Type == api.NodeInternalIP:
+			hasInternalIP = true
 		}
+	}
 
-		if externalIP == "" && ((lbc.allowInternalIP && address.Type == api.NodeInternalIP) || address.Type == api.NodeLegacyHostIP) {
-			externalIP = address.Address
-			// Continue to the next iteration because we may encounter api.NodeExternalIP later.
+	if len(externalAddrs) > 0 {
+		return externalAddrs, nil
+	}
+
+	if len(fallbackAddrs) == 0 {
+		if hasInternalIP {
+			lbc.warnNoNodeAddress(node, fmt.Sprintf("Node %v has no external IP, and its internal IP is not used.  Give "+
+				"--allow-internal-ip or --address-type=InternalIP flag to publish it", node.Name))
+		} else {
+			lbc.warnNoNodeAddress(node, fmt.Sprintf("Node %v has no external IP", node.Name))
 		}
+		return nil, fmt.Errorf("Node %v has no external IP", node.Name)
 	}
 
-	if externalIP == "" {
-		return "", fmt.Errorf("Node %v has no external IP", node.Name)
+	return fallbackAddrs, nil
+}
+
+// warnNoNodeAddress logs msg, and records it as Warning event for node.  It does nothing if it has already been called for node.
+func (lbc *LoadBalancerController) warnNoNodeAddress(node *api.Node, msg string) {
+	lbc.noNodeAddressWarnedMu.Lock()
+	defer lbc.noNodeAddressWarnedMu.Unlock()
+
+	if lbc.noNodeAddressWarned[node.Name] {
+		return
+	}
+	if lbc.noNodeAddressWarned == nil {
+		lbc.noNodeAddressWarned = make(map[string]bool)
 	}
+	lbc.noNodeAddressWarned[node.Name] = true
 
-	return externalIP, nil
+	glog.Warning(msg)
+	lbc.recorder.Event(node, api.EventTypeWarning, "NoNodeAddress", msg)
 }
 
 // removeAddressFromLoadBalancerIngress removes this address from all Ingress.Status.LoadBalancer.Ingress.
@@ -1287,7 +2905,7 @@ func (lbc *LoadBalancerController) removeAddressFromLoadBalancerIngress() error
 		return fmt.Errorf("Could not remove address from LoadBalancerIngress: %v", err)
 	}
 
-	addr, err := lbc.getPodAddress(thisPod)
+	addrs, err := lbc.getPodAddresses(thisPod)
 	if err != nil {
 		return fmt.Errorf("Could not remove address from LoadBalancerIngress: %v", err)
 	}
@@ -1304,27 +2922,35 @@ func (lbc *LoadBalancerController) removeAddressFromLoadBalancerIngress() error
 
 		// Time may be short because we should do all the work during Pod graceful shut down period.
 		if err := wait.Poll(250*time.Millisecond, 2*time.Second, func() (bool, error) {
-			ing, err := lbc.clientset.Extensions().Ingresses(ing.Namespace).Get(ing.Name)
+			curIng, err := lbc.clientset.Extensions().Ingresses(ing.Namespace).Get(ing.Name)
 			if err != nil {
 				if errors.IsNotFound(err) {
-					return false, err
+					// The Ingress has been deleted, and there is no status to clean up.
+					glog.V(4).Infof("Ingress %v/%v has been deleted", ing.Namespace, ing.Name)
+					return true, nil
 				}
 				glog.Errorf("Could not get Ingress %v/%v: %v", ing.Namespace, ing.Name, err)
 				return false, nil
 			}
 
-			numOld := len(ing.Status.LoadBalancer.Ingress)
+			numOld := len(curIng.Status.LoadBalancer.Ingress)
 			if numOld == 0 {
 				return true, nil
 			}
 
-			ing.Status.LoadBalancer.Ingress = removeAddressFromLoadBalancerIngress(ing.Status.LoadBalancer.Ingress, addr)
+			for _, addr := range addrs {
+				curIng.Status.LoadBalancer.Ingress = removeAddressFromLoadBalancerIngress(curIng.Status.LoadBalancer.Ingress, addr)
+			}
 
-			if numOld == len(ing.Status.LoadBalancer.Ingress) {
+			if numOld == len(curIng.Status.LoadBalancer.Ingress) {
 				return true, nil
 			}
 
-			if _, err := lbc.clientset.Extensions().Ingresses(ing.Namespace).UpdateStatus(ing); err != nil {
+			if _, err := lbc.clientset.Extensions().Ingresses(ing.Namespace).UpdateStatus(curIng); err != nil {
+				if errors.IsNotFound(err) {
+					glog.V(4).Infof("Ingress %v/%v has been deleted", ing.Namespace, ing.Name)
+					return true, nil
+				}
 				glog.Errorf("Could not update Ingress %v/%v: %v", ing.Namespace, ing.Name, err)
 				return false, nil
 			}
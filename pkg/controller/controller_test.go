@@ -25,9 +25,19 @@ limitations under the License.
 package controller
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/pem"
 	"fmt"
+	"math/big"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -35,12 +45,16 @@ import (
 	"k8s.io/kubernetes/pkg/api/unversioned"
 	"k8s.io/kubernetes/pkg/apis/extensions"
 	"k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset/fake"
+	"k8s.io/kubernetes/pkg/client/record"
 	"k8s.io/kubernetes/pkg/client/testing/core"
 	"k8s.io/kubernetes/pkg/controller"
 	"k8s.io/kubernetes/pkg/labels"
 	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/util/flowcontrol"
 	"k8s.io/kubernetes/pkg/util/intstr"
+	"k8s.io/kubernetes/pkg/util/wait"
 
+	"github.com/zlabjp/nghttpx-ingress-lb/pkg/metrics"
 	"github.com/zlabjp/nghttpx-ingress-lb/pkg/nghttpx"
 )
 
@@ -105,9 +119,14 @@ func (f *fixture) prepare() {
 		WatchNamespace:        defaultIngNamespace,
 		NghttpxConfigMap:      fmt.Sprintf("%v/%v", defaultConfigMapNamespace, defaultConfigMapName),
 		IngressClass:          defaultIngressClass,
+		WatchWithoutClass:     true,
+		RedirectWithoutCert:   true,
+		StrictPathValidation:  true,
 	}
 	f.lbc = NewLoadBalancerController(f.clientset, newFakeManager(), &config, &defaultRuntimeInfo)
 	f.lbc.controllersInSyncHandler = func() bool { return true }
+	// Use FakeRecorder, so that events are not sent to clientset asynchronously.
+	f.lbc.recorder = record.NewFakeRecorder(100)
 }
 
 func (f *fixture) run(ingKey string) {
@@ -206,6 +225,10 @@ func (fm *fakeManager) CheckAndReload(ingConfig *nghttpx.IngressConfig) (bool, e
 	return fm.checkAndReloadHandler(ingConfig)
 }
 
+func (fm *fakeManager) Supervised() bool {
+	return true
+}
+
 func (fm *fakeManager) defaultCheckAndReload(ingConfig *nghttpx.IngressConfig) (bool, error) {
 	fm.ingConfig = ingConfig
 	return true, nil
@@ -436,7 +459,7 @@ func TestSyncDefaultTLSSecretNotFound(t *testing.T) {
 	f.objects = append(f.objects, svc, eps)
 
 	f.prepare()
-	f.lbc.defaultTLSSecret = "kube-system/default-tls"
+	f.lbc.defaultTLSSecrets = []string{"kube-system/default-tls"}
 	f.runShouldFail(getKey(svc, t))
 }
 
@@ -456,7 +479,7 @@ func TestSyncDefaultSecret(t *testing.T) {
 	f.objects = append(f.objects, tlsSecret, svc, eps)
 
 	f.prepare()
-	f.lbc.defaultTLSSecret = fmt.Sprintf("%v/%v", tlsSecret.Namespace, tlsSecret.Name)
+	f.lbc.defaultTLSSecrets = []string{fmt.Sprintf("%v/%v", tlsSecret.Namespace, tlsSecret.Name)}
 	f.run(getKey(svc, t))
 
 	fm := f.lbc.nghttpx.(*fakeManager)
@@ -485,6 +508,121 @@ func TestSyncDefaultSecret(t *testing.T) {
 	}
 }
 
+// TestSyncMultipleDefaultSecrets verifies that the first default TLS Secret becomes the default certificate, and the others are
+// added as SNI certificates.
+func TestSyncMultipleDefaultSecrets(t *testing.T) {
+	f := newFixture(t)
+
+	dCrt, _ := base64.StdEncoding.DecodeString(tlsCrt)
+	dKey, _ := base64.StdEncoding.DecodeString(tlsKey)
+	tlsSecret1 := newTLSSecret("kube-system", "default-tls", dCrt, dKey)
+	tlsSecret2 := newTLSSecret("kube-system", "other-tls", dCrt, dKey)
+	svc, eps := newDefaultBackend()
+
+	f.secretStore = append(f.secretStore, tlsSecret1, tlsSecret2)
+	f.svcStore = append(f.svcStore, svc)
+	f.epStore = append(f.epStore, eps)
+
+	f.objects = append(f.objects, tlsSecret1, tlsSecret2, svc, eps)
+
+	f.prepare()
+	f.lbc.defaultTLSSecrets = []string{
+		fmt.Sprintf("%v/%v", tlsSecret1.Namespace, tlsSecret1.Name),
+		fmt.Sprintf("%v/%v", tlsSecret2.Namespace, tlsSecret2.Name),
+	}
+	f.run(getKey(svc, t))
+
+	fm := f.lbc.nghttpx.(*fakeManager)
+	ingConfig := fm.ingConfig
+
+	if got, want := ingConfig.TLS, true; got != want {
+		t.Errorf("ingConfig.TLS = %v, want %v", got, want)
+	}
+	if got, want := ingConfig.DefaultTLSCred.Key.Path, nghttpx.CreateTLSKeyPath(nghttpx.TLSCredPrefix(tlsSecret1)); got != want {
+		t.Errorf("ingConfig.DefaultTLSCred.Key.Path = %v, want %v", got, want)
+	}
+	if got, want := len(ingConfig.SubTLSCred), 1; got != want {
+		t.Fatalf("len(ingConfig.SubTLSCred) = %v, want %v", got, want)
+	}
+	if got, want := ingConfig.SubTLSCred[0].Key.Path, nghttpx.CreateTLSKeyPath(nghttpx.TLSCredPrefix(tlsSecret2)); got != want {
+		t.Errorf("ingConfig.SubTLSCred[0].Key.Path = %v, want %v", got, want)
+	}
+	if got, want := ingConfig.Upstreams[0].RedirectIfNotTLS, true; got != want {
+		t.Errorf("ingConfig.Upstreams[0].RedirectIfNotTLS = %v, want %v", got, want)
+	}
+
+	if !f.lbc.secretReferenced(tlsSecret2.Namespace, tlsSecret2.Name) {
+		t.Errorf("f.lbc.secretReferenced(%q, %q) = false, want true", tlsSecret2.Namespace, tlsSecret2.Name)
+	}
+}
+
+// TestSyncBackendTLSCASecret verifies that CA bundle to verify backend server certificate is loaded from the Secret, and sync fails
+// if the Secret is not found.
+func TestSyncBackendTLSCASecret(t *testing.T) {
+	dCrt, _ := base64.StdEncoding.DecodeString(tlsCrt)
+	caSecret := &api.Secret{
+		ObjectMeta: api.ObjectMeta{
+			Name:      "backend-ca",
+			Namespace: "kube-system",
+		},
+		Data: map[string][]byte{
+			caCertKey: dCrt,
+		},
+	}
+
+	tests := []struct {
+		backendTLSCASecret string
+		wantErr            bool
+	}{
+		{},
+		{backendTLSCASecret: "kube-system/backend-ca"},
+		{backendTLSCASecret: "kube-system/not-found", wantErr: true},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		f.secretStore = append(f.secretStore, caSecret)
+		f.svcStore = append(f.svcStore, svc)
+		f.epStore = append(f.epStore, eps)
+
+		f.objects = append(f.objects, caSecret, svc, eps)
+
+		f.prepare()
+		f.lbc.backendTLSCASecret = tt.backendTLSCASecret
+
+		if tt.wantErr {
+			f.runShouldFail(getKey(svc, t))
+			continue
+		}
+
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		if tt.backendTLSCASecret == "" {
+			if ingConfig.BackendTLSCACert != nil {
+				t.Errorf("#%v: ingConfig.BackendTLSCACert = %+v, want nil", i, ingConfig.BackendTLSCACert)
+			}
+			continue
+		}
+
+		if ingConfig.BackendTLSCACert == nil {
+			t.Errorf("#%v: ingConfig.BackendTLSCACert = nil, want non-nil", i)
+			continue
+		}
+		if got, want := ingConfig.BackendTLSCACert.Checksum, nghttpx.Checksum(dCrt); got != want {
+			t.Errorf("#%v: ingConfig.BackendTLSCACert.Checksum = %v, want %v", i, got, want)
+		}
+		if !f.lbc.secretReferenced(caSecret.Namespace, caSecret.Name) {
+			t.Errorf("#%v: f.lbc.secretReferenced(%q, %q) = false, want true", i, caSecret.Namespace, caSecret.Name)
+		}
+	}
+}
+
 // TestSyncDupDefaultSecret verifies that duplicated default TLS secret is removed.
 func TestSyncDupDefaultSecret(t *testing.T) {
 	f := newFixture(t)
@@ -505,7 +643,7 @@ func TestSyncDupDefaultSecret(t *testing.T) {
 	f.objects = append(f.objects, tlsSecret, svc, eps, bs1, be1, ing1)
 
 	f.prepare()
-	f.lbc.defaultTLSSecret = fmt.Sprintf("%v/%v", tlsSecret.Namespace, tlsSecret.Name)
+	f.lbc.defaultTLSSecrets = []string{fmt.Sprintf("%v/%v", tlsSecret.Namespace, tlsSecret.Name)}
 	f.run(getKey(svc, t))
 
 	fm := f.lbc.nghttpx.(*fakeManager)
@@ -657,6 +795,291 @@ func TestSyncIngressClass(t *testing.T) {
 	}
 }
 
+// TestSyncWatchWithoutClass verifies that Ingress without Ingress class is processed only if watchWithoutClass is true.
+func TestSyncWatchWithoutClass(t *testing.T) {
+	tests := []struct {
+		watchWithoutClass bool
+		wantUpstreams     int
+	}{
+		{watchWithoutClass: true, wantUpstreams: 3},
+		{wantUpstreams: 2},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+		ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+
+		bs2, be2 := newBackend(api.NamespaceDefault, "bravo", []string{"192.168.10.2"})
+		ing2 := newIngress(bs2.Namespace, "bravo-ing", bs2.Name, bs2.Spec.Ports[0].TargetPort.String())
+		delete(ing2.Annotations, ingressClassKey)
+
+		f.svcStore = append(f.svcStore, svc, bs1, bs2)
+		f.epStore = append(f.epStore, eps, be1, be2)
+		f.ingStore = append(f.ingStore, ing1, ing2)
+
+		f.objects = append(f.objects, svc, eps, bs1, be1, ing1, bs2, be2, ing2)
+
+		f.prepare()
+		f.lbc.watchWithoutClass = tt.watchWithoutClass
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		if got, want := len(ingConfig.Upstreams), tt.wantUpstreams; got != want {
+			t.Errorf("#%v: len(ingConfig.Upstreams) = %v, want %v", i, got, want)
+		}
+	}
+}
+
+// TestSyncDisabledIngress verifies that the disabled Ingress produces no upstreams, and its TLS Secret is not referenced.
+func TestSyncDisabledIngress(t *testing.T) {
+	f := newFixture(t)
+
+	dCrt, _ := base64.StdEncoding.DecodeString(tlsCrt)
+	dKey, _ := base64.StdEncoding.DecodeString(tlsKey)
+	tlsSecret := newTLSSecret(api.NamespaceDefault, "alpha-tls", dCrt, dKey)
+
+	svc, eps := newDefaultBackend()
+
+	bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+	ing1 := newIngressTLS(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String(), tlsSecret.Name)
+	ing1.Annotations[disabledKey] = "true"
+
+	f.secretStore = append(f.secretStore, tlsSecret)
+	f.svcStore = append(f.svcStore, svc, bs1)
+	f.epStore = append(f.epStore, eps, be1)
+	f.ingStore = append(f.ingStore, ing1)
+
+	f.objects = append(f.objects, svc, eps, bs1, be1, ing1, tlsSecret)
+
+	f.prepare()
+	f.run(getKey(svc, t))
+
+	fm := f.lbc.nghttpx.(*fakeManager)
+	ingConfig := fm.ingConfig
+
+	if got, want := len(ingConfig.Upstreams), 1; got != want {
+		t.Errorf("len(ingConfig.Upstreams) = %v, want %v", got, want)
+	}
+	if got, want := ingConfig.Upstreams[0].Path, ""; got != want {
+		t.Errorf("ingConfig.Upstreams[0].Path = %v, want %v", got, want)
+	}
+	if got, want := ingConfig.TLS, false; got != want {
+		t.Errorf("ingConfig.TLS = %v, want %v", got, want)
+	}
+	if got, want := f.lbc.secretReferenced(tlsSecret.Namespace, tlsSecret.Name), false; got != want {
+		t.Errorf("f.lbc.secretReferenced(%q, %q) = %v, want %v", tlsSecret.Namespace, tlsSecret.Name, got, want)
+	}
+}
+
+// TestSyncMissingCertificate verifies that Event is recorded for the host which is redirected to https URI without matching TLS
+// certificate, and the redirect is skipped if redirectWithoutCert is false.
+func TestSyncMissingCertificate(t *testing.T) {
+	tests := []struct {
+		redirectWithoutCert bool
+		wantEvent           string
+	}{
+		{
+			redirectWithoutCert: true,
+			wantEvent:           "Warning MissingCertificate Host alpha-ing.default.test is redirected to https URI, but no TLS certificate matches it; the default certificate is served",
+		},
+		{
+			wantEvent: "Warning MissingCertificate Host alpha-ing.default.test is not redirected to https URI because no TLS certificate matches it",
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		dCrt, _ := base64.StdEncoding.DecodeString(tlsCrt)
+		dKey, _ := base64.StdEncoding.DecodeString(tlsKey)
+		tlsSecret := newTLSSecret("kube-system", "default-tls", dCrt, dKey)
+
+		svc, eps := newDefaultBackend()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+		ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+		// The certificate has "echoheaders" as its common name.
+		ing2 := newIngress(bs1.Namespace, "bravo-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+		ing2.Spec.Rules[0].Host = "echoheaders"
+
+		f.secretStore = append(f.secretStore, tlsSecret)
+		f.svcStore = append(f.svcStore, svc, bs1)
+		f.epStore = append(f.epStore, eps, be1)
+		f.ingStore = append(f.ingStore, ing1, ing2)
+
+		f.objects = append(f.objects, tlsSecret, svc, eps, bs1, be1, ing1, ing2)
+
+		f.prepare()
+		f.lbc.defaultTLSSecrets = []string{fmt.Sprintf("%v/%v", tlsSecret.Namespace, tlsSecret.Name)}
+		f.lbc.redirectWithoutCert = tt.redirectWithoutCert
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		for _, ups := range ingConfig.Upstreams {
+			var want bool
+			switch ups.Host {
+			case ing1.Spec.Rules[0].Host:
+				want = tt.redirectWithoutCert
+			case ing2.Spec.Rules[0].Host:
+				want = true
+			default:
+				continue
+			}
+			if got := ups.RedirectIfNotTLS; got != want {
+				t.Errorf("#%v: ups.RedirectIfNotTLS for host %v = %v, want %v", i, ups.Host, got, want)
+			}
+		}
+
+		recorder := f.lbc.recorder.(*record.FakeRecorder)
+		select {
+		case e := <-recorder.Events:
+			if got, want := e, tt.wantEvent; got != want {
+				t.Errorf("#%v: event = %q, want %q", i, got, want)
+			}
+		default:
+			t.Errorf("#%v: No event was recorded", i)
+		}
+		select {
+		case e := <-recorder.Events:
+			t.Errorf("#%v: Unexpected event %v", i, e)
+		default:
+		}
+	}
+}
+
+// TestSyncEmptyUpstreamBehavior verifies that the rule whose Service has no active endpoints is dropped, or responds with 503,
+// depending on emptyUpstreamBehavior.
+func TestSyncEmptyUpstreamBehavior(t *testing.T) {
+	tests := []struct {
+		emptyUpstreamBehavior string
+		allowHTTP             string
+		wantUpstream          bool
+	}{
+		{emptyUpstreamBehavior: EmptyUpstreamBehaviorDrop},
+		{emptyUpstreamBehavior: EmptyUpstreamBehaviorServiceUnavailable, wantUpstream: true},
+		{emptyUpstreamBehavior: EmptyUpstreamBehaviorServiceUnavailable, allowHTTP: "false", wantUpstream: true},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", nil)
+		ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+		if tt.allowHTTP != "" {
+			ing1.Annotations[allowHTTPKey] = tt.allowHTTP
+		}
+
+		f.svcStore = append(f.svcStore, svc, bs1)
+		f.epStore = append(f.epStore, eps, be1)
+		f.ingStore = append(f.ingStore, ing1)
+
+		f.objects = append(f.objects, svc, eps, bs1, be1, ing1)
+
+		f.prepare()
+		f.lbc.emptyUpstreamBehavior = tt.emptyUpstreamBehavior
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		var ups *nghttpx.Upstream
+		for _, u := range ingConfig.Upstreams {
+			if u.Host == ing1.Spec.Rules[0].Host {
+				ups = u
+				break
+			}
+		}
+
+		if !tt.wantUpstream {
+			if ups != nil {
+				t.Errorf("#%v: Upstream for host %v was found", i, ing1.Spec.Rules[0].Host)
+			}
+			continue
+		}
+
+		if ups == nil {
+			t.Errorf("#%v: Upstream for host %v was not found", i, ing1.Spec.Rules[0].Host)
+			continue
+		}
+		if got, want := ups.Backends, []nghttpx.UpstreamServer{nghttpx.NewDefaultServer()}; !reflect.DeepEqual(got, want) {
+			t.Errorf("#%v: ups.Backends = %+v, want %+v", i, got, want)
+		}
+		if ups.Mruby == nil {
+			t.Errorf("#%v: ups.Mruby = nil, want non-nil", i)
+			continue
+		}
+		// The cleartext HTTP requests are still rejected before 503 is returned.
+		want := string(nghttpx.CreatePathMruby(&nghttpx.PathMruby{
+			DenyPlaintext:  tt.allowHTTP == "false",
+			StaticResponse: &nghttpx.StaticResponse{StatusCode: 503, Body: []byte("Service Unavailable")},
+		}))
+		if got := string(ups.Mruby.Content); got != want {
+			t.Errorf("#%v: ups.Mruby.Content = %q, want %q", i, got, want)
+		}
+	}
+}
+
+// TestSyncClientCertHeaders verifies that sync sets the mruby script which sends TLS client certificate information to backend if
+// clientCertHeaders is given.
+func TestSyncClientCertHeaders(t *testing.T) {
+	headers := &nghttpx.ClientCertHeaders{
+		Subject:     "X-Subject",
+		Fingerprint: "X-Fingerprint",
+		Verify:      "X-Verify",
+	}
+
+	tests := []struct {
+		clientCertHeaders *nghttpx.ClientCertHeaders
+		wantMruby         bool
+	}{
+		{},
+		{clientCertHeaders: headers, wantMruby: true},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		f.svcStore = append(f.svcStore, svc)
+		f.epStore = append(f.epStore, eps)
+
+		f.objects = append(f.objects, svc, eps)
+
+		f.prepare()
+		f.lbc.clientCertHeaders = tt.clientCertHeaders
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		if !tt.wantMruby {
+			if ingConfig.Mruby != nil {
+				t.Errorf("#%v: ingConfig.Mruby = %+v, want nil", i, ingConfig.Mruby)
+			}
+			continue
+		}
+
+		if ingConfig.Mruby == nil {
+			t.Errorf("#%v: ingConfig.Mruby = nil, want non-nil", i)
+			continue
+		}
+		if got, want := string(ingConfig.Mruby.Content), string(nghttpx.CreateClientCertHeadersMruby(*headers)); got != want {
+			t.Errorf("#%v: ingConfig.Mruby.Content = %q, want %q", i, got, want)
+		}
+	}
+}
+
 // newIngPod creates Ingress controller pod.
 func newIngPod(name, nodeName string) *api.Pod {
 	return &api.Pod{
@@ -735,105 +1158,2927 @@ func TestGetLoadBalancerIngress(t *testing.T) {
 	}
 }
 
-// TestUpdateIngressStatus verifies that Ingress resources are updated with the given lbIngs.
-func TestUpdateIngressStatus(t *testing.T) {
+// TestGetLoadBalancerIngressIPv6 verifies that IPv6 node address is reported as IP.
+func TestGetLoadBalancerIngressIPv6(t *testing.T) {
 	f := newFixture(t)
 
-	lbIngs := []api.LoadBalancerIngress{{IP: "192.168.0.1"}, {IP: "192.168.0.2"}}
-
-	ing1 := newIngress(api.NamespaceDefault, "delta-ing", "delta", "80")
-	ing3 := newIngress(api.NamespaceDefault, "foxtrot-ing", "foxtrot", "80")
-	ing3.Annotations[ingressClassKey] = "not-nghttpx"
-	ing4 := newIngress(api.NamespaceDefault, "golf-ing", "golf", "80")
-	ing4.Status.LoadBalancer.Ingress = lbIngs
-	ing2 := newIngress(api.NamespaceDefault, "echo-ing", "echo", "80")
-
-	f.ingStore = append(f.ingStore, ing1, ing2, ing3, ing4)
+	po := newIngPod(defaultRuntimeInfo.PodName, "alpha.test")
+	node := newNode("alpha.test", api.NodeAddress{Type: api.NodeExternalIP, Address: "2001:db8::1"})
 
-	f.objects = append(f.objects, ing1, ing2, ing3, ing4)
+	f.podStore = append(f.podStore, po)
+	f.nodeStore = append(f.nodeStore, node)
 
-	f.expectUpdateIngAction(ing1)
-	f.expectUpdateIngAction(ing2)
+	f.objects = append(f.objects, po, node)
 
 	f.prepare()
 	f.setupStore()
 
-	err := f.lbc.updateIngressStatus(lbIngs)
+	lbIngs, err := f.lbc.getLoadBalancerIngress(labels.Set(defaultIngPodLables).AsSelector())
 
 	f.verifyActions()
 
 	if err != nil {
-		t.Fatalf("f.lbc.updateIngressStatus(lbIngs) returned unexpected error %v", err)
+		t.Fatalf("f.lbc.getLoadBalancerIngress() returned unexpected error %v", err)
 	}
 
-	if updatedIng, err := f.clientset.Extensions().Ingresses(ing1.Namespace).Get(ing1.Name); err != nil {
-		t.Errorf("Could not get Ingress %v/%v: %v", ing1.Namespace, ing1.Name, err)
-	} else {
-		if got, want := updatedIng.Status.LoadBalancer.Ingress, lbIngs; !reflect.DeepEqual(got, want) {
-			t.Errorf("updatedIng.Status.LoadBalancer.Ingress = %+v, want %+v", got, want)
-		}
+	if got, want := lbIngs, []api.LoadBalancerIngress{{IP: "2001:db8::1"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lbIngs = %+v, want %+v", got, want)
 	}
-	if updatedIng, err := f.clientset.Extensions().Ingresses(ing2.Namespace).Get(ing2.Name); err != nil {
-		t.Errorf("Could not get Ingress %v/%v: %v", ing2.Namespace, ing2.Name, err)
-	} else {
-		if got, want := updatedIng.Status.LoadBalancer.Ingress, lbIngs; !reflect.DeepEqual(got, want) {
-			t.Errorf("updatedIng.Status.LoadBalancer.Ingress = %+v, want %+v", got, want)
+}
+
+// TestGetLoadBalancerIngressAddressType verifies that the addresses of the first type in addressTypes which Node has are
+// collected.
+func TestGetLoadBalancerIngressAddressType(t *testing.T) {
+	tests := []struct {
+		addressTypes []api.NodeAddressType
+		want         []api.LoadBalancerIngress
+	}{
+		{
+			want: []api.LoadBalancerIngress{{IP: "192.168.0.1"}},
+		},
+		{
+			addressTypes: []api.NodeAddressType{api.NodeInternalIP, api.NodeExternalIP},
+			want:         []api.LoadBalancerIngress{{IP: "10.0.0.1"}},
+		},
+		{
+			addressTypes: []api.NodeAddressType{api.NodeHostName},
+			want:         []api.LoadBalancerIngress{{Hostname: "alpha.example.com"}},
+		},
+		{
+			addressTypes: []api.NodeAddressType{api.NodeLegacyHostIP},
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		po := newIngPod(defaultRuntimeInfo.PodName, "alpha.test")
+		node := newNode("alpha.test",
+			api.NodeAddress{Type: api.NodeInternalIP, Address: "10.0.0.1"},
+			api.NodeAddress{Type: api.NodeExternalIP, Address: "192.168.0.1"},
+			api.NodeAddress{Type: api.NodeHostName, Address: "alpha.example.com"},
+		)
+
+		f.podStore = append(f.podStore, po)
+		f.nodeStore = append(f.nodeStore, node)
+
+		f.objects = append(f.objects, po, node)
+
+		f.prepare()
+		f.lbc.addressTypes = tt.addressTypes
+		f.setupStore()
+
+		lbIngs, err := f.lbc.getLoadBalancerIngress(labels.Set(defaultIngPodLables).AsSelector())
+
+		f.verifyActions()
+
+		if err != nil {
+			t.Fatalf("#%v: f.lbc.getLoadBalancerIngress() returned unexpected error %v", i, err)
+		}
+
+		if got, want := lbIngs, tt.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("#%v: lbIngs = %+v, want %+v", i, got, want)
 		}
 	}
 }
 
-// TestRemoveAddressFromLoadBalancerIngress verifies that removeAddressFromLoadBalancerIngress clears Ingress.Status.LoadBalancer.Ingress.
-func TestRemoveAddressFromLoadBalancerIngress(t *testing.T) {
+// TestGetLoadBalancerIngressNoExternalIP verifies that Warning event is recorded only once for Node which has only internal IP.
+func TestGetLoadBalancerIngressNoExternalIP(t *testing.T) {
 	f := newFixture(t)
 
 	po := newIngPod(defaultRuntimeInfo.PodName, "alpha.test")
-	node := newNode("alpha.test", api.NodeAddress{Type: api.NodeExternalIP, Address: "192.168.0.1"})
+	node := newNode("alpha.test", api.NodeAddress{Type: api.NodeInternalIP, Address: "10.0.0.1"})
 
-	lbIngs := []api.LoadBalancerIngress{{IP: "192.168.0.1"}, {IP: "192.168.0.2"}}
+	f.podStore = append(f.podStore, po)
+	f.nodeStore = append(f.nodeStore, node)
 
-	ing1 := newIngress(api.NamespaceDefault, "delta-ing", "delta", "80")
-	ing1.Status.LoadBalancer.Ingress = lbIngs
+	f.objects = append(f.objects, po, node)
 
-	ing2 := newIngress(api.NamespaceDefault, "echo-ing", "echo", "80")
-	ing2.Status.LoadBalancer.Ingress = lbIngs
+	f.prepare()
+	f.setupStore()
 
-	ing3 := newIngress(api.NamespaceDefault, "foxtrot-ing", "foxtrot", "80")
-	ing3.Annotations[ingressClassKey] = "not-nghttpx"
-	ing3.Status.LoadBalancer.Ingress = lbIngs
+	for i := 0; i < 2; i++ {
+		lbIngs, err := f.lbc.getLoadBalancerIngress(labels.Set(defaultIngPodLables).AsSelector())
+		if err != nil {
+			t.Fatalf("f.lbc.getLoadBalancerIngress() returned unexpected error %v", err)
+		}
+		if len(lbIngs) != 0 {
+			t.Errorf("lbIngs = %+v, want empty", lbIngs)
+		}
+	}
 
-	ing4 := newIngress(api.NamespaceDefault, "golf-ing", "golf", "80")
-	ing4.Status.LoadBalancer.Ingress = lbIngs[1:]
+	f.verifyActions()
 
-	f.podStore = append(f.podStore, po)
+	recorder := f.lbc.recorder.(*record.FakeRecorder)
+	select {
+	case e := <-recorder.Events:
+		if !strings.HasPrefix(e, api.EventTypeWarning+" NoNodeAddress ") || !strings.Contains(e, "--allow-internal-ip") {
+			t.Errorf("event = %q, want NoNodeAddress with a hint of --allow-internal-ip", e)
+		}
+	default:
+		t.Errorf("No event was recorded")
+	}
+	select {
+	case e := <-recorder.Events:
+		t.Errorf("Unexpected event %q", e)
+	default:
+	}
+}
+
+// TestGetLoadBalancerIngressDualStack verifies that all external addresses of Node are collected, and duplicates are removed across
+// address families.
+func TestGetLoadBalancerIngressDualStack(t *testing.T) {
+	f := newFixture(t)
+
+	po1 := newIngPod(defaultRuntimeInfo.PodName, "alpha.test")
+	po2 := newIngPod("bravo", "alpha.test")
+	node := newNode("alpha.test",
+		api.NodeAddress{Type: api.NodeInternalIP, Address: "10.0.0.1"},
+		api.NodeAddress{Type: api.NodeExternalIP, Address: "192.168.0.1"},
+		api.NodeAddress{Type: api.NodeExternalIP, Address: "2001:0db8::1"},
+		api.NodeAddress{Type: api.NodeExternalIP, Address: "::ffff:192.168.0.1"},
+	)
+
+	f.podStore = append(f.podStore, po1, po2)
 	f.nodeStore = append(f.nodeStore, node)
-	f.ingStore = append(f.ingStore, ing1, ing2, ing3, ing4)
 
-	f.objects = append(f.objects, po, node, ing1, ing2, ing3, ing4)
+	f.objects = append(f.objects, po1, po2, node)
 
 	f.prepare()
 	f.setupStore()
 
-	err := f.lbc.removeAddressFromLoadBalancerIngress()
+	lbIngs, err := f.lbc.getLoadBalancerIngress(labels.Set(defaultIngPodLables).AsSelector())
+
+	f.verifyActions()
 
 	if err != nil {
-		t.Fatalf("f.lbc.removeAddressFromLoadBalancerIngress() returned unexpected error %v", err)
+		t.Fatalf("f.lbc.getLoadBalancerIngress() returned unexpected error %v", err)
 	}
 
-	if updatedIng, err := f.lbc.clientset.Extensions().Ingresses(ing1.Namespace).Get(ing1.Name); err != nil {
-		t.Errorf("Could not get Ingress %v/%v: %v", ing1.Namespace, ing1.Name, err)
-	} else {
-		ans := []api.LoadBalancerIngress{{IP: "192.168.0.2"}}
-		if got, want := updatedIng.Status.LoadBalancer.Ingress, ans; !reflect.DeepEqual(got, want) {
-			t.Errorf("updatedIng.Status.LoadBalancer.Ingress = %+v, want %+v", got, want)
-		}
+	sortLoadBalancerIngress(lbIngs)
+	lbIngs = uniqLoadBalancerIngress(lbIngs)
+
+	ans := []api.LoadBalancerIngress{
+		{IP: "192.168.0.1"}, {IP: "2001:db8::1"},
 	}
 
-	if updatedIng, err := f.lbc.clientset.Extensions().Ingresses(ing4.Namespace).Get(ing4.Name); err != nil {
-		t.Errorf("Could not get Ingress %v/%v: %v", ing4.Namespace, ing4.Name, err)
-	} else {
-		ans := []api.LoadBalancerIngress{{IP: "192.168.0.2"}}
-		if got, want := updatedIng.Status.LoadBalancer.Ingress, ans; !reflect.DeepEqual(got, want) {
+	if got, want := lbIngs, ans; !reflect.DeepEqual(got, want) {
+		t.Errorf("lbIngs = %+v, want %+v", got, want)
+	}
+}
+
+// TestGetPublishServiceLoadBalancerIngress verifies that LoadBalancer status of the published Service is used.
+func TestGetPublishServiceLoadBalancerIngress(t *testing.T) {
+	tests := []struct {
+		lbIngs  []api.LoadBalancerIngress
+		wantErr error
+	}{
+		{
+			wantErr: errNoPublishServiceAddress,
+		},
+		{
+			lbIngs: []api.LoadBalancerIngress{{IP: "203.0.113.1"}, {Hostname: "lb.example.com"}},
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc := &api.Service{
+			ObjectMeta: api.ObjectMeta{
+				Name:      "nghttpx-ingress-lb",
+				Namespace: "kube-system",
+			},
+			Status: api.ServiceStatus{
+				LoadBalancer: api.LoadBalancerStatus{
+					Ingress: tt.lbIngs,
+				},
+			},
+		}
+
+		f.svcStore = append(f.svcStore, svc)
+
+		f.objects = append(f.objects, svc)
+
+		f.prepare()
+		f.lbc.publishService = "kube-system/nghttpx-ingress-lb"
+		f.setupStore()
+
+		lbIngs, err := f.lbc.getPublishServiceLoadBalancerIngress()
+
+		f.verifyActions()
+
+		if tt.wantErr != nil {
+			if err != tt.wantErr {
+				t.Errorf("#%v: f.lbc.getPublishServiceLoadBalancerIngress() returned error %v, want %v", i, err, tt.wantErr)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("#%v: f.lbc.getPublishServiceLoadBalancerIngress() returned unexpected error %v", i, err)
+			continue
+		}
+
+		if got, want := lbIngs, tt.lbIngs; !reflect.DeepEqual(got, want) {
+			t.Errorf("#%v: lbIngs = %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+// TestUpdateIngressStatus verifies that Ingress resources are updated with the given lbIngs, and the address is removed from the
+// disabled Ingress.
+func TestUpdateIngressStatus(t *testing.T) {
+	f := newFixture(t)
+
+	lbIngs := []api.LoadBalancerIngress{{IP: "192.168.0.1"}, {IP: "192.168.0.2"}}
+
+	ing1 := newIngress(api.NamespaceDefault, "delta-ing", "delta", "80")
+	ing3 := newIngress(api.NamespaceDefault, "foxtrot-ing", "foxtrot", "80")
+	ing3.Annotations[ingressClassKey] = "not-nghttpx"
+	ing4 := newIngress(api.NamespaceDefault, "golf-ing", "golf", "80")
+	ing4.Status.LoadBalancer.Ingress = lbIngs
+	ing2 := newIngress(api.NamespaceDefault, "echo-ing", "echo", "80")
+	ing5 := newIngress(api.NamespaceDefault, "hotel-ing", "hotel", "80")
+	ing5.Annotations[disabledKey] = "true"
+	ing5.Status.LoadBalancer.Ingress = lbIngs
+
+	f.ingStore = append(f.ingStore, ing1, ing2, ing3, ing4, ing5)
+
+	f.objects = append(f.objects, ing1, ing2, ing3, ing4, ing5)
+
+	f.expectUpdateIngAction(ing1)
+	f.expectUpdateIngAction(ing2)
+	f.expectUpdateIngAction(ing5)
+
+	f.prepare()
+	f.setupStore()
+
+	err := f.lbc.updateIngressStatus(lbIngs)
+
+	f.verifyActions()
+
+	if err != nil {
+		t.Fatalf("f.lbc.updateIngressStatus(lbIngs) returned unexpected error %v", err)
+	}
+
+	if updatedIng, err := f.clientset.Extensions().Ingresses(ing1.Namespace).Get(ing1.Name); err != nil {
+		t.Errorf("Could not get Ingress %v/%v: %v", ing1.Namespace, ing1.Name, err)
+	} else {
+		if got, want := updatedIng.Status.LoadBalancer.Ingress, lbIngs; !reflect.DeepEqual(got, want) {
+			t.Errorf("updatedIng.Status.LoadBalancer.Ingress = %+v, want %+v", got, want)
+		}
+	}
+	if updatedIng, err := f.clientset.Extensions().Ingresses(ing2.Namespace).Get(ing2.Name); err != nil {
+		t.Errorf("Could not get Ingress %v/%v: %v", ing2.Namespace, ing2.Name, err)
+	} else {
+		if got, want := updatedIng.Status.LoadBalancer.Ingress, lbIngs; !reflect.DeepEqual(got, want) {
+			t.Errorf("updatedIng.Status.LoadBalancer.Ingress = %+v, want %+v", got, want)
+		}
+	}
+	if updatedIng, err := f.clientset.Extensions().Ingresses(ing5.Namespace).Get(ing5.Name); err != nil {
+		t.Errorf("Could not get Ingress %v/%v: %v", ing5.Namespace, ing5.Name, err)
+	} else {
+		if got := updatedIng.Status.LoadBalancer.Ingress; len(got) != 0 {
+			t.Errorf("updatedIng.Status.LoadBalancer.Ingress = %+v, want empty", got)
+		}
+	}
+}
+
+// TestRemoveAddressFromLoadBalancerIngress verifies that removeAddressFromLoadBalancerIngress clears Ingress.Status.LoadBalancer.Ingress.
+func TestRemoveAddressFromLoadBalancerIngress(t *testing.T) {
+	f := newFixture(t)
+
+	po := newIngPod(defaultRuntimeInfo.PodName, "alpha.test")
+	node := newNode("alpha.test", api.NodeAddress{Type: api.NodeExternalIP, Address: "192.168.0.1"})
+
+	lbIngs := []api.LoadBalancerIngress{{IP: "192.168.0.1"}, {IP: "192.168.0.2"}}
+
+	ing1 := newIngress(api.NamespaceDefault, "delta-ing", "delta", "80")
+	ing1.Status.LoadBalancer.Ingress = lbIngs
+
+	ing2 := newIngress(api.NamespaceDefault, "echo-ing", "echo", "80")
+	ing2.Status.LoadBalancer.Ingress = lbIngs
+
+	ing3 := newIngress(api.NamespaceDefault, "foxtrot-ing", "foxtrot", "80")
+	ing3.Annotations[ingressClassKey] = "not-nghttpx"
+	ing3.Status.LoadBalancer.Ingress = lbIngs
+
+	ing4 := newIngress(api.NamespaceDefault, "golf-ing", "golf", "80")
+	ing4.Status.LoadBalancer.Ingress = lbIngs[1:]
+
+	f.podStore = append(f.podStore, po)
+	f.nodeStore = append(f.nodeStore, node)
+	f.ingStore = append(f.ingStore, ing1, ing2, ing3, ing4)
+
+	f.objects = append(f.objects, po, node, ing1, ing2, ing3, ing4)
+
+	f.prepare()
+	f.setupStore()
+
+	err := f.lbc.removeAddressFromLoadBalancerIngress()
+
+	if err != nil {
+		t.Fatalf("f.lbc.removeAddressFromLoadBalancerIngress() returned unexpected error %v", err)
+	}
+
+	if updatedIng, err := f.lbc.clientset.Extensions().Ingresses(ing1.Namespace).Get(ing1.Name); err != nil {
+		t.Errorf("Could not get Ingress %v/%v: %v", ing1.Namespace, ing1.Name, err)
+	} else {
+		ans := []api.LoadBalancerIngress{{IP: "192.168.0.2"}}
+		if got, want := updatedIng.Status.LoadBalancer.Ingress, ans; !reflect.DeepEqual(got, want) {
+			t.Errorf("updatedIng.Status.LoadBalancer.Ingress = %+v, want %+v", got, want)
+		}
+	}
+
+	if updatedIng, err := f.lbc.clientset.Extensions().Ingresses(ing4.Namespace).Get(ing4.Name); err != nil {
+		t.Errorf("Could not get Ingress %v/%v: %v", ing4.Namespace, ing4.Name, err)
+	} else {
+		ans := []api.LoadBalancerIngress{{IP: "192.168.0.2"}}
+		if got, want := updatedIng.Status.LoadBalancer.Ingress, ans; !reflect.DeepEqual(got, want) {
 			t.Errorf("updatedIng.Status.LoadBalancer.Ingress = %+v, want %+v", got, want)
 		}
 	}
 }
+
+// TestSyncClientCASecret verifies that CA bundle to verify client certificate is loaded from the Secret given by clientCASecret,
+// and sync fails if the Secret is missing.
+func TestSyncClientCASecret(t *testing.T) {
+	dCrt, _ := base64.StdEncoding.DecodeString(tlsCrt)
+	caSecret := &api.Secret{
+		ObjectMeta: api.ObjectMeta{
+			Name:      "client-ca",
+			Namespace: "kube-system",
+		},
+		Data: map[string][]byte{
+			caCertKey: dCrt,
+		},
+	}
+
+	tests := []struct {
+		clientCASecret string
+		wantErr        bool
+	}{
+		{},
+		{clientCASecret: "kube-system/client-ca"},
+		{clientCASecret: "kube-system/not-found", wantErr: true},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+		ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+
+		f.secretStore = append(f.secretStore, caSecret)
+		f.svcStore = append(f.svcStore, svc, bs1)
+		f.epStore = append(f.epStore, eps, be1)
+		f.ingStore = append(f.ingStore, ing1)
+
+		f.objects = append(f.objects, caSecret, svc, eps, bs1, be1, ing1)
+
+		f.prepare()
+		f.lbc.clientCASecret = tt.clientCASecret
+
+		if tt.wantErr {
+			f.runShouldFail(getKey(svc, t))
+			continue
+		}
+
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		if tt.clientCASecret == "" {
+			if ingConfig.ClientCACert != nil {
+				t.Errorf("#%v: ingConfig.ClientCACert = %+v, want nil", i, ingConfig.ClientCACert)
+			}
+			if got, want := f.lbc.secretReferenced(caSecret.Namespace, caSecret.Name), false; got != want {
+				t.Errorf("#%v: f.lbc.secretReferenced(%q, %q) = %v, want %v", i, caSecret.Namespace, caSecret.Name, got, want)
+			}
+			continue
+		}
+
+		if ingConfig.ClientCACert == nil {
+			t.Errorf("#%v: ingConfig.ClientCACert = nil, want non-nil", i)
+			continue
+		}
+		if got, want := ingConfig.ClientCACert.Checksum, nghttpx.Checksum(dCrt); got != want {
+			t.Errorf("#%v: ingConfig.ClientCACert.Checksum = %v, want %v", i, got, want)
+		}
+		if got, want := f.lbc.secretReferenced(caSecret.Namespace, caSecret.Name), true; got != want {
+			t.Errorf("#%v: f.lbc.secretReferenced(%q, %q) = %v, want %v", i, caSecret.Namespace, caSecret.Name, got, want)
+		}
+	}
+}
+
+// countingRateLimiter is flowcontrol.RateLimiter which never blocks, and counts the calls of Accept.
+type countingRateLimiter struct {
+	flowcontrol.RateLimiter
+	accepted int
+}
+
+func (l *countingRateLimiter) Accept() {
+	l.accepted++
+}
+
+// TestSyncReloadRateLimit verifies that the reload rate limiter is consulted only when the configuration differs from the applied
+// one.
+func TestSyncReloadRateLimit(t *testing.T) {
+	f := newFixture(t)
+
+	svc, eps := newDefaultBackend()
+
+	bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+	ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+
+	f.svcStore = append(f.svcStore, svc, bs1)
+	f.epStore = append(f.epStore, eps, be1)
+	f.ingStore = append(f.ingStore, ing1)
+
+	f.objects = append(f.objects, svc, eps, bs1, be1, ing1)
+
+	f.prepare()
+	limiter := &countingRateLimiter{}
+	f.lbc.reloadRateLimiter = limiter
+	f.run(getKey(svc, t))
+
+	if got, want := limiter.accepted, 1; got != want {
+		t.Errorf("limiter.accepted = %v, want %v", got, want)
+	}
+
+	if err := f.lbc.sync(getKey(svc, t)); err != nil {
+		t.Fatalf("f.lbc.sync(...) returned unexpected error %v", err)
+	}
+
+	if got, want := limiter.accepted, 1; got != want {
+		t.Errorf("limiter.accepted = %v, want %v", got, want)
+	}
+}
+
+// TestConfigApplied verifies that ConfigApplied returns false until configuration is applied successfully for the first time.
+func TestConfigApplied(t *testing.T) {
+	f := newFixture(t)
+
+	svc, eps := newDefaultBackend()
+
+	f.svcStore = append(f.svcStore, svc)
+	f.epStore = append(f.epStore, eps)
+
+	f.objects = append(f.objects, svc, eps)
+
+	f.prepare()
+
+	fm := f.lbc.nghttpx.(*fakeManager)
+	fm.checkAndReloadHandler = func(ingConfig *nghttpx.IngressConfig) (bool, error) {
+		return false, fmt.Errorf("invalid configuration")
+	}
+
+	f.runShouldFail(getKey(svc, t))
+
+	if got, want := f.lbc.ConfigApplied(), false; got != want {
+		t.Errorf("f.lbc.ConfigApplied() = %v, want %v", got, want)
+	}
+
+	fm.checkAndReloadHandler = fm.defaultCheckAndReload
+
+	f.run(getKey(svc, t))
+
+	if got, want := f.lbc.ConfigApplied(), true; got != want {
+		t.Errorf("f.lbc.ConfigApplied() = %v, want %v", got, want)
+	}
+}
+
+// TestServiceNotification verifies that changes to Service referenced by Ingress or default backend trigger synchronization.
+func TestServiceNotification(t *testing.T) {
+	tests := []struct {
+		svcNamespace string
+		svcName      string
+		want         int
+	}{
+		// default backend
+		{
+			svcNamespace: defaultBackendNamespace,
+			svcName:      defaultBackendName,
+			want:         1,
+		},
+		// referenced by Ingress
+		{
+			svcNamespace: api.NamespaceDefault,
+			svcName:      "alpha",
+			want:         1,
+		},
+		// not referenced
+		{
+			svcNamespace: api.NamespaceDefault,
+			svcName:      "bravo",
+			want:         0,
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		ing := newIngress(api.NamespaceDefault, "alpha-ing", "alpha", "80")
+		f.ingStore = append(f.ingStore, ing)
+
+		f.prepare()
+		f.setupStore()
+
+		oldSvc, _ := newBackend(tt.svcNamespace, tt.svcName, nil)
+		curSvc, _ := newBackend(tt.svcNamespace, tt.svcName, nil)
+		curSvc.Spec.Ports[0].TargetPort = intstr.FromString("my-port")
+
+		f.lbc.updateServiceNotification(oldSvc, curSvc)
+
+		if got, want := f.lbc.syncQueue.Len(), tt.want; got != want {
+			t.Errorf("#%v: f.lbc.syncQueue.Len() = %v, want %v", i, got, want)
+		}
+	}
+}
+
+// TestSyncDefaultBackendPreference verifies that --default-backend-preference chooses between the catch-all rule in Ingress and the
+// default backend Service.
+func TestSyncDefaultBackendPreference(t *testing.T) {
+	tests := []struct {
+		preference string
+		// ingAddrs is the endpoint addresses of Service which the catch-all rule in Ingress refers to.
+		ingAddrs []string
+		want     string
+	}{
+		{
+			preference: DefaultBackendPreferIngress,
+			ingAddrs:   []string{"192.168.10.1"},
+			want:       "192.168.10.1",
+		},
+		{
+			// Fallback to the default backend Service because the catch-all rule has no available endpoints.
+			preference: DefaultBackendPreferIngress,
+			want:       "192.168.100.1",
+		},
+		{
+			preference: DefaultBackendPreferGlobal,
+			ingAddrs:   []string{"192.168.10.1"},
+			want:       "192.168.100.1",
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", tt.ingAddrs)
+		ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+		ing1.Spec.Rules[0].Host = ""
+
+		f.svcStore = append(f.svcStore, svc, bs1)
+		f.epStore = append(f.epStore, eps, be1)
+		f.ingStore = append(f.ingStore, ing1)
+
+		f.objects = append(f.objects, svc, eps, bs1, be1, ing1)
+
+		f.prepare()
+		f.lbc.defaultBackendPreference = tt.preference
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		if got, want := len(ingConfig.Upstreams), 1; got != want {
+			t.Errorf("#%v: len(ingConfig.Upstreams) = %v, want %v", i, got, want)
+			continue
+		}
+
+		if got, want := ingConfig.Upstreams[0].Backends[0].Address, tt.want; got != want {
+			t.Errorf("#%v: ingConfig.Upstreams[0].Backends[0].Address = %v, want %v", i, got, want)
+		}
+	}
+}
+
+// newTLSCertKey creates self-signed certificate for cn and dnsNames, and its private key in PEM format.
+func newTLSCertKey(t *testing.T, cn string, dnsNames ...string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate private key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Could not marshal private key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// TestSyncSNIMapping verifies that the mapping from SNI host name to Secret is computed from loaded certificates.
+func TestSyncSNIMapping(t *testing.T) {
+	f := newFixture(t)
+
+	svc, eps := newDefaultBackend()
+
+	crt1, key1 := newTLSCertKey(t, "alpha.example.com")
+	tlsSecret1 := newTLSSecret(api.NamespaceDefault, "alpha-tls", crt1, key1)
+	crt2, key2 := newTLSCertKey(t, "bravo.example.com", "bravo.example.com", "shared.example.com")
+	tlsSecret2 := newTLSSecret(api.NamespaceDefault, "bravo-tls", crt2, key2)
+	crt3, key3 := newTLSCertKey(t, "shared.example.com")
+	tlsSecret3 := newTLSSecret(api.NamespaceDefault, "charlie-tls", crt3, key3)
+
+	bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+	ing1 := newIngressTLS(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String(), tlsSecret1.Name)
+	ing1.Spec.TLS = append(ing1.Spec.TLS, extensions.IngressTLS{SecretName: tlsSecret2.Name})
+	ing2 := newIngressTLS(bs1.Namespace, "bravo-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String(), tlsSecret3.Name)
+
+	f.secretStore = append(f.secretStore, tlsSecret1, tlsSecret2, tlsSecret3)
+	f.svcStore = append(f.svcStore, svc, bs1)
+	f.epStore = append(f.epStore, eps, be1)
+	f.ingStore = append(f.ingStore, ing1, ing2)
+
+	f.objects = append(f.objects, tlsSecret1, tlsSecret2, tlsSecret3, svc, eps, bs1, be1, ing1, ing2)
+
+	f.prepare()
+	f.run(getKey(svc, t))
+
+	ans := map[string][]string{
+		"alpha.example.com":  {"default/alpha-tls"},
+		"bravo.example.com":  {"default/bravo-tls"},
+		"shared.example.com": {"default/bravo-tls", "default/charlie-tls"},
+	}
+
+	if got, want := f.lbc.SNIMapping(), ans; !reflect.DeepEqual(got, want) {
+		t.Errorf("f.lbc.SNIMapping() = %+v, want %+v", got, want)
+	}
+}
+
+// TestAppliedIngressConfig verifies that the last applied configuration is available without private key.
+func TestAppliedIngressConfig(t *testing.T) {
+	f := newFixture(t)
+
+	svc, eps := newDefaultBackend()
+
+	crt, key := newTLSCertKey(t, "alpha.example.com")
+	tlsSecret := newTLSSecret(api.NamespaceDefault, "alpha-tls", crt, key)
+
+	bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+	ing1 := newIngressTLS(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String(), tlsSecret.Name)
+
+	f.secretStore = append(f.secretStore, tlsSecret)
+	f.svcStore = append(f.svcStore, svc, bs1)
+	f.epStore = append(f.epStore, eps, be1)
+	f.ingStore = append(f.ingStore, ing1)
+
+	f.objects = append(f.objects, tlsSecret, svc, eps, bs1, be1, ing1)
+
+	f.prepare()
+
+	if ingConfig := f.lbc.AppliedIngressConfig(); ingConfig != nil {
+		t.Fatalf("f.lbc.AppliedIngressConfig() = %+v, want nil", ingConfig)
+	}
+
+	f.run(getKey(svc, t))
+
+	ingConfig := f.lbc.AppliedIngressConfig()
+	if ingConfig == nil {
+		t.Fatalf("f.lbc.AppliedIngressConfig() returned nil")
+	}
+
+	if got, want := len(ingConfig.Upstreams), 2; got != want {
+		t.Errorf("len(ingConfig.Upstreams) = %v, want %v", got, want)
+	}
+
+	if ingConfig.DefaultTLSCred == nil {
+		t.Fatalf("ingConfig.DefaultTLSCred = nil, want non-nil")
+	}
+	if got, want := ingConfig.DefaultTLSCred.Secret, "default/alpha-tls"; got != want {
+		t.Errorf("ingConfig.DefaultTLSCred.Secret = %v, want %v", got, want)
+	}
+	if ingConfig.DefaultTLSCred.Key.Content != nil {
+		t.Errorf("ingConfig.DefaultTLSCred.Key.Content is not redacted")
+	}
+
+	// The configuration passed to nghttpx must keep the private key.
+	fm := f.lbc.nghttpx.(*fakeManager)
+	if got, want := string(fm.ingConfig.DefaultTLSCred.Key.Content), string(key); got != want {
+		t.Errorf("fm.ingConfig.DefaultTLSCred.Key.Content = %q, want %q", got, want)
+	}
+}
+
+// TestProxyProtoEnabled verifies that PROXY protocol is enabled on the public frontends except for the excluded ports.
+func TestProxyProtoEnabled(t *testing.T) {
+	tests := []struct {
+		proxyProto   bool
+		excludePorts []int
+		http         bool
+		https        bool
+	}{
+		{},
+		{
+			proxyProto: true,
+			http:       true,
+			https:      true,
+		},
+		{
+			proxyProto:   true,
+			excludePorts: []int{httpPort},
+			https:        true,
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		f.svcStore = append(f.svcStore, svc)
+		f.epStore = append(f.epStore, eps)
+
+		f.objects = append(f.objects, svc, eps)
+
+		f.prepare()
+		f.lbc.proxyProto = tt.proxyProto
+		f.lbc.proxyProtoExcludePorts = tt.excludePorts
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		if got, want := ingConfig.HTTPProxyProto, tt.http; got != want {
+			t.Errorf("#%v: ingConfig.HTTPProxyProto = %v, want %v", i, got, want)
+		}
+		if got, want := ingConfig.HTTPSProxyProto, tt.https; got != want {
+			t.Errorf("#%v: ingConfig.HTTPSProxyProto = %v, want %v", i, got, want)
+		}
+	}
+}
+
+// TestSyncIncludeNotReadyEndpoints verifies that not-ready endpoint addresses are used as backends only if
+// includeNotReadyEndpoints is true.
+func TestSyncIncludeNotReadyEndpoints(t *testing.T) {
+	tests := []struct {
+		includeNotReadyEndpoints bool
+		want                     []string
+	}{
+		{
+			want: []string{"192.168.10.1"},
+		},
+		{
+			includeNotReadyEndpoints: true,
+			want:                     []string{"192.168.10.1", "192.168.10.2"},
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+		be1.Subsets[0].NotReadyAddresses = []api.EndpointAddress{{IP: "192.168.10.2"}}
+		ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+
+		f.svcStore = append(f.svcStore, svc, bs1)
+		f.epStore = append(f.epStore, eps, be1)
+		f.ingStore = append(f.ingStore, ing1)
+
+		f.objects = append(f.objects, svc, eps, bs1, be1, ing1)
+
+		f.prepare()
+		f.lbc.includeNotReadyEndpoints = tt.includeNotReadyEndpoints
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		var addrs []string
+		for _, backend := range ingConfig.Upstreams[0].Backends {
+			addrs = append(addrs, backend.Address)
+		}
+
+		if got, want := addrs, tt.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("#%v: addrs = %v, want %v", i, got, want)
+		}
+	}
+}
+
+// TestSyncUnixSocketBackend verifies that unixSocketPath in backend configuration replaces endpoints only if
+// allowUnixSocketBackend is true.
+func TestSyncUnixSocketBackend(t *testing.T) {
+	tests := []struct {
+		allowUnixSocketBackend bool
+		want                   []nghttpx.UpstreamServer
+	}{
+		{
+			want: []nghttpx.UpstreamServer{
+				{Address: "192.168.10.1", Port: "80", Protocol: nghttpx.ProtocolH1, Affinity: nghttpx.AffinityNone},
+			},
+		},
+		{
+			allowUnixSocketBackend: true,
+			want: []nghttpx.UpstreamServer{
+				{UnixSocketPath: "/run/alpha/alpha.sock", Protocol: nghttpx.ProtocolH1, Affinity: nghttpx.AffinityNone},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+		ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+		ing1.Annotations[backendConfigKey] = `{"alpha": {"80": {"unixSocketPath": "/run/alpha/alpha.sock"}}}`
+
+		f.svcStore = append(f.svcStore, svc, bs1)
+		f.epStore = append(f.epStore, eps, be1)
+		f.ingStore = append(f.ingStore, ing1)
+
+		f.objects = append(f.objects, svc, eps, bs1, be1, ing1)
+
+		f.prepare()
+		f.lbc.allowUnixSocketBackend = tt.allowUnixSocketBackend
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		var backends []nghttpx.UpstreamServer
+		for _, ups := range ingConfig.Upstreams {
+			if ups.Host == ing1.Spec.Rules[0].Host {
+				backends = append(backends, ups.Backends...)
+			}
+		}
+
+		if got, want := backends, tt.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("#%v: backends = %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+// TestSyncLongPath verifies that very long Path is handled properly.
+func TestSyncLongPath(t *testing.T) {
+	longPath := "/" + strings.Repeat("a", maxUpstreamNameLength)
+
+	tests := []struct {
+		maxPathLength int
+		wantUpstreams int
+	}{
+		{
+			wantUpstreams: 2,
+		},
+		{
+			maxPathLength: maxUpstreamNameLength,
+			wantUpstreams: 1,
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+		ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+		ing1.Spec.Rules[0].HTTP.Paths[0].Path = longPath
+
+		f.svcStore = append(f.svcStore, svc, bs1)
+		f.epStore = append(f.epStore, eps, be1)
+		f.ingStore = append(f.ingStore, ing1)
+
+		f.objects = append(f.objects, svc, eps, bs1, be1, ing1)
+
+		f.prepare()
+		f.lbc.maxPathLength = tt.maxPathLength
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		if got, want := len(ingConfig.Upstreams), tt.wantUpstreams; got != want {
+			t.Errorf("#%v: len(ingConfig.Upstreams) = %v, want %v", i, got, want)
+			continue
+		}
+
+		if tt.wantUpstreams == 1 {
+			continue
+		}
+
+		var ups *nghttpx.Upstream
+		for _, u := range ingConfig.Upstreams {
+			if u.Path == longPath {
+				ups = u
+			}
+		}
+		if ups == nil {
+			t.Errorf("#%v: no upstream has Path %v", i, longPath)
+			continue
+		}
+		if got, want := len(ups.Name), maxUpstreamNameLength; got != want {
+			t.Errorf("#%v: len(ups.Name) = %v, want %v", i, got, want)
+		}
+	}
+}
+
+// TestSyncWeightPerService verifies that weights are assigned to backends so that traffic is split evenly among Services which
+// share the same host and path.
+func TestSyncWeightPerService(t *testing.T) {
+	tests := []struct {
+		weightPerService bool
+		wantAlpha        uint32
+		wantBravo        uint32
+	}{
+		{},
+		{
+			weightPerService: true,
+			wantAlpha:        256,
+			wantBravo:        128,
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+		ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+		ing1.Spec.Rules[0].Host = "example.test"
+
+		bs2, be2 := newBackend(api.NamespaceDefault, "bravo", []string{"192.168.10.2", "192.168.10.3"})
+		ing2 := newIngress(bs2.Namespace, "bravo-ing", bs2.Name, bs2.Spec.Ports[0].TargetPort.String())
+		ing2.Spec.Rules[0].Host = "example.test"
+
+		f.svcStore = append(f.svcStore, svc, bs1, bs2)
+		f.epStore = append(f.epStore, eps, be1, be2)
+		f.ingStore = append(f.ingStore, ing1, ing2)
+
+		f.objects = append(f.objects, svc, eps, bs1, be1, ing1, bs2, be2, ing2)
+
+		f.prepare()
+		f.lbc.weightPerService = tt.weightPerService
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		if got, want := len(ingConfig.Upstreams), 3; got != want {
+			t.Errorf("#%v: len(ingConfig.Upstreams) = %v, want %v", i, got, want)
+			continue
+		}
+
+		for _, ups := range ingConfig.Upstreams {
+			var want uint32
+			switch ups.Name {
+			case "default/alpha,80;example.test/":
+				want = tt.wantAlpha
+			case "default/bravo,80;example.test/":
+				want = tt.wantBravo
+			}
+			for _, backend := range ups.Backends {
+				if got := backend.Weight; got != want {
+					t.Errorf("#%v: %v: backend.Weight = %v, want %v", i, ups.Name, got, want)
+				}
+			}
+		}
+	}
+}
+
+// TestSyncReloadFailed verifies that sync fails and records an Event if nghttpx configuration cannot be applied.
+func TestSyncReloadFailed(t *testing.T) {
+	f := newFixture(t)
+
+	svc, eps := newDefaultBackend()
+
+	f.svcStore = append(f.svcStore, svc)
+	f.epStore = append(f.epStore, eps)
+
+	f.objects = append(f.objects, svc, eps)
+
+	f.prepare()
+	recorder := f.lbc.recorder.(*record.FakeRecorder)
+	fm := f.lbc.nghttpx.(*fakeManager)
+	fm.checkAndReloadHandler = func(ingConfig *nghttpx.IngressConfig) (bool, error) {
+		return false, fmt.Errorf("nghttpx failed to load configuration")
+	}
+	f.runShouldFail(getKey(svc, t))
+
+	if got, want := f.lbc.ConfigApplied(), false; got != want {
+		t.Errorf("f.lbc.ConfigApplied() = %v, want %v", got, want)
+	}
+
+	select {
+	case e := <-recorder.Events:
+		if !strings.Contains(e, "ReloadFailed") {
+			t.Errorf("event = %v, want ReloadFailed", e)
+		}
+	default:
+		t.Errorf("No event was recorded")
+	}
+}
+
+// TestSyncExtraPorts verifies that the backends of extra ports are added to the same pattern with their weights.
+func TestSyncExtraPorts(t *testing.T) {
+	tests := []struct {
+		backendConfig string
+		want          []nghttpx.UpstreamServer
+	}{
+		{
+			want: []nghttpx.UpstreamServer{
+				{Address: "192.168.10.1", Port: "80", Protocol: nghttpx.ProtocolH1, Affinity: nghttpx.AffinityNone},
+			},
+		},
+		{
+			backendConfig: `{"alpha": {"80": {"extraPorts": ["8080"], "weight": 3}, "8080": {"weight": 1}}}`,
+			want: []nghttpx.UpstreamServer{
+				{Address: "192.168.10.1", Port: "80", Protocol: nghttpx.ProtocolH1, Affinity: nghttpx.AffinityNone, Weight: 3},
+				{Address: "192.168.10.1", Port: "8080", Protocol: nghttpx.ProtocolH1, Affinity: nghttpx.AffinityNone, Weight: 1},
+			},
+		},
+		{
+			// Unknown extra port is ignored.
+			backendConfig: `{"alpha": {"80": {"extraPorts": ["9000"]}}}`,
+			want: []nghttpx.UpstreamServer{
+				{Address: "192.168.10.1", Port: "80", Protocol: nghttpx.ProtocolH1, Affinity: nghttpx.AffinityNone},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+		bs1.Spec.Ports = append(bs1.Spec.Ports, api.ServicePort{
+			Port:       8080,
+			TargetPort: intstr.FromInt(8080),
+			Protocol:   api.ProtocolTCP,
+		})
+		be1.Subsets = append(be1.Subsets, api.EndpointSubset{
+			Addresses: []api.EndpointAddress{{IP: "192.168.10.1"}},
+			Ports:     []api.EndpointPort{{Protocol: api.ProtocolTCP, Port: 8080}},
+		})
+		ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+		if tt.backendConfig != "" {
+			ing1.Annotations[backendConfigKey] = tt.backendConfig
+		}
+
+		f.svcStore = append(f.svcStore, svc, bs1)
+		f.epStore = append(f.epStore, eps, be1)
+		f.ingStore = append(f.ingStore, ing1)
+
+		f.objects = append(f.objects, svc, eps, bs1, be1, ing1)
+
+		f.prepare()
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		var backends []nghttpx.UpstreamServer
+		for _, ups := range ingConfig.Upstreams {
+			if ups.Host == ing1.Spec.Rules[0].Host {
+				backends = append(backends, ups.Backends...)
+			}
+		}
+
+		if got, want := backends, tt.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("#%v: backends = %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+// TestSyncBackendProto verifies that proto and tls in backend configuration are applied independently.
+func TestSyncBackendProto(t *testing.T) {
+	tests := []struct {
+		backendConfig string
+		wantProto     nghttpx.Protocol
+		wantTLS       bool
+	}{
+		{
+			wantProto: nghttpx.ProtocolH1,
+		},
+		{
+			backendConfig: `{"alpha": {"80": {"proto": "h2"}}}`,
+			wantProto:     nghttpx.ProtocolH2,
+		},
+		{
+			backendConfig: `{"alpha": {"80": {"proto": "h2", "tls": true}}}`,
+			wantProto:     nghttpx.ProtocolH2,
+			wantTLS:       true,
+		},
+		{
+			backendConfig: `{"alpha": {"80": {"tls": true}}}`,
+			wantProto:     nghttpx.ProtocolH1,
+			wantTLS:       true,
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+		ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+		if tt.backendConfig != "" {
+			ing1.Annotations[backendConfigKey] = tt.backendConfig
+		}
+
+		f.svcStore = append(f.svcStore, svc, bs1)
+		f.epStore = append(f.epStore, eps, be1)
+		f.ingStore = append(f.ingStore, ing1)
+
+		f.objects = append(f.objects, svc, eps, bs1, be1, ing1)
+
+		f.prepare()
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		for _, ups := range ingConfig.Upstreams {
+			if ups.Host != ing1.Spec.Rules[0].Host {
+				continue
+			}
+			for _, backend := range ups.Backends {
+				if got, want := backend.Protocol, tt.wantProto; got != want {
+					t.Errorf("#%v: backend.Protocol = %v, want %v", i, got, want)
+				}
+				if got, want := backend.TLS, tt.wantTLS; got != want {
+					t.Errorf("#%v: backend.TLS = %v, want %v", i, got, want)
+				}
+			}
+		}
+	}
+}
+
+// TestSyncSlowStart verifies that the weight of a newly added backend is reduced during slow start, and the backends found in the
+// first computation are not.
+func TestSyncSlowStart(t *testing.T) {
+	tests := []struct {
+		// seen is the list of backend addresses which were found in the previous computation.  nil means that there is no previous
+		// computation.
+		seen []string
+		want map[string]uint32
+	}{
+		{
+			want: map[string]uint32{"192.168.10.1": 0, "192.168.10.2": 0},
+		},
+		{
+			seen: []string{"192.168.10.1"},
+			want: map[string]uint32{"192.168.10.1": nghttpx.MaxBackendWeight, "192.168.10.2": 1},
+		},
+		{
+			seen: []string{"192.168.10.1", "192.168.10.2"},
+			want: map[string]uint32{"192.168.10.1": 0, "192.168.10.2": 0},
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1", "192.168.10.2"})
+		ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+		ing1.Annotations[backendConfigKey] = `{"alpha": {"80": {"slowStart": "1h"}}}`
+
+		f.svcStore = append(f.svcStore, svc, bs1)
+		f.epStore = append(f.epStore, eps, be1)
+		f.ingStore = append(f.ingStore, ing1)
+
+		f.objects = append(f.objects, svc, eps, bs1, be1, ing1)
+
+		f.prepare()
+		if tt.seen != nil {
+			f.lbc.endpointFirstSeen = make(map[string]time.Time)
+			for _, addr := range tt.seen {
+				f.lbc.endpointFirstSeen[ing1.Spec.Rules[0].Host+"/,"+addr+",80"] = time.Time{}
+			}
+		}
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		got := make(map[string]uint32)
+		for _, ups := range ingConfig.Upstreams {
+			if ups.Host != ing1.Spec.Rules[0].Host {
+				continue
+			}
+			for _, backend := range ups.Backends {
+				got[backend.Address] = backend.Weight
+			}
+		}
+
+		if want := tt.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("#%v: weights = %v, want %v", i, got, want)
+		}
+		if got, want := len(f.lbc.endpointFirstSeen), 2; got != want {
+			t.Errorf("#%v: len(f.lbc.endpointFirstSeen) = %v, want %v", i, got, want)
+		}
+	}
+}
+
+// TestSyncNodeSelector verifies that only the endpoints on the Nodes which match node selector become backends, and all endpoints
+// are used if none matches or the selector is invalid.
+func TestSyncNodeSelector(t *testing.T) {
+	const zoneLabel = "failure-domain.beta.kubernetes.io/zone"
+
+	tests := []struct {
+		nodeSelector string
+		want         []string
+	}{
+		{
+			want: []string{"192.168.10.1", "192.168.10.2", "192.168.10.3"},
+		},
+		{
+			nodeSelector: zoneLabel + "=zone-a",
+			want:         []string{"192.168.10.1", "192.168.10.3"},
+		},
+		{
+			nodeSelector: zoneLabel + "=zone-b",
+			want:         []string{"192.168.10.2"},
+		},
+		{
+			// No endpoint matches, and all endpoints are used.
+			nodeSelector: zoneLabel + "=zone-c",
+			want:         []string{"192.168.10.1", "192.168.10.2", "192.168.10.3"},
+		},
+		{
+			// Invalid selector is ignored.
+			nodeSelector: zoneLabel + " in (",
+			want:         []string{"192.168.10.1", "192.168.10.2", "192.168.10.3"},
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1", "192.168.10.2", "192.168.10.3"})
+		ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+		if tt.nodeSelector != "" {
+			ing1.Annotations[backendConfigKey] = fmt.Sprintf(`{"alpha": {"80": {"nodeSelector": %q}}}`, tt.nodeSelector)
+		}
+
+		nodeA := newNode("node-a")
+		nodeA.Labels = map[string]string{zoneLabel: "zone-a"}
+		nodeB := newNode("node-b")
+		nodeB.Labels = map[string]string{zoneLabel: "zone-b"}
+
+		// The first and third endpoints have nodeName.  The second one is resolved through its Pod.
+		nodeAName := nodeA.Name
+		be1.Subsets[0].Addresses[0].NodeName = &nodeAName
+		be1.Subsets[0].Addresses[2].NodeName = &nodeAName
+
+		pod := &api.Pod{
+			ObjectMeta: api.ObjectMeta{
+				Name:      "alpha-pod",
+				Namespace: bs1.Namespace,
+			},
+			Spec: api.PodSpec{
+				NodeName: nodeB.Name,
+			},
+		}
+		be1.Subsets[0].Addresses[1].TargetRef = &api.ObjectReference{
+			Kind:      "Pod",
+			Namespace: pod.Namespace,
+			Name:      pod.Name,
+		}
+
+		f.svcStore = append(f.svcStore, svc, bs1)
+		f.epStore = append(f.epStore, eps, be1)
+		f.ingStore = append(f.ingStore, ing1)
+		f.podStore = append(f.podStore, pod)
+		f.nodeStore = append(f.nodeStore, nodeA, nodeB)
+
+		f.objects = append(f.objects, svc, eps, bs1, be1, ing1, pod, nodeA, nodeB)
+
+		f.prepare()
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		var addrs []string
+		for _, ups := range ingConfig.Upstreams {
+			if ups.Host != ing1.Spec.Rules[0].Host {
+				continue
+			}
+			for _, backend := range ups.Backends {
+				addrs = append(addrs, backend.Address)
+			}
+		}
+
+		if got, want := addrs, tt.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("#%v: addrs = %v, want %v", i, got, want)
+		}
+	}
+}
+
+// TestSyncBackendEndpointsMetric verifies that the number of endpoints per Service referenced by Ingress is exported, and the
+// Services which are no longer referenced are removed.
+func TestSyncBackendEndpointsMetric(t *testing.T) {
+	f := newFixture(t)
+
+	svc, eps := newDefaultBackend()
+
+	bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1", "192.168.10.2"})
+	ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+	// Service bravo does not exist.
+	ing2 := newIngress(bs1.Namespace, "bravo-ing", "bravo", "80")
+
+	f.svcStore = append(f.svcStore, svc, bs1)
+	f.epStore = append(f.epStore, eps, be1)
+	f.ingStore = append(f.ingStore, ing1, ing2)
+
+	f.objects = append(f.objects, svc, eps, bs1, be1, ing1, ing2)
+
+	f.prepare()
+	f.run(getKey(svc, t))
+
+	reg := metrics.NewRegistry()
+	reg.MustRegister(f.lbc.backendEndpoints)
+
+	var buf bytes.Buffer
+	if err := reg.Write(&buf); err != nil {
+		t.Fatalf("reg.Write(...) returned unexpected error %v", err)
+	}
+
+	for _, want := range []string{
+		`nghttpx_ingress_backend_endpoints{namespace="default",ingress="alpha-ing",service="alpha"} 2` + "\n",
+		`nghttpx_ingress_backend_endpoints{namespace="default",ingress="bravo-ing",service="bravo"} 0` + "\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics = %q, does not contain %q", buf.String(), want)
+		}
+	}
+
+	f.lbc.updateBackendEndpointsMetric(nil)
+
+	buf.Reset()
+	if err := reg.Write(&buf); err != nil {
+		t.Fatalf("reg.Write(...) returned unexpected error %v", err)
+	}
+
+	if strings.Contains(buf.String(), "alpha-ing") {
+		t.Errorf("metrics = %q, contains stale series", buf.String())
+	}
+}
+
+// TestSyncServiceSessionAffinity verifies that client IP session affinity of Service enables IP based affinity unless annotation
+// specifies affinity.
+func TestSyncServiceSessionAffinity(t *testing.T) {
+	tests := []struct {
+		sessionAffinity api.ServiceAffinity
+		backendConfig   string
+		want            nghttpx.Affinity
+	}{
+		{
+			sessionAffinity: api.ServiceAffinityNone,
+			want:            nghttpx.AffinityNone,
+		},
+		{
+			sessionAffinity: api.ServiceAffinityClientIP,
+			want:            nghttpx.AffinityIP,
+		},
+		{
+			sessionAffinity: api.ServiceAffinityClientIP,
+			backendConfig:   `{"alpha": {"80": {"proto": "h2"}}}`,
+			want:            nghttpx.AffinityIP,
+		},
+		{
+			sessionAffinity: api.ServiceAffinityClientIP,
+			backendConfig:   `{"alpha": {"80": {"affinity": "none"}}}`,
+			want:            nghttpx.AffinityNone,
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+		bs1.Spec.SessionAffinity = tt.sessionAffinity
+		ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+		if tt.backendConfig != "" {
+			ing1.Annotations[backendConfigKey] = tt.backendConfig
+		}
+
+		f.svcStore = append(f.svcStore, svc, bs1)
+		f.epStore = append(f.epStore, eps, be1)
+		f.ingStore = append(f.ingStore, ing1)
+
+		f.objects = append(f.objects, svc, eps, bs1, be1, ing1)
+
+		f.prepare()
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		for _, ups := range ingConfig.Upstreams {
+			if ups.Host != ing1.Spec.Rules[0].Host {
+				continue
+			}
+			for _, backend := range ups.Backends {
+				if got, want := backend.Affinity, tt.want; got != want {
+					t.Errorf("#%v: backend.Affinity = %v, want %v", i, got, want)
+				}
+			}
+		}
+	}
+}
+
+// TestSyncHostRewriteWithSNI verifies that hostRewrite in path configuration and sni in backend configuration are applied
+// independently.
+func TestSyncHostRewriteWithSNI(t *testing.T) {
+	f := newFixture(t)
+
+	svc, eps := newDefaultBackend()
+
+	bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+	ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+	ing1.Annotations[backendConfigKey] = `{"alpha": {"80": {"tls": true, "sni": "backend.internal"}}}`
+	ing1.Annotations[pathConfigKey] = `{"alpha-ing.default.test/": {"hostRewrite": "www.example.com"}}`
+
+	f.svcStore = append(f.svcStore, svc, bs1)
+	f.epStore = append(f.epStore, eps, be1)
+	f.ingStore = append(f.ingStore, ing1)
+
+	f.objects = append(f.objects, svc, eps, bs1, be1, ing1)
+
+	f.prepare()
+	f.run(getKey(svc, t))
+
+	fm := f.lbc.nghttpx.(*fakeManager)
+	ingConfig := fm.ingConfig
+
+	if got, want := len(ingConfig.Upstreams), 2; got != want {
+		t.Fatalf("len(ingConfig.Upstreams) = %v, want %v", got, want)
+	}
+
+	ups := ingConfig.Upstreams[0]
+	if ups.Mruby == nil {
+		t.Fatalf("ups.Mruby is nil")
+	}
+	if got, want := string(ups.Mruby.Content), string(nghttpx.CreatePathMruby(&nghttpx.PathMruby{HostRewrite: "www.example.com"})); got != want {
+		t.Errorf("ups.Mruby.Content = %q, want %q", got, want)
+	}
+	for _, backend := range ups.Backends {
+		if !backend.TLS {
+			t.Errorf("backend.TLS = %v, want true", backend.TLS)
+		}
+		if got, want := backend.SNI, "backend.internal"; got != want {
+			t.Errorf("backend.SNI = %v, want %v", got, want)
+		}
+	}
+}
+
+// TestSyncRejectConflictingRules verifies that only the oldest Ingress serves the conflicting host and path if
+// rejectConflictingRules is true.
+func TestSyncRejectConflictingRules(t *testing.T) {
+	tests := []struct {
+		rejectConflictingRules bool
+		want                   []string
+	}{
+		{
+			want: []string{"default/alpha,80;example.test/", "default/bravo,80;example.test/"},
+		},
+		{
+			rejectConflictingRules: true,
+			want:                   []string{"default/bravo,80;example.test/"},
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		now := time.Now()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+		ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+		ing1.Spec.Rules[0].Host = "example.test"
+		ing1.CreationTimestamp = unversioned.NewTime(now)
+
+		bs2, be2 := newBackend(api.NamespaceDefault, "bravo", []string{"192.168.10.2"})
+		ing2 := newIngress(bs2.Namespace, "bravo-ing", bs2.Name, bs2.Spec.Ports[0].TargetPort.String())
+		ing2.Spec.Rules[0].Host = "example.test"
+		ing2.CreationTimestamp = unversioned.NewTime(now.Add(-time.Hour))
+
+		f.svcStore = append(f.svcStore, svc, bs1, bs2)
+		f.epStore = append(f.epStore, eps, be1, be2)
+		f.ingStore = append(f.ingStore, ing1, ing2)
+
+		f.objects = append(f.objects, svc, eps, bs1, be1, ing1, bs2, be2, ing2)
+
+		f.prepare()
+		f.lbc.rejectConflictingRules = tt.rejectConflictingRules
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		var names []string
+		for _, ups := range ingConfig.Upstreams {
+			if ups.Host == "example.test" {
+				names = append(names, ups.Name)
+			}
+		}
+
+		if got, want := names, tt.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("#%v: names = %v, want %v", i, got, want)
+		}
+
+		recorder := f.lbc.recorder.(*record.FakeRecorder)
+		select {
+		case e := <-recorder.Events:
+			if !tt.rejectConflictingRules {
+				t.Errorf("#%v: Unexpected event %v", i, e)
+			} else if !strings.HasPrefix(e, api.EventTypeWarning+" ConflictingRule ") {
+				t.Errorf("#%v: event = %v, want ConflictingRule", i, e)
+			}
+		default:
+			if tt.rejectConflictingRules {
+				t.Errorf("#%v: No event was recorded", i)
+			}
+		}
+	}
+}
+
+// TestSyncRequiredPodConditions verifies that the endpoints whose Pod does not satisfy required conditions are excluded.
+func TestSyncRequiredPodConditions(t *testing.T) {
+	const gate = "example.com/mesh-ready"
+
+	tests := []struct {
+		requiredPodConditions []string
+		want                  []string
+	}{
+		{
+			want: []string{"192.168.10.1", "192.168.10.2", "192.168.10.3"},
+		},
+		{
+			requiredPodConditions: []string{gate},
+			// 192.168.10.3 is not backed by a Pod.
+			want: []string{"192.168.10.1", "192.168.10.3"},
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1", "192.168.10.2", "192.168.10.3"})
+		ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+
+		var pods []*api.Pod
+		for j, status := range []api.ConditionStatus{api.ConditionTrue, api.ConditionFalse} {
+			pod := &api.Pod{
+				ObjectMeta: api.ObjectMeta{
+					Name:      fmt.Sprintf("alpha-pod-%v", j),
+					Namespace: bs1.Namespace,
+					Labels:    bs1.Spec.Selector,
+				},
+				Status: api.PodStatus{
+					Conditions: []api.PodCondition{
+						{Type: api.PodReady, Status: api.ConditionTrue},
+						{Type: api.PodConditionType(gate), Status: status},
+					},
+				},
+			}
+			be1.Subsets[0].Addresses[j].TargetRef = &api.ObjectReference{
+				Kind:      "Pod",
+				Namespace: pod.Namespace,
+				Name:      pod.Name,
+			}
+			pods = append(pods, pod)
+		}
+
+		f.svcStore = append(f.svcStore, svc, bs1)
+		f.epStore = append(f.epStore, eps, be1)
+		f.ingStore = append(f.ingStore, ing1)
+		f.podStore = append(f.podStore, pods...)
+
+		f.objects = append(f.objects, svc, eps, bs1, be1, ing1, pods[0], pods[1])
+
+		f.prepare()
+		f.lbc.requiredPodConditions = tt.requiredPodConditions
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		var addrs []string
+		for _, backend := range ingConfig.Upstreams[0].Backends {
+			addrs = append(addrs, backend.Address)
+		}
+
+		if got, want := addrs, tt.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("#%v: addrs = %v, want %v", i, got, want)
+		}
+	}
+}
+
+// TestSyncInvalidAnnotationEvent verifies that Warning Event is recorded on Ingress which has invalid annotation or refers to
+// missing Secret.
+func TestSyncInvalidAnnotationEvent(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		tlsSecret   string
+		wantReason  string
+	}{
+		{
+			annotations: map[string]string{backendConfigKey: "{"},
+			wantReason:  "InvalidAnnotation",
+		},
+		{
+			annotations: map[string]string{backendConfigKey: `{"alpha": {"80": {"proto": "h3"}}}`},
+			wantReason:  "InvalidAnnotation",
+		},
+		{
+			tlsSecret:  "missing",
+			wantReason: "InvalidSecret",
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+		var ing1 *extensions.Ingress
+		if tt.tlsSecret != "" {
+			ing1 = newIngressTLS(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String(), tt.tlsSecret)
+		} else {
+			ing1 = newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+		}
+		for k, v := range tt.annotations {
+			ing1.Annotations[k] = v
+		}
+
+		f.svcStore = append(f.svcStore, svc, bs1)
+		f.epStore = append(f.epStore, eps, be1)
+		f.ingStore = append(f.ingStore, ing1)
+
+		f.objects = append(f.objects, svc, eps, bs1, be1, ing1)
+
+		f.prepare()
+		f.run(getKey(svc, t))
+
+		recorder := f.lbc.recorder.(*record.FakeRecorder)
+
+		select {
+		case e := <-recorder.Events:
+			if !strings.HasPrefix(e, api.EventTypeWarning+" "+tt.wantReason+" ") {
+				t.Errorf("#%v: event = %v, want reason %v", i, e, tt.wantReason)
+			}
+		default:
+			t.Errorf("#%v: No event was recorded", i)
+		}
+	}
+}
+
+// TestSyncCanonicalOrder verifies that the same set of objects always produces the same configuration regardless of the order in
+// which they are stored.
+func TestSyncCanonicalOrder(t *testing.T) {
+	dCrt, _ := base64.StdEncoding.DecodeString(tlsCrt)
+	dKey, _ := base64.StdEncoding.DecodeString(tlsKey)
+
+	var first *nghttpx.IngressConfig
+
+	for i := 0; i < 4; i++ {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		addrs := []string{"192.168.10.1", "192.168.10.2", "192.168.10.3"}
+		if i%2 == 1 {
+			addrs = []string{"192.168.10.3", "192.168.10.2", "192.168.10.1"}
+		}
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", addrs)
+		bs2, be2 := newBackend(api.NamespaceDefault, "bravo", []string{"192.168.10.4"})
+
+		tlsSecret1 := newTLSSecret(api.NamespaceDefault, "alpha-tls", dCrt, dKey)
+		tlsSecret2 := newTLSSecret(api.NamespaceDefault, "bravo-tls", dCrt, dKey)
+
+		ing1 := newIngressTLS(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String(), tlsSecret1.Name)
+		ing1.Annotations[backendConfigKey] = `{"alpha": {"80": {"proto": "h2"}}}`
+		ing2 := newIngressTLS(bs2.Namespace, "bravo-ing", bs2.Name, bs2.Spec.Ports[0].TargetPort.String(), tlsSecret2.Name)
+		// Share the same host and path with ing1.
+		ing2.Spec.Rules[0].Host = ing1.Spec.Rules[0].Host
+		ing3 := newIngressTLS(bs1.Namespace, "charlie-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String(), tlsSecret1.Name)
+
+		secrets := []*api.Secret{tlsSecret1, tlsSecret2}
+		ings := []*extensions.Ingress{ing1, ing2, ing3}
+		if i >= 2 {
+			secrets = []*api.Secret{tlsSecret2, tlsSecret1}
+			ings = []*extensions.Ingress{ing3, ing2, ing1}
+		}
+
+		f.secretStore = append(f.secretStore, secrets...)
+		f.svcStore = append(f.svcStore, svc, bs1, bs2)
+		f.epStore = append(f.epStore, eps, be1, be2)
+		f.ingStore = append(f.ingStore, ings...)
+
+		f.objects = append(f.objects, svc, eps, bs1, be1, bs2, be2, ing1, ing2, ing3, tlsSecret1, tlsSecret2)
+
+		f.prepare()
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		if first == nil {
+			first = ingConfig
+			continue
+		}
+
+		if got, want := ingConfig.Upstreams, first.Upstreams; !reflect.DeepEqual(got, want) {
+			t.Errorf("#%v: ingConfig.Upstreams = %+v, want %+v", i, got, want)
+		}
+		if got, want := ingConfig.DefaultTLSCred, first.DefaultTLSCred; !reflect.DeepEqual(got, want) {
+			t.Errorf("#%v: ingConfig.DefaultTLSCred = %+v, want %+v", i, got, want)
+		}
+		if got, want := ingConfig.SubTLSCred, first.SubTLSCred; !reflect.DeepEqual(got, want) {
+			t.Errorf("#%v: ingConfig.SubTLSCred = %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+// TestSyncIncompleteTLSSecret verifies that only TLS Secret which lacks private key is skipped, cleartext HTTP requests to the Ingress
+// are still redirected, Warning Event is recorded, and retries are bounded.
+func TestSyncIncompleteTLSSecret(t *testing.T) {
+	tests := []struct {
+		retries     int
+		wantRetries int
+	}{
+		{wantRetries: 1},
+		{retries: incompleteSecretMaxRetries, wantRetries: incompleteSecretMaxRetries},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		dCrt, _ := base64.StdEncoding.DecodeString(tlsCrt)
+		dKey, _ := base64.StdEncoding.DecodeString(tlsKey)
+		tlsSecret := newTLSSecret(api.NamespaceDefault, "alpha-tls", dCrt, dKey)
+		incompleteSecret := newTLSSecret(api.NamespaceDefault, "bravo-tls", dCrt, nil)
+		delete(incompleteSecret.Data, api.TLSPrivateKeyKey)
+
+		svc, eps := newDefaultBackend()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+		ing1 := newIngressTLS(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String(), tlsSecret.Name)
+		ing1.Spec.TLS = append(ing1.Spec.TLS, extensions.IngressTLS{SecretName: incompleteSecret.Name})
+
+		f.secretStore = append(f.secretStore, tlsSecret, incompleteSecret)
+		f.svcStore = append(f.svcStore, svc, bs1)
+		f.epStore = append(f.epStore, eps, be1)
+		f.ingStore = append(f.ingStore, ing1)
+
+		f.objects = append(f.objects, tlsSecret, incompleteSecret, svc, eps, bs1, be1, ing1)
+
+		f.prepare()
+		f.lbc.incompleteSecretRetries = tt.retries
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		if got, want := ingConfig.TLS, true; got != want {
+			t.Errorf("#%v: ingConfig.TLS = %v, want %v", i, got, want)
+		}
+		if got, want := len(ingConfig.SubTLSCred), 0; got != want {
+			t.Errorf("#%v: len(ingConfig.SubTLSCred) = %v, want %v", i, got, want)
+		}
+
+		var found bool
+		for _, ups := range ingConfig.Upstreams {
+			if ups.Host != ing1.Spec.Rules[0].Host {
+				continue
+			}
+			found = true
+			if got, want := ups.RedirectIfNotTLS, true; got != want {
+				t.Errorf("#%v: ups.RedirectIfNotTLS = %v, want %v", i, got, want)
+			}
+		}
+		if !found {
+			t.Errorf("#%v: No upstream found for host %v", i, ing1.Spec.Rules[0].Host)
+		}
+
+		if got, want := f.lbc.incompleteSecretRetries, tt.wantRetries; got != want {
+			t.Errorf("#%v: f.lbc.incompleteSecretRetries = %v, want %v", i, got, want)
+		}
+
+		recorder := f.lbc.recorder.(*record.FakeRecorder)
+
+		select {
+		case e := <-recorder.Events:
+			if want := api.EventTypeWarning + " IncompleteSecret "; !strings.HasPrefix(e, want) {
+				t.Errorf("#%v: event = %v, want prefix %q", i, e, want)
+			}
+		default:
+			t.Errorf("#%v: No event was recorded", i)
+		}
+	}
+}
+
+// TestSyncIncompleteTLSSecretRedirectWithoutCert verifies that the host listed in spec.tls is redirected to https URI even if its only
+// TLS Secret is incomplete and redirectWithoutCert is false.
+func TestSyncIncompleteTLSSecretRedirectWithoutCert(t *testing.T) {
+	f := newFixture(t)
+
+	dCrt, _ := base64.StdEncoding.DecodeString(tlsCrt)
+	incompleteSecret := newTLSSecret(api.NamespaceDefault, "alpha-tls", dCrt, nil)
+	delete(incompleteSecret.Data, api.TLSPrivateKeyKey)
+
+	svc, eps := newDefaultBackend()
+
+	bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+	ing1 := newIngressTLS(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String(), incompleteSecret.Name)
+	ing1.Spec.TLS[0].Hosts = []string{ing1.Spec.Rules[0].Host}
+	unlistedRule := ing1.Spec.Rules[0]
+	unlistedRule.Host = "bravo.default.test"
+	ing1.Spec.Rules = append(ing1.Spec.Rules, unlistedRule)
+
+	f.secretStore = append(f.secretStore, incompleteSecret)
+	f.svcStore = append(f.svcStore, svc, bs1)
+	f.epStore = append(f.epStore, eps, be1)
+	f.ingStore = append(f.ingStore, ing1)
+
+	f.objects = append(f.objects, incompleteSecret, svc, eps, bs1, be1, ing1)
+
+	f.prepare()
+	f.lbc.redirectWithoutCert = false
+	f.run(getKey(svc, t))
+
+	fm := f.lbc.nghttpx.(*fakeManager)
+	ingConfig := fm.ingConfig
+
+	wantRedirect := map[string]bool{
+		ing1.Spec.Rules[0].Host: true,
+		unlistedRule.Host:       false,
+	}
+
+	for _, ups := range ingConfig.Upstreams {
+		want, ok := wantRedirect[ups.Host]
+		if !ok {
+			continue
+		}
+		delete(wantRedirect, ups.Host)
+		if got := ups.RedirectIfNotTLS; got != want {
+			t.Errorf("host %v: ups.RedirectIfNotTLS = %v, want %v", ups.Host, got, want)
+		}
+	}
+	for host := range wantRedirect {
+		t.Errorf("No upstream found for host %v", host)
+	}
+}
+
+// TestSyncStrictPathValidation verifies that Path which does not start with "/" is ignored only if strict path validation is
+// enabled.
+func TestSyncStrictPathValidation(t *testing.T) {
+	tests := []struct {
+		path                 string
+		strictPathValidation bool
+		wantUpstreams        int
+	}{
+		{
+			path:                 "foo",
+			strictPathValidation: true,
+			wantUpstreams:        1,
+		},
+		{
+			path:          "foo",
+			wantUpstreams: 2,
+		},
+		{
+			path:                 "//double",
+			strictPathValidation: true,
+			wantUpstreams:        2,
+		},
+		{
+			path:          "//double",
+			wantUpstreams: 2,
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+		ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+		ing1.Spec.Rules[0].HTTP.Paths[0].Path = tt.path
+
+		f.svcStore = append(f.svcStore, svc, bs1)
+		f.epStore = append(f.epStore, eps, be1)
+		f.ingStore = append(f.ingStore, ing1)
+
+		f.objects = append(f.objects, svc, eps, bs1, be1, ing1)
+
+		f.prepare()
+		f.lbc.strictPathValidation = tt.strictPathValidation
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		if got, want := len(ingConfig.Upstreams), tt.wantUpstreams; got != want {
+			t.Errorf("#%v: len(ingConfig.Upstreams) = %v, want %v", i, got, want)
+			continue
+		}
+
+		if tt.wantUpstreams == 1 {
+			continue
+		}
+
+		found := false
+		for _, ups := range ingConfig.Upstreams {
+			if ups.Path == tt.path {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("#%v: no upstream has Path %v", i, tt.path)
+		}
+	}
+}
+
+// TestSyncCacheUpstreams verifies that upstreams are reused when only nghttpx ConfigMap has changed, and nghttpx configuration is
+// still applied.
+func TestSyncCacheUpstreams(t *testing.T) {
+	f := newFixture(t)
+
+	svc, eps := newDefaultBackend()
+
+	bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+	ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+
+	cm := newEmptyConfigMap()
+
+	f.svcStore = append(f.svcStore, svc, bs1)
+	f.epStore = append(f.epStore, eps, be1)
+	f.ingStore = append(f.ingStore, ing1)
+	f.cmStore = append(f.cmStore, cm)
+
+	f.objects = append(f.objects, svc, eps, bs1, be1, ing1, cm)
+
+	f.prepare()
+	f.lbc.cacheUpstreams = true
+	f.run(getKey(svc, t))
+
+	fm := f.lbc.nghttpx.(*fakeManager)
+	if got, want := len(fm.ingConfig.Upstreams), 2; got != want {
+		t.Fatalf("len(fm.ingConfig.Upstreams) = %v, want %v", got, want)
+	}
+
+	// Remove Ingress from cache without notification, so that recomputation of upstreams is detectable.
+	if err := f.lbc.ingLister.indexer.Delete(ing1); err != nil {
+		t.Fatalf("f.lbc.ingLister.indexer.Delete(...) returned unexpected error %v", err)
+	}
+	f.ingStore = nil
+
+	updatedCM := newEmptyConfigMap()
+	updatedCM.Data[nghttpx.NghttpxExtraConfigKey] = "workers=3"
+	f.lbc.cmLister.Update(updatedCM)
+	f.lbc.updateConfigMapNotification(cm, updatedCM)
+	f.cmStore = []*api.ConfigMap{updatedCM}
+
+	fm.ingConfig = nil
+	f.run(getKey(svc, t))
+
+	if fm.ingConfig == nil {
+		t.Fatalf("nghttpx configuration was not applied")
+	}
+	if got, want := len(fm.ingConfig.Upstreams), 2; got != want {
+		t.Errorf("len(fm.ingConfig.Upstreams) = %v, want %v", got, want)
+	}
+	if got, want := fm.ingConfig.ExtraConfig, "workers=3"; got != want {
+		t.Errorf("fm.ingConfig.ExtraConfig = %v, want %v", got, want)
+	}
+
+	// Any other change invalidates the cache.
+	f.lbc.deleteIngressNotification(ing1)
+
+	fm.ingConfig = nil
+	f.run(getKey(svc, t))
+
+	if got, want := len(fm.ingConfig.Upstreams), 1; got != want {
+		t.Errorf("len(fm.ingConfig.Upstreams) = %v, want %v", got, want)
+	}
+}
+
+// TestSyncReloadSuppressed verifies that sync succeeds without Event, and enqueues the key again if reload is suppressed.
+func TestSyncReloadSuppressed(t *testing.T) {
+	f := newFixture(t)
+
+	svc, eps := newDefaultBackend()
+
+	f.svcStore = append(f.svcStore, svc)
+	f.epStore = append(f.epStore, eps)
+
+	f.objects = append(f.objects, svc, eps)
+
+	f.prepare()
+	fm := f.lbc.nghttpx.(*fakeManager)
+	fm.checkAndReloadHandler = func(ingConfig *nghttpx.IngressConfig) (bool, error) {
+		return false, &nghttpx.ReloadSuppressedError{RetryAfter: time.Millisecond}
+	}
+	f.run(getKey(svc, t))
+
+	recorder := f.lbc.recorder.(*record.FakeRecorder)
+	select {
+	case e := <-recorder.Events:
+		t.Errorf("Unexpected event %v", e)
+	default:
+	}
+
+	if err := wait.Poll(10*time.Millisecond, time.Second, func() (bool, error) {
+		return f.lbc.syncQueue.Len() == 1, nil
+	}); err != nil {
+		t.Errorf("Key was not enqueued again: %v", err)
+	}
+}
+
+// int64Ptr returns the pointer to n.
+func int64Ptr(n int64) *int64 {
+	return &n
+}
+
+// TestSyncPathConfigMruby verifies that mruby script in path configuration is set to upstream, either inline or from ConfigMap, and
+// the built-in features are composed into a single script.
+func TestSyncPathConfigMruby(t *testing.T) {
+	const (
+		inlineMruby     = "class App\nend\n"
+		configMapMruby  = "class ConfigMapApp\nend\n"
+		maintenancePage = "<html><body>Under maintenance</body></html>\n"
+	)
+
+	tests := []struct {
+		pathConfig string
+		want       string
+		// wantIgnored is true if the rule is ignored.
+		wantIgnored bool
+	}{
+		{
+			pathConfig: `{"alpha-ing.default.test/": {"mruby": "class App\nend\n"}}`,
+			want:       inlineMruby,
+		},
+		{
+			pathConfig: `{"alpha-ing.default.test/": {"mrubyConfigMapRef": "mruby/app.rb"}}`,
+			want:       configMapMruby,
+		},
+		{
+			pathConfig: `{"alpha-ing.default.test/": {"mruby": "class App\nend\n", "mrubyConfigMapRef": "mruby/app.rb"}}`,
+			want:       configMapMruby,
+		},
+		{
+			pathConfig:  `{"alpha-ing.default.test/": {"mrubyConfigMapRef": "mruby/missing.rb"}}`,
+			wantIgnored: true,
+		},
+		{
+			pathConfig: `{"other.test/": {"mruby": "class App\nend\n"}}`,
+		},
+		{
+			pathConfig: `{"alpha-ing.default.test/": {"clientMaxBodySize": "2Gi"}}`,
+			want:       string(nghttpx.CreatePathMruby(&nghttpx.PathMruby{ClientMaxBodySize: int64Ptr(2 << 30)})),
+		},
+		{
+			pathConfig:  `{"alpha-ing.default.test/": {"clientMaxBodySize": "1Mi", "mruby": "class App\nend\n"}}`,
+			wantIgnored: true,
+		},
+		{
+			pathConfig:  `{"alpha-ing.default.test/": {"clientMaxBodySize": "-1"}}`,
+			wantIgnored: true,
+		},
+		{
+			pathConfig: `{"alpha-ing.default.test/": {"rateLimitRPS": 10}}`,
+			want:       string(nghttpx.CreatePathMruby(&nghttpx.PathMruby{RateLimit: &nghttpx.RateLimit{RPS: 10, Burst: 10}})),
+		},
+		{
+			pathConfig: `{"alpha-ing.default.test/": {"rateLimitRPS": 10, "rateLimitBurst": 50}}`,
+			want:       string(nghttpx.CreatePathMruby(&nghttpx.PathMruby{RateLimit: &nghttpx.RateLimit{RPS: 10, Burst: 50}})),
+		},
+		{
+			pathConfig:  `{"alpha-ing.default.test/": {"rateLimitRPS": 0}}`,
+			wantIgnored: true,
+		},
+		{
+			pathConfig:  `{"alpha-ing.default.test/": {"rateLimitBurst": 50}}`,
+			wantIgnored: true,
+		},
+		{
+			pathConfig: `{"alpha-ing.default.test/": {"rateLimitRPS": 10, "clientMaxBodySize": "1Mi"}}`,
+			want: string(nghttpx.CreatePathMruby(&nghttpx.PathMruby{
+				RateLimit:         &nghttpx.RateLimit{RPS: 10, Burst: 10},
+				ClientMaxBodySize: int64Ptr(1 << 20),
+			})),
+		},
+		{
+			pathConfig: `{"alpha-ing.default.test/": {"rewriteTarget": "/v1/$1"}}`,
+			want:       string(nghttpx.CreatePathMruby(&nghttpx.PathMruby{Rewrite: &nghttpx.Rewrite{Target: "/v1/$1"}})),
+		},
+		{
+			pathConfig:  `{"alpha-ing.default.test/": {"rewriteTarget": "v1"}}`,
+			wantIgnored: true,
+		},
+		{
+			pathConfig:  `{"alpha-ing.default.test/": {"rewriteTarget": "/$2"}}`,
+			wantIgnored: true,
+		},
+		{
+			pathConfig: `{"alpha-ing.default.test/": {"rewriteTarget": "/", "rateLimitRPS": 10}}`,
+			want: string(nghttpx.CreatePathMruby(&nghttpx.PathMruby{
+				RateLimit: &nghttpx.RateLimit{RPS: 10, Burst: 10},
+				Rewrite:   &nghttpx.Rewrite{Target: "/"},
+			})),
+		},
+		{
+			pathConfig: `{"alpha-ing.default.test/": {"hostRewrite": "www.example.com:8080"}}`,
+			want:       string(nghttpx.CreatePathMruby(&nghttpx.PathMruby{HostRewrite: "www.example.com:8080"})),
+		},
+		{
+			pathConfig:  `{"alpha-ing.default.test/": {"hostRewrite": "www.example.com/"}}`,
+			wantIgnored: true,
+		},
+		{
+			pathConfig: `{"alpha-ing.default.test/": {"hostRewrite": "www.example.com", "rewriteTarget": "/"}}`,
+			want: string(nghttpx.CreatePathMruby(&nghttpx.PathMruby{
+				Rewrite:     &nghttpx.Rewrite{Target: "/"},
+				HostRewrite: "www.example.com",
+			})),
+		},
+		{
+			pathConfig: `{"alpha-ing.default.test/": {"errorPages": {"503": "mruby/maintenance.html"}}}`,
+			want:       string(nghttpx.CreatePathMruby(&nghttpx.PathMruby{ErrorPages: map[int][]byte{503: []byte(maintenancePage)}})),
+		},
+		{
+			pathConfig:  `{"alpha-ing.default.test/": {"errorPages": {"302": "mruby/maintenance.html"}}}`,
+			wantIgnored: true,
+		},
+		{
+			pathConfig:  `{"alpha-ing.default.test/": {"errorPages": {"503": "mruby/missing.html"}}}`,
+			wantIgnored: true,
+		},
+		{
+			pathConfig: `{"alpha-ing.default.test/": {"errorPages": {"503": "mruby/maintenance.html"}, "clientMaxBodySize": "1Mi"}}`,
+			want: string(nghttpx.CreatePathMruby(&nghttpx.PathMruby{
+				ClientMaxBodySize: int64Ptr(1 << 20),
+				ErrorPages:        map[int][]byte{503: []byte(maintenancePage)},
+			})),
+		},
+		{
+			pathConfig:  `{"alpha-ing.default.test/": {"errorPages": {"503": "mruby/maintenance.html"}, "mruby": "class App\nend\n"}}`,
+			wantIgnored: true,
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+		ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+		ing1.Annotations[pathConfigKey] = tt.pathConfig
+
+		cm := &api.ConfigMap{
+			ObjectMeta: api.ObjectMeta{
+				Name:      "mruby",
+				Namespace: bs1.Namespace,
+			},
+			Data: map[string]string{
+				"app.rb":           configMapMruby,
+				"maintenance.html": maintenancePage,
+			},
+		}
+
+		f.svcStore = append(f.svcStore, svc, bs1)
+		f.epStore = append(f.epStore, eps, be1)
+		f.ingStore = append(f.ingStore, ing1)
+		f.cmStore = append(f.cmStore, cm)
+
+		f.objects = append(f.objects, svc, eps, bs1, be1, ing1, cm)
+
+		f.prepare()
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		if tt.wantIgnored {
+			if got, want := len(ingConfig.Upstreams), 1; got != want {
+				t.Errorf("#%v: len(ingConfig.Upstreams) = %v, want %v", i, got, want)
+			}
+			continue
+		}
+
+		if got, want := len(ingConfig.Upstreams), 2; got != want {
+			t.Errorf("#%v: len(ingConfig.Upstreams) = %v, want %v", i, got, want)
+			continue
+		}
+
+		ups := ingConfig.Upstreams[0]
+		if tt.want == "" {
+			if ups.Mruby != nil {
+				t.Errorf("#%v: ups.Mruby = %+v, want nil", i, ups.Mruby)
+			}
+			continue
+		}
+
+		if ups.Mruby == nil {
+			t.Errorf("#%v: ups.Mruby is nil", i)
+			continue
+		}
+		if got, want := string(ups.Mruby.Content), tt.want; got != want {
+			t.Errorf("#%v: ups.Mruby.Content = %q, want %q", i, got, want)
+		}
+	}
+}
+
+// TestConfigMapReferenced verifies that configMapReferenced returns true only for ConfigMap referenced by path configuration.
+func TestConfigMapReferenced(t *testing.T) {
+	f := newFixture(t)
+
+	ing1 := newIngress(api.NamespaceDefault, "alpha-ing", "alpha", "80")
+	ing1.Annotations[pathConfigKey] = `{"alpha-ing.default.test/": {"mrubyConfigMapRef": "mruby/app.rb"}}`
+	ing2 := newIngress(api.NamespaceDefault, "bravo-ing", "bravo", "80")
+	ing2.Annotations[pathConfigKey] = `{"bravo-ing.default.test/": {"errorPages": {"503": "pages/maintenance.html"}}}`
+
+	f.ingStore = append(f.ingStore, ing1, ing2)
+
+	f.prepare()
+	f.setupStore()
+
+	tests := []struct {
+		namespace string
+		name      string
+		want      bool
+	}{
+		{namespace: api.NamespaceDefault, name: "mruby", want: true},
+		{namespace: api.NamespaceDefault, name: "pages", want: true},
+		{namespace: api.NamespaceDefault, name: "other"},
+		{namespace: "kube-system", name: "mruby"},
+	}
+
+	for i, tt := range tests {
+		if got, want := f.lbc.configMapReferenced(tt.namespace, tt.name), tt.want; got != want {
+			t.Errorf("#%v: f.lbc.configMapReferenced(%v, %v) = %v, want %v", i, tt.namespace, tt.name, got, want)
+		}
+	}
+}
+
+// TestRemoveAddressFromLoadBalancerIngressDeletedIngress verifies that removeAddressFromLoadBalancerIngress completes without error
+// if Ingress has been deleted since it was cached.
+func TestRemoveAddressFromLoadBalancerIngressDeletedIngress(t *testing.T) {
+	f := newFixture(t)
+
+	po := newIngPod(defaultRuntimeInfo.PodName, "alpha.test")
+	node := newNode("alpha.test", api.NodeAddress{Type: api.NodeExternalIP, Address: "192.168.0.1"})
+
+	lbIngs := []api.LoadBalancerIngress{{IP: "192.168.0.1"}, {IP: "192.168.0.2"}}
+
+	ing1 := newIngress(api.NamespaceDefault, "delta-ing", "delta", "80")
+	ing1.Status.LoadBalancer.Ingress = lbIngs
+
+	f.podStore = append(f.podStore, po)
+	f.nodeStore = append(f.nodeStore, node)
+	f.ingStore = append(f.ingStore, ing1)
+
+	// ing1 is only in cache.
+	f.objects = append(f.objects, po, node)
+
+	f.prepare()
+	f.setupStore()
+
+	done := make(chan error)
+	go func() {
+		done <- f.lbc.removeAddressFromLoadBalancerIngress()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("f.lbc.removeAddressFromLoadBalancerIngress() returned unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("f.lbc.removeAddressFromLoadBalancerIngress() did not complete in time")
+	}
+
+	for _, action := range f.clientset.Actions() {
+		if action.GetVerb() == "update" {
+			t.Errorf("Unexpected action %+v", action)
+		}
+	}
+}
+
+// TestSyncEndpointSelector verifies that only the endpoints whose Pod matches endpoint selector become backends.
+func TestSyncEndpointSelector(t *testing.T) {
+	tests := []struct {
+		endpointSelector string
+		want             []string
+	}{
+		{
+			want: []string{"192.168.10.1", "192.168.10.2", "192.168.10.3"},
+		},
+		{
+			endpointSelector: "version=blue",
+			want:             []string{"192.168.10.1"},
+		},
+		{
+			endpointSelector: "version in (blue, green)",
+			want:             []string{"192.168.10.1", "192.168.10.2"},
+		},
+		{
+			endpointSelector: "version in (",
+			// Invalid selector matches nothing.
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1", "192.168.10.2", "192.168.10.3"})
+		ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+		if tt.endpointSelector != "" {
+			ing1.Annotations[backendConfigKey] = fmt.Sprintf(`{"alpha": {"80": {"endpointSelector": %q}}}`, tt.endpointSelector)
+		}
+
+		var pods []*api.Pod
+		for j, version := range []string{"blue", "green"} {
+			pod := &api.Pod{
+				ObjectMeta: api.ObjectMeta{
+					Name:      fmt.Sprintf("alpha-pod-%v", j),
+					Namespace: bs1.Namespace,
+					Labels: map[string]string{
+						"k8s-app": "test",
+						"version": version,
+					},
+				},
+			}
+			be1.Subsets[0].Addresses[j].TargetRef = &api.ObjectReference{
+				Kind:      "Pod",
+				Namespace: pod.Namespace,
+				Name:      pod.Name,
+			}
+			pods = append(pods, pod)
+		}
+
+		f.svcStore = append(f.svcStore, svc, bs1)
+		f.epStore = append(f.epStore, eps, be1)
+		f.ingStore = append(f.ingStore, ing1)
+		f.podStore = append(f.podStore, pods...)
+
+		f.objects = append(f.objects, svc, eps, bs1, be1, ing1, pods[0], pods[1])
+
+		f.prepare()
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		var addrs []string
+		for _, ups := range ingConfig.Upstreams {
+			if ups.Host != ing1.Spec.Rules[0].Host {
+				continue
+			}
+			for _, backend := range ups.Backends {
+				addrs = append(addrs, backend.Address)
+			}
+		}
+
+		if got, want := addrs, tt.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("#%v: addrs = %v, want %v", i, got, want)
+		}
+	}
+}
+
+// TestSyncEndpointWeightLabel verifies that the weight of endpoint is taken from the label of its Pod if endpointWeightLabel is
+// set.
+func TestSyncEndpointWeightLabel(t *testing.T) {
+	const weightLabel = "ingress.zlab.co.jp/weight"
+
+	tests := []struct {
+		endpointWeightLabel string
+		want                []uint32
+	}{
+		{
+			want: []uint32{0, 0, 0},
+		},
+		{
+			endpointWeightLabel: weightLabel,
+			// The third endpoint has no Pod, and the second one has invalid weight.
+			want: []uint32{10, 0, 0},
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1", "192.168.10.2", "192.168.10.3"})
+		ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+
+		var pods []*api.Pod
+		for j, weight := range []string{"10", "low"} {
+			pod := &api.Pod{
+				ObjectMeta: api.ObjectMeta{
+					Name:      fmt.Sprintf("alpha-pod-%v", j),
+					Namespace: bs1.Namespace,
+					Labels: map[string]string{
+						"k8s-app":   "test",
+						weightLabel: weight,
+					},
+				},
+			}
+			be1.Subsets[0].Addresses[j].TargetRef = &api.ObjectReference{
+				Kind:      "Pod",
+				Namespace: pod.Namespace,
+				Name:      pod.Name,
+			}
+			pods = append(pods, pod)
+		}
+
+		f.svcStore = append(f.svcStore, svc, bs1)
+		f.epStore = append(f.epStore, eps, be1)
+		f.ingStore = append(f.ingStore, ing1)
+		f.podStore = append(f.podStore, pods...)
+
+		f.objects = append(f.objects, svc, eps, bs1, be1, ing1, pods[0], pods[1])
+
+		f.prepare()
+		f.lbc.endpointWeightLabel = tt.endpointWeightLabel
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		var weights []uint32
+		for _, ups := range ingConfig.Upstreams {
+			if ups.Host != ing1.Spec.Rules[0].Host {
+				continue
+			}
+			for _, backend := range ups.Backends {
+				weights = append(weights, backend.Weight)
+			}
+		}
+
+		if got, want := weights, tt.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("#%v: weights = %v, want %v", i, got, want)
+		}
+	}
+}
+
+// TestSyncIPv6Endpoints verifies that IPv6 endpoint addresses are used as backend addresses as is.
+func TestSyncIPv6Endpoints(t *testing.T) {
+	f := newFixture(t)
+
+	svc, eps := newDefaultBackend()
+
+	bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"2001:db8::1", "2001:db8::2"})
+	ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+
+	f.svcStore = append(f.svcStore, svc, bs1)
+	f.epStore = append(f.epStore, eps, be1)
+	f.ingStore = append(f.ingStore, ing1)
+
+	f.objects = append(f.objects, svc, eps, bs1, be1, ing1)
+
+	f.prepare()
+	f.run(getKey(svc, t))
+
+	fm := f.lbc.nghttpx.(*fakeManager)
+	ingConfig := fm.ingConfig
+
+	var addrs []string
+	for _, backend := range ingConfig.Upstreams[0].Backends {
+		addrs = append(addrs, backend.Address)
+	}
+
+	if got, want := addrs, []string{"2001:db8::1", "2001:db8::2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("addrs = %v, want %v", got, want)
+	}
+}
+
+// TestReloadWorkerAppliesLatest verifies that reloadWorker applies only the latest computed configuration.
+func TestReloadWorkerAppliesLatest(t *testing.T) {
+	f := newFixture(t)
+	f.prepare()
+
+	applied := make(chan *nghttpx.IngressConfig, 2)
+	fm := f.lbc.nghttpx.(*fakeManager)
+	fm.checkAndReloadHandler = func(ingConfig *nghttpx.IngressConfig) (bool, error) {
+		applied <- ingConfig
+		return true, nil
+	}
+
+	cfg1 := nghttpx.NewIngressConfig()
+	cfg1.Workers = "1"
+	cfg2 := nghttpx.NewIngressConfig()
+	cfg2.Workers = "2"
+
+	f.lbc.setPendingIngConfig(syncKey, cfg1)
+	f.lbc.setPendingIngConfig(syncKey, cfg2)
+
+	go f.lbc.reloadWorker()
+	defer close(f.lbc.stopCh)
+
+	select {
+	case ingConfig := <-applied:
+		if got, want := ingConfig, cfg2; got != want {
+			t.Errorf("applied ingConfig.Workers = %v, want %v", got.Workers, want.Workers)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("Configuration has not been applied")
+	}
+
+	select {
+	case ingConfig := <-applied:
+		t.Errorf("Unexpected configuration has been applied: Workers = %v", ingConfig.Workers)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if got, want := atomic.LoadInt32(&f.lbc.configApplied), int32(1); got != want {
+		t.Errorf("f.lbc.configApplied = %v, want %v", got, want)
+	}
+}
+
+// TestRetryOrForget verifies that failed sync is retried until the number of retries reaches syncMaxRetries.
+func TestRetryOrForget(t *testing.T) {
+	f := newFixture(t)
+	f.prepare()
+	f.lbc.syncMaxRetries = 2
+	defer f.lbc.syncQueue.ShutDown()
+
+	err := fmt.Errorf("sync failed")
+
+	for i, want := range []int{1, 2} {
+		f.lbc.retryOrForget(syncKey, err)
+		if got := f.lbc.syncQueue.NumRequeues(syncKey); got != want {
+			t.Errorf("#%v: f.lbc.syncQueue.NumRequeues(syncKey) = %v, want %v", i, got, want)
+		}
+	}
+
+	f.lbc.retryOrForget(syncKey, err)
+	if got, want := f.lbc.syncQueue.NumRequeues(syncKey), 0; got != want {
+		t.Errorf("f.lbc.syncQueue.NumRequeues(syncKey) = %v, want %v", got, want)
+	}
+
+	fr := f.lbc.recorder.(*record.FakeRecorder)
+	select {
+	case e := <-fr.Events:
+		if !strings.Contains(e, "SyncFailed") {
+			t.Errorf("Unexpected event %q", e)
+		}
+	default:
+		t.Errorf("No event has been recorded")
+	}
+
+	f.lbc.retryOrForget(syncKey, err)
+	f.lbc.retryOrForget(syncKey, nil)
+	if got, want := f.lbc.syncQueue.NumRequeues(syncKey), 0; got != want {
+		t.Errorf("f.lbc.syncQueue.NumRequeues(syncKey) = %v, want %v", got, want)
+	}
+}
+
+// TestSyncIngressDefaultBackend verifies that the default backend of Ingress overrides the default backend Service.
+func TestSyncIngressDefaultBackend(t *testing.T) {
+	f := newFixture(t)
+
+	svc, eps := newDefaultBackend()
+
+	bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+	ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+	ing1.Spec.Backend = &ing1.Spec.Rules[0].HTTP.Paths[0].Backend
+	ing1.Spec.Rules = nil
+
+	f.svcStore = append(f.svcStore, svc, bs1)
+	f.epStore = append(f.epStore, eps, be1)
+	f.ingStore = append(f.ingStore, ing1)
+
+	f.objects = append(f.objects, svc, eps, bs1, be1, ing1)
+
+	f.prepare()
+	f.run(getKey(svc, t))
+
+	fm := f.lbc.nghttpx.(*fakeManager)
+	ingConfig := fm.ingConfig
+
+	if got, want := len(ingConfig.Upstreams), 1; got != want {
+		t.Fatalf("len(ingConfig.Upstreams) = %v, want %v", got, want)
+	}
+
+	ups := ingConfig.Upstreams[0]
+	if got, want := ups.Host, ""; got != want {
+		t.Errorf("ups.Host = %v, want %v", got, want)
+	}
+	if got, want := ups.Path, "/"; got != want {
+		t.Errorf("ups.Path = %v, want %v", got, want)
+	}
+
+	var addrs []string
+	for _, backend := range ups.Backends {
+		addrs = append(addrs, backend.Address)
+	}
+
+	if got, want := addrs, []string{"192.168.10.1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("addrs = %v, want %v", got, want)
+	}
+}
+
+// TestGetUpstreamServersStableOrder verifies that the order of Ingresses does not change the configuration.
+func TestGetUpstreamServersStableOrder(t *testing.T) {
+	f := newFixture(t)
+
+	svc, eps := newDefaultBackend()
+
+	bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+	ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+	ing1.Spec.Rules[0].Host = "example.test"
+	ing2 := newIngress(bs1.Namespace, "bravo-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+	ing2.Spec.Rules[0].Host = "example.test"
+	ing2.Annotations[pathConfigKey] = `{"example.test/": {"mruby": "class App\nend\n"}}`
+
+	f.svcStore = append(f.svcStore, svc, bs1)
+	f.epStore = append(f.epStore, eps, be1)
+	f.ingStore = append(f.ingStore, ing1, ing2)
+
+	f.objects = append(f.objects, svc, eps, bs1, be1, ing1, ing2)
+
+	f.prepare()
+	f.setupStore()
+
+	ingConfig1, err := f.lbc.getUpstreamServers([]*extensions.Ingress{ing1, ing2})
+	if err != nil {
+		t.Fatalf("f.lbc.getUpstreamServers(...) returned unexpected error %v", err)
+	}
+	ingConfig2, err := f.lbc.getUpstreamServers([]*extensions.Ingress{ing2, ing1})
+	if err != nil {
+		t.Fatalf("f.lbc.getUpstreamServers(...) returned unexpected error %v", err)
+	}
+
+	if got, want := ingConfig2.Upstreams, ingConfig1.Upstreams; !reflect.DeepEqual(got, want) {
+		t.Errorf("ingConfig2.Upstreams = %+v, want %+v", got, want)
+	}
+}
+
+// TestSyncDefaultBackendResponse verifies that static response is served if the default backend Service has no endpoints.
+func TestSyncDefaultBackendResponse(t *testing.T) {
+	tests := []struct {
+		addrs     []string
+		wantMruby bool
+	}{
+		{
+			wantMruby: true,
+		},
+		{
+			addrs: []string{"192.168.100.1"},
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+		eps.Subsets[0].Addresses = nil
+		for _, addr := range tt.addrs {
+			eps.Subsets[0].Addresses = append(eps.Subsets[0].Addresses, api.EndpointAddress{IP: addr})
+		}
+
+		f.svcStore = append(f.svcStore, svc)
+		f.epStore = append(f.epStore, eps)
+
+		f.objects = append(f.objects, svc, eps)
+
+		f.prepare()
+		f.lbc.defaultBackendResponseCode = 404
+		f.lbc.defaultBackendResponseBody = []byte("Not Found")
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		if got, want := len(ingConfig.Upstreams), 1; got != want {
+			t.Errorf("#%v: len(ingConfig.Upstreams) = %v, want %v", i, got, want)
+			continue
+		}
+
+		ups := ingConfig.Upstreams[0]
+		if !tt.wantMruby {
+			if ups.Mruby != nil {
+				t.Errorf("#%v: ups.Mruby = %+v, want nil", i, ups.Mruby)
+			}
+			continue
+		}
+
+		if ups.Mruby == nil {
+			t.Errorf("#%v: ups.Mruby is nil", i)
+			continue
+		}
+		if got, want := string(ups.Mruby.Content), string(nghttpx.CreateStaticResponseMruby(404, []byte("Not Found"))); got != want {
+			t.Errorf("#%v: ups.Mruby.Content = %q, want %q", i, got, want)
+		}
+	}
+}
+
+// TestSyncAllowHTTP verifies that cleartext HTTP requests are rejected rather than redirected if allow-http annotation is "false".
+// The check is composed with the other mruby features of the rule.
+func TestSyncAllowHTTP(t *testing.T) {
+	tests := []struct {
+		allowHTTP  string
+		pathConfig string
+		// wantMruby is the expected mruby script.  If it is nil, no mruby script is expected, and the cleartext HTTP requests are
+		// redirected.
+		wantMruby *nghttpx.PathMruby
+	}{
+		{},
+		{
+			allowHTTP: "true",
+		},
+		{
+			allowHTTP: "false",
+			wantMruby: &nghttpx.PathMruby{DenyPlaintext: true},
+		},
+		{
+			allowHTTP:  "false",
+			pathConfig: `{"alpha-ing.default.test/": {"mruby": "class App\nend\nApp.new\n"}}`,
+			wantMruby:  &nghttpx.PathMruby{DenyPlaintext: true, User: []byte("class App\nend\nApp.new\n")},
+		},
+		{
+			allowHTTP:  "false",
+			pathConfig: `{"alpha-ing.default.test/": {"rewriteTarget": "/"}}`,
+			wantMruby:  &nghttpx.PathMruby{DenyPlaintext: true, Rewrite: &nghttpx.Rewrite{Target: "/"}},
+		},
+	}
+
+	for i, tt := range tests {
+		f := newFixture(t)
+
+		svc, eps := newDefaultBackend()
+
+		bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+		ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+		if tt.allowHTTP != "" {
+			ing1.Annotations[allowHTTPKey] = tt.allowHTTP
+		}
+		if tt.pathConfig != "" {
+			ing1.Annotations[pathConfigKey] = tt.pathConfig
+		}
+
+		f.svcStore = append(f.svcStore, svc, bs1)
+		f.epStore = append(f.epStore, eps, be1)
+		f.ingStore = append(f.ingStore, ing1)
+
+		f.objects = append(f.objects, svc, eps, bs1, be1, ing1)
+
+		f.prepare()
+		f.run(getKey(svc, t))
+
+		fm := f.lbc.nghttpx.(*fakeManager)
+		ingConfig := fm.ingConfig
+
+		if got, want := len(ingConfig.Upstreams), 2; got != want {
+			t.Errorf("#%v: len(ingConfig.Upstreams) = %v, want %v", i, got, want)
+			continue
+		}
+
+		ups := ingConfig.Upstreams[0]
+		if tt.wantMruby == nil {
+			if ups.Mruby != nil {
+				t.Errorf("#%v: ups.Mruby = %+v, want nil", i, ups.Mruby)
+			}
+			continue
+		}
+
+		if ups.Mruby == nil {
+			t.Errorf("#%v: ups.Mruby is nil", i)
+			continue
+		}
+		if got, want := string(ups.Mruby.Content), string(nghttpx.CreatePathMruby(tt.wantMruby)); got != want {
+			t.Errorf("#%v: ups.Mruby.Content = %q, want %q", i, got, want)
+		}
+		if ups.RedirectIfNotTLS {
+			t.Errorf("#%v: ups.RedirectIfNotTLS = true, want false", i)
+		}
+	}
+}
+
+// TestFullResync verifies that fullResync enqueues syncKey periodically, and invalidates the cached upstreams.
+func TestFullResync(t *testing.T) {
+	f := newFixture(t)
+	f.prepare()
+	f.lbc.fullResyncPeriod = 10 * time.Millisecond
+
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		f.lbc.fullResync(stopCh)
+		close(doneCh)
+	}()
+
+	key, _ := f.lbc.syncQueue.Get()
+	close(stopCh)
+	<-doneCh
+
+	if got, want := key, syncKey; got != want {
+		t.Errorf("key = %v, want %v", got, want)
+	}
+	if got := atomic.LoadUint64(&f.lbc.upstreamsGeneration); got == 0 {
+		t.Errorf("f.lbc.upstreamsGeneration = %v, want > 0", got)
+	}
+}
+
+// TestSyncReloadedIngressEvent verifies that Reloaded Event is recorded only on the Ingress whose configuration changed, and its
+// reload counter is incremented.
+func TestSyncReloadedIngressEvent(t *testing.T) {
+	f := newFixture(t)
+
+	svc, eps := newDefaultBackend()
+
+	bs1, be1 := newBackend(api.NamespaceDefault, "alpha", []string{"192.168.10.1"})
+	bs2, be2 := newBackend(api.NamespaceDefault, "bravo", []string{"192.168.10.2"})
+	ing1 := newIngress(bs1.Namespace, "alpha-ing", bs1.Name, bs1.Spec.Ports[0].TargetPort.String())
+	ing2 := newIngress(bs2.Namespace, "bravo-ing", bs2.Name, bs2.Spec.Ports[0].TargetPort.String())
+
+	f.svcStore = append(f.svcStore, svc, bs1, bs2)
+	f.epStore = append(f.epStore, eps, be1, be2)
+	f.ingStore = append(f.ingStore, ing1, ing2)
+
+	f.objects = append(f.objects, svc, eps, bs1, be1, bs2, be2, ing1, ing2)
+
+	f.prepare()
+	f.run(getKey(svc, t))
+
+	recorder := f.lbc.recorder.(*record.FakeRecorder)
+	select {
+	case e := <-recorder.Events:
+		t.Errorf("Unexpected event %v", e)
+	default:
+	}
+
+	updatedIng1 := *ing1
+	updatedIng1.Annotations = map[string]string{backendConfigKey: `{"alpha": {"80": {"proto": "h2"}}}`}
+	for k, v := range ing1.Annotations {
+		updatedIng1.Annotations[k] = v
+	}
+	f.lbc.ingLister.indexer.Update(&updatedIng1)
+
+	if err := f.lbc.sync(syncKey); err != nil {
+		t.Fatalf("f.lbc.sync(%q) returned unexpected error %v", syncKey, err)
+	}
+
+	select {
+	case e := <-recorder.Events:
+		if got, want := e, "Normal Reloaded nghttpx configuration was reloaded with the change of this Ingress"; got != want {
+			t.Errorf("event = %q, want %q", got, want)
+		}
+	default:
+		t.Fatalf("No event was recorded")
+	}
+	select {
+	case e := <-recorder.Events:
+		t.Errorf("Unexpected event %v", e)
+	default:
+	}
+
+	reg := metrics.NewRegistry()
+	reg.MustRegister(f.lbc.ingressReloads)
+
+	var buf bytes.Buffer
+	if err := reg.Write(&buf); err != nil {
+		t.Fatalf("reg.Write(...) returned unexpected error %v", err)
+	}
+
+	if want := `nghttpx_ingress_reloads_total{namespace="default",ingress="alpha-ing"} 1` + "\n"; !strings.Contains(buf.String(), want) {
+		t.Errorf("metrics = %q, does not contain %q", buf.String(), want)
+	}
+	if strings.Contains(buf.String(), "bravo-ing") {
+		t.Errorf("metrics = %q, contains bravo-ing", buf.String())
+	}
+}
@@ -25,16 +25,25 @@ limitations under the License.
 package controller
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
+	"io"
 	"math/rand"
+	"net"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/apis/extensions"
 	"k8s.io/kubernetes/pkg/client/cache"
 	"k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
 	extensionslisters "k8s.io/kubernetes/pkg/client/listers/extensions/internalversion"
+
+	"github.com/zlabjp/nghttpx-ingress-lb/pkg/nghttpx"
 )
 
 // ingressLister makes a Store that lists Ingresses.
@@ -152,3 +161,467 @@ func removeAddressFromLoadBalancerIngress(a []api.LoadBalancerIngress, addr stri
 	}
 	return a[:p]
 }
+
+// ingressRules returns the rules of ing.  If ing has default backend, it is included as the rule with empty host and path "/", unless
+// ing has such rule explicitly.
+func ingressRules(ing *extensions.Ingress) []extensions.IngressRule {
+	if ing.Spec.Backend == nil {
+		return ing.Spec.Rules
+	}
+
+	for i, _ := range ing.Spec.Rules {
+		rule := &ing.Spec.Rules[i]
+		if rule.Host != "" || rule.HTTP == nil {
+			continue
+		}
+		for i, _ := range rule.HTTP.Paths {
+			if path := rule.HTTP.Paths[i].Path; path == "" || path == "/" {
+				return ing.Spec.Rules
+			}
+		}
+	}
+
+	rules := make([]extensions.IngressRule, len(ing.Spec.Rules), len(ing.Spec.Rules)+1)
+	copy(rules, ing.Spec.Rules)
+
+	return append(rules, extensions.IngressRule{
+		IngressRuleValue: extensions.IngressRuleValue{
+			HTTP: &extensions.HTTPIngressRuleValue{
+				Paths: []extensions.HTTPIngressPath{
+					{
+						Path:    "/",
+						Backend: *ing.Spec.Backend,
+					},
+				},
+			},
+		},
+	})
+}
+
+// canonicalAddress returns addr in canonical form if it is an IP address.  Otherwise, it returns addr as is.  This makes
+// uniqLoadBalancerIngress remove the same IP address written in different forms, including IPv4-mapped IPv6 address.
+func canonicalAddress(addr string) string {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.String()
+	}
+	return addr
+}
+
+// isDefaultUpstream returns true if upstream is the catch-all rule, that is, it has empty host and path "/".
+func isDefaultUpstream(upstream *nghttpx.Upstream) bool {
+	return upstream.Host == "" && (upstream.Path == "" || upstream.Path == "/")
+}
+
+// ingressOlder returns true if a was created before b.  Ingresses created at the same time are ordered by namespace and name.
+func ingressOlder(a, b *extensions.Ingress) bool {
+	if !a.CreationTimestamp.Equal(b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(b.CreationTimestamp)
+	}
+	return a.Namespace < b.Namespace || (a.Namespace == b.Namespace && a.Name < b.Name)
+}
+
+// redactTLSCred returns a copy of cred without the content of private key.
+func redactTLSCred(cred *nghttpx.TLSCred) *nghttpx.TLSCred {
+	c := *cred
+	c.Key.Content = nil
+	return &c
+}
+
+// createSNIMapping returns the mapping from host name to the list of Secrets which contain the certificate for the host.  The
+// list of Secrets is sorted in the ascending order.
+func createSNIMapping(creds []*nghttpx.TLSCred) map[string][]string {
+	m := make(map[string][]string)
+	for _, cred := range creds {
+		for _, host := range cred.Hosts {
+			if host == "" {
+				continue
+			}
+			secrets := m[host]
+			dup := false
+			for _, s := range secrets {
+				if s == cred.Secret {
+					dup = true
+					break
+				}
+			}
+			if !dup {
+				m[host] = append(secrets, cred.Secret)
+			}
+		}
+	}
+	for _, secrets := range m {
+		sort.Strings(secrets)
+	}
+	return m
+}
+
+const (
+	// maxUpstreamNameLength is the maximum length of upstream name.  Longer name is shortened by createUpstreamName.
+	maxUpstreamNameLength = 256
+	// upstreamNameHashLength is the length of hex encoded hash appended to the shortened upstream name.
+	upstreamNameHashLength = 16
+)
+
+// createUpstreamName returns the name of upstream.  The format of name is similar to backend option syntax of nghttpx.  If the
+// name is longer than maxUpstreamNameLength, it is truncated and the hash of the original name is appended to it, so that the
+// result is still unique and stable.  The second return value is true if the name is shortened.
+func createUpstreamName(namespace, serviceName, servicePort, host, path string) (string, bool) {
+	name := fmt.Sprintf("%v/%v,%v;%v%v", namespace, serviceName, servicePort, host, path)
+	if len(name) <= maxUpstreamNameLength {
+		return name, false
+	}
+
+	h := sha256.Sum256([]byte(name))
+	// "#" is prepended to hash.
+	return name[:maxUpstreamNameLength-upstreamNameHashLength-1] + "#" + hex.EncodeToString(h[:])[:upstreamNameHashLength], true
+}
+
+// assignWeightPerService assigns weights to backend servers so that traffic is split evenly among Services which share the same
+// host and path, rather than by the number of endpoints.  upstreams must have deduplicated backend servers.
+func assignWeightPerService(upstreams []*nghttpx.Upstream) {
+	groups := make(map[string][]*nghttpx.Upstream)
+	for _, ups := range upstreams {
+		key := ups.Host + ups.Path
+		groups[key] = append(groups[key], ups)
+	}
+
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+		for _, ups := range group {
+			if len(ups.Backends) == 0 {
+				continue
+			}
+			w := uint32((nghttpx.MaxBackendWeight + len(ups.Backends)/2) / len(ups.Backends))
+			if w == 0 {
+				w = 1
+			}
+			for i := range ups.Backends {
+				ups.Backends[i].Weight = w
+			}
+		}
+	}
+}
+
+// normalizePath returns the path pattern for Path in Ingress.  Empty path is normalized to "/".  If strict is true, path which does
+// not start with "/" is rejected with an error.  Otherwise, it is returned as is.  Other paths are returned unchanged.
+func normalizePath(path string, strict bool) (string, error) {
+	switch {
+	case path == "":
+		return "/", nil
+	case strict && !strings.HasPrefix(path, "/"):
+		return "", fmt.Errorf("Path does not start with /: %v", path)
+	default:
+		return path, nil
+	}
+}
+
+// configMapRefs returns all ConfigMap references in the form of name/key in pc.  pc may be nil.
+func configMapRefs(pc *nghttpx.PathConfig) []string {
+	if pc == nil {
+		return nil
+	}
+	var refs []string
+	if pc.MrubyConfigMapRef != nil {
+		refs = append(refs, *pc.MrubyConfigMapRef)
+	}
+	for _, ref := range pc.ErrorPages {
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// parseConfigMapRef parses ref in the form of name/key, and returns name and key.
+func parseConfigMapRef(ref string) (string, string, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid ConfigMap reference format (name/key): %v", ref)
+	}
+	return parts[0], parts[1], nil
+}
+
+// validateRewriteTarget returns an error if target is not a valid rewriteTarget.  It must start with "/", and "$1" is the only
+// allowed reference.
+func validateRewriteTarget(target string) error {
+	if !strings.HasPrefix(target, "/") {
+		return fmt.Errorf("rewriteTarget must start with /: %v", target)
+	}
+	for i := 0; i < len(target)-1; i++ {
+		if target[i] == '$' && target[i+1] >= '0' && target[i+1] <= '9' && target[i+1] != '1' {
+			return fmt.Errorf("rewriteTarget may only refer to $1: %v", target)
+		}
+	}
+	return nil
+}
+
+// validateHostRewrite returns an error if host is not a valid hostRewrite.  It must be a host name or IP address optionally
+// followed by port.
+func validateHostRewrite(host string) error {
+	if host == "" {
+		return fmt.Errorf("hostRewrite must not be empty")
+	}
+	for _, c := range host {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune(`/?#@\`, c) {
+			return fmt.Errorf("hostRewrite contains invalid character: %q", host)
+		}
+	}
+	return nil
+}
+
+// minIntervalRateLimiter is flowcontrol.RateLimiter which guarantees at least 1/qps seconds between any two accepted requests.
+// Unlike token bucket, it never allows a burst.
+type minIntervalRateLimiter struct {
+	qps      float32
+	interval time.Duration
+
+	// mu protects last.
+	mu sync.Mutex
+	// last is the time when the last request was, or will be accepted.
+	last time.Time
+}
+
+func newMinIntervalRateLimiter(qps float32) *minIntervalRateLimiter {
+	return &minIntervalRateLimiter{
+		qps:      qps,
+		interval: time.Duration(float64(time.Second) / float64(qps)),
+	}
+}
+
+func (r *minIntervalRateLimiter) TryAccept() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if !r.last.IsZero() && now.Sub(r.last) < r.interval {
+		return false
+	}
+	r.last = now
+	return true
+}
+
+func (r *minIntervalRateLimiter) Accept() {
+	r.mu.Lock()
+	now := time.Now()
+	next := r.last.Add(r.interval)
+	if r.last.IsZero() || !now.Before(next) {
+		r.last = now
+		r.mu.Unlock()
+		return
+	}
+	// Reserve the slot before sleeping, so that the concurrent callers are spaced out too.
+	r.last = next
+	r.mu.Unlock()
+
+	time.Sleep(next.Sub(now))
+}
+
+func (r *minIntervalRateLimiter) Stop() {}
+
+func (r *minIntervalRateLimiter) Saturation() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.last.IsZero() {
+		return 0
+	}
+	elapsed := time.Since(r.last)
+	if elapsed >= r.interval {
+		return 0
+	}
+	if elapsed < 0 {
+		return 1
+	}
+	return 1 - float64(elapsed)/float64(r.interval)
+}
+
+func (r *minIntervalRateLimiter) QPS() float32 {
+	return r.qps
+}
+
+// ingressHash returns the hash for ing in hashes, creating it if it does not exist.
+func ingressHash(hashes map[string]hash.Hash, ing *extensions.Ingress) hash.Hash {
+	key := ing.Namespace + "/" + ing.Name
+	h, ok := hashes[key]
+	if !ok {
+		h = sha256.New()
+		hashes[key] = h
+	}
+	return h
+}
+
+// writeUpstream writes the content of ups which affects nghttpx configuration to w.  The backends are sorted, so that the order in
+// which they were found does not matter.
+func writeUpstream(w io.Writer, ups *nghttpx.Upstream) {
+	backends := make([]string, len(ups.Backends))
+	for i := range ups.Backends {
+		backends[i] = fmt.Sprintf("%+v", ups.Backends[i])
+	}
+	sort.Strings(backends)
+
+	fmt.Fprintf(w, "%v;%v;%v;%v", ups.Name, ups.Host, ups.Path, ups.RedirectIfNotTLS)
+	if ups.Mruby != nil {
+		fmt.Fprintf(w, ";%v", ups.Mruby.Checksum)
+	}
+	for _, backend := range backends {
+		fmt.Fprintf(w, ";%v", backend)
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+// commentAnnotationKeys is the list of annotation keys which affect nghttpx configuration, and are rendered as comments by
+// ingressComments.
+var commentAnnotationKeys = []string{backendConfigKey, pathConfigKey, allowHTTPKey}
+
+// ingressComments returns the comments which describe ing and its annotations that affect nghttpx configuration.  Each comment is a
+// single line.
+func ingressComments(ing *extensions.Ingress) []string {
+	comments := []string{fmt.Sprintf("ingress: %v/%v", ing.Namespace, ing.Name)}
+	for _, key := range commentAnnotationKeys {
+		v, ok := ing.Annotations[key]
+		if !ok {
+			continue
+		}
+		// Collapse white spaces including new lines, so that the value does not end the comment.
+		comments = append(comments, fmt.Sprintf("%v: %v", key, strings.Join(strings.Fields(v), " ")))
+	}
+	return comments
+}
+
+// ingressUpstream is an upstream paired with the Ingress which it is created from.
+type ingressUpstream struct {
+	ing      *extensions.Ingress
+	upstream *nghttpx.Upstream
+}
+
+// certMatchesHost returns true if defaultCred or one of creds has a certificate for host.  defaultCred may be nil.
+func certMatchesHost(defaultCred *nghttpx.TLSCred, creds []*nghttpx.TLSCred, host string) bool {
+	if defaultCred != nil {
+		creds = append([]*nghttpx.TLSCred{defaultCred}, creds...)
+	}
+	for _, cred := range creds {
+		for _, pattern := range cred.Hosts {
+			if hostMatches(pattern, host) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ingressListsTLSHost returns true if host is listed in spec.tls of ing.
+func ingressListsTLSHost(ing *extensions.Ingress, host string) bool {
+	for i := range ing.Spec.TLS {
+		for _, pattern := range ing.Spec.TLS[i].Hosts {
+			if hostMatches(pattern, host) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hostMatches returns true if host matches pattern which is a host name in certificate.  The wildcard "*" is only allowed as the
+// leftmost label, and matches exactly one label.
+func hostMatches(pattern, host string) bool {
+	pattern, host = strings.ToLower(pattern), strings.ToLower(host)
+	if pattern == "" {
+		return false
+	}
+	if !strings.HasPrefix(pattern, "*.") {
+		return pattern == host
+	}
+	i := strings.Index(host, ".")
+	if i <= 0 {
+		return false
+	}
+	return host[i:] == pattern[1:]
+}
+
+// slowStartWeight returns the weight of a backend which was added elapsed ago, and whose slow start duration is window.  The weight
+// increases linearly from 1 to weight.
+func slowStartWeight(weight uint32, elapsed, window time.Duration) uint32 {
+	if elapsed >= window {
+		return weight
+	}
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	w := uint32(uint64(weight) * uint64(elapsed) / uint64(window))
+	if w == 0 {
+		w = 1
+	}
+	return w
+}
+
+const (
+	// backendDialTimeout is the timeout of TCP connection attempt to a backend in waitBackendsReachable.
+	backendDialTimeout = time.Second
+	// backendDialRetryInterval is the interval between the rounds of TCP connection attempts in waitBackendsReachable.
+	backendDialRetryInterval = time.Second
+)
+
+// sampleBackends returns at most n backends from ingConfig which are reachable over TCP.  The default backend served by the
+// controller itself, and Unix domain socket backends are excluded.  The same address and port is returned only once.
+func sampleBackends(ingConfig *nghttpx.IngressConfig, n int) []nghttpx.UpstreamServer {
+	defaultServer := nghttpx.NewDefaultServer()
+	seen := make(map[string]bool)
+	var backends []nghttpx.UpstreamServer
+	for _, ups := range ingConfig.Upstreams {
+		for _, backend := range ups.Backends {
+			if len(backends) == n {
+				return backends
+			}
+			if backend.UnixSocketPath != "" ||
+				(backend.Address == defaultServer.Address && backend.Port == defaultServer.Port) {
+				continue
+			}
+			hostport := net.JoinHostPort(backend.Address, backend.Port)
+			if seen[hostport] {
+				continue
+			}
+			seen[hostport] = true
+			backends = append(backends, backend)
+		}
+	}
+	return backends
+}
+
+// waitBackendsReachable tries to connect to backends over TCP until at least one of them accepts connection, or timeout elapses.
+// It returns true if any backend is reachable, or backends is empty.
+func waitBackendsReachable(backends []nghttpx.UpstreamServer, timeout time.Duration) bool {
+	if len(backends) == 0 {
+		return true
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		ch := make(chan bool, len(backends))
+		for _, backend := range backends {
+			go func(hostport string) {
+				conn, err := net.DialTimeout("tcp", hostport, backendDialTimeout)
+				if err != nil {
+					ch <- false
+					return
+				}
+				conn.Close()
+				ch <- true
+			}(net.JoinHostPort(backend.Address, backend.Port))
+		}
+
+		reachable := false
+		for range backends {
+			if <-ch {
+				reachable = true
+			}
+		}
+		if reachable {
+			return true
+		}
+
+		if time.Now().Add(backendDialRetryInterval).After(deadline) {
+			return false
+		}
+		time.Sleep(backendDialRetryInterval)
+	}
+}
@@ -9,10 +9,17 @@
 package controller
 
 import (
+	"net"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/apis/extensions"
+	"k8s.io/kubernetes/pkg/util/intstr"
+
+	"github.com/zlabjp/nghttpx-ingress-lb/pkg/nghttpx"
 )
 
 // TestSortLoadBalancerIngress verifies that sortLoadBalancerIngress sorts given items.
@@ -123,3 +130,315 @@ func TestUtilRemoveAddressFromLoadBalancerIngress(t *testing.T) {
 		}
 	}
 }
+
+// TestCreateUpstreamName verifies that createUpstreamName shortens long name into stable and unique name.
+func TestCreateUpstreamName(t *testing.T) {
+	longPath := "/" + strings.Repeat("a", maxUpstreamNameLength)
+
+	name, shortened := createUpstreamName("default", "alpha", "80", "alpha.test", "/")
+	if got, want := name, "default/alpha,80;alpha.test/"; got != want {
+		t.Errorf("createUpstreamName(...) = %v, want %v", got, want)
+	}
+	if shortened {
+		t.Errorf("shortened = %v, want %v", shortened, false)
+	}
+
+	name1, shortened := createUpstreamName("default", "alpha", "80", "alpha.test", longPath)
+	if !shortened {
+		t.Errorf("shortened = %v, want %v", shortened, true)
+	}
+	if got, want := len(name1), maxUpstreamNameLength; got != want {
+		t.Errorf("len(name1) = %v, want %v", got, want)
+	}
+
+	if got, _ := createUpstreamName("default", "alpha", "80", "alpha.test", longPath); got != name1 {
+		t.Errorf("createUpstreamName(...) = %v, want %v", got, name1)
+	}
+
+	// Only the last byte differs, which is truncated.
+	name2, _ := createUpstreamName("default", "alpha", "80", "alpha.test", longPath+"b")
+	name3, _ := createUpstreamName("default", "alpha", "80", "alpha.test", longPath+"c")
+	if name2 == name3 || name1 == name2 {
+		t.Errorf("createUpstreamName(...) returned the same name for the different paths: %v, %v, %v", name1, name2, name3)
+	}
+}
+
+// TestNormalizePath verifies normalizePath.
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		strict  bool
+		want    string
+		wantErr bool
+	}{
+		{path: "", strict: true, want: "/"},
+		{path: "", want: "/"},
+		{path: "/alpha", strict: true, want: "/alpha"},
+		{path: "foo", strict: true, wantErr: true},
+		{path: "foo", want: "foo"},
+		{path: "//double", strict: true, want: "//double"},
+		{path: "//double", want: "//double"},
+	}
+
+	for i, tt := range tests {
+		got, err := normalizePath(tt.path, tt.strict)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("#%v: normalizePath(%q, %v) succeeded, want error", i, tt.path, tt.strict)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%v: normalizePath(%q, %v) returned unexpected error %v", i, tt.path, tt.strict, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("#%v: normalizePath(%q, %v) = %v, want %v", i, tt.path, tt.strict, got, tt.want)
+		}
+	}
+}
+
+// TestValidateRewriteTarget verifies validateRewriteTarget.
+func TestValidateRewriteTarget(t *testing.T) {
+	tests := []struct {
+		target  string
+		wantErr bool
+	}{
+		{target: "/"},
+		{target: "/v1/$1"},
+		{target: "/$1/$1"},
+		{target: "/price$"},
+		{target: "/$a"},
+		{target: "", wantErr: true},
+		{target: "v1", wantErr: true},
+		{target: "/$0", wantErr: true},
+		{target: "/$1/$2", wantErr: true},
+	}
+
+	for i, tt := range tests {
+		err := validateRewriteTarget(tt.target)
+		if got, want := err != nil, tt.wantErr; got != want {
+			t.Errorf("#%v: validateRewriteTarget(%q) returned error %v, wantErr %v", i, tt.target, err, tt.wantErr)
+		}
+	}
+}
+
+// TestValidateHostRewrite verifies validateHostRewrite.
+func TestValidateHostRewrite(t *testing.T) {
+	tests := []struct {
+		host    string
+		wantErr bool
+	}{
+		{host: "www.example.com"},
+		{host: "www.example.com:8080"},
+		{host: "192.168.0.1"},
+		{host: "[::1]:443"},
+		{host: "", wantErr: true},
+		{host: "www.example.com/", wantErr: true},
+		{host: "user@www.example.com", wantErr: true},
+		{host: "www example com", wantErr: true},
+		{host: "www.example.com\r\nfoo: bar", wantErr: true},
+	}
+
+	for i, tt := range tests {
+		err := validateHostRewrite(tt.host)
+		if got, want := err != nil, tt.wantErr; got != want {
+			t.Errorf("#%v: validateHostRewrite(%q) returned error %v, wantErr %v", i, tt.host, err, tt.wantErr)
+		}
+	}
+}
+
+// TestIngressComments verifies ingressComments.
+func TestIngressComments(t *testing.T) {
+	ing := &extensions.Ingress{
+		ObjectMeta: api.ObjectMeta{
+			Name:      "alpha-ing",
+			Namespace: "default",
+			Annotations: map[string]string{
+				backendConfigKey: "{\"alpha\": {\"80\": {\"proto\": \"h2\"}}}\n",
+				allowHTTPKey:     "false",
+				"unrelated":      "foo",
+			},
+		},
+	}
+
+	want := []string{
+		"ingress: default/alpha-ing",
+		`ingress.zlab.co.jp/backend-config: {"alpha": {"80": {"proto": "h2"}}}`,
+		"kubernetes.io/ingress.allow-http: false",
+	}
+	if got := ingressComments(ing); !reflect.DeepEqual(got, want) {
+		t.Errorf("ingressComments(...) = %q, want %q", got, want)
+	}
+}
+
+// TestHostMatches verifies hostMatches.
+func TestHostMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{pattern: "alpha.test", host: "alpha.test", want: true},
+		{pattern: "Alpha.Test", host: "alpha.test", want: true},
+		{pattern: "alpha.test", host: "bravo.test"},
+		{pattern: "*.test", host: "alpha.test", want: true},
+		{pattern: "*.test", host: "alpha.bravo.test"},
+		{pattern: "*.test", host: "test"},
+		{pattern: "*.test", host: ".test"},
+		{pattern: "", host: ""},
+	}
+
+	for i, tt := range tests {
+		if got, want := hostMatches(tt.pattern, tt.host), tt.want; got != want {
+			t.Errorf("#%v: hostMatches(%q, %q) = %v, want %v", i, tt.pattern, tt.host, got, want)
+		}
+	}
+}
+
+// TestMinIntervalRateLimiter verifies that minIntervalRateLimiter never accepts two requests within its interval.
+func TestMinIntervalRateLimiter(t *testing.T) {
+	r := newMinIntervalRateLimiter(20)
+
+	if got, want := r.TryAccept(), true; got != want {
+		t.Errorf("r.TryAccept() = %v, want %v", got, want)
+	}
+	if got, want := r.TryAccept(), false; got != want {
+		t.Errorf("r.TryAccept() = %v, want %v", got, want)
+	}
+	if got := r.Saturation(); got <= 0 {
+		t.Errorf("r.Saturation() = %v, want positive value", got)
+	}
+
+	start := time.Now()
+	r.Accept()
+	r.Accept()
+	// The first Accept waits until 50ms after TryAccept, and the second one waits for another 50ms.
+	if got, want := time.Since(start), 90*time.Millisecond; got < want {
+		t.Errorf("Two Accept() calls took %v, want at least %v", got, want)
+	}
+}
+
+func TestSlowStartWeight(t *testing.T) {
+	tests := []struct {
+		weight  uint32
+		elapsed time.Duration
+		window  time.Duration
+		want    uint32
+	}{
+		{weight: 256, elapsed: 0, window: 10 * time.Second, want: 1},
+		{weight: 256, elapsed: 5 * time.Second, window: 10 * time.Second, want: 128},
+		{weight: 256, elapsed: 10 * time.Second, window: 10 * time.Second, want: 256},
+		{weight: 256, elapsed: time.Minute, window: 10 * time.Second, want: 256},
+		{weight: 3, elapsed: time.Second, window: 10 * time.Second, want: 1},
+		{weight: 256, elapsed: -time.Second, window: 10 * time.Second, want: 1},
+	}
+
+	for i, tt := range tests {
+		if got, want := slowStartWeight(tt.weight, tt.elapsed, tt.window), tt.want; got != want {
+			t.Errorf("#%v: slowStartWeight(%v, %v, %v) = %v, want %v", i, tt.weight, tt.elapsed, tt.window, got, want)
+		}
+	}
+}
+
+// TestIngressRules verifies that the default backend of Ingress is included as the catch-all rule unless it is given explicitly.
+func TestIngressRules(t *testing.T) {
+	ing := newIngress(api.NamespaceDefault, "alpha-ing", "alpha", "80")
+	ing.Spec.Backend = &extensions.IngressBackend{ServiceName: "bravo", ServicePort: intstr.FromString("80")}
+
+	rules := ingressRules(ing)
+	if got, want := len(rules), 2; got != want {
+		t.Fatalf("len(rules) = %v, want %v", got, want)
+	}
+	if got, want := rules[1].HTTP.Paths[0].Backend.ServiceName, "bravo"; got != want {
+		t.Errorf("rules[1].HTTP.Paths[0].Backend.ServiceName = %v, want %v", got, want)
+	}
+	if got, want := len(ing.Spec.Rules), 1; got != want {
+		t.Errorf("len(ing.Spec.Rules) = %v, want %v", got, want)
+	}
+
+	ing.Spec.Rules[0].Host = ""
+
+	if got, want := len(ingressRules(ing)), 1; got != want {
+		t.Errorf("len(ingressRules(ing)) = %v, want %v", got, want)
+	}
+}
+
+// TestSampleBackends verifies that sampleBackends returns at most n distinct TCP backends excluding the default server.
+func TestSampleBackends(t *testing.T) {
+	ingConfig := &nghttpx.IngressConfig{
+		Upstreams: []*nghttpx.Upstream{
+			{
+				Backends: []nghttpx.UpstreamServer{
+					nghttpx.NewDefaultServer(),
+					{Address: "192.168.10.1", Port: "80"},
+					{UnixSocketPath: "/run/alpha.sock"},
+				},
+			},
+			{
+				Backends: []nghttpx.UpstreamServer{
+					{Address: "192.168.10.1", Port: "80"},
+					{Address: "192.168.10.2", Port: "80"},
+					{Address: "192.168.10.3", Port: "80"},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		n    int
+		want []string
+	}{
+		{n: 5, want: []string{"192.168.10.1", "192.168.10.2", "192.168.10.3"}},
+		{n: 2, want: []string{"192.168.10.1", "192.168.10.2"}},
+	}
+
+	for i, tt := range tests {
+		var got []string
+		for _, backend := range sampleBackends(ingConfig, tt.n) {
+			got = append(got, backend.Address)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("#%v: sampleBackends(ingConfig, %v) = %v, want %v", i, tt.n, got, tt.want)
+		}
+	}
+}
+
+// TestWaitBackendsReachable verifies that waitBackendsReachable returns true if any backend accepts connection, and false if none
+// of them does within timeout.
+func TestWaitBackendsReachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen(...) returned unexpected error %v", err)
+	}
+	defer ln.Close()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen(...) returned unexpected error %v", err)
+	}
+	closed.Close()
+
+	newBackend := func(addr net.Addr) nghttpx.UpstreamServer {
+		host, port, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			t.Fatalf("net.SplitHostPort(%q) returned unexpected error %v", addr, err)
+		}
+		return nghttpx.UpstreamServer{Address: host, Port: port}
+	}
+
+	tests := []struct {
+		backends []nghttpx.UpstreamServer
+		want     bool
+	}{
+		{want: true},
+		{backends: []nghttpx.UpstreamServer{newBackend(closed.Addr()), newBackend(ln.Addr())}, want: true},
+		{backends: []nghttpx.UpstreamServer{newBackend(closed.Addr())}},
+	}
+
+	for i, tt := range tests {
+		if got, want := waitBackendsReachable(tt.backends, 100*time.Millisecond), tt.want; got != want {
+			t.Errorf("#%v: waitBackendsReachable(...) = %v, want %v", i, got, want)
+		}
+	}
+}
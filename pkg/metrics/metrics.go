@@ -0,0 +1,243 @@
+/**
+ * Copyright 2017, nghttpx Ingress controller contributors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+// Package metrics implements a minimal set of metrics which are exposed in Prometheus text format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Collector is a metric family which writes its samples in Prometheus text format.
+type Collector interface {
+	// Name returns the name of metric family.
+	Name() string
+	// Write writes the metric family to w in Prometheus text format.
+	Write(w io.Writer) error
+}
+
+// Registry is a set of Collectors.
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[string]Collector
+}
+
+// NewRegistry returns new Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: make(map[string]Collector),
+	}
+}
+
+// DefaultRegistry is the Registry which the controller exposes at /metrics.
+var DefaultRegistry = NewRegistry()
+
+// MustRegister registers c to r.  It panics if a Collector of the same name has already been registered.
+func (r *Registry) MustRegister(c Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.collectors[c.Name()]; ok {
+		panic(fmt.Sprintf("metrics: %v has already been registered", c.Name()))
+	}
+	r.collectors[c.Name()] = c
+}
+
+// Write writes all registered metric families to w in Prometheus text format.  They are sorted by name.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	collectors := make([]Collector, 0, len(r.collectors))
+	for _, c := range r.collectors {
+		collectors = append(collectors, c)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(collectors, func(i, j int) bool { return collectors[i].Name() < collectors[j].Name() })
+
+	for _, c := range collectors {
+		if err := c.Write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler returns http.Handler which serves the metrics in r.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var buf bytes.Buffer
+		if err := r.Write(&buf); err != nil {
+			glog.Errorf("Could not write metrics: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+	})
+}
+
+// metricVec is the set of samples of a metric family which are partitioned by label values.
+type metricVec struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+
+	mu      sync.Mutex
+	samples map[string]*sample
+}
+
+// sample is a single sample of metric family.
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+func newMetricVec(name, help, typ string, labelNames []string) *metricVec {
+	return &metricVec{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		samples:    make(map[string]*sample),
+	}
+}
+
+// Name returns the name of metric family.
+func (v *metricVec) Name() string {
+	return v.name
+}
+
+// key returns the key of samples for labelValues.  It panics if the number of labelValues does not match the number of label
+// names.
+func (v *metricVec) key(labelValues []string) string {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metrics: %v: got %v label values, want %v", v.name, len(labelValues), len(v.labelNames)))
+	}
+	// "\xff" never appears in valid UTF-8 string.
+	return strings.Join(labelValues, "\xff")
+}
+
+// update calls f with the sample for labelValues, creating it if it does not exist.
+func (v *metricVec) update(labelValues []string, f func(s *sample)) {
+	k := v.key(labelValues)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	s, ok := v.samples[k]
+	if !ok {
+		s = &sample{labelValues: append([]string(nil), labelValues...)}
+		v.samples[k] = s
+	}
+	f(s)
+}
+
+// Delete removes the sample for labelValues.
+func (v *metricVec) Delete(labelValues ...string) {
+	k := v.key(labelValues)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	delete(v.samples, k)
+}
+
+// Reset removes all samples.
+func (v *metricVec) Reset() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.samples = make(map[string]*sample)
+}
+
+// Write writes the metric family to w in Prometheus text format.  Samples are sorted by label values.
+func (v *metricVec) Write(w io.Writer) error {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.samples))
+	for k := range v.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# HELP %v %v\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(&buf, "# TYPE %v %v\n", v.name, v.typ)
+	for _, k := range keys {
+		s := v.samples[k]
+		buf.WriteString(v.name)
+		if len(v.labelNames) > 0 {
+			buf.WriteByte('{')
+			for i, name := range v.labelNames {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				fmt.Fprintf(&buf, "%v=\"%v\"", name, escapeLabelValue(s.labelValues[i]))
+			}
+			buf.WriteByte('}')
+		}
+		fmt.Fprintf(&buf, " %v\n", strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+	v.mu.Unlock()
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// GaugeVec is a gauge metric family partitioned by label values.
+type GaugeVec struct {
+	*metricVec
+}
+
+// NewGaugeVec returns new GaugeVec.
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{newMetricVec(name, help, "gauge", labelNames)}
+}
+
+// Set sets the value of the sample for labelValues to value.
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.update(labelValues, func(s *sample) { s.value = value })
+}
+
+// CounterVec is a counter metric family partitioned by label values.
+type CounterVec struct {
+	*metricVec
+}
+
+// NewCounterVec returns new CounterVec.
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{newMetricVec(name, help, "counter", labelNames)}
+}
+
+// Inc increments the value of the sample for labelValues by 1.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.update(labelValues, func(s *sample) { s.value++ })
+}
+
+var (
+	helpReplacer       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// escapeHelp escapes s for HELP line.
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+// escapeLabelValue escapes s for label value.
+func escapeLabelValue(s string) string {
+	return labelValueReplacer.Replace(s)
+}
@@ -0,0 +1,75 @@
+/**
+ * Copyright 2017, nghttpx Ingress controller contributors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestRegistryWrite verifies that Registry.Write writes metrics in Prometheus text format.
+func TestRegistryWrite(t *testing.T) {
+	reg := NewRegistry()
+
+	g := NewGaugeVec("bravo", "Bravo help.", "name")
+	g.Set(2, `b"\`)
+	g.Set(1, "a")
+	reg.MustRegister(g)
+
+	a := NewGaugeVec("alpha", "Alpha help.")
+	a.Set(0.5)
+	reg.MustRegister(a)
+
+	var buf bytes.Buffer
+	if err := reg.Write(&buf); err != nil {
+		t.Fatalf("reg.Write(...) returned unexpected error %v", err)
+	}
+
+	want := `# HELP alpha Alpha help.
+# TYPE alpha gauge
+alpha 0.5
+# HELP bravo Bravo help.
+# TYPE bravo gauge
+bravo{name="a"} 1
+bravo{name="b\"\\"} 2
+`
+	if got := buf.String(); got != want {
+		t.Errorf("reg.Write(...) wrote %q, want %q", got, want)
+	}
+
+	g.Delete("a")
+	buf.Reset()
+	if err := g.Write(&buf); err != nil {
+		t.Fatalf("g.Write(...) returned unexpected error %v", err)
+	}
+	if got, want := buf.String(), "# HELP bravo Bravo help.\n# TYPE bravo gauge\nbravo{name=\"b\\\"\\\\\"} 2\n"; got != want {
+		t.Errorf("g.Write(...) wrote %q, want %q", got, want)
+	}
+}
+
+// TestCounterVecInc verifies that CounterVec.Inc increments the sample for the label values.
+func TestCounterVecInc(t *testing.T) {
+	c := NewCounterVec("alpha_total", "Alpha help.", "name")
+	c.Inc("a")
+	c.Inc("a")
+	c.Inc("b")
+
+	var buf bytes.Buffer
+	if err := c.Write(&buf); err != nil {
+		t.Fatalf("c.Write(...) returned unexpected error %v", err)
+	}
+
+	want := `# HELP alpha_total Alpha help.
+# TYPE alpha_total counter
+alpha_total{name="a"} 2
+alpha_total{name="b"} 1
+`
+	if got := buf.String(); got != want {
+		t.Errorf("c.Write(...) wrote %q, want %q", got, want)
+	}
+}
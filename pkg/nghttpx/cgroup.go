@@ -0,0 +1,90 @@
+/**
+ * Copyright 2017, nghttpx Ingress controller contributors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package nghttpx
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	// WorkersAuto is the special value for the number of workers which makes the controller choose it from CPU quota.
+	WorkersAuto = "auto"
+	// cgroupRoot is the directory where cgroup filesystem is mounted.
+	cgroupRoot = "/sys/fs/cgroup"
+)
+
+// ParseWorkers parses s as the number of nghttpx worker threads.  s must be either a positive integer, or WorkersAuto.  If s is
+// WorkersAuto, the number is computed from CPU quota of cgroup, and if there is no quota, the number of CPU cores is used.
+func ParseWorkers(s string) (string, error) {
+	if s == WorkersAuto {
+		return strconv.Itoa(workersFromCPUQuota(cgroupRoot)), nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return "", fmt.Errorf("workers must be a positive integer or %q: %q", WorkersAuto, s)
+	}
+	return s, nil
+}
+
+// workersFromCPUQuota returns the number of workers computed from CPU quota of cgroup mounted under root.  The result is at least 1,
+// and does not exceed the number of CPU cores.
+func workersFromCPUQuota(root string) int {
+	n := runtime.NumCPU()
+	if quota, ok := cgroupCPUQuota(root); ok {
+		if q := int(math.Ceil(quota)); q < n {
+			n = q
+		}
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// cgroupCPUQuota returns CPU quota in the number of CPUs.  It understands both cgroup v2 and v1.  It returns false if no quota is set.
+func cgroupCPUQuota(root string) (float64, bool) {
+	// cgroup v2: cpu.max contains "<quota> <period>", and quota may be "max".
+	if b, err := ioutil.ReadFile(filepath.Join(root, "cpu.max")); err == nil {
+		fields := strings.Fields(string(b))
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0, false
+		}
+		return cpuQuota(fields[0], fields[1])
+	}
+
+	// cgroup v1
+	quota, err := ioutil.ReadFile(filepath.Join(root, "cpu", "cpu.cfs_quota_us"))
+	if err != nil {
+		return 0, false
+	}
+	period, err := ioutil.ReadFile(filepath.Join(root, "cpu", "cpu.cfs_period_us"))
+	if err != nil {
+		return 0, false
+	}
+	return cpuQuota(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+// cpuQuota returns quota/period.  It returns false if quota is not positive.
+func cpuQuota(quota, period string) (float64, bool) {
+	q, err := strconv.ParseInt(quota, 10, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseInt(period, 10, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return float64(q) / float64(p), true
+}
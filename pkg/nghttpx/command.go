@@ -31,6 +31,9 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -46,8 +49,10 @@ const (
 
 // Start starts a nghttpx process, and wait.
 func (ngx *Manager) Start(stopCh <-chan struct{}) {
+	defer atomic.StoreInt32(&ngx.unsupervised, 1)
+
 	glog.Info("Starting nghttpx process...")
-	cmd := exec.Command("/usr/local/bin/nghttpx")
+	cmd := exec.Command("/usr/local/bin/nghttpx", ngx.ExtraArgs...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Start(); err != nil {
@@ -76,18 +81,90 @@ func (ngx *Manager) Start(stopCh <-chan struct{}) {
 	}
 }
 
+// Supervised implements Interface.Supervised.
+func (ngx *Manager) Supervised() bool {
+	return atomic.LoadInt32(&ngx.unsupervised) == 0
+}
+
+// reservedLongArgs is the list of nghttpx long options which the controller relies on, and cannot be given in extra arguments.
+var reservedLongArgs = []string{"--conf", "--pid-file", "--daemon"}
+
+const (
+	// reservedShortArg is the nghttpx short option which the controller relies on, and cannot be given in extra arguments.
+	reservedShortArg = 'D'
+	// shortArgsWithValue is the nghttpx short options which take a value.  The rest of the bundled short options is the value.
+	shortArgsWithValue = "Lbcfn"
+)
+
+// ValidateExtraArgs returns an error if args contains the option which the controller relies on.  Like getopt_long, nghttpx accepts
+// an unambiguous prefix of a long option, and bundled short options, so they are rejected as well.
+func ValidateExtraArgs(args []string) error {
+	for _, arg := range args {
+		switch {
+		case arg == "--":
+			// The rest is not options.
+			return nil
+		case strings.HasPrefix(arg, "--"):
+			name := arg
+			if i := strings.Index(name, "="); i != -1 {
+				name = name[:i]
+			}
+			for _, reserved := range reservedLongArgs {
+				if strings.HasPrefix(reserved, name) {
+					return fmt.Errorf("%v cannot be overridden", reserved)
+				}
+			}
+		case strings.HasPrefix(arg, "-"):
+			for _, c := range arg[1:] {
+				if c == reservedShortArg {
+					return fmt.Errorf("-%c cannot be overridden", reservedShortArg)
+				}
+				if strings.ContainsRune(shortArgsWithValue, c) {
+					break
+				}
+			}
+		}
+	}
+	return nil
+}
+
 // CheckAndReload verify if the nghttpx configuration changed and sends a reload
 //
 // The current running nghttpx master process executes new nghttpx
 // with new configuration.  If its invocation succeeds, current
 // nghttpx is going to shutdown gracefully.  The invocation of new
 // process may fail due to invalid configurations.
+//
+// How nghttpx is told to load the new configuration depends on ReloadMethod.  With ReloadMethodAPI, the backend-only change is
+// applied through backendconfig API without executing new process.  With ReloadMethodNone, the configuration files are written,
+// and nghttpx is not notified.  It returns false because nothing has been reloaded, and the files which are no longer referred to
+// are kept, because running nghttpx may still use them.
 func (ngx *Manager) CheckAndReload(ingressCfg *IngressConfig) (bool, error) {
 	mainConfig, backendConfig, err := ngx.generateCfg(ingressCfg)
 	if err != nil {
 		return false, err
 	}
 
+	if ngx.MinReloadInterval > 0 && !ngx.lastReload.IsZero() {
+		if d := ngx.MinReloadInterval - time.Now().Sub(ngx.lastReload); d > 0 {
+			mainChanged, backendChanged, err := ngx.checkCfg(mainConfig, backendConfig)
+			if err != nil {
+				return false, fmt.Errorf("failed to check nghttpx configuration: %v", err)
+			}
+			if mainChanged || backendChanged {
+				// Leave the configuration files untouched, so that the change is detected in the next attempt.
+				return false, &ReloadSuppressedError{RetryAfter: d}
+			}
+			return false, nil
+		}
+	}
+
+	// Keep the current configuration, so that we can restore it if nghttpx fails to load new configuration.
+	oldMainConfig, oldBackendConfig, err := ngx.readCfg()
+	if err != nil {
+		return false, fmt.Errorf("failed to read current nghttpx configuration. Avoiding reload: %v", err)
+	}
+
 	changed, err := ngx.checkAndWriteCfg(mainConfig, backendConfig)
 	if err != nil {
 		return false, fmt.Errorf("failed to write new nghttpx configuration. Avoiding reload: %v", err)
@@ -105,13 +182,31 @@ func (ngx *Manager) CheckAndReload(ingressCfg *IngressConfig) (bool, error) {
 		glog.Infof("nghttpx configuration:\n%v", string(b))
 	}
 
-	switch changed {
-	case mainConfigChanged:
+	if err := writePerPatternMrubyFile(ingressCfg); err != nil {
+		ngx.restoreCfg(oldMainConfig, oldBackendConfig)
+		return false, err
+	}
+
+	switch {
+	case ngx.ReloadMethod == ReloadMethodNone:
+		if err := ngx.writeTLSKeyCert(ingressCfg); err != nil {
+			ngx.restoreCfg(oldMainConfig, oldBackendConfig)
+			return false, err
+		}
+
+		glog.Info("change in configuration detected. Not reloading because reload method is none")
+
+		// nghttpx has not loaded the new configuration.  Neither record the reload, nor remove the files which it may still refer
+		// to.
+		return false, nil
+	case changed == mainConfigChanged || ngx.ReloadMethod == ReloadMethodSignal:
 		oldConfRev, err := ngx.getNghttpxConfigRevision()
 		if err != nil {
+			ngx.restoreCfg(oldMainConfig, oldBackendConfig)
 			return false, err
 		}
 		if err := ngx.writeTLSKeyCert(ingressCfg); err != nil {
+			ngx.restoreCfg(oldMainConfig, oldBackendConfig)
 			return false, err
 		}
 
@@ -120,23 +215,98 @@ func (ngx *Manager) CheckAndReload(ingressCfg *IngressConfig) (bool, error) {
 		glog.Info("change in configuration detected. Reloading...")
 		out, err := exec.Command(cmd, args...).CombinedOutput()
 		if err != nil {
+			ngx.restoreCfg(oldMainConfig, oldBackendConfig)
 			return false, fmt.Errorf("failed to execute %v %v: %v", cmd, args, string(out))
 		}
 
+		// If new configuration is invalid, nghttpx keeps running with the current configuration, and configRevision does not
+		// change.
 		if err := ngx.waitUntilConfigRevisionChanges(oldConfRev); err != nil {
+			ngx.restoreCfg(oldMainConfig, oldBackendConfig)
 			return false, err
 		}
 
 		glog.Info("nghttpx has finished reloading new configuration")
-	case backendConfigChanged:
+	default:
+		// nghttpx validates new backend configuration, and rejects it if it is invalid.
 		if err := ngx.issueBackendReplaceRequest(); err != nil {
+			ngx.restoreCfg(oldMainConfig, oldBackendConfig)
 			return false, fmt.Errorf("failed to issue backend replace request: %v", err)
 		}
 	}
 
+	ngx.lastReload = time.Now()
+
+	// nghttpx has loaded the new configuration, and no longer needs the files which it does not refer to.
+	removeUnusedFiles(ingressCfg)
+
 	return true, nil
 }
 
+// removeUnusedFiles removes TLS key, certificate, and per-pattern mruby files which ingConfig does not refer to.  The errors are
+// logged, and otherwise ignored.
+func removeUnusedFiles(ingConfig *IngressConfig) {
+	used := make(map[string]bool)
+	if ingConfig.DefaultTLSCred != nil {
+		used[ingConfig.DefaultTLSCred.Key.Path] = true
+		used[ingConfig.DefaultTLSCred.Cert.Path] = true
+	}
+	for _, tlsCred := range ingConfig.SubTLSCred {
+		used[tlsCred.Key.Path] = true
+		used[tlsCred.Cert.Path] = true
+	}
+	if ingConfig.ClientCACert != nil {
+		used[ingConfig.ClientCACert.Path] = true
+	}
+	if ingConfig.BackendTLSCACert != nil {
+		used[ingConfig.BackendTLSCACert.Path] = true
+	}
+	if ingConfig.Mruby != nil {
+		used[ingConfig.Mruby.Path] = true
+	}
+	for _, upstream := range ingConfig.Upstreams {
+		if upstream.Mruby != nil {
+			used[upstream.Mruby.Path] = true
+		}
+	}
+
+	for _, d := range []struct {
+		dir  string
+		exts []string
+	}{
+		{tlsDirectory, []string{".key", ".crt"}},
+		{mrubyDirectory, []string{".rb"}},
+	} {
+		for _, ext := range d.exts {
+			paths, err := filepath.Glob(filepath.Join(d.dir, "*"+ext))
+			if err != nil {
+				glog.Errorf("Could not list files in %v: %v", d.dir, err)
+				continue
+			}
+			for _, path := range paths {
+				if used[path] {
+					continue
+				}
+				glog.V(2).Infof("Removing unused file %v", path)
+				if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+					glog.Errorf("Could not remove unused file %v: %v", path, err)
+				}
+			}
+		}
+	}
+}
+
+// ReloadSuppressedError is returned by CheckAndReload if the configuration has changed, but reloading is suppressed because the
+// previous reload happened less than MinReloadInterval ago.
+type ReloadSuppressedError struct {
+	// RetryAfter is the duration after which reloading is allowed.
+	RetryAfter time.Duration
+}
+
+func (e *ReloadSuppressedError) Error() string {
+	return fmt.Sprintf("reload is suppressed for %v because the previous reload happened too recently", e.RetryAfter)
+}
+
 func (ngx *Manager) issueBackendReplaceRequest() error {
 	glog.Infof("Issuing API request %v", backendconfigURI)
 
@@ -0,0 +1,305 @@
+/**
+ * Copyright 2017, nghttpx Ingress controller contributors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package nghttpx
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestValidateExtraArgs verifies that ValidateExtraArgs rejects the options which the controller relies on.
+func TestValidateExtraArgs(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr bool
+	}{
+		{},
+		{args: []string{"--frontend-http2-max-concurrent-streams=200", "--log-level", "INFO"}},
+		{args: []string{"--conf=/tmp/nghttpx.conf"}, wantErr: true},
+		{args: []string{"--pid-file", "/tmp/nghttpx.pid"}, wantErr: true},
+		{args: []string{"--daemon"}, wantErr: true},
+		{args: []string{"-D"}, wantErr: true},
+		{args: []string{"--pid=/tmp/nghttpx.pid"}, wantErr: true},
+		{args: []string{"--con=/tmp/nghttpx.conf"}, wantErr: true},
+		{args: []string{"--dae"}, wantErr: true},
+		{args: []string{"-sD"}, wantErr: true},
+		{args: []string{"-Ds"}, wantErr: true},
+		{args: []string{"-LDEBUG"}},
+		{args: []string{"-s", "-b127.0.0.1,3000"}},
+		{args: []string{"--", "-D"}},
+	}
+
+	for i, tt := range tests {
+		if err := ValidateExtraArgs(tt.args); (err != nil) != tt.wantErr {
+			t.Errorf("#%v: ValidateExtraArgs(%q) = %v, want error %v", i, tt.args, err, tt.wantErr)
+		}
+	}
+}
+
+// TestCheckAndReloadMinReloadInterval verifies that CheckAndReload suppresses reload within MinReloadInterval after the previous
+// reload, and leaves the configuration files untouched.
+func TestCheckAndReloadMinReloadInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nghttpx")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(...) returned unexpected error %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ngx := newTestManager()
+	ngx.ConfigFile = filepath.Join(dir, "nghttpx.conf")
+	ngx.BackendConfigFile = filepath.Join(dir, "nghttpx-backend.conf")
+	ngx.MinReloadInterval = time.Hour
+	ngx.lastReload = time.Now()
+
+	ingConfig := NewIngressConfig()
+	mainConfig, backendConfig, err := ngx.generateCfg(ingConfig)
+	if err != nil {
+		t.Fatalf("ngx.generateCfg(...) returned unexpected error %v", err)
+	}
+
+	if err := ioutil.WriteFile(ngx.ConfigFile, mainConfig, 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile(...) returned unexpected error %v", err)
+	}
+	if err := ioutil.WriteFile(ngx.BackendConfigFile, backendConfig, 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile(...) returned unexpected error %v", err)
+	}
+
+	// Configuration has not changed.
+	if reloaded, err := ngx.CheckAndReload(ingConfig); err != nil || reloaded {
+		t.Errorf("ngx.CheckAndReload(...) = %v, %v, want %v, %v", reloaded, err, false, nil)
+	}
+
+	ingConfig.ExtraConfig = "log-level=INFO"
+
+	reloaded, err := ngx.CheckAndReload(ingConfig)
+	if reloaded {
+		t.Errorf("reloaded = %v, want %v", reloaded, false)
+	}
+	if e, ok := err.(*ReloadSuppressedError); !ok {
+		t.Errorf("ngx.CheckAndReload(...) returned error %v, want *ReloadSuppressedError", err)
+	} else if e.RetryAfter <= 0 || e.RetryAfter > time.Hour {
+		t.Errorf("e.RetryAfter = %v, want (0, %v]", e.RetryAfter, time.Hour)
+	}
+
+	b, err := ioutil.ReadFile(ngx.ConfigFile)
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile(...) returned unexpected error %v", err)
+	}
+	if got, want := string(b), string(mainConfig); got != want {
+		t.Errorf("Configuration file was modified: %v, want %v", got, want)
+	}
+}
+
+// TestCheckAndReloadNone verifies that CheckAndReload with ReloadMethodNone writes the new configuration without telling nghttpx to
+// load it.  It does not report reload, and keeps the files which the running nghttpx may refer to.
+func TestCheckAndReloadNone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nghttpx")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(...) returned unexpected error %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	origTLSDirectory, origMrubyDirectory := tlsDirectory, mrubyDirectory
+	defer func() {
+		tlsDirectory, mrubyDirectory = origTLSDirectory, origMrubyDirectory
+	}()
+	tlsDirectory, mrubyDirectory = filepath.Join(dir, "tls"), filepath.Join(dir, "mruby")
+
+	ngx := newTestManager()
+	ngx.ConfigFile = filepath.Join(dir, "nghttpx.conf")
+	ngx.BackendConfigFile = filepath.Join(dir, "nghttpx-backend.conf")
+	ngx.ReloadMethod = ReloadMethodNone
+
+	ingConfig := NewIngressConfig()
+	mainConfig, backendConfig, err := ngx.generateCfg(ingConfig)
+	if err != nil {
+		t.Fatalf("ngx.generateCfg(...) returned unexpected error %v", err)
+	}
+
+	if err := ioutil.WriteFile(ngx.ConfigFile, mainConfig, 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile(...) returned unexpected error %v", err)
+	}
+	if err := ioutil.WriteFile(ngx.BackendConfigFile, backendConfig, 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile(...) returned unexpected error %v", err)
+	}
+
+	// The file which the new configuration does not refer to, but running nghttpx may.
+	if err := os.MkdirAll(mrubyDirectory, 0755); err != nil {
+		t.Fatalf("os.MkdirAll(...) returned unexpected error %v", err)
+	}
+	oldMrubyPath := filepath.Join(mrubyDirectory, "old.rb")
+	if err := ioutil.WriteFile(oldMrubyPath, []byte("App.new"), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile(...) returned unexpected error %v", err)
+	}
+
+	for _, tt := range []struct {
+		desc   string
+		modify func(*IngressConfig)
+	}{
+		{
+			desc: "main configuration",
+			modify: func(ingConfig *IngressConfig) {
+				ingConfig.ExtraConfig = "log-level=INFO"
+			},
+		},
+		{
+			desc: "backend configuration",
+			modify: func(ingConfig *IngressConfig) {
+				ingConfig.Upstreams = append(ingConfig.Upstreams, &Upstream{
+					Name:     "foo",
+					Host:     "example.com",
+					Path:     "/",
+					Backends: []UpstreamServer{{Address: "192.168.0.1", Port: "80", Protocol: ProtocolH1}},
+				})
+			},
+		},
+	} {
+		tt.modify(ingConfig)
+
+		// nghttpx is not running, so that CheckAndReload fails if it tries to reload it.
+		if reloaded, err := ngx.CheckAndReload(ingConfig); err != nil || reloaded {
+			t.Errorf("%v: ngx.CheckAndReload(...) = %v, %v, want %v, %v", tt.desc, reloaded, err, false, nil)
+			continue
+		}
+
+		if !ngx.lastReload.IsZero() {
+			t.Errorf("%v: ngx.lastReload = %v, want zero", tt.desc, ngx.lastReload)
+		}
+		if _, err := os.Stat(oldMrubyPath); err != nil {
+			t.Errorf("%v: os.Stat(%q) returned unexpected error %v", tt.desc, oldMrubyPath, err)
+		}
+
+		wantMainConfig, wantBackendConfig, err := ngx.generateCfg(ingConfig)
+		if err != nil {
+			t.Fatalf("ngx.generateCfg(...) returned unexpected error %v", err)
+		}
+
+		gotMainConfig, gotBackendConfig, err := ngx.readCfg()
+		if err != nil {
+			t.Fatalf("ngx.readCfg() returned unexpected error %v", err)
+		}
+		if got, want := string(gotMainConfig), string(wantMainConfig); got != want {
+			t.Errorf("%v: main configuration = %v, want %v", tt.desc, got, want)
+		}
+		if got, want := string(gotBackendConfig), string(wantBackendConfig); got != want {
+			t.Errorf("%v: backend configuration = %v, want %v", tt.desc, got, want)
+		}
+	}
+}
+
+// errorRoundTripper is http.RoundTripper which always fails.
+type errorRoundTripper struct{}
+
+func (errorRoundTripper) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+// TestCheckAndReloadRestoreOnAPIError verifies that CheckAndReload restores the previous configuration files if it cannot get
+// configRevision from nghttpx, so that the next attempt detects the change again.
+func TestCheckAndReloadRestoreOnAPIError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nghttpx")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(...) returned unexpected error %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ngx := newTestManager()
+	ngx.ConfigFile = filepath.Join(dir, "nghttpx.conf")
+	ngx.BackendConfigFile = filepath.Join(dir, "nghttpx-backend.conf")
+	ngx.httpClient = &http.Client{Transport: errorRoundTripper{}}
+
+	ingConfig := NewIngressConfig()
+	mainConfig, backendConfig, err := ngx.generateCfg(ingConfig)
+	if err != nil {
+		t.Fatalf("ngx.generateCfg(...) returned unexpected error %v", err)
+	}
+
+	if err := ioutil.WriteFile(ngx.ConfigFile, mainConfig, 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile(...) returned unexpected error %v", err)
+	}
+	if err := ioutil.WriteFile(ngx.BackendConfigFile, backendConfig, 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile(...) returned unexpected error %v", err)
+	}
+
+	ingConfig.ExtraConfig = "log-level=INFO"
+
+	if reloaded, err := ngx.CheckAndReload(ingConfig); err == nil || reloaded {
+		t.Fatalf("ngx.CheckAndReload(...) = %v, %v, want %v, non-nil error", reloaded, err, false)
+	}
+
+	b, err := ioutil.ReadFile(ngx.ConfigFile)
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile(...) returned unexpected error %v", err)
+	}
+	if got, want := string(b), string(mainConfig); got != want {
+		t.Errorf("Configuration file was not restored: %v, want %v", got, want)
+	}
+}
+
+// TestRemoveUnusedFiles verifies that removeUnusedFiles removes TLS and mruby files which are not referred to by IngressConfig.
+func TestRemoveUnusedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nghttpx")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(...) returned unexpected error %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	origTLSDirectory, origMrubyDirectory := tlsDirectory, mrubyDirectory
+	defer func() {
+		tlsDirectory, mrubyDirectory = origTLSDirectory, origMrubyDirectory
+	}()
+	tlsDirectory, mrubyDirectory = filepath.Join(dir, "tls"), filepath.Join(dir, "mruby")
+
+	for _, d := range []string{tlsDirectory, mrubyDirectory} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatalf("os.Mkdir(%q) returned unexpected error %v", d, err)
+		}
+	}
+
+	defaultCred, _ := CreateTLSCred("default", []byte("cert"), []byte("key"))
+	subCred, _ := CreateTLSCred("sub", []byte("cert"), []byte("key"))
+	staleCred, _ := CreateTLSCred("stale", []byte("cert"), []byte("key"))
+	clientCA := CreateClientCACert([]byte("ca"))
+	mruby := CreatePerPatternMrubyChecksumFile([]byte("class App\nend\n"))
+	staleMruby := CreatePerPatternMrubyChecksumFile([]byte("class StaleApp\nend\n"))
+	other := filepath.Join(tlsDirectory, "README")
+
+	for _, path := range []string{
+		defaultCred.Key.Path, defaultCred.Cert.Path, subCred.Key.Path, subCred.Cert.Path, staleCred.Key.Path, staleCred.Cert.Path,
+		clientCA.Path, mruby.Path, staleMruby.Path, other,
+	} {
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatalf("ioutil.WriteFile(%q, ...) returned unexpected error %v", path, err)
+		}
+	}
+
+	removeUnusedFiles(&IngressConfig{
+		DefaultTLSCred: defaultCred,
+		SubTLSCred:     []*TLSCred{subCred},
+		ClientCACert:   clientCA,
+		Upstreams:      []*Upstream{{Mruby: mruby}, {}},
+	})
+
+	for _, path := range []string{
+		defaultCred.Key.Path, defaultCred.Cert.Path, subCred.Key.Path, subCred.Cert.Path, clientCA.Path, mruby.Path, other,
+	} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("os.Stat(%q) returned unexpected error %v", path, err)
+		}
+	}
+	for _, path := range []string{staleCred.Key.Path, staleCred.Cert.Path, staleMruby.Path} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("os.Stat(%q) returned %v, want not exist error", path, err)
+		}
+	}
+}
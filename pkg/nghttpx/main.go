@@ -36,6 +36,18 @@ import (
 var (
 	// Base directory that contains the mounted secrets with TLS certificates, keys and
 	tlsDirectory = "/etc/nghttpx-tls"
+	// mrubyDirectory is the directory where per-pattern mruby script files are written.
+	mrubyDirectory = "/etc/nghttpx/mruby"
+)
+
+const (
+	// ReloadMethodAPI applies the backend-only changes through backendconfig API, and reloads nghttpx by SIGHUP when the main
+	// configuration changes.  This is the default.
+	ReloadMethodAPI = "api"
+	// ReloadMethodSignal always reloads nghttpx by SIGHUP, even if only the backend configuration changes.
+	ReloadMethodSignal = "signal"
+	// ReloadMethodNone writes the configuration files, but does not tell nghttpx to load them.
+	ReloadMethodNone = "none"
 )
 
 // Manager ...
@@ -56,13 +68,32 @@ type Manager struct {
 	// backend configuration without reloading nghttpx if main
 	// configuration has not changed.
 	backendTemplate *template.Template
+
+	// MinReloadInterval is the minimum interval between reloads.  If the configuration changes within this interval after the
+	// previous reload, CheckAndReload returns ReloadSuppressedError without applying it.  0 means no limit.
+	MinReloadInterval time.Duration
+	// lastReload is the time when the configuration was last applied.
+	lastReload time.Time
+	// ExtraArgs is the additional command-line arguments passed to nghttpx.  It must pass ValidateExtraArgs.
+	ExtraArgs []string
+	// ReloadMethod is the method to make nghttpx load the new configuration.  It is one of ReloadMethodAPI, ReloadMethodSignal,
+	// and ReloadMethodNone.
+	ReloadMethod string
+	// unsupervised is nonzero once Start has returned.  Access it atomically.
+	unsupervised int32
 }
 
-// NewManager ...
-func NewManager() *Manager {
+// NewManager ...  reloadMethod is one of ReloadMethodAPI, ReloadMethodSignal, and ReloadMethodNone.  Empty string means
+// ReloadMethodAPI.
+func NewManager(reloadMethod string) *Manager {
+	if reloadMethod == "" {
+		reloadMethod = ReloadMethodAPI
+	}
+
 	ngx := &Manager{
 		ConfigFile:        "/etc/nghttpx/nghttpx.conf",
 		BackendConfigFile: "/etc/nghttpx/nghttpx-backend.conf",
+		ReloadMethod:      reloadMethod,
 		httpClient: &http.Client{
 			Timeout: time.Second * 30,
 			Transport: &http.Transport{
@@ -74,7 +105,11 @@ func NewManager() *Manager {
 
 	ngx.createCertsDir(tlsDirectory)
 
-	ngx.loadTemplate()
+	if err := os.MkdirAll(mrubyDirectory, 0755); err != nil {
+		glog.Fatalf("Couldn't create directory %v: %v", mrubyDirectory, err)
+	}
+
+	ngx.loadTemplate(".")
 
 	return ngx
 }
@@ -0,0 +1,280 @@
+/**
+ * Copyright 2017, nghttpx Ingress controller contributors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package nghttpx
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CreatePerPatternMrubyChecksumFile returns ChecksumFile for per-pattern mruby script.  The file name is derived from the checksum
+// of the script, so that the change of script changes backend configuration.
+func CreatePerPatternMrubyChecksumFile(mruby []byte) *ChecksumFile {
+	checksum := Checksum(mruby)
+	return &ChecksumFile{
+		Path:     filepath.Join(mrubyDirectory, checksum+".rb"),
+		Content:  mruby,
+		Checksum: checksum,
+	}
+}
+
+// CreatePathMruby returns mruby script which implements the features enabled in m in a single App.  The request is checked in the
+// fixed order: DenyPlaintext, StaticResponse, RateLimit, ClientMaxBodySize, Rewrite, and HostRewrite.  Once a check responds to the
+// request, the rest is skipped.  ErrorPages is applied to the response from backend.  The script given by user is evaluated in its
+// own module, and App delegates on_req and on_resp to the object which it returns.  If only User is given, it is returned as is.
+// If no feature is enabled, it returns nil.
+func CreatePathMruby(m *PathMruby) []byte {
+	var header string
+	var consts, init, onReq, onResp, methods []string
+
+	if m.DenyPlaintext {
+		onReq = append(onReq, "    return if deny_plaintext(env)\n")
+		methods = append(methods, mrubyDenyPlaintext)
+	}
+	if m.StaticResponse != nil {
+		consts = append(consts, fmt.Sprintf("  STATUS = %v\n  BODY = '%v'\n", m.StaticResponse.StatusCode,
+			rubySingleQuoteReplacer.Replace(string(m.StaticResponse.Body))))
+		onReq = append(onReq, "    return if respond_static(env)\n")
+		methods = append(methods, mrubyRespondStatic)
+	}
+	if m.RateLimit != nil {
+		consts = append(consts, fmt.Sprintf("  RATE = %v.0\n  BURST = %v.0\n  MAX_CLIENTS = 100000\n", m.RateLimit.RPS,
+			m.RateLimit.Burst))
+		init = append(init, "    @buckets = {}\n")
+		onReq = append(onReq, "    return if limit_rate(env)\n")
+		methods = append(methods, mrubyLimitRate)
+	}
+	if m.ClientMaxBodySize != nil {
+		consts = append(consts, fmt.Sprintf("  MAX_BODY_SIZE = %v\n", *m.ClientMaxBodySize))
+		onReq = append(onReq, "    return if limit_body_size(env)\n")
+		methods = append(methods, mrubyLimitBodySize)
+	}
+	if m.Rewrite != nil {
+		parts := strings.Split(m.Rewrite.Target, "$1")
+		for i := range parts {
+			parts[i] = "'" + rubySingleQuoteReplacer.Replace(parts[i]) + "'"
+		}
+		consts = append(consts, fmt.Sprintf("  PREFIX = '%v'\n  TARGET = [%v]\n", rubySingleQuoteReplacer.Replace(m.Rewrite.Prefix),
+			strings.Join(parts, ", ")))
+		onReq = append(onReq, "    rewrite_path(env)\n")
+		methods = append(methods, mrubyRewritePath)
+	}
+	if m.HostRewrite != "" {
+		consts = append(consts, fmt.Sprintf("  HOST = '%v'\n", rubySingleQuoteReplacer.Replace(m.HostRewrite)))
+		onReq = append(onReq, "    env.req.authority = HOST\n")
+	}
+	if len(m.ErrorPages) > 0 {
+		codes := make([]int, 0, len(m.ErrorPages))
+		for code := range m.ErrorPages {
+			codes = append(codes, code)
+		}
+		// Sort status codes, so that the same pages always produce the same script.
+		sort.Ints(codes)
+
+		var entries []string
+		for _, code := range codes {
+			entries = append(entries, fmt.Sprintf("    %v => '%v',\n", code, rubySingleQuoteReplacer.Replace(string(m.ErrorPages[code]))))
+		}
+		consts = append(consts, fmt.Sprintf("  PAGES = {\n%v  }\n", strings.Join(entries, "")))
+		onResp = append(onResp, "    replace_error_page(env)\n")
+		methods = append(methods, mrubyReplaceErrorPage)
+	}
+	if m.User != nil {
+		if len(onReq) == 0 && len(onResp) == 0 {
+			return m.User
+		}
+		user := string(m.User)
+		if !strings.HasSuffix(user, "\n") {
+			user += "\n"
+		}
+		// The value of module definition is the value of the last expression in the script, that is the object which handles
+		// the requests.
+		header = "USER_APP = module UserMruby\n" + user + "end\n\n"
+		onReq = append(onReq, "    USER_APP.on_req(env) if USER_APP.respond_to?(:on_req)\n")
+		onResp = append(onResp, "    USER_APP.on_resp(env) if USER_APP.respond_to?(:on_resp)\n")
+	}
+
+	if len(onReq) == 0 && len(onResp) == 0 {
+		return nil
+	}
+
+	// Each part of App is separated by an empty line.
+	var parts []string
+	if len(consts) > 0 {
+		parts = append(parts, strings.Join(consts, ""))
+	}
+	if len(init) > 0 {
+		parts = append(parts, "  def initialize\n"+strings.Join(init, "")+"  end\n")
+	}
+	if len(onReq) > 0 {
+		parts = append(parts, "  def on_req(env)\n"+strings.Join(onReq, "")+"  end\n")
+	}
+	if len(onResp) > 0 {
+		parts = append(parts, "  def on_resp(env)\n"+strings.Join(onResp, "")+"  end\n")
+	}
+	parts = append(parts, methods...)
+
+	return []byte(header + "class App\n" + strings.Join(parts, "\n") + "end\n\nApp.new\n")
+}
+
+// The methods below implement the features of PathMruby.  The method which checks the request returns true if it has responded
+// to the request.
+
+const mrubyDenyPlaintext = `  def deny_plaintext(env)
+    return false if env.tls_used
+    env.resp.status = 404
+    env.resp.return("")
+    true
+  end
+`
+
+const mrubyRespondStatic = `  def respond_static(env)
+    env.resp.status = STATUS
+    env.resp.add_header "content-type", "text/html; charset=utf-8"
+    env.resp.return(BODY)
+    true
+  end
+`
+
+// mrubyLimitRate keeps the state per mruby context, that is per nghttpx worker thread.  At most MAX_CLIENTS buckets are kept.  When
+// it is full, the full buckets are pruned first, and then the least recently seen ones are evicted.
+const mrubyLimitRate = `  def limit_rate(env)
+    now = Time.now.to_f
+    addr = env.remote_addr
+    # Delete and insert again so that @buckets is ordered by the last access.
+    tokens, last = @buckets.delete(addr)
+    if tokens.nil?
+      prune_buckets(now) if @buckets.size >= MAX_CLIENTS
+      tokens = BURST
+    else
+      tokens = [tokens + (now - last) * RATE, BURST].min
+    end
+    if tokens < 1
+      @buckets[addr] = [tokens, now]
+      env.resp.status = 429
+      env.resp.return("")
+      return true
+    end
+    @buckets[addr] = [tokens - 1, now]
+    false
+  end
+
+  def prune_buckets(now)
+    @buckets.delete_if { |_, v| v[0] + (now - v[1]) * RATE >= BURST }
+    @buckets.shift while @buckets.size >= MAX_CLIENTS
+  end
+`
+
+// mrubyLimitBodySize only checks Content-Length.  The request without Content-Length (e.g., chunked request body, or HTTP/2
+// request which omits it) is not checked at all.  nghttpx runs the script before the request body arrives, and mruby cannot see
+// the body, so the size of such request cannot be limited.
+const mrubyLimitBodySize = `  def limit_body_size(env)
+    len = env.req.headers["content-length"]
+    len = len[0] if len.is_a?(Array)
+    return false if len.nil? || len.to_i <= MAX_BODY_SIZE
+    env.resp.status = 413
+    env.resp.return("")
+    true
+  end
+`
+
+// mrubyRewritePath keeps query string as is.
+const mrubyRewritePath = `  def rewrite_path(env)
+    path = env.req.path
+    return if path[0, PREFIX.size] != PREFIX
+    rest = path[PREFIX.size..-1]
+    query = ''
+    i = rest.index('?')
+    unless i.nil?
+      query = rest[i..-1]
+      rest = rest[0, i]
+    end
+    return unless rest.empty? || rest[0] == '/'
+    if TARGET.size > 1
+      path = TARGET.join(rest.empty? ? rest : rest[1..-1])
+    elsif rest.empty?
+      path = TARGET[0]
+    else
+      path = TARGET[0].chomp('/') + rest
+    end
+    path = '/' if path.empty?
+    env.req.path = path + query
+  end
+`
+
+// mrubyReplaceErrorPage drops the header fields from backend other than Retry-After, and sets Content-Type to text/html.
+const mrubyReplaceErrorPage = `  def replace_error_page(env)
+    resp = env.resp
+    page = PAGES[resp.status]
+    return if page.nil?
+    retry_after = resp.headers['retry-after']
+    resp.clear_headers
+    resp.set_header('retry-after', retry_after) unless retry_after.nil?
+    resp.set_header('content-type', 'text/html; charset=utf-8')
+    resp.return(page)
+  end
+`
+
+// CreateStaticResponseMruby returns mruby script which responds to all requests with the given status code and body without
+// forwarding them to backend.
+func CreateStaticResponseMruby(statusCode int, body []byte) []byte {
+	return CreatePathMruby(&PathMruby{StaticResponse: &StaticResponse{StatusCode: statusCode, Body: body}})
+}
+
+// CreateClientCertHeadersMruby returns mruby script which sets the header fields in h to the information of TLS client
+// certificate.  The header fields in the request from client are always removed, so that client cannot spoof them.  If client
+// does not present certificate, Verify header field is set to "NONE", and the others are not sent.  nghttpx rejects the
+// certificate which fails verification during TLS handshake, so that the presented certificate is always verified.
+func CreateClientCertHeadersMruby(h ClientCertHeaders) []byte {
+	return []byte(fmt.Sprintf(`class App
+  SUBJECT = '%v'
+  FINGERPRINT = '%v'
+  VERIFY = '%v'
+
+  def on_req(env)
+    req = env.req
+    fingerprint = env.tls_used ? env.tls_client_fingerprint_sha256 : ''
+    if fingerprint.empty?
+      req.set_header(SUBJECT, [])
+      req.set_header(FINGERPRINT, [])
+      req.set_header(VERIFY, 'NONE')
+      return
+    end
+    req.set_header(SUBJECT, env.tls_client_subject_name)
+    req.set_header(FINGERPRINT, fingerprint)
+    req.set_header(VERIFY, 'SUCCESS')
+  end
+end
+
+App.new
+`, rubySingleQuoteReplacer.Replace(strings.ToLower(h.Subject)), rubySingleQuoteReplacer.Replace(strings.ToLower(h.Fingerprint)),
+		rubySingleQuoteReplacer.Replace(strings.ToLower(h.Verify))))
+}
+
+// rubySingleQuoteReplacer escapes a string so that it can be embedded in Ruby single quoted string literal.
+var rubySingleQuoteReplacer = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// writePerPatternMrubyFile writes global and per-pattern mruby script files referenced by ingConfig.
+func writePerPatternMrubyFile(ingConfig *IngressConfig) error {
+	if ingConfig.Mruby != nil {
+		if err := writeFile(ingConfig.Mruby.Path, ingConfig.Mruby.Content); err != nil {
+			return fmt.Errorf("failed to write mruby file %v: %v", ingConfig.Mruby.Path, err)
+		}
+	}
+	for _, upstream := range ingConfig.Upstreams {
+		if upstream.Mruby == nil {
+			continue
+		}
+		if err := writeFile(upstream.Mruby.Path, upstream.Mruby.Content); err != nil {
+			return fmt.Errorf("failed to write per-pattern mruby file %v: %v", upstream.Mruby.Path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+/**
+ * Copyright 2017, nghttpx Ingress controller contributors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package nghttpx
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestCreatePathMrubyRewrite verifies that CreatePathMruby embeds prefix and target of Rewrite in the script.  target is split at
+// "$1", and both are escaped for Ruby string literal.
+func TestCreatePathMrubyRewrite(t *testing.T) {
+	tests := []struct {
+		prefix     string
+		target     string
+		wantPrefix string
+		wantTarget string
+	}{
+		{
+			prefix:     "/api",
+			target:     "/",
+			wantPrefix: "PREFIX = '/api'\n",
+			wantTarget: "TARGET = ['/']\n",
+		},
+		{
+			prefix:     "/api",
+			target:     "/v1/$1/index",
+			wantPrefix: "PREFIX = '/api'\n",
+			wantTarget: "TARGET = ['/v1/', '/index']\n",
+		},
+		{
+			prefix:     "/it's",
+			target:     `/a\b`,
+			wantPrefix: `PREFIX = '/it\'s'` + "\n",
+			wantTarget: `TARGET = ['/a\\b']` + "\n",
+		},
+	}
+
+	for i, tt := range tests {
+		s := string(CreatePathMruby(&PathMruby{Rewrite: &Rewrite{Prefix: tt.prefix, Target: tt.target}}))
+		if !strings.Contains(s, tt.wantPrefix) {
+			t.Errorf("#%v: CreatePathMruby(%q, %q) = %q, does not contain %q", i, tt.prefix, tt.target, s, tt.wantPrefix)
+		}
+		if !strings.Contains(s, tt.wantTarget) {
+			t.Errorf("#%v: CreatePathMruby(%q, %q) = %q, does not contain %q", i, tt.prefix, tt.target, s, tt.wantTarget)
+		}
+		// Query string must be carried over to the rewritten path.
+		if want := "env.req.path = path + query\n"; !strings.Contains(s, want) {
+			t.Errorf("#%v: CreatePathMruby(%q, %q) = %q, does not contain %q", i, tt.prefix, tt.target, s, want)
+		}
+	}
+}
+
+// TestCreatePathMrubyErrorPages verifies that CreatePathMruby embeds error pages in the order of status code, and escapes them for
+// Ruby string literal.
+func TestCreatePathMrubyErrorPages(t *testing.T) {
+	s := string(CreatePathMruby(&PathMruby{
+		ErrorPages: map[int][]byte{
+			503: []byte("it's down"),
+			404: []byte(`a\b`),
+		},
+	}))
+
+	if want := "  PAGES = {\n    404 => 'a\\\\b',\n    503 => 'it\\'s down',\n  }\n"; !strings.Contains(s, want) {
+		t.Errorf("CreatePathMruby(...) = %q, does not contain %q", s, want)
+	}
+}
+
+// TestCreatePathMrubyUser verifies that the script given by user is returned as is if no other feature is enabled.  Otherwise, it
+// is wrapped in App which runs the other features first, and then delegates to it.
+func TestCreatePathMrubyUser(t *testing.T) {
+	const user = "class App\n  def on_req(env)\n  end\nend\n\nApp.new"
+
+	if got, want := string(CreatePathMruby(&PathMruby{User: []byte(user)})), user; got != want {
+		t.Errorf("CreatePathMruby(...) = %q, want %q", got, want)
+	}
+
+	s := string(CreatePathMruby(&PathMruby{DenyPlaintext: true, User: []byte(user)}))
+	for _, want := range []string{
+		"USER_APP = module UserMruby\n" + user + "\nend\n",
+		"  def on_req(env)\n" +
+			"    return if deny_plaintext(env)\n" +
+			"    USER_APP.on_req(env) if USER_APP.respond_to?(:on_req)\n" +
+			"  end\n",
+		"  def on_resp(env)\n    USER_APP.on_resp(env) if USER_APP.respond_to?(:on_resp)\n  end\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("CreatePathMruby(...) = %q, does not contain %q", s, want)
+		}
+	}
+}
+
+// TestCreatePathMruby verifies that CreatePathMruby runs the enabled checks in the fixed order, and returns nil if nothing is
+// enabled.
+func TestCreatePathMruby(t *testing.T) {
+	if s := CreatePathMruby(&PathMruby{}); s != nil {
+		t.Errorf("CreatePathMruby(&PathMruby{}) = %q, want nil", s)
+	}
+
+	maxBodySize := int64(1024)
+	s := string(CreatePathMruby(&PathMruby{
+		DenyPlaintext:     true,
+		RateLimit:         &RateLimit{RPS: 10, Burst: 20},
+		ClientMaxBodySize: &maxBodySize,
+		Rewrite:           &Rewrite{Prefix: "/api", Target: "/"},
+		HostRewrite:       "www.example.com",
+		ErrorPages:        map[int][]byte{503: []byte("down")},
+	}))
+
+	for _, want := range []string{
+		"  def initialize\n    @buckets = {}\n  end\n",
+		"  def on_req(env)\n" +
+			"    return if deny_plaintext(env)\n" +
+			"    return if limit_rate(env)\n" +
+			"    return if limit_body_size(env)\n" +
+			"    rewrite_path(env)\n" +
+			"    env.req.authority = HOST\n" +
+			"  end\n",
+		"  def on_resp(env)\n    replace_error_page(env)\n  end\n",
+		"  RATE = 10.0\n  BURST = 20.0\n",
+		"  MAX_BODY_SIZE = 1024\n",
+		"  HOST = 'www.example.com'\n",
+		"  def limit_rate(env)\n",
+		"  def limit_body_size(env)\n",
+		"  def rewrite_path(env)\n",
+		"  def replace_error_page(env)\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("CreatePathMruby(...) = %q, does not contain %q", s, want)
+		}
+	}
+}
+
+// TestCreateClientCertHeadersMruby verifies that CreateClientCertHeadersMruby embeds the lowercased header field names in the
+// script.
+func TestCreateClientCertHeadersMruby(t *testing.T) {
+	s := string(CreateClientCertHeadersMruby(ClientCertHeaders{
+		Subject:     "X-Client-Cert-Subject",
+		Fingerprint: "X-Client-Cert-Fingerprint",
+		Verify:      "X-Client-Verify",
+	}))
+
+	for _, want := range []string{
+		"  SUBJECT = 'x-client-cert-subject'\n",
+		"  FINGERPRINT = 'x-client-cert-fingerprint'\n",
+		"  VERIFY = 'x-client-verify'\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("CreateClientCertHeadersMruby(...) = %q, does not contain %q", s, want)
+		}
+	}
+}
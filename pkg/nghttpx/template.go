@@ -26,6 +26,8 @@ package nghttpx
 
 import (
 	"bytes"
+	"io/ioutil"
+	"path/filepath"
 	"regexp"
 	"text/template"
 
@@ -47,9 +49,10 @@ var (
 	}
 )
 
-func (ngx *Manager) loadTemplate() {
-	ngx.template = template.Must(template.New("nghttpx.tmpl").Funcs(funcMap).ParseFiles("./nghttpx.tmpl"))
-	ngx.backendTemplate = template.Must(template.New("nghttpx-backend.tmpl").Funcs(funcMap).ParseFiles("./nghttpx-backend.tmpl"))
+// loadTemplate loads nghttpx configuration templates from dir.
+func (ngx *Manager) loadTemplate(dir string) {
+	ngx.template = template.Must(template.New("nghttpx.tmpl").Funcs(funcMap).ParseFiles(filepath.Join(dir, "nghttpx.tmpl")))
+	ngx.backendTemplate = template.Must(template.New("nghttpx-backend.tmpl").Funcs(funcMap).ParseFiles(filepath.Join(dir, "nghttpx-backend.tmpl")))
 }
 
 const (
@@ -78,16 +81,51 @@ func (ngx *Manager) generateCfg(ingConfig *IngressConfig) ([]byte, []byte, error
 	return mainConfigBuffer.Bytes(), backendConfigBuffer.Bytes(), nil
 }
 
-func (ngx *Manager) checkAndWriteCfg(mainConfig, backendConfig []byte) (int, error) {
+// readCfg returns the contents of the current main and backend configuration files.
+func (ngx *Manager) readCfg() ([]byte, []byte, error) {
+	mainConfig, err := ioutil.ReadFile(ngx.ConfigFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	backendConfig, err := ioutil.ReadFile(ngx.BackendConfigFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mainConfig, backendConfig, nil
+}
+
+// restoreCfg writes mainConfig and backendConfig back to the configuration files.  This is used to revert the configuration which
+// nghttpx failed to load, so that nghttpx does not pick it up when it is restarted.
+func (ngx *Manager) restoreCfg(mainConfig, backendConfig []byte) {
+	glog.Warningf("Restoring previous nghttpx configuration")
+	if err := writeFile(ngx.ConfigFile, mainConfig); err != nil {
+		glog.Errorf("Could not restore nghttpx configuration %v: %v", ngx.ConfigFile, err)
+	}
+	if err := writeFile(ngx.BackendConfigFile, backendConfig); err != nil {
+		glog.Errorf("Could not restore nghttpx backend configuration %v: %v", ngx.BackendConfigFile, err)
+	}
+}
+
+// checkCfg returns whether mainConfig and backendConfig differ from the current configuration files respectively.
+func (ngx *Manager) checkCfg(mainConfig, backendConfig []byte) (bool, bool, error) {
 	// If main configuration has changed, we need to reload nghttpx
 	mainChanged, err := needsReload(ngx.ConfigFile, mainConfig)
 	if err != nil {
-		return configNotChanged, err
+		return false, false, err
 	}
 
 	// If backend configuration has changed, we need to issue
 	// backend replace API to nghttpx
 	backendChanged, err := needsReload(ngx.BackendConfigFile, backendConfig)
+	if err != nil {
+		return false, false, err
+	}
+
+	return mainChanged, backendChanged, nil
+}
+
+func (ngx *Manager) checkAndWriteCfg(mainConfig, backendConfig []byte) (int, error) {
+	mainChanged, backendChanged, err := ngx.checkCfg(mainConfig, backendConfig)
 	if err != nil {
 		return configNotChanged, err
 	}
@@ -0,0 +1,876 @@
+/**
+ * Copyright 2017, nghttpx Ingress controller contributors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package nghttpx
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// update makes TestGenerateCfgGolden rewrite the golden files with the generated configuration.
+var update = flag.Bool("update", false, "update golden files")
+
+// newTestManager returns Manager which only has templates loaded.
+func newTestManager() *Manager {
+	ngx := &Manager{}
+	ngx.loadTemplate("../..")
+	return ngx
+}
+
+// TestGenerateCfgProxyProto verifies that proxyproto parameter is rendered only for the frontends which enable PROXY protocol.
+func TestGenerateCfgProxyProto(t *testing.T) {
+	tests := []struct {
+		httpProxyProto  bool
+		httpsProxyProto bool
+		want            []string
+		notWant         []string
+	}{
+		{
+			want:    []string{"frontend=*,80;no-tls\n", "frontend=*,443;no-tls\n"},
+			notWant: []string{"proxyproto"},
+		},
+		{
+			httpProxyProto:  true,
+			httpsProxyProto: true,
+			want:            []string{"frontend=*,80;no-tls;proxyproto\n", "frontend=*,443;no-tls;proxyproto\n"},
+		},
+		{
+			httpsProxyProto: true,
+			want:            []string{"frontend=*,80;no-tls\n", "frontend=*,443;no-tls;proxyproto\n"},
+		},
+	}
+
+	ngx := newTestManager()
+
+	for i, tt := range tests {
+		ingConfig := NewIngressConfig()
+		ingConfig.HTTPProxyProto = tt.httpProxyProto
+		ingConfig.HTTPSProxyProto = tt.httpsProxyProto
+
+		mainConfig, _, err := ngx.generateCfg(ingConfig)
+		if err != nil {
+			t.Fatalf("#%v: ngx.generateCfg(...) returned unexpected error %v", i, err)
+		}
+
+		for _, want := range tt.want {
+			if !strings.Contains(string(mainConfig), want) {
+				t.Errorf("#%v: mainConfig does not contain %q", i, want)
+			}
+		}
+		for _, notWant := range tt.notWant {
+			if strings.Contains(string(mainConfig), notWant) {
+				t.Errorf("#%v: mainConfig contains %q", i, notWant)
+			}
+		}
+		for _, s := range []string{"frontend=127.0.0.1,3001;api;no-tls\n", "frontend=127.0.0.1,8080;healthmon;no-tls\n"} {
+			if !strings.Contains(string(mainConfig), s) {
+				t.Errorf("#%v: mainConfig does not contain %q", i, s)
+			}
+		}
+	}
+}
+
+// TestGenerateCfgBindAddress verifies that public frontends bind to the given addresses.
+func TestGenerateCfgBindAddress(t *testing.T) {
+	tests := []struct {
+		httpBindAddress   string
+		httpsBindAddress  string
+		apiBindAddress    string
+		healthBindAddress string
+		want              []string
+	}{
+		{
+			want: []string{"frontend=*,80;no-tls\n", "frontend=*,443;no-tls\n", "frontend=127.0.0.1,3001;api;no-tls\n",
+				"frontend=127.0.0.1,8080;healthmon;no-tls\n"},
+		},
+		{
+			httpBindAddress:  "10.0.0.5",
+			httpsBindAddress: "10.0.0.6",
+			want:             []string{"frontend=10.0.0.5,80;no-tls\n", "frontend=10.0.0.6,443;no-tls\n"},
+		},
+		{
+			apiBindAddress:    "0.0.0.0",
+			healthBindAddress: "0.0.0.0",
+			want:              []string{"frontend=0.0.0.0,3001;api;no-tls\n", "frontend=0.0.0.0,8080;healthmon;no-tls\n"},
+		},
+	}
+
+	ngx := newTestManager()
+
+	for i, tt := range tests {
+		ingConfig := NewIngressConfig()
+		if tt.httpBindAddress != "" {
+			ingConfig.HTTPBindAddress = tt.httpBindAddress
+		}
+		if tt.httpsBindAddress != "" {
+			ingConfig.HTTPSBindAddress = tt.httpsBindAddress
+		}
+		if tt.apiBindAddress != "" {
+			ingConfig.APIBindAddress = tt.apiBindAddress
+		}
+		if tt.healthBindAddress != "" {
+			ingConfig.HealthBindAddress = tt.healthBindAddress
+		}
+
+		mainConfig, _, err := ngx.generateCfg(ingConfig)
+		if err != nil {
+			t.Fatalf("#%v: ngx.generateCfg(...) returned unexpected error %v", i, err)
+		}
+
+		for _, want := range tt.want {
+			if !strings.Contains(string(mainConfig), want) {
+				t.Errorf("#%v: mainConfig does not contain %q", i, want)
+			}
+		}
+	}
+}
+
+// TestGenerateCfgOCSP verifies that OCSP stapling options are rendered.
+func TestGenerateCfgOCSP(t *testing.T) {
+	tests := []struct {
+		noOCSP             bool
+		ocspUpdateInterval string
+		want               []string
+		notWant            []string
+	}{
+		{
+			notWant: []string{"no-ocsp", "ocsp-update-interval"},
+		},
+		{
+			ocspUpdateInterval: "3600s",
+			want:               []string{"ocsp-update-interval=3600s\n"},
+			notWant:            []string{"no-ocsp"},
+		},
+		{
+			noOCSP:             true,
+			ocspUpdateInterval: "3600s",
+			want:               []string{"no-ocsp=yes\n"},
+			notWant:            []string{"ocsp-update-interval"},
+		},
+	}
+
+	ngx := newTestManager()
+
+	for i, tt := range tests {
+		ingConfig := NewIngressConfig()
+		ingConfig.TLS = true
+		ingConfig.DefaultTLSCred = &TLSCred{
+			Key:  ChecksumFile{Path: "/etc/nghttpx/tls/server.key"},
+			Cert: ChecksumFile{Path: "/etc/nghttpx/tls/server.crt"},
+		}
+		ingConfig.NoOCSP = tt.noOCSP
+		ingConfig.OCSPUpdateInterval = tt.ocspUpdateInterval
+
+		mainConfig, _, err := ngx.generateCfg(ingConfig)
+		if err != nil {
+			t.Fatalf("#%v: ngx.generateCfg(...) returned unexpected error %v", i, err)
+		}
+
+		for _, want := range tt.want {
+			if !strings.Contains(string(mainConfig), want) {
+				t.Errorf("#%v: mainConfig does not contain %q", i, want)
+			}
+		}
+		for _, notWant := range tt.notWant {
+			if strings.Contains(string(mainConfig), notWant) {
+				t.Errorf("#%v: mainConfig contains %q", i, notWant)
+			}
+		}
+	}
+}
+
+// TestGenerateCfgAddResponseHeaders verifies that response header fields in ConfigMap are rendered as add-response-header.
+func TestGenerateCfgAddResponseHeaders(t *testing.T) {
+	ngx := newTestManager()
+
+	ingConfig := NewIngressConfig()
+	ReadConfig(ingConfig, &api.ConfigMap{
+		Data: map[string]string{
+			NghttpxAddResponseHeadersKey: "X-Frame-Options: DENY\n\n  X-Content-Type-Options:nosniff  \n",
+		},
+	})
+
+	mainConfig, _, err := ngx.generateCfg(ingConfig)
+	if err != nil {
+		t.Fatalf("ngx.generateCfg(...) returned unexpected error %v", err)
+	}
+
+	for _, want := range []string{
+		"add-response-header=X-Frame-Options: DENY\n",
+		"add-response-header=X-Content-Type-Options: nosniff\n",
+	} {
+		if !strings.Contains(string(mainConfig), want) {
+			t.Errorf("mainConfig does not contain %q", want)
+		}
+	}
+}
+
+// TestGenerateCfgConfigMapKeys verifies that the ConfigMap keys which are rendered as nghttpx options are rendered, and invalid
+// values are ignored.
+func TestGenerateCfgConfigMapKeys(t *testing.T) {
+	// backlog is rendered even if it exceeds net.core.somaxconn.
+	f, err := ioutil.TempFile("", "somaxconn")
+	if err != nil {
+		t.Fatalf("ioutil.TempFile(...) returned unexpected error %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("128\n")
+	f.Close()
+
+	defer func(path string) { somaxconnPath = path }(somaxconnPath)
+	somaxconnPath = f.Name()
+
+	tests := []struct {
+		key     string
+		value   string
+		want    string
+		notWant string
+	}{
+		{key: NghttpxFrontendReadTimeoutKey, value: "1m", want: "\nfrontend-read-timeout=60s\n"},
+		{key: NghttpxBackendReadTimeoutKey, value: "90s", want: "\nbackend-read-timeout=90s\n"},
+		{key: NghttpxBackendWriteTimeoutKey, value: "foo", notWant: "backend-write-timeout="},
+		{key: NghttpxFrontendKeepAliveTimeoutKey, value: "15s", want: "\nfrontend-keep-alive-timeout=15s\n"},
+		{key: NghttpxFrontendKeepAliveTimeoutKey, value: "0s", notWant: "frontend-keep-alive-timeout="},
+		{key: NghttpxFrontendHTTP2ReadTimeoutKey, value: "1m", want: "\nfrontend-http2-read-timeout=60s\n"},
+		{key: NghttpxFrontendHTTP2ReadTimeoutKey, value: "foo", notWant: "frontend-http2-read-timeout="},
+		{key: NghttpxAddXForwardedForKey, value: "true", want: "\nadd-x-forwarded-for=yes\n"},
+		{key: NghttpxAddXForwardedForKey, value: "false", want: "\nadd-x-forwarded-for=no\n"},
+		{key: NghttpxStripIncomingXForwardedForKey, value: "true", want: "\nstrip-incoming-x-forwarded-for=yes\n"},
+		{key: NghttpxStripIncomingXForwardedForKey, value: "foo", notWant: "strip-incoming-x-forwarded-for"},
+		{key: NghttpxAddXForwardedProtoKey, value: "false", want: "\nno-add-x-forwarded-proto=yes\n"},
+		{key: NghttpxAddXForwardedProtoKey, value: "true", want: "\nno-add-x-forwarded-proto=no\n"},
+		{key: NghttpxStripIncomingXForwardedProtoKey, value: "false", want: "\nno-strip-incoming-x-forwarded-proto=yes\n"},
+		{key: NghttpxWorkerFrontendConnectionsKey, value: "10000", want: "\nworker-frontend-connections=10000\n"},
+		{key: NghttpxBackendConnectionsPerHostKey, value: "0", notWant: "backend-connections-per-host="},
+		{key: NghttpxBackendConnectionsPerFrontendKey, value: "foo", notWant: "backend-connections-per-frontend="},
+		{key: NghttpxRequestHeaderFieldBufferKey, value: "256Ki", want: "\nrequest-header-field-buffer=262144\n"},
+		{key: NghttpxMaxRequestHeaderFieldsKey, value: "200", want: "\nmax-request-header-fields=200\n"},
+		{key: NghttpxResponseHeaderFieldBufferKey, value: "-1Ki", notWant: "response-header-field-buffer="},
+		{key: NghttpxMaxResponseHeaderFieldsKey, value: "foo", notWant: "max-response-header-fields="},
+		{key: NghttpxBacklogKey, value: "4096", want: "\nbacklog=4096\n"},
+		{key: NghttpxDNSCacheTimeoutKey, value: "30s", want: "\ndns-cache-timeout=30s\n"},
+		{key: NghttpxDNSLookupTimeoutKey, value: "foo", notWant: "dns-lookup-timeout="},
+		{key: NghttpxDNSMaxTryKey, value: "3", want: "\ndns-max-try=3\n"},
+	}
+
+	for i, tt := range tests {
+		ngx := newTestManager()
+
+		ingConfig := NewIngressConfig()
+		ReadConfig(ingConfig, &api.ConfigMap{Data: map[string]string{tt.key: tt.value}})
+
+		mainConfig, _, err := ngx.generateCfg(ingConfig)
+		if err != nil {
+			t.Fatalf("#%v: ngx.generateCfg(...) returned unexpected error %v", i, err)
+		}
+
+		if tt.want != "" && !strings.Contains(string(mainConfig), tt.want) {
+			t.Errorf("#%v: %v=%q: mainConfig does not contain %q", i, tt.key, tt.value, tt.want)
+		}
+		if tt.notWant != "" && strings.Contains(string(mainConfig), tt.notWant) {
+			t.Errorf("#%v: %v=%q: mainConfig contains %q", i, tt.key, tt.value, tt.notWant)
+		}
+	}
+}
+
+// TestGenerateCfgBaseConfig verifies that the base configuration file is included with its checksum, and the frontends which the
+// controller relies on are still rendered.
+func TestGenerateCfgBaseConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "nghttpx-base")
+	if err != nil {
+		t.Fatalf("ioutil.TempFile(...) returned unexpected error %v", err)
+	}
+	defer os.Remove(f.Name())
+	content := []byte("frontend-http2-window-size=1048576\n")
+	f.Write(content)
+	f.Close()
+
+	baseConfig, err := CreateBaseConfig(f.Name())
+	if err != nil {
+		t.Fatalf("CreateBaseConfig(%q) returned unexpected error %v", f.Name(), err)
+	}
+	if got, want := baseConfig.Checksum, Checksum(content); got != want {
+		t.Errorf("baseConfig.Checksum = %v, want %v", got, want)
+	}
+
+	if _, err := CreateBaseConfig(f.Name() + ".missing"); err == nil {
+		t.Errorf("CreateBaseConfig(...) for missing file succeeded, want error")
+	}
+
+	ngx := newTestManager()
+
+	ingConfig := NewIngressConfig()
+	ingConfig.BaseConfig = baseConfig
+
+	mainConfig, _, err := ngx.generateCfg(ingConfig)
+	if err != nil {
+		t.Fatalf("ngx.generateCfg(...) returned unexpected error %v", err)
+	}
+
+	for _, want := range []string{
+		"\n# checksum: " + baseConfig.Checksum + "\ninclude=" + f.Name() + "\n",
+		"\nfrontend=127.0.0.1,3001;api;no-tls\n",
+		"\nfrontend=127.0.0.1,8080;healthmon;no-tls\n",
+	} {
+		if !strings.Contains(string(mainConfig), want) {
+			t.Errorf("mainConfig does not contain %q", want)
+		}
+	}
+}
+
+// TestGenerateCfgBackendTLSCACert verifies that cacert is rendered only if CA bundle to verify backend server certificate is given.
+func TestGenerateCfgBackendTLSCACert(t *testing.T) {
+	ca := CreateBackendTLSCACert([]byte("ca"))
+
+	tests := []struct {
+		backendTLSCACert *ChecksumFile
+		want             string
+	}{
+		{},
+		{backendTLSCACert: ca, want: "\ncacert=" + ca.Path + "\n"},
+	}
+
+	for i, tt := range tests {
+		ngx := newTestManager()
+
+		ingConfig := NewIngressConfig()
+		ingConfig.BackendTLSCACert = tt.backendTLSCACert
+
+		mainConfig, _, err := ngx.generateCfg(ingConfig)
+		if err != nil {
+			t.Fatalf("#%v: ngx.generateCfg(...) returned unexpected error %v", i, err)
+		}
+
+		if tt.want == "" {
+			if strings.Contains(string(mainConfig), "cacert=") {
+				t.Errorf("#%v: mainConfig contains cacert", i)
+			}
+			continue
+		}
+		if !strings.Contains(string(mainConfig), tt.want) {
+			t.Errorf("#%v: mainConfig does not contain %q", i, tt.want)
+		}
+	}
+}
+
+// TestGenerateCfgGlobalMruby verifies that mruby-file is rendered only if global mruby script is given.
+func TestGenerateCfgGlobalMruby(t *testing.T) {
+	mruby := CreatePerPatternMrubyChecksumFile([]byte("App.new\n"))
+
+	tests := []struct {
+		mruby *ChecksumFile
+		want  string
+	}{
+		{},
+		{mruby: mruby, want: "\nmruby-file=" + mruby.Path + "\n"},
+	}
+
+	for i, tt := range tests {
+		ngx := newTestManager()
+
+		ingConfig := NewIngressConfig()
+		ingConfig.Mruby = tt.mruby
+
+		mainConfig, _, err := ngx.generateCfg(ingConfig)
+		if err != nil {
+			t.Fatalf("#%v: ngx.generateCfg(...) returned unexpected error %v", i, err)
+		}
+
+		if tt.want == "" {
+			if strings.Contains(string(mainConfig), "mruby-file=") {
+				t.Errorf("#%v: mainConfig contains mruby-file", i)
+			}
+			continue
+		}
+		if !strings.Contains(string(mainConfig), tt.want) {
+			t.Errorf("#%v: mainConfig does not contain %q", i, tt.want)
+		}
+	}
+}
+
+// TestGenerateCfgWorkerProcesses verifies that the limits of worker processes are rendered only if they are specified.
+func TestGenerateCfgWorkerProcesses(t *testing.T) {
+	tests := []struct {
+		maxWorkerProcesses               int
+		workerProcessGraceShutdownPeriod string
+		want                             []string
+		notWant                          []string
+	}{
+		{
+			notWant: []string{"max-worker-processes", "worker-process-grace-shutdown-period"},
+		},
+		{
+			maxWorkerProcesses:               2,
+			workerProcessGraceShutdownPeriod: "60s",
+			want:                             []string{"\nmax-worker-processes=2\n", "\nworker-process-grace-shutdown-period=60s\n"},
+		},
+	}
+
+	ngx := newTestManager()
+
+	for i, tt := range tests {
+		ingConfig := NewIngressConfig()
+		ingConfig.MaxWorkerProcesses = tt.maxWorkerProcesses
+		ingConfig.WorkerProcessGraceShutdownPeriod = tt.workerProcessGraceShutdownPeriod
+
+		mainConfig, _, err := ngx.generateCfg(ingConfig)
+		if err != nil {
+			t.Fatalf("#%v: ngx.generateCfg(...) returned unexpected error %v", i, err)
+		}
+
+		for _, want := range tt.want {
+			if !strings.Contains(string(mainConfig), want) {
+				t.Errorf("#%v: mainConfig does not contain %q", i, want)
+			}
+		}
+		for _, notWant := range tt.notWant {
+			if strings.Contains(string(mainConfig), notWant) {
+				t.Errorf("#%v: mainConfig contains %q", i, notWant)
+			}
+		}
+	}
+}
+
+// TestGenerateCfgBackendWeight verifies that weight parameter is rendered only if it is specified.
+func TestGenerateCfgBackendWeight(t *testing.T) {
+	ngx := newTestManager()
+
+	ingConfig := NewIngressConfig()
+	ingConfig.Upstreams = []*Upstream{
+		{
+			Name: "alpha",
+			Host: "alpha.test",
+			Path: "/",
+			Backends: []UpstreamServer{
+				{Address: "192.168.10.1", Port: "80", Protocol: ProtocolH1, Affinity: AffinityNone, Weight: 128},
+				{Address: "192.168.10.2", Port: "80", Protocol: ProtocolH1, Affinity: AffinityNone},
+			},
+		},
+	}
+
+	_, backendConfig, err := ngx.generateCfg(ingConfig)
+	if err != nil {
+		t.Fatalf("ngx.generateCfg(...) returned unexpected error %v", err)
+	}
+
+	for _, want := range []string{
+		"backend=192.168.10.1,80;alpha.test/;proto=http/1.1;affinity=none;weight=128\n",
+		"backend=192.168.10.2,80;alpha.test/;proto=http/1.1;affinity=none\n",
+	} {
+		if !strings.Contains(string(backendConfig), want) {
+			t.Errorf("backendConfig does not contain %q", want)
+		}
+	}
+}
+
+// TestGenerateCfgBackendProto verifies that proto and tls parameters are rendered independently, so that HTTP/2 backend without
+// TLS is h2c.
+func TestGenerateCfgBackendProto(t *testing.T) {
+	tests := []struct {
+		proto Protocol
+		tls   bool
+		want  string
+	}{
+		{
+			proto: ProtocolH1,
+			want:  "backend=192.168.10.1,80;alpha.test/;proto=http/1.1;affinity=none\n",
+		},
+		{
+			proto: ProtocolH1,
+			tls:   true,
+			want:  "backend=192.168.10.1,80;alpha.test/;proto=http/1.1;tls;affinity=none\n",
+		},
+		{
+			proto: ProtocolH2,
+			want:  "backend=192.168.10.1,80;alpha.test/;proto=h2;affinity=none\n",
+		},
+		{
+			proto: ProtocolH2,
+			tls:   true,
+			want:  "backend=192.168.10.1,80;alpha.test/;proto=h2;tls;affinity=none\n",
+		},
+	}
+
+	for i, tt := range tests {
+		ngx := newTestManager()
+
+		ingConfig := NewIngressConfig()
+		ingConfig.Upstreams = []*Upstream{
+			{
+				Name:     "alpha",
+				Host:     "alpha.test",
+				Path:     "/",
+				Backends: []UpstreamServer{{Address: "192.168.10.1", Port: "80", Protocol: tt.proto, TLS: tt.tls, Affinity: AffinityNone}},
+			},
+		}
+
+		_, backendConfig, err := ngx.generateCfg(ingConfig)
+		if err != nil {
+			t.Fatalf("#%v: ngx.generateCfg(...) returned unexpected error %v", i, err)
+		}
+
+		if !strings.Contains(string(backendConfig), tt.want) {
+			t.Errorf("#%v: backendConfig does not contain %q", i, tt.want)
+		}
+	}
+}
+
+// TestGenerateCfgAffinityCookie verifies that cookie affinity parameters are rendered.
+func TestGenerateCfgAffinityCookie(t *testing.T) {
+	ngx := newTestManager()
+
+	ingConfig := NewIngressConfig()
+	ingConfig.Upstreams = []*Upstream{
+		{
+			Name: "alpha",
+			Host: "alpha.test",
+			Path: "/",
+			Backends: []UpstreamServer{
+				{
+					Address:              "192.168.10.1",
+					Port:                 "80",
+					Protocol:             ProtocolH1,
+					Affinity:             AffinityCookie,
+					AffinityCookieName:   "lb",
+					AffinityCookiePath:   "/",
+					AffinityCookieSecure: AffinityCookieSecureYes,
+				},
+				{
+					Address:            "192.168.10.2",
+					Port:               "80",
+					Protocol:           ProtocolH1,
+					Affinity:           AffinityCookie,
+					AffinityCookieName: "lb",
+				},
+			},
+		},
+	}
+
+	_, backendConfig, err := ngx.generateCfg(ingConfig)
+	if err != nil {
+		t.Fatalf("ngx.generateCfg(...) returned unexpected error %v", err)
+	}
+
+	for _, want := range []string{
+		"backend=192.168.10.1,80;alpha.test/;proto=http/1.1;affinity=cookie;affinity-cookie-name=lb;affinity-cookie-path=/;affinity-cookie-secure=yes\n",
+		"backend=192.168.10.2,80;alpha.test/;proto=http/1.1;affinity=cookie;affinity-cookie-name=lb\n",
+	} {
+		if !strings.Contains(string(backendConfig), want) {
+			t.Errorf("backendConfig does not contain %q", want)
+		}
+	}
+}
+
+// TestGenerateCfgIPv6Backend verifies that IPv6 backend address is rendered without square brackets.
+func TestGenerateCfgIPv6Backend(t *testing.T) {
+	ngx := newTestManager()
+
+	ingConfig := NewIngressConfig()
+	ingConfig.Upstreams = []*Upstream{
+		{
+			Name: "alpha",
+			Host: "alpha.test",
+			Path: "/",
+			Backends: []UpstreamServer{
+				{Address: "2001:db8::1", Port: "80", Protocol: ProtocolH1, Affinity: AffinityNone},
+			},
+		},
+	}
+
+	_, backendConfig, err := ngx.generateCfg(ingConfig)
+	if err != nil {
+		t.Fatalf("ngx.generateCfg(...) returned unexpected error %v", err)
+	}
+
+	if want := "backend=2001:db8::1,80;alpha.test/;proto=http/1.1;affinity=none\n"; !strings.Contains(string(backendConfig), want) {
+		t.Errorf("backendConfig does not contain %q", want)
+	}
+}
+
+// TestGenerateCfgUnixSocketBackend verifies that Unix domain socket backend is rendered with unix: prefix.
+func TestGenerateCfgUnixSocketBackend(t *testing.T) {
+	ngx := newTestManager()
+
+	ingConfig := NewIngressConfig()
+	ingConfig.Upstreams = []*Upstream{
+		{
+			Name: "alpha",
+			Host: "alpha.test",
+			Path: "/",
+			Backends: []UpstreamServer{
+				{UnixSocketPath: "/run/alpha.sock", Protocol: ProtocolH1, Affinity: AffinityNone},
+			},
+		},
+	}
+
+	_, backendConfig, err := ngx.generateCfg(ingConfig)
+	if err != nil {
+		t.Fatalf("ngx.generateCfg(...) returned unexpected error %v", err)
+	}
+
+	if want := "backend=unix:/run/alpha.sock;alpha.test/;proto=http/1.1;affinity=none\n"; !strings.Contains(string(backendConfig), want) {
+		t.Errorf("backendConfig does not contain %q", want)
+	}
+}
+
+// TestGenerateCfgMruby verifies that mruby parameter is rendered only for upstream which has mruby script.
+func TestGenerateCfgMruby(t *testing.T) {
+	ngx := newTestManager()
+
+	mruby := CreatePerPatternMrubyChecksumFile([]byte("class App\nend\n"))
+
+	ingConfig := NewIngressConfig()
+	ingConfig.Upstreams = []*Upstream{
+		{
+			Name:     "alpha",
+			Host:     "alpha.test",
+			Path:     "/",
+			Backends: []UpstreamServer{{Address: "192.168.10.1", Port: "80", Protocol: ProtocolH1, Affinity: AffinityNone}},
+			Mruby:    mruby,
+		},
+		{
+			Name:     "bravo",
+			Host:     "bravo.test",
+			Path:     "/",
+			Backends: []UpstreamServer{{Address: "192.168.10.2", Port: "80", Protocol: ProtocolH1, Affinity: AffinityNone}},
+		},
+	}
+
+	_, backendConfig, err := ngx.generateCfg(ingConfig)
+	if err != nil {
+		t.Fatalf("ngx.generateCfg(...) returned unexpected error %v", err)
+	}
+
+	for _, want := range []string{
+		"backend=192.168.10.1,80;alpha.test/;proto=http/1.1;affinity=none;mruby=" + mruby.Path + "\n",
+		"backend=192.168.10.2,80;bravo.test/;proto=http/1.1;affinity=none\n",
+	} {
+		if !strings.Contains(string(backendConfig), want) {
+			t.Errorf("backendConfig does not contain %q", want)
+		}
+	}
+}
+
+// TestGenerateCfgDNS verifies that dns parameter is rendered only for the backend which has DNS enabled.
+func TestGenerateCfgDNS(t *testing.T) {
+	ngx := newTestManager()
+
+	ingConfig := NewIngressConfig()
+	ingConfig.Upstreams = []*Upstream{
+		{
+			Name:     "alpha",
+			Host:     "alpha.test",
+			Path:     "/",
+			Backends: []UpstreamServer{{Address: "alpha.example.com", Port: "80", Protocol: ProtocolH1, DNS: true, Affinity: AffinityNone}},
+		},
+		{
+			Name:     "bravo",
+			Host:     "bravo.test",
+			Path:     "/",
+			Backends: []UpstreamServer{{Address: "192.168.10.2", Port: "80", Protocol: ProtocolH1, Affinity: AffinityNone}},
+		},
+	}
+
+	_, backendConfig, err := ngx.generateCfg(ingConfig)
+	if err != nil {
+		t.Fatalf("ngx.generateCfg(...) returned unexpected error %v", err)
+	}
+
+	for _, want := range []string{
+		"backend=alpha.example.com,80;alpha.test/;proto=http/1.1;dns;affinity=none\n",
+		"backend=192.168.10.2,80;bravo.test/;proto=http/1.1;affinity=none\n",
+	} {
+		if !strings.Contains(string(backendConfig), want) {
+			t.Errorf("backendConfig does not contain %q", want)
+		}
+	}
+}
+
+// TestGenerateCfgAnnotateConfig verifies that comments of upstream are rendered above its backends, and the Secret of TLS
+// certificate is rendered only if AnnotateConfig is true.
+func TestGenerateCfgAnnotateConfig(t *testing.T) {
+	tests := []struct {
+		annotateConfig bool
+	}{
+		{annotateConfig: true},
+		{},
+	}
+
+	for i, tt := range tests {
+		ngx := newTestManager()
+
+		ingConfig := NewIngressConfig()
+		ingConfig.AnnotateConfig = tt.annotateConfig
+		ingConfig.TLS = true
+		ingConfig.DefaultTLSCred = &TLSCred{
+			Key:    ChecksumFile{Path: "/etc/nghttpx/tls/default.key", Checksum: "k0"},
+			Cert:   ChecksumFile{Path: "/etc/nghttpx/tls/default.crt", Checksum: "c0"},
+			Secret: "kube-system/default-tls",
+		}
+		ingConfig.SubTLSCred = []*TLSCred{
+			{
+				Key:    ChecksumFile{Path: "/etc/nghttpx/tls/default_alpha-tls.key", Checksum: "k1"},
+				Cert:   ChecksumFile{Path: "/etc/nghttpx/tls/default_alpha-tls.crt", Checksum: "c1"},
+				Secret: "default/alpha-tls",
+			},
+		}
+		ingConfig.Upstreams = []*Upstream{
+			{
+				Name:     "default/alpha,80;alpha.test/",
+				Host:     "alpha.test",
+				Path:     "/",
+				Backends: []UpstreamServer{{Address: "192.168.10.1", Port: "80", Protocol: ProtocolH1, Affinity: AffinityNone}},
+				Comments: []string{"ingress: default/alpha-ing"},
+			},
+		}
+
+		mainConfig, backendConfig, err := ngx.generateCfg(ingConfig)
+		if err != nil {
+			t.Fatalf("#%v: ngx.generateCfg(...) returned unexpected error %v", i, err)
+		}
+
+		want := "# default/alpha,80;alpha.test/\n# ingress: default/alpha-ing\nbackend=192.168.10.1,80;"
+		if !strings.Contains(string(backendConfig), want) {
+			t.Errorf("#%v: backendConfig does not contain %q", i, want)
+		}
+
+		for _, s := range []string{
+			"# checksum: k0 c0\n# secret: kube-system/default-tls\nprivate-key-file=",
+			"# checksum: k1 c1\n# secret: default/alpha-tls\nsubcert=",
+		} {
+			if got, want := strings.Contains(string(mainConfig), s), tt.annotateConfig; got != want {
+				t.Errorf("#%v: strings.Contains(mainConfig, %q) = %v, want %v", i, s, got, want)
+			}
+		}
+	}
+}
+
+// TestGenerateCfgGolden verifies that the generated configuration matches the golden files in testdata.  Run the test with -update
+// flag to rewrite them after changing templates intentionally.
+func TestGenerateCfgGolden(t *testing.T) {
+	ngx := newTestManager()
+
+	ingConfig := NewIngressConfig()
+	ingConfig.Workers = "4"
+	ingConfig.TLS = true
+	ingConfig.DefaultTLSCred = &TLSCred{
+		Key:  ChecksumFile{Path: "/etc/nghttpx/tls/default.key", Checksum: "k0"},
+		Cert: ChecksumFile{Path: "/etc/nghttpx/tls/default.crt", Checksum: "c0"},
+	}
+	ingConfig.SubTLSCred = []*TLSCred{
+		{
+			Key:  ChecksumFile{Path: "/etc/nghttpx/tls/default_alpha-tls.key", Checksum: "k1"},
+			Cert: ChecksumFile{Path: "/etc/nghttpx/tls/default_alpha-tls.crt", Checksum: "c1"},
+		},
+		{
+			Key:  ChecksumFile{Path: "/etc/nghttpx/tls/default_bravo-tls.key", Checksum: "k2"},
+			Cert: ChecksumFile{Path: "/etc/nghttpx/tls/default_bravo-tls.crt", Checksum: "c2"},
+		},
+	}
+	ingConfig.AddResponseHeaders = []string{"X-Frame-Options: DENY"}
+	ingConfig.FrontendReadTimeout = "30s"
+	ingConfig.Upstreams = []*Upstream{
+		{
+			Name: "default/alpha,80;alpha.test/",
+			Host: "alpha.test",
+			Path: "/",
+			Backends: []UpstreamServer{
+				{Address: "192.168.10.1", Port: "80", Protocol: ProtocolH2, Affinity: AffinityNone},
+				{Address: "192.168.10.2", Port: "80", Protocol: ProtocolH2, Affinity: AffinityNone},
+			},
+			RedirectIfNotTLS: true,
+		},
+		{
+			Name: "default/bravo,443;bravo.test/",
+			Host: "bravo.test",
+			Path: "/",
+			Backends: []UpstreamServer{
+				{Address: "192.168.10.3", Port: "443", Protocol: ProtocolH1, TLS: true, SNI: "bravo.test", Affinity: AffinityIP,
+					Weight: 2},
+			},
+			RedirectIfNotTLS: true,
+		},
+	}
+
+	mainConfig, backendConfig, err := ngx.generateCfg(ingConfig)
+	if err != nil {
+		t.Fatalf("ngx.generateCfg(...) returned unexpected error %v", err)
+	}
+
+	for _, tt := range []struct {
+		golden string
+		config []byte
+	}{
+		{golden: "nghttpx.conf.golden", config: mainConfig},
+		{golden: "nghttpx-backend.conf.golden", config: backendConfig},
+	} {
+		path := filepath.Join("testdata", tt.golden)
+		if *update {
+			if err := ioutil.WriteFile(path, tt.config, 0644); err != nil {
+				t.Fatalf("ioutil.WriteFile(%q, ...) returned unexpected error %v", path, err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("ioutil.ReadFile(%q) returned unexpected error %v", path, err)
+		}
+		if !bytes.Equal(tt.config, want) {
+			t.Errorf("%v does not match the generated configuration:\n%s", tt.golden, tt.config)
+		}
+	}
+}
+
+// TestRestoreCfg verifies that restoreCfg reverts the configuration files to the ones which readCfg returned.
+func TestRestoreCfg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nghttpx")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(...) returned unexpected error %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ngx := newTestManager()
+	ngx.ConfigFile = filepath.Join(dir, "nghttpx.conf")
+	ngx.BackendConfigFile = filepath.Join(dir, "nghttpx-backend.conf")
+
+	if err := ioutil.WriteFile(ngx.ConfigFile, []byte("main-old"), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile(...) returned unexpected error %v", err)
+	}
+	if err := ioutil.WriteFile(ngx.BackendConfigFile, []byte("backend-old"), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile(...) returned unexpected error %v", err)
+	}
+
+	oldMainConfig, oldBackendConfig, err := ngx.readCfg()
+	if err != nil {
+		t.Fatalf("ngx.readCfg() returned unexpected error %v", err)
+	}
+
+	if _, err := ngx.checkAndWriteCfg([]byte("main-new"), []byte("backend-new")); err != nil {
+		t.Fatalf("ngx.checkAndWriteCfg(...) returned unexpected error %v", err)
+	}
+
+	ngx.restoreCfg(oldMainConfig, oldBackendConfig)
+
+	mainConfig, backendConfig, err := ngx.readCfg()
+	if err != nil {
+		t.Fatalf("ngx.readCfg() returned unexpected error %v", err)
+	}
+	if got, want := string(mainConfig), "main-old"; got != want {
+		t.Errorf("mainConfig = %v, want %v", got, want)
+	}
+	if got, want := string(backendConfig), "backend-old"; got != want {
+		t.Errorf("backendConfig = %v, want %v", got, want)
+	}
+}
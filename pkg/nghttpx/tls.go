@@ -25,6 +25,7 @@ limitations under the License.
 package nghttpx
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/rsa"
@@ -65,8 +66,38 @@ func CreateTLSCred(name string, cert, key []byte) (*TLSCred, error) {
 	}, nil
 }
 
+// CreateClientCACert creates ChecksumFile for CA bundle which is used to verify client certificate.
+func CreateClientCACert(ca []byte) *ChecksumFile {
+	return &ChecksumFile{
+		Path:     filepath.Join(tlsDirectory, "client-ca.crt"),
+		Content:  ca,
+		Checksum: Checksum(ca),
+	}
+}
+
+// CreateBackendTLSCACert creates ChecksumFile for CA bundle which is used to verify backend server certificate.
+func CreateBackendTLSCACert(ca []byte) *ChecksumFile {
+	return &ChecksumFile{
+		Path:     filepath.Join(tlsDirectory, "backend-ca.crt"),
+		Content:  ca,
+		Checksum: Checksum(ca),
+	}
+}
+
 // writeTLSKeyCert writes TLS private keys and certificates to their files.
 func (ngx *Manager) writeTLSKeyCert(ingConfig *IngressConfig) error {
+	if ingConfig.ClientCACert != nil {
+		if err := writeFile(ingConfig.ClientCACert.Path, ingConfig.ClientCACert.Content); err != nil {
+			return fmt.Errorf("failed to write client CA certificate: %v", err)
+		}
+	}
+
+	if ingConfig.BackendTLSCACert != nil {
+		if err := writeFile(ingConfig.BackendTLSCACert.Path, ingConfig.BackendTLSCACert.Content); err != nil {
+			return fmt.Errorf("failed to write backend CA certificate: %v", err)
+		}
+	}
+
 	if ingConfig.DefaultTLSCred != nil {
 		if err := writeTLSKeyCert(ingConfig.DefaultTLSCred); err != nil {
 			return err
@@ -118,6 +149,80 @@ func CommonNames(certBlob []byte) ([]string, error) {
 	return cn, nil
 }
 
+// AppendCACert returns certBlob followed by the certificates in caBlob.  The self-signed certificate, which is the root
+// certificate that client must already trust, and the certificate which certBlob already contains are not appended.  certBlob is
+// not modified.
+func AppendCACert(certBlob, caBlob []byte) ([]byte, error) {
+	existing := make(map[string]bool)
+	for rest := certBlob; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			existing[string(block.Bytes)] = true
+		}
+	}
+
+	chain := append([]byte(nil), certBlob...)
+	for rest := caBlob; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if existing[string(block.Bytes)] || isSelfSigned(cert) {
+			continue
+		}
+		existing[string(block.Bytes)] = true
+		if len(chain) > 0 && chain[len(chain)-1] != '\n' {
+			chain = append(chain, '\n')
+		}
+		chain = append(chain, pem.EncodeToMemory(block)...)
+	}
+
+	return chain, nil
+}
+
+// isSelfSigned returns true if cert is signed by its own key.
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawSubject, cert.RawIssuer) &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+// CheckCACert checks that caBlob contains at least one PEM encoded certificate, and all of them are valid.
+func CheckCACert(caBlob []byte) error {
+	n := 0
+	for {
+		var block *pem.Block
+		block, caBlob = pem.Decode(caBlob)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return err
+		}
+		n++
+	}
+
+	if n == 0 {
+		return fmt.Errorf("No valid PEM formatted certificate found from CA bundle")
+	}
+
+	return nil
+}
+
 // checkPrivateKey checks if the key is valid.
 func CheckPrivateKey(keyBlob []byte) error {
 	block, _ := pem.Decode(keyBlob)
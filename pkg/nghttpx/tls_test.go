@@ -25,8 +25,16 @@ limitations under the License.
 package nghttpx
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/pem"
 	"fmt"
+	"math/big"
 	"path/filepath"
 	"reflect"
 	"testing"
@@ -116,3 +124,82 @@ func TestRemoveDuplicatePems(t *testing.T) {
 		}
 	}
 }
+
+// newTestCert creates a certificate for cn signed by parent with parentKey.  If parent is nil, the certificate is self-signed.  It
+// returns PEM encoded certificate and its private key.
+func newTestCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) ([]byte, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey(...) returned unexpected error %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{cn},
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate(...) returned unexpected error %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate(...) returned unexpected error %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), cert, key
+}
+
+// TestAppendCACert verifies that AppendCACert appends intermediate certificates, and skips self-signed root certificate and the
+// certificates already in the chain.
+func TestAppendCACert(t *testing.T) {
+	rootPEM, root, rootKey := newTestCert(t, "root", nil, nil)
+	interPEM, inter, interKey := newTestCert(t, "intermediate", root, rootKey)
+	leafPEM, _, _ := newTestCert(t, "example.com", inter, interKey)
+
+	concat := func(pems ...[]byte) []byte {
+		return bytes.Join(pems, nil)
+	}
+
+	tests := []struct {
+		cert []byte
+		ca   []byte
+		want []byte
+	}{
+		{cert: leafPEM, ca: interPEM, want: concat(leafPEM, interPEM)},
+		{cert: leafPEM, ca: concat(interPEM, rootPEM), want: concat(leafPEM, interPEM)},
+		{cert: leafPEM, ca: rootPEM, want: leafPEM},
+		{cert: concat(leafPEM, interPEM), ca: concat(interPEM, rootPEM), want: concat(leafPEM, interPEM)},
+		{cert: leafPEM, ca: concat(interPEM, interPEM), want: concat(leafPEM, interPEM)},
+		{cert: bytes.TrimSuffix(leafPEM, []byte("\n")), ca: interPEM, want: concat(leafPEM, interPEM)},
+	}
+
+	for i, tt := range tests {
+		got, err := AppendCACert(tt.cert, tt.ca)
+		if err != nil {
+			t.Errorf("#%v: AppendCACert(...) returned unexpected error %v", i, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("#%v: AppendCACert(...) = %s, want %s", i, got, tt.want)
+			continue
+		}
+		cn, err := CommonNames(got)
+		if err != nil {
+			t.Errorf("#%v: CommonNames(...) returned unexpected error %v", i, err)
+			continue
+		}
+		if got, want := cn[0], "example.com"; got != want {
+			t.Errorf("#%v: cn[0] = %v, want %v", i, got, want)
+		}
+	}
+
+	if _, err := AppendCACert(leafPEM, []byte("-----BEGIN CERTIFICATE-----\nZm9v\n-----END CERTIFICATE-----\n")); err == nil {
+		t.Errorf("AppendCACert(...) with malformed CA succeeded, want error")
+	}
+}
@@ -27,6 +27,10 @@ package nghttpx
 import (
 	"runtime"
 	"strconv"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api/resource"
+	"k8s.io/kubernetes/pkg/api/unversioned"
 )
 
 // Interface is the API to update underlying load balancer.
@@ -35,8 +39,11 @@ type Interface interface {
 	Start(stopCh <-chan struct{})
 	// CheckAndReload checks whether the nghttpx configuration changed, and if so, make nghttpx reload its configuration.  If reloading
 	// is required, and it successfully issues reloading, returns true.  If there is no need to reloading, it returns false.  On error,
-	// it returns false, and non-nil error.
+	// it returns false, and non-nil error.  If reloading is suppressed by minimum reload interval, the error is *ReloadSuppressedError.
 	CheckAndReload(ingressCfg *IngressConfig) (bool, error)
+	// Supervised returns false once Start has returned, that is, nghttpx process has exited or failed to start, and nothing
+	// supervises it anymore.  It returns true before Start is called.
+	Supervised() bool
 }
 
 // IngressConfig describes an nghttpx configuration
@@ -45,17 +52,100 @@ type IngressConfig struct {
 	TLS            bool
 	DefaultTLSCred *TLSCred
 	SubTLSCred     []*TLSCred
+	// IngressChecksums is a mapping from namespace/name of Ingress to the checksum of the configuration derived from it.  It is
+	// only used by the controller to find the Ingresses which have changed, and not written to nghttpx configuration.
+	IngressChecksums map[string]string
+	// HTTPBindAddress is the address which cleartext HTTP frontend binds to.  "*" means all addresses.
+	HTTPBindAddress string
+	// HTTPSBindAddress is the address which TLS frontend binds to.  "*" means all addresses.
+	HTTPSBindAddress string
+	// APIBindAddress is the address which API frontend binds to.
+	APIBindAddress string
+	// HealthBindAddress is the address which health monitor frontend binds to.
+	HealthBindAddress string
+	// HTTPProxyProto is true if PROXY protocol is enabled on cleartext HTTP frontend.
+	HTTPProxyProto bool
+	// HTTPSProxyProto is true if PROXY protocol is enabled on TLS frontend.
+	HTTPSProxyProto bool
+	// ClientCACert is the CA bundle to verify client certificate.  If it is nil, client certificate verification is disabled.
+	ClientCACert *ChecksumFile
+	// Mruby is the mruby script which nghttpx runs for all requests before per-pattern mruby script.  If it is nil, no script is
+	// run.
+	Mruby *ChecksumFile
+	// BackendTLSCACert is the CA bundle to verify backend server certificate.  If it is nil, nghttpx uses the system default CA
+	// store.
+	BackendTLSCACert *ChecksumFile
+	// NoOCSP is true if OCSP stapling is disabled.
+	NoOCSP bool
+	// OCSPUpdateInterval is the interval to refresh OCSP responses in nghttpx duration format.  Empty string means nghttpx default.
+	OCSPUpdateInterval string
+	// AddResponseHeaders is the list of header fields in the form of "<NAME>: <VALUE>" which are added to all responses.
+	AddResponseHeaders []string
+	// FrontendReadTimeout, FrontendWriteTimeout, BackendReadTimeout, and BackendWriteTimeout are the timeouts in nghttpx duration
+	// format.  Empty string means nghttpx default.
+	FrontendReadTimeout  string
+	FrontendWriteTimeout string
+	BackendReadTimeout   string
+	BackendWriteTimeout  string
+	// FrontendKeepAliveTimeout is the idle timeout of HTTP/1.1 frontend connection, and FrontendHTTP2ReadTimeout is the idle
+	// timeout of HTTP/2 frontend connection, in nghttpx duration format.  Empty string means nghttpx default.
+	FrontendKeepAliveTimeout string
+	FrontendHTTP2ReadTimeout string
+	// WorkerFrontendConnections is the maximum number of frontend connections per worker.  0 means nghttpx default.
+	WorkerFrontendConnections int
+	// BackendConnectionsPerHost and BackendConnectionsPerFrontend are the maximum number of backend connections per backend host
+	// and per frontend connection respectively.  0 means nghttpx default.
+	BackendConnectionsPerHost     int
+	BackendConnectionsPerFrontend int
+	// DNSCacheTimeout and DNSLookupTimeout are the cache duration of dynamic name resolution and the timeout of a DNS query in
+	// nghttpx duration format.  They only affect backends which have DNS enabled.  Empty string means nghttpx default.
+	DNSCacheTimeout  string
+	DNSLookupTimeout string
+	// DNSMaxTry is the number of DNS query attempts.  0 means nghttpx default.
+	DNSMaxTry int
+	// AddXForwardedFor, StripIncomingXForwardedFor, NoAddXForwardedProto, and NoStripIncomingXForwardedProto are the values of
+	// nghttpx options of the same name, either "yes" or "no".  Empty string means nghttpx default.
+	AddXForwardedFor               string
+	StripIncomingXForwardedFor     string
+	NoAddXForwardedProto           string
+	NoStripIncomingXForwardedProto string
+	// RequestHeaderFieldBuffer and ResponseHeaderFieldBuffer are the maximum total size in bytes of request header fields from
+	// client and response header fields from backend respectively.  0 means nghttpx default.
+	RequestHeaderFieldBuffer  int64
+	ResponseHeaderFieldBuffer int64
+	// MaxRequestHeaderFields and MaxResponseHeaderFields are the maximum number of request header fields from client and response
+	// header fields from backend respectively.  0 means nghttpx default.
+	MaxRequestHeaderFields  int
+	MaxResponseHeaderFields int
+	// Backlog is the listen backlog of frontend sockets.  0 means nghttpx default.
+	Backlog int
+	// MaxWorkerProcesses is the maximum number of nghttpx worker processes, including the old ones which are shutting down after
+	// reload.  0 means nghttpx default.
+	MaxWorkerProcesses int
+	// WorkerProcessGraceShutdownPeriod is the maximum period for old worker process to finish in-flight requests after reload in
+	// nghttpx duration format.  Empty string means nghttpx default.
+	WorkerProcessGraceShutdownPeriod string
 	// https://nghttp2.org/documentation/nghttpx.1.html#cmdoption-nghttpx-n
 	// Set the number of worker threads.
 	Workers string
+	// BaseConfig is the operator provided nghttpx configuration file which is included before ExtraConfig.  Its Content is not
+	// populated because the controller never writes it.  If it is nil, no file is included.
+	BaseConfig *ChecksumFile
 	// ExtraConfig is the extra configurations in a format that nghttpx accepts in --conf.
 	ExtraConfig string
+	// AnnotateConfig is true if the Secret which each TLS certificate is created from is rendered as comment.
+	AnnotateConfig bool
 }
 
-// NewIngressConfig returns new IngressConfig.  Workers is initialized as the number of CPU cores.
+// NewIngressConfig returns new IngressConfig.  Workers is initialized as the number of CPU cores.  Public frontends bind to all
+// addresses, and API and health monitor frontends bind to loopback address.
 func NewIngressConfig() *IngressConfig {
 	return &IngressConfig{
-		Workers: strconv.Itoa(runtime.NumCPU()),
+		Workers:           strconv.Itoa(runtime.NumCPU()),
+		HTTPBindAddress:   "*",
+		HTTPSBindAddress:  "*",
+		APIBindAddress:    "127.0.0.1",
+		HealthBindAddress: "127.0.0.1",
 	}
 }
 
@@ -66,6 +156,11 @@ type Upstream struct {
 	Path             string
 	Backends         []UpstreamServer
 	RedirectIfNotTLS bool
+	// Mruby is mruby script file which is invoked for the requests matching this upstream.  nil means no mruby script.
+	Mruby *ChecksumFile
+	// Comments is the list of single line comments rendered above the backends of this upstream, e.g., the Ingress which this
+	// upstream is created from.
+	Comments []string
 }
 
 type Affinity string
@@ -73,6 +168,20 @@ type Affinity string
 const (
 	AffinityNone = "none"
 	AffinityIP   = "ip"
+	// AffinityCookie enables cookie based session affinity.  nghttpx issues the cookie if the request does not have it.
+	AffinityCookie = "cookie"
+)
+
+// AffinityCookieSecure specifies whether Secure attribute is added to affinity cookie.
+type AffinityCookieSecure string
+
+const (
+	// AffinityCookieSecureAuto adds Secure attribute if the request is made over TLS.
+	AffinityCookieSecureAuto = "auto"
+	// AffinityCookieSecureYes always adds Secure attribute.
+	AffinityCookieSecureYes = "yes"
+	// AffinityCookieSecureNo never adds Secure attribute.
+	AffinityCookieSecureNo = "no"
 )
 
 type Protocol string
@@ -86,6 +195,8 @@ const (
 
 // UpstreamServer describes a server in an nghttpx upstream
 type UpstreamServer struct {
+	// Address is the IP address or hostname of backend server.  IPv6 address must not be enclosed in square brackets because
+	// nghttpx separates host and port with ',' and passes host to name resolution as is.
 	Address  string
 	Port     string
 	Protocol Protocol
@@ -93,12 +204,29 @@ type UpstreamServer struct {
 	SNI      string
 	DNS      bool
 	Affinity Affinity
+	// AffinityCookieName is the name of cookie for cookie based session affinity.
+	AffinityCookieName string
+	// AffinityCookiePath is the path attribute of affinity cookie.  Empty string means that path attribute is not added.
+	AffinityCookiePath string
+	// AffinityCookieSecure specifies whether Secure attribute is added to affinity cookie.  Empty string means nghttpx default.
+	AffinityCookieSecure AffinityCookieSecure
+	// Weight is the weight of this backend server.  0 means that weight is not specified.
+	Weight uint32
+	// UnixSocketPath is the path to Unix domain socket of backend server.  If it is not empty, Address and Port are ignored.
+	UnixSocketPath string
+	// SlowStart is the duration during which the weight of newly added backend server is gradually increased.  0 means that
+	// slow start is disabled.  It is only used by the controller, and not written to nghttpx configuration.
+	SlowStart time.Duration
 }
 
 // TLS server private key and certificate file path
 type TLSCred struct {
 	Key  ChecksumFile
 	Cert ChecksumFile
+	// Secret is the namespace/name of Secret which this credential is created from.
+	Secret string
+	// Hosts is the list of host names found in the certificate.
+	Hosts []string
 }
 
 // NewDefaultServer return an UpstreamServer to be use as default server that returns 503.
@@ -112,9 +240,13 @@ func NewDefaultServer() UpstreamServer {
 	}
 }
 
+// MaxBackendWeight is the maximum weight of backend which nghttpx accepts.
+const MaxBackendWeight = 256
+
 // backend configuration obtained from ingress annotation, specified per service port
 type PortBackendConfig struct {
-	// backend application protocol.  At the moment, this should be either ProtocolH2 or ProtocolH1.
+	// backend application protocol.  At the moment, this should be either ProtocolH2 or ProtocolH1.  It is independent of TLS:
+	// ProtocolH2 without TLS is cleartext HTTP/2 with prior knowledge (h2c), and ProtocolH2 with TLS negotiates h2 by ALPN.
 	Proto Protocol `json:"proto,omitempty"`
 	// true if backend connection requires TLS
 	TLS bool `json:"tls,omitempty"`
@@ -124,6 +256,69 @@ type PortBackendConfig struct {
 	DNS bool `json:"dns,omitempty"`
 	// Affinity is session affinity method nghttpx supports.  See affinity parameter in backend option of nghttpx.
 	Affinity Affinity `json:"affinity,omitempty"`
+	// AffinityCookieName is the name of cookie for cookie based session affinity.  It is required if Affinity is AffinityCookie.
+	AffinityCookieName string `json:"affinityCookieName,omitempty"`
+	// AffinityCookiePath is the path attribute of affinity cookie.
+	AffinityCookiePath string `json:"affinityCookiePath,omitempty"`
+	// AffinityCookieSecure specifies whether Secure attribute is added to affinity cookie.
+	AffinityCookieSecure AffinityCookieSecure `json:"affinityCookieSecure,omitempty"`
+	// EndpointSelector is the label selector for Pods.  If it is not empty, only the endpoints whose backing Pod matches it are
+	// used as backends.
+	EndpointSelector string `json:"endpointSelector,omitempty"`
+	// NodeSelector is the label selector for Nodes, e.g., the zone label.  If it is not empty, only the endpoints which run on the
+	// matching Nodes are used as backends.  If no endpoint matches, all endpoints are used.
+	NodeSelector string `json:"nodeSelector,omitempty"`
+	// UnixSocketPath is the absolute path to Unix domain socket which backend listens on.  If it is not empty, a single backend
+	// which connects to the socket is used instead of the endpoints of Service.  The socket must be accessible from nghttpx
+	// process, e.g., via a volume shared with the controller Pod.
+	UnixSocketPath string `json:"unixSocketPath,omitempty"`
+	// ExtraPorts is the list of other ports of the same Service whose backends are added to the same pattern.  The backend
+	// configuration of each port is looked up by the port as usual.
+	ExtraPorts []string `json:"extraPorts,omitempty"`
+	// Weight is the weight of the backends of this port in the range [1, 256].  0 means that weight is not specified.
+	Weight uint32 `json:"weight,omitempty"`
+	// SlowStart is the duration during which the weight of newly added endpoint is gradually increased from 1 to its full
+	// weight, e.g., "30s".  It is best effort: the controller remembers when it first saw each endpoint, and the memory is lost
+	// when the controller restarts.
+	SlowStart *unversioned.Duration `json:"slowStart,omitempty"`
+	// EgressProxy is the URI of forward proxy which backend connections are made through.  nghttpx cannot route the individual
+	// backends through a proxy, so that it is always rejected.  It exists to tell users that it is not supported rather than
+	// ignoring it silently.
+	EgressProxy string `json:"egressProxy,omitempty"`
+	// SendProxyProtocol is true if PROXY protocol header is sent to the backends.  nghttpx only accepts PROXY protocol on frontend,
+	// and cannot send it to backends, so that true is always rejected like EgressProxy.
+	SendProxyProtocol bool `json:"sendProxyProtocol,omitempty"`
+}
+
+// PathConfig is per-pattern configuration obtained from annotation.
+type PathConfig struct {
+	// Mruby is the inline mruby script which is invoked for the requests matching the pattern.
+	Mruby *string `json:"mruby,omitempty"`
+	// MrubyConfigMapRef refers to the key of ConfigMap which contains mruby script in the form of name/key.  The ConfigMap must be in
+	// the same namespace as Ingress.  It takes precedence over Mruby.
+	MrubyConfigMapRef *string `json:"mrubyConfigMapRef,omitempty"`
+	// ClientMaxBodySize is the maximum size of request body, e.g., "1Mi".  The request which has larger Content-Length is responded
+	// with 413.  It is implemented by mruby script, and cannot be used with Mruby or MrubyConfigMapRef.
+	ClientMaxBodySize *resource.Quantity `json:"clientMaxBodySize,omitempty"`
+	// RateLimitRPS is the number of requests per second which a client IP address is allowed to make.  The request which exceeds
+	// the limit is responded with 429.  It is implemented by mruby script, and cannot be used with Mruby or MrubyConfigMapRef.
+	RateLimitRPS *int `json:"rateLimitRPS,omitempty"`
+	// RateLimitBurst is the number of requests which a client IP address is allowed to make in a burst.  It defaults to
+	// RateLimitRPS.
+	RateLimitBurst *int `json:"rateLimitBurst,omitempty"`
+	// RewriteTarget is the path which replaces the Ingress path in the request path before the request is forwarded to backend,
+	// e.g., "/" strips the Ingress path "/api".  "$1" in RewriteTarget is replaced with the remaining part of the request path
+	// without leading "/", e.g., "/v1/$1".  Query string is preserved.  It is implemented by mruby script, and cannot be used with
+	// Mruby or MrubyConfigMapRef.
+	RewriteTarget *string `json:"rewriteTarget,omitempty"`
+	// HostRewrite is the host which replaces the host of request, that is Host header field or :authority, before the request is
+	// forwarded to backend.  It does not change SNI of backend TLS connection, which is specified by sni in backend
+	// configuration.  It is implemented by mruby script, and cannot be used with Mruby or MrubyConfigMapRef.
+	HostRewrite *string `json:"hostRewrite,omitempty"`
+	// ErrorPages is a mapping from status code to the key of ConfigMap which contains the page, in the form of name/key.  The
+	// ConfigMap must be in the same namespace as Ingress.  The response from backend with the status code is replaced with the
+	// page.  It is implemented by mruby script, and cannot be used with Mruby or MrubyConfigMapRef.
+	ErrorPages map[int]string `json:"errorPages,omitempty"`
 }
 
 // ChecksumFile represents a file with path, its arbitrary content, and its checksum.
@@ -132,3 +327,53 @@ type ChecksumFile struct {
 	Content  []byte
 	Checksum string
 }
+
+// ClientCertHeaders is the names of request header fields which carry TLS client certificate information to backend.
+type ClientCertHeaders struct {
+	// Subject is the header field for the subject name of client certificate in RFC 2253 format.
+	Subject string
+	// Fingerprint is the header field for SHA-256 fingerprint of client certificate in lowercase hex.
+	Fingerprint string
+	// Verify is the header field for the result of client certificate verification.  It is either "SUCCESS" or "NONE".
+	Verify string
+}
+
+// PathMruby is the set of built-in mruby features enabled for a pattern.  CreatePathMruby composes them into a single script.
+type PathMruby struct {
+	// DenyPlaintext, if true, responds with 404 to the requests which are not made over TLS.
+	DenyPlaintext bool
+	// StaticResponse, if non-nil, is the response to all requests.  The requests are not forwarded to backend.
+	StaticResponse *StaticResponse
+	// RateLimit, if non-nil, limits the requests per client IP address.
+	RateLimit *RateLimit
+	// ClientMaxBodySize, if non-nil, is the maximum Content-Length of request.
+	ClientMaxBodySize *int64
+	// Rewrite, if non-nil, rewrites the request path.
+	Rewrite *Rewrite
+	// HostRewrite, if not empty, replaces the host of request.
+	HostRewrite string
+	// ErrorPages is a mapping from status code to the page which replaces the response from backend with the status code.
+	ErrorPages map[int][]byte
+	// User, if non-nil, is the mruby script given by user.  Its on_req and on_resp are invoked after the other features.
+	User []byte
+}
+
+// StaticResponse is the response which mruby script returns without forwarding the request to backend.
+type StaticResponse struct {
+	StatusCode int
+	Body       []byte
+}
+
+// RateLimit is the token bucket which limits the requests per client IP address.  The bucket is refilled with RPS tokens per
+// second up to Burst.
+type RateLimit struct {
+	RPS   int
+	Burst int
+}
+
+// Rewrite replaces Prefix in the request path with Target.  If Target contains "$1", it is replaced with the remaining part of the
+// path without leading "/".  Otherwise, the remaining part is appended to Target.  Prefix must not end with "/".
+type Rewrite struct {
+	Prefix string
+	Target string
+}
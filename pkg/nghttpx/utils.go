@@ -28,24 +28,349 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/golang/glog"
 
 	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/resource"
+	"k8s.io/kubernetes/pkg/labels"
 )
 
 const (
 	// NghttpxExtraConfigKey is a field name of extra nghttpx configuration in ConfigMap.
 	NghttpxExtraConfigKey = "nghttpx-conf"
+	// NghttpxWorkersKey is a field name of the number of nghttpx worker threads in ConfigMap.
+	NghttpxWorkersKey = "workers"
+	// NghttpxAddResponseHeadersKey is a field name of the response header fields added to all responses in ConfigMap.  Each line
+	// is a header field in the form of "<NAME>: <VALUE>".
+	NghttpxAddResponseHeadersKey = "add-response-headers"
+	// NghttpxFrontendReadTimeoutKey is a field name of frontend read timeout in ConfigMap.
+	NghttpxFrontendReadTimeoutKey = "frontend-read-timeout"
+	// NghttpxFrontendWriteTimeoutKey is a field name of frontend write timeout in ConfigMap.
+	NghttpxFrontendWriteTimeoutKey = "frontend-write-timeout"
+	// NghttpxBackendReadTimeoutKey is a field name of backend read timeout in ConfigMap.
+	NghttpxBackendReadTimeoutKey = "backend-read-timeout"
+	// NghttpxBackendWriteTimeoutKey is a field name of backend write timeout in ConfigMap.
+	NghttpxBackendWriteTimeoutKey = "backend-write-timeout"
+	// NghttpxWorkerFrontendConnectionsKey is a field name of the maximum number of frontend connections per worker in ConfigMap.
+	NghttpxWorkerFrontendConnectionsKey = "worker-frontend-connections"
+	// NghttpxBackendConnectionsPerHostKey is a field name of the maximum number of backend connections per host in ConfigMap.
+	NghttpxBackendConnectionsPerHostKey = "backend-connections-per-host"
+	// NghttpxBackendConnectionsPerFrontendKey is a field name of the maximum number of backend connections per frontend in
+	// ConfigMap.
+	NghttpxBackendConnectionsPerFrontendKey = "backend-connections-per-frontend"
+	// NghttpxDNSCacheTimeoutKey is a field name of the duration which nghttpx caches the result of dynamic name resolution in
+	// ConfigMap.
+	NghttpxDNSCacheTimeoutKey = "dns-cache-timeout"
+	// NghttpxDNSLookupTimeoutKey is a field name of the timeout of a DNS query in ConfigMap.
+	NghttpxDNSLookupTimeoutKey = "dns-lookup-timeout"
+	// NghttpxDNSMaxTryKey is a field name of the number of DNS query attempts in ConfigMap.
+	NghttpxDNSMaxTryKey = "dns-max-try"
+	// NghttpxAddXForwardedForKey is a field name in ConfigMap which specifies whether X-Forwarded-For is added to the request
+	// forwarded to backend.
+	NghttpxAddXForwardedForKey = "add-x-forwarded-for"
+	// NghttpxStripIncomingXForwardedForKey is a field name in ConfigMap which specifies whether X-Forwarded-For from client is
+	// stripped.
+	NghttpxStripIncomingXForwardedForKey = "strip-incoming-x-forwarded-for"
+	// NghttpxAddXForwardedProtoKey is a field name in ConfigMap which specifies whether X-Forwarded-Proto is added to the request
+	// forwarded to backend.
+	NghttpxAddXForwardedProtoKey = "add-x-forwarded-proto"
+	// NghttpxStripIncomingXForwardedProtoKey is a field name in ConfigMap which specifies whether X-Forwarded-Proto from client is
+	// stripped.
+	NghttpxStripIncomingXForwardedProtoKey = "strip-incoming-x-forwarded-proto"
+	// NghttpxRequestHeaderFieldBufferKey is a field name of the maximum total size of request header fields in ConfigMap.
+	NghttpxRequestHeaderFieldBufferKey = "request-header-field-buffer"
+	// NghttpxMaxRequestHeaderFieldsKey is a field name of the maximum number of request header fields in ConfigMap.
+	NghttpxMaxRequestHeaderFieldsKey = "max-request-header-fields"
+	// NghttpxResponseHeaderFieldBufferKey is a field name of the maximum total size of response header fields from backend in
+	// ConfigMap.
+	NghttpxResponseHeaderFieldBufferKey = "response-header-field-buffer"
+	// NghttpxMaxResponseHeaderFieldsKey is a field name of the maximum number of response header fields from backend in ConfigMap.
+	NghttpxMaxResponseHeaderFieldsKey = "max-response-header-fields"
+	// NghttpxFrontendKeepAliveTimeoutKey is a field name of the idle timeout of HTTP/1.1 frontend connection in ConfigMap.
+	NghttpxFrontendKeepAliveTimeoutKey = "frontend-keep-alive-timeout"
+	// NghttpxFrontendHTTP2ReadTimeoutKey is a field name of the idle timeout of HTTP/2 frontend connection in ConfigMap.
+	NghttpxFrontendHTTP2ReadTimeoutKey = "frontend-http2-read-timeout"
+	// NghttpxBacklogKey is a field name of the listen backlog of frontend sockets in ConfigMap.
+	NghttpxBacklogKey = "backlog"
 )
 
+// somaxconnPath is the path to the file which contains the upper limit of listen backlog imposed by kernel.  It is a variable so
+// that it can be replaced in test.
+var somaxconnPath = "/proc/sys/net/core/somaxconn"
+
+// MaxDNSMaxTry is the maximum value of dns-max-try which nghttpx accepts.
+const MaxDNSMaxTry = 5
+
 // ReadConfig obtains the configuration defined by the user merged with the defaults.
 func ReadConfig(ingConfig *IngressConfig, config *api.ConfigMap) {
 	ingConfig.ExtraConfig = config.Data[NghttpxExtraConfigKey]
+
+	if v, ok := config.Data[NghttpxWorkersKey]; ok {
+		if workers, err := ParseWorkers(v); err != nil {
+			glog.Errorf("Ignoring %v in ConfigMap %v/%v: %v", NghttpxWorkersKey, config.Namespace, config.Name, err)
+		} else {
+			ingConfig.Workers = workers
+		}
+	}
+
+	if v, ok := config.Data[NghttpxAddResponseHeadersKey]; ok {
+		headers, err := ParseHeaderFields(v)
+		if err != nil {
+			glog.Errorf("Ignoring %v in ConfigMap %v/%v: %v", NghttpxAddResponseHeadersKey, config.Namespace, config.Name, err)
+		} else {
+			ingConfig.AddResponseHeaders = headers
+		}
+	}
+
+	for _, t := range []struct {
+		key string
+		dst *string
+	}{
+		{NghttpxFrontendReadTimeoutKey, &ingConfig.FrontendReadTimeout},
+		{NghttpxFrontendWriteTimeoutKey, &ingConfig.FrontendWriteTimeout},
+		{NghttpxBackendReadTimeoutKey, &ingConfig.BackendReadTimeout},
+		{NghttpxBackendWriteTimeoutKey, &ingConfig.BackendWriteTimeout},
+		{NghttpxDNSCacheTimeoutKey, &ingConfig.DNSCacheTimeout},
+		{NghttpxDNSLookupTimeoutKey, &ingConfig.DNSLookupTimeout},
+		{NghttpxFrontendKeepAliveTimeoutKey, &ingConfig.FrontendKeepAliveTimeout},
+		{NghttpxFrontendHTTP2ReadTimeoutKey, &ingConfig.FrontendHTTP2ReadTimeout},
+	} {
+		v, ok := config.Data[t.key]
+		if !ok {
+			continue
+		}
+		timeout, err := ParseTimeout(v)
+		if err != nil {
+			glog.Errorf("Ignoring %v in ConfigMap %v/%v: %v", t.key, config.Namespace, config.Name, err)
+			continue
+		}
+		*t.dst = timeout
+	}
+
+	for _, t := range []struct {
+		key string
+		dst *int
+	}{
+		{NghttpxWorkerFrontendConnectionsKey, &ingConfig.WorkerFrontendConnections},
+		{NghttpxBackendConnectionsPerHostKey, &ingConfig.BackendConnectionsPerHost},
+		{NghttpxBackendConnectionsPerFrontendKey, &ingConfig.BackendConnectionsPerFrontend},
+	} {
+		v, ok := config.Data[t.key]
+		if !ok {
+			continue
+		}
+		n, err := ParseConnections(v)
+		if err != nil {
+			glog.Errorf("Ignoring %v in ConfigMap %v/%v: %v", t.key, config.Namespace, config.Name, err)
+			continue
+		}
+		*t.dst = n
+	}
+
+	for _, t := range []struct {
+		key string
+		dst *string
+		// negate is true if nghttpx option has the opposite meaning of the key.
+		negate bool
+	}{
+		{NghttpxAddXForwardedForKey, &ingConfig.AddXForwardedFor, false},
+		{NghttpxStripIncomingXForwardedForKey, &ingConfig.StripIncomingXForwardedFor, false},
+		{NghttpxAddXForwardedProtoKey, &ingConfig.NoAddXForwardedProto, true},
+		{NghttpxStripIncomingXForwardedProtoKey, &ingConfig.NoStripIncomingXForwardedProto, true},
+	} {
+		v, ok := config.Data[t.key]
+		if !ok {
+			continue
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			glog.Errorf("Ignoring %v in ConfigMap %v/%v: %v", t.key, config.Namespace, config.Name, err)
+			continue
+		}
+		if b != t.negate {
+			*t.dst = "yes"
+		} else {
+			*t.dst = "no"
+		}
+	}
+
+	for _, t := range []struct {
+		key string
+		dst *int64
+	}{
+		{NghttpxRequestHeaderFieldBufferKey, &ingConfig.RequestHeaderFieldBuffer},
+		{NghttpxResponseHeaderFieldBufferKey, &ingConfig.ResponseHeaderFieldBuffer},
+	} {
+		v, ok := config.Data[t.key]
+		if !ok {
+			continue
+		}
+		n, err := ParseBufferSize(v)
+		if err != nil {
+			glog.Errorf("Ignoring %v in ConfigMap %v/%v: %v", t.key, config.Namespace, config.Name, err)
+			continue
+		}
+		*t.dst = n
+	}
+
+	for _, t := range []struct {
+		key string
+		dst *int
+	}{
+		{NghttpxMaxRequestHeaderFieldsKey, &ingConfig.MaxRequestHeaderFields},
+		{NghttpxMaxResponseHeaderFieldsKey, &ingConfig.MaxResponseHeaderFields},
+	} {
+		v, ok := config.Data[t.key]
+		if !ok {
+			continue
+		}
+		n, err := ParseMaxHeaderFields(v)
+		if err != nil {
+			glog.Errorf("Ignoring %v in ConfigMap %v/%v: %v", t.key, config.Namespace, config.Name, err)
+			continue
+		}
+		*t.dst = n
+	}
+
+	if v, ok := config.Data[NghttpxDNSMaxTryKey]; ok {
+		if n, err := ParseDNSMaxTry(v); err != nil {
+			glog.Errorf("Ignoring %v in ConfigMap %v/%v: %v", NghttpxDNSMaxTryKey, config.Namespace, config.Name, err)
+		} else {
+			ingConfig.DNSMaxTry = n
+		}
+	}
+
+	if v, ok := config.Data[NghttpxBacklogKey]; ok {
+		if n, err := ParseBacklog(v); err != nil {
+			glog.Errorf("Ignoring %v in ConfigMap %v/%v: %v", NghttpxBacklogKey, config.Namespace, config.Name, err)
+		} else {
+			if somaxconn, err := readSomaxconn(); err == nil && n > somaxconn {
+				glog.Warningf("%v %v in ConfigMap %v/%v exceeds net.core.somaxconn %v, and kernel silently truncates it", NghttpxBacklogKey,
+					n, config.Namespace, config.Name, somaxconn)
+			}
+			ingConfig.Backlog = n
+		}
+	}
+}
+
+// ParseBacklog parses s as the positive listen backlog.
+func ParseBacklog(s string) (int, error) {
+	n, err := strconv.ParseInt(s, 10, 32)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("backlog must be a positive integer: %q", s)
+	}
+	return int(n), nil
+}
+
+// readSomaxconn returns the upper limit of listen backlog imposed by kernel in the current network namespace.
+func readSomaxconn() (int, error) {
+	b, err := ioutil.ReadFile(somaxconnPath)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// ParseDNSMaxTry parses s as the number of DNS query attempts in the range [1, MaxDNSMaxTry].
+func ParseDNSMaxTry(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 || n > MaxDNSMaxTry {
+		return 0, fmt.Errorf("dns-max-try must be an integer in [1, %v]: %q", MaxDNSMaxTry, s)
+	}
+	return n, nil
+}
+
+// ParseConnections parses s as the positive number of connections.
+func ParseConnections(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("the number of connections must be a positive integer: %q", s)
+	}
+	return n, nil
+}
+
+// ParseBufferSize parses s as the positive size in bytes, e.g., "64Ki" or "1Mi".
+func ParseBufferSize(s string) (int64, error) {
+	q, err := resource.ParseQuantity(s)
+	if err != nil {
+		return 0, fmt.Errorf("buffer size must be a quantity, e.g., 64Ki: %q: %v", s, err)
+	}
+	n := q.Value()
+	if n <= 0 {
+		return 0, fmt.Errorf("buffer size must be positive: %q", s)
+	}
+	return n, nil
+}
+
+// ParseMaxHeaderFields parses s as the positive number of header fields.
+func ParseMaxHeaderFields(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("the number of header fields must be a positive integer: %q", s)
+	}
+	return n, nil
+}
+
+// CreateBaseConfig returns ChecksumFile for the nghttpx configuration file at path which is included in the generated
+// configuration.  The checksum of its content is computed so that the change of the file makes nghttpx reload its configuration.
+func CreateBaseConfig(path string) (*ChecksumFile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ChecksumFile{
+		Path:     path,
+		Checksum: Checksum(b),
+	}, nil
+}
+
+// ParseTimeout parses s as a positive duration, e.g., "30s" or "1m30s", and returns it in nghttpx duration format.
+func ParseTimeout(s string) (string, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return "", err
+	}
+	if d <= 0 {
+		return "", fmt.Errorf("timeout must be positive: %q", s)
+	}
+	if d%time.Second == 0 {
+		return fmt.Sprintf("%vs", int64(d/time.Second)), nil
+	}
+	if d%time.Millisecond != 0 {
+		return "", fmt.Errorf("timeout must be a multiple of 1ms: %q", s)
+	}
+	return fmt.Sprintf("%vms", int64(d/time.Millisecond)), nil
+}
+
+// ParseHeaderFields parses s which contains a header field in the form of "<NAME>: <VALUE>" per line.  Empty lines are ignored.
+// It returns header fields in the same form with surrounding white spaces removed.
+func ParseHeaderFields(s string) ([]string, error) {
+	var headers []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i == -1 {
+			return nil, fmt.Errorf("header field must be in the form of <NAME>: <VALUE>: %q", line)
+		}
+		name, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid header field name: %q", line)
+		}
+		headers = append(headers, name+": "+value)
+	}
+	return headers, nil
 }
 
 // needsReload first checks that configuration is changed.  filename
@@ -126,15 +451,162 @@ func FixupPortBackendConfig(config PortBackendConfig, svc, port string) PortBack
 	switch config.Affinity {
 	case AffinityNone, AffinityIP:
 		// OK
+	case AffinityCookie:
+		if config.AffinityCookieName == "" {
+			glog.Errorf("affinityCookieName is required for cookie affinity for service %v, port %v", svc, port)
+			config.Affinity = AffinityNone
+		} else if err := validateAffinityCookieName(config.AffinityCookieName); err != nil {
+			glog.Errorf("%v for service %v, port %v", err, svc, port)
+			config.Affinity = AffinityNone
+		}
 	case "":
 		config.Affinity = AffinityNone
 	default:
 		glog.Errorf("unsupported affinity method %v for service %v, port %v", config.Affinity, svc, port)
 		config.Affinity = AffinityNone
 	}
+	if config.Affinity == AffinityCookie {
+		if err := validateAffinityCookiePath(config.AffinityCookiePath); err != nil {
+			glog.Errorf("%v for service %v, port %v", err, svc, port)
+			config.AffinityCookiePath = ""
+		}
+		switch config.AffinityCookieSecure {
+		case AffinityCookieSecureAuto, AffinityCookieSecureYes, AffinityCookieSecureNo, "":
+			// OK
+		default:
+			glog.Errorf("unsupported affinityCookieSecure %v for service %v, port %v", config.AffinityCookieSecure, svc, port)
+			config.AffinityCookieSecure = ""
+		}
+	} else {
+		config.AffinityCookieName = ""
+		config.AffinityCookiePath = ""
+		config.AffinityCookieSecure = ""
+	}
+	if config.Weight > MaxBackendWeight {
+		glog.Errorf("weight %v must be in the range [1, %v] for service %v, port %v", config.Weight, MaxBackendWeight, svc, port)
+		config.Weight = 0
+	}
+	if config.SlowStart != nil && config.SlowStart.Duration < 0 {
+		glog.Errorf("slowStart %v must not be negative for service %v, port %v", config.SlowStart.Duration, svc, port)
+		config.SlowStart = nil
+	}
+	if config.EgressProxy != "" {
+		glog.Errorf("egressProxy is not supported for service %v, port %v", svc, port)
+		config.EgressProxy = ""
+	}
+	if config.SendProxyProtocol {
+		glog.Errorf("sendProxyProtocol is not supported for service %v, port %v", svc, port)
+		config.SendProxyProtocol = false
+	}
+	if config.UnixSocketPath != "" {
+		if err := validateUnixSocketPath(config.UnixSocketPath); err != nil {
+			glog.Errorf("%v for service %v, port %v", err, svc, port)
+			config.UnixSocketPath = ""
+		}
+	}
 	return config
 }
 
+// ValidatePortBackendConfig returns an error if config contains invalid values.  Empty values are considered valid because they are
+// replaced with the default values.
+func ValidatePortBackendConfig(config PortBackendConfig) error {
+	switch config.Proto {
+	case ProtocolH2, ProtocolH1, "":
+	default:
+		return fmt.Errorf("unrecognized backend protocol %v", config.Proto)
+	}
+	switch config.Affinity {
+	case AffinityNone, AffinityIP, "":
+		if config.AffinityCookieName != "" || config.AffinityCookiePath != "" || config.AffinityCookieSecure != "" {
+			return fmt.Errorf("affinity cookie settings require cookie affinity")
+		}
+	case AffinityCookie:
+		if config.AffinityCookieName == "" {
+			return fmt.Errorf("affinityCookieName is required for cookie affinity")
+		}
+		if err := validateAffinityCookieName(config.AffinityCookieName); err != nil {
+			return err
+		}
+		if err := validateAffinityCookiePath(config.AffinityCookiePath); err != nil {
+			return err
+		}
+		switch config.AffinityCookieSecure {
+		case AffinityCookieSecureAuto, AffinityCookieSecureYes, AffinityCookieSecureNo, "":
+		default:
+			return fmt.Errorf("unsupported affinityCookieSecure %v", config.AffinityCookieSecure)
+		}
+	default:
+		return fmt.Errorf("unsupported affinity method %v", config.Affinity)
+	}
+	if config.EndpointSelector != "" {
+		if _, err := labels.Parse(config.EndpointSelector); err != nil {
+			return fmt.Errorf("invalid endpoint selector %v: %v", config.EndpointSelector, err)
+		}
+	}
+	if config.NodeSelector != "" {
+		if _, err := labels.Parse(config.NodeSelector); err != nil {
+			return fmt.Errorf("invalid node selector %v: %v", config.NodeSelector, err)
+		}
+	}
+	if config.Weight > MaxBackendWeight {
+		return fmt.Errorf("weight %v must be in the range [1, %v]", config.Weight, MaxBackendWeight)
+	}
+	if config.SlowStart != nil && config.SlowStart.Duration < 0 {
+		return fmt.Errorf("slowStart %v must not be negative", config.SlowStart.Duration)
+	}
+	if config.EgressProxy != "" {
+		return fmt.Errorf("egressProxy is not supported because nghttpx cannot route a backend through a proxy; " +
+			"use backend-http-proxy-uri in nghttpx-conf to route all HTTP/2 backends")
+	}
+	if config.SendProxyProtocol {
+		return fmt.Errorf("sendProxyProtocol is not supported because nghttpx cannot send PROXY protocol to backends; " +
+			"the client address is available in X-Forwarded-For or Forwarded header field")
+	}
+	if config.UnixSocketPath != "" {
+		if err := validateUnixSocketPath(config.UnixSocketPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateAffinityCookieName returns an error if name is not a valid cookie name, that is a token defined in RFC 6265.
+func validateAffinityCookieName(name string) error {
+	for _, c := range []byte(name) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) != -1:
+		default:
+			return fmt.Errorf("affinityCookieName %q must not contain %q", name, c)
+		}
+	}
+	return nil
+}
+
+// validateAffinityCookiePath returns an error if path contains the characters which RFC 6265 does not allow in Path attribute.
+func validateAffinityCookiePath(path string) error {
+	for _, c := range []byte(path) {
+		if c < ' ' || c >= 0x7f || c == ';' {
+			return fmt.Errorf("affinityCookiePath %q must not contain %q", path, c)
+		}
+	}
+	return nil
+}
+
+// validateUnixSocketPath returns an error if path is not an absolute path, or contains the characters which nghttpx configuration
+// treats specially.  path is rendered in backend option as is.
+func validateUnixSocketPath(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("unixSocketPath %q must be absolute path", path)
+	}
+	for _, c := range path {
+		if c <= ' ' || c == 0x7f || c == ';' || c == ',' || c == ':' {
+			return fmt.Errorf("unixSocketPath %q must not contain %q", path, c)
+		}
+	}
+	return nil
+}
+
 // DefaultPortBackendConfig returns default PortBackendConfig
 func DefaultPortBackendConfig() PortBackendConfig {
 	// Update NewDefaultServer() too.
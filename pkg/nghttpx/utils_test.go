@@ -9,6 +9,11 @@
 package nghttpx
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"testing"
 )
 
@@ -46,11 +51,526 @@ func TestFixupPortBackendConfig(t *testing.T) {
 				Affinity: AffinityIP,
 			},
 		},
+		{
+			// Cookie affinity without cookie name is disabled.
+			in: PortBackendConfig{
+				Affinity:           AffinityCookie,
+				AffinityCookiePath: "/",
+			},
+			out: PortBackendConfig{
+				Proto:    ProtocolH1,
+				Affinity: AffinityNone,
+			},
+		},
+		{
+			in: PortBackendConfig{
+				Affinity:             AffinityCookie,
+				AffinityCookieName:   "lb",
+				AffinityCookieSecure: "bar",
+			},
+			out: PortBackendConfig{
+				Proto:              ProtocolH1,
+				Affinity:           AffinityCookie,
+				AffinityCookieName: "lb",
+			},
+		},
+		{
+			// Cookie affinity with invalid cookie name is disabled.
+			in: PortBackendConfig{
+				Affinity:           AffinityCookie,
+				AffinityCookieName: "lb;secure",
+			},
+			out: PortBackendConfig{
+				Proto:    ProtocolH1,
+				Affinity: AffinityNone,
+			},
+		},
+		{
+			// Invalid cookie path is dropped.
+			in: PortBackendConfig{
+				Affinity:           AffinityCookie,
+				AffinityCookieName: "lb",
+				AffinityCookiePath: "/\nbackend=evil,80",
+			},
+			out: PortBackendConfig{
+				Proto:              ProtocolH1,
+				Affinity:           AffinityCookie,
+				AffinityCookieName: "lb",
+			},
+		},
 	}
 
 	for i, tt := range tests {
-		if got, want := FixupPortBackendConfig(tt.in, "svc", "port"), tt.out; got != want {
+		if got, want := FixupPortBackendConfig(tt.in, "svc", "port"), tt.out; !reflect.DeepEqual(got, want) {
 			t.Errorf("#%v: fixupPortBackendConfig(%+v) = %+v, want %+v", i, tt.in, got, want)
 		}
 	}
 }
+
+// TestValidatePortBackendConfig verifies that ValidatePortBackendConfig returns an error for invalid values.
+func TestValidatePortBackendConfig(t *testing.T) {
+	tests := []struct {
+		in      PortBackendConfig
+		wantErr bool
+	}{
+		{},
+		{
+			in: PortBackendConfig{
+				Proto:    ProtocolH2,
+				Affinity: AffinityIP,
+			},
+		},
+		{
+			in: PortBackendConfig{
+				Proto: "foo",
+			},
+			wantErr: true,
+		},
+		{
+			in: PortBackendConfig{
+				Affinity: "bar",
+			},
+			wantErr: true,
+		},
+		{
+			in: PortBackendConfig{
+				Affinity:             AffinityCookie,
+				AffinityCookieName:   "lb",
+				AffinityCookiePath:   "/",
+				AffinityCookieSecure: AffinityCookieSecureYes,
+			},
+		},
+		{
+			in: PortBackendConfig{
+				Affinity: AffinityCookie,
+			},
+			wantErr: true,
+		},
+		{
+			in: PortBackendConfig{
+				Affinity:           AffinityCookie,
+				AffinityCookieName: "lb;affinity=ip",
+			},
+			wantErr: true,
+		},
+		{
+			in: PortBackendConfig{
+				Affinity:           AffinityCookie,
+				AffinityCookieName: "lb",
+				AffinityCookiePath: "/;affinity=ip",
+			},
+			wantErr: true,
+		},
+		{
+			in: PortBackendConfig{
+				Affinity:           AffinityCookie,
+				AffinityCookieName: "lb",
+				AffinityCookiePath: "/\r\nbackend=evil,80",
+			},
+			wantErr: true,
+		},
+		{
+			in: PortBackendConfig{
+				Affinity:           AffinityIP,
+				AffinityCookieName: "lb",
+			},
+			wantErr: true,
+		},
+		{
+			in: PortBackendConfig{
+				Affinity:             AffinityCookie,
+				AffinityCookieName:   "lb",
+				AffinityCookieSecure: "bar",
+			},
+			wantErr: true,
+		},
+		{
+			in: PortBackendConfig{
+				EgressProxy: "http://proxy.example.com:3128",
+			},
+			wantErr: true,
+		},
+		{
+			in: PortBackendConfig{
+				SendProxyProtocol: true,
+			},
+			wantErr: true,
+		},
+		{
+			in: PortBackendConfig{
+				EndpointSelector: "version=blue",
+			},
+		},
+		{
+			in: PortBackendConfig{
+				EndpointSelector: "version in (",
+			},
+			wantErr: true,
+		},
+		{
+			in: PortBackendConfig{
+				NodeSelector: "failure-domain.beta.kubernetes.io/zone=zone-a",
+			},
+		},
+		{
+			in: PortBackendConfig{
+				NodeSelector: "zone in (",
+			},
+			wantErr: true,
+		},
+		{
+			in: PortBackendConfig{
+				UnixSocketPath: "/run/backend.sock",
+			},
+		},
+		{
+			in: PortBackendConfig{
+				UnixSocketPath: "backend.sock",
+			},
+			wantErr: true,
+		},
+		{
+			in: PortBackendConfig{
+				UnixSocketPath: "/run/backend.sock;tls",
+			},
+			wantErr: true,
+		},
+		{
+			in: PortBackendConfig{
+				UnixSocketPath: "/run/backend.sock\nbackend=evil,80",
+			},
+			wantErr: true,
+		},
+		{
+			in: PortBackendConfig{
+				UnixSocketPath: "/run/back end.sock",
+			},
+			wantErr: true,
+		},
+		{
+			in: PortBackendConfig{
+				UnixSocketPath: "/run/backend:1.sock",
+			},
+			wantErr: true,
+		},
+		{
+			in: PortBackendConfig{
+				Weight: MaxBackendWeight,
+			},
+		},
+		{
+			in: PortBackendConfig{
+				Weight: MaxBackendWeight + 1,
+			},
+			wantErr: true,
+		},
+	}
+
+	for i, tt := range tests {
+		if err := ValidatePortBackendConfig(tt.in); (err != nil) != tt.wantErr {
+			t.Errorf("#%v: ValidatePortBackendConfig(%+v) = %v, want error %v", i, tt.in, err, tt.wantErr)
+		}
+	}
+}
+
+// TestParseHeaderFields verifies ParseHeaderFields.
+func TestParseHeaderFields(t *testing.T) {
+	tests := []struct {
+		in      string
+		out     []string
+		wantErr bool
+	}{
+		{in: ""},
+		{in: "X-Frame-Options: DENY\nX-Content-Type-Options:nosniff\n", out: []string{"X-Frame-Options: DENY", "X-Content-Type-Options: nosniff"}},
+		{in: "X-Empty:", out: []string{"X-Empty: "}},
+		{in: "X-Frame-Options DENY", wantErr: true},
+		{in: ": DENY", wantErr: true},
+		{in: "X Frame: DENY", wantErr: true},
+	}
+
+	for i, tt := range tests {
+		out, err := ParseHeaderFields(tt.in)
+		if err != nil {
+			if !tt.wantErr {
+				t.Errorf("#%v: ParseHeaderFields(%q) returned unexpected error %v", i, tt.in, err)
+			}
+			continue
+		}
+		if tt.wantErr {
+			t.Errorf("#%v: ParseHeaderFields(%q) did not return error", i, tt.in)
+			continue
+		}
+		if got, want := out, tt.out; !reflect.DeepEqual(got, want) {
+			t.Errorf("#%v: ParseHeaderFields(%q) = %q, want %q", i, tt.in, got, want)
+		}
+	}
+}
+
+// TestParseTimeout verifies ParseTimeout.
+func TestParseTimeout(t *testing.T) {
+	tests := []struct {
+		in      string
+		out     string
+		wantErr bool
+	}{
+		{in: "30s", out: "30s"},
+		{in: "1m30s", out: "90s"},
+		{in: "1h", out: "3600s"},
+		{in: "1500ms", out: "1500ms"},
+		{in: "0s", wantErr: true},
+		{in: "-1s", wantErr: true},
+		{in: "1500us", wantErr: true},
+		{in: "30", wantErr: true},
+	}
+
+	for i, tt := range tests {
+		out, err := ParseTimeout(tt.in)
+		if err != nil {
+			if !tt.wantErr {
+				t.Errorf("#%v: ParseTimeout(%q) returned unexpected error %v", i, tt.in, err)
+			}
+			continue
+		}
+		if tt.wantErr {
+			t.Errorf("#%v: ParseTimeout(%q) did not return error", i, tt.in)
+			continue
+		}
+		if got, want := out, tt.out; got != want {
+			t.Errorf("#%v: ParseTimeout(%q) = %q, want %q", i, tt.in, got, want)
+		}
+	}
+}
+
+// TestParseConnections verifies ParseConnections.
+func TestParseBufferSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		out     int64
+		wantErr bool
+	}{
+		{in: "65536", out: 65536},
+		{in: "64Ki", out: 65536},
+		{in: "1Mi", out: 1048576},
+		{in: "64k", out: 64000},
+		{in: "0", wantErr: true},
+		{in: "-1Ki", wantErr: true},
+		{in: "64KB", wantErr: true},
+		{in: "", wantErr: true},
+	}
+
+	for i, tt := range tests {
+		out, err := ParseBufferSize(tt.in)
+		if err != nil {
+			if !tt.wantErr {
+				t.Errorf("#%v: ParseBufferSize(%q) returned unexpected error %v", i, tt.in, err)
+			}
+			continue
+		}
+		if tt.wantErr {
+			t.Errorf("#%v: ParseBufferSize(%q) did not return error", i, tt.in)
+			continue
+		}
+		if got, want := out, tt.out; got != want {
+			t.Errorf("#%v: ParseBufferSize(%q) = %v, want %v", i, tt.in, got, want)
+		}
+	}
+}
+
+func TestParseConnections(t *testing.T) {
+	tests := []struct {
+		in      string
+		out     int
+		wantErr bool
+	}{
+		{in: "1", out: 1},
+		{in: "65536", out: 65536},
+		{in: "0", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "1k", wantErr: true},
+		{in: "", wantErr: true},
+	}
+
+	for i, tt := range tests {
+		out, err := ParseConnections(tt.in)
+		if err != nil {
+			if !tt.wantErr {
+				t.Errorf("#%v: ParseConnections(%q) returned unexpected error %v", i, tt.in, err)
+			}
+			continue
+		}
+		if tt.wantErr {
+			t.Errorf("#%v: ParseConnections(%q) did not return error", i, tt.in)
+			continue
+		}
+		if got, want := out, tt.out; got != want {
+			t.Errorf("#%v: ParseConnections(%q) = %v, want %v", i, tt.in, got, want)
+		}
+	}
+}
+
+// TestParseDNSMaxTry verifies ParseDNSMaxTry.
+func TestParseDNSMaxTry(t *testing.T) {
+	tests := []struct {
+		in      string
+		out     int
+		wantErr bool
+	}{
+		{in: "1", out: 1},
+		{in: "5", out: 5},
+		{in: "0", wantErr: true},
+		{in: "6", wantErr: true},
+		{in: "foo", wantErr: true},
+	}
+
+	for i, tt := range tests {
+		out, err := ParseDNSMaxTry(tt.in)
+		if err != nil {
+			if !tt.wantErr {
+				t.Errorf("#%v: ParseDNSMaxTry(%q) returned unexpected error %v", i, tt.in, err)
+			}
+			continue
+		}
+		if tt.wantErr {
+			t.Errorf("#%v: ParseDNSMaxTry(%q) did not return error", i, tt.in)
+			continue
+		}
+		if got, want := out, tt.out; got != want {
+			t.Errorf("#%v: ParseDNSMaxTry(%q) = %v, want %v", i, tt.in, got, want)
+		}
+	}
+}
+
+// TestParseBacklog verifies ParseBacklog.
+func TestParseBacklog(t *testing.T) {
+	tests := []struct {
+		in      string
+		out     int
+		wantErr bool
+	}{
+		{in: "1", out: 1},
+		{in: "65536", out: 65536},
+		{in: "0", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "4294967296", wantErr: true},
+		{in: "foo", wantErr: true},
+	}
+
+	for i, tt := range tests {
+		out, err := ParseBacklog(tt.in)
+		if err != nil {
+			if !tt.wantErr {
+				t.Errorf("#%v: ParseBacklog(%q) returned unexpected error %v", i, tt.in, err)
+			}
+			continue
+		}
+		if tt.wantErr {
+			t.Errorf("#%v: ParseBacklog(%q) did not return error", i, tt.in)
+			continue
+		}
+		if got, want := out, tt.out; got != want {
+			t.Errorf("#%v: ParseBacklog(%q) = %v, want %v", i, tt.in, got, want)
+		}
+	}
+}
+
+// TestParseWorkers verifies ParseWorkers.
+func TestParseWorkers(t *testing.T) {
+	tests := []struct {
+		in      string
+		out     string
+		wantErr bool
+	}{
+		{in: "4", out: "4"},
+		{in: "0", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "foo", wantErr: true},
+		{in: "", wantErr: true},
+	}
+
+	for i, tt := range tests {
+		out, err := ParseWorkers(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("#%v: ParseWorkers(%q) returned no error", i, tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%v: ParseWorkers(%q) returned unexpected error %v", i, tt.in, err)
+			continue
+		}
+		if got, want := out, tt.out; got != want {
+			t.Errorf("#%v: ParseWorkers(%q) = %v, want %v", i, tt.in, got, want)
+		}
+	}
+}
+
+// TestWorkersFromCPUQuota verifies that the number of workers is computed from cgroup CPU quota.
+func TestWorkersFromCPUQuota(t *testing.T) {
+	tests := []struct {
+		files map[string]string
+		want  int
+	}{
+		// cgroup v2 with 2 CPUs quota
+		{
+			files: map[string]string{"cpu.max": "200000 100000\n"},
+			want:  2,
+		},
+		// cgroup v2 with 1.5 CPUs quota is rounded up
+		{
+			files: map[string]string{"cpu.max": "150000 100000\n"},
+			want:  2,
+		},
+		// cgroup v2 without quota
+		{
+			files: map[string]string{"cpu.max": "max 100000\n"},
+			want:  runtime.NumCPU(),
+		},
+		// cgroup v1 with 1 CPU quota
+		{
+			files: map[string]string{
+				"cpu/cpu.cfs_quota_us":  "100000\n",
+				"cpu/cpu.cfs_period_us": "100000\n",
+			},
+			want: 1,
+		},
+		// cgroup v1 without quota
+		{
+			files: map[string]string{
+				"cpu/cpu.cfs_quota_us":  "-1\n",
+				"cpu/cpu.cfs_period_us": "100000\n",
+			},
+			want: runtime.NumCPU(),
+		},
+		// no cgroup
+		{
+			want: runtime.NumCPU(),
+		},
+	}
+
+	for i, tt := range tests {
+		root, err := ioutil.TempDir("", "cgroup")
+		if err != nil {
+			t.Fatalf("Could not create temporary directory: %v", err)
+		}
+		for name, content := range tt.files {
+			path := filepath.Join(root, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatalf("Could not create directory: %v", err)
+			}
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatalf("Could not write file: %v", err)
+			}
+		}
+
+		want := tt.want
+		if want > runtime.NumCPU() {
+			want = runtime.NumCPU()
+		}
+		if got := workersFromCPUQuota(root); got != want {
+			t.Errorf("#%v: workersFromCPUQuota(...) = %v, want %v", i, got, want)
+		}
+
+		os.RemoveAll(root)
+	}
+}